@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StraceAlerts passes the stderr of strace (which the traced command shares)
+// through, picking out the diagnostics strace prints about itself, e.g.
+// failing to attach to a process or detaching from one. These mean the
+// capture is incomplete, so they are turned into alerts in the trace.
+type StraceAlerts struct {
+	w io.Writer
+
+	mu     sync.Mutex
+	line   []byte
+	events []*Event
+}
+
+// NewStraceAlerts returns a writer that passes everything through to w.
+func NewStraceAlerts(w io.Writer) *StraceAlerts {
+	return &StraceAlerts{w: w}
+}
+
+func (a *StraceAlerts) Write(p []byte) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.line = append(a.line, p...)
+	for {
+		i := bytes.IndexByte(a.line, '\n')
+		if i == -1 {
+			break
+		}
+		a.scan(string(a.line[:i]))
+		a.line = a.line[i+1:]
+	}
+	return a.w.Write(p)
+}
+
+func (a *StraceAlerts) scan(line string) {
+	msg, ok := strings.CutPrefix(line, "strace: ")
+	if !ok {
+		return
+	}
+	a.events = append(a.events, &Event{
+		Name:  "strace: " + msg,
+		Cat:   "alert",
+		Ph:    "i",
+		Scope: "g",
+		Ts:    time.Now().UnixMicro(),
+	})
+}
+
+func (a *StraceAlerts) Events() []*Event {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.events
+}
+
+// Warnings returns a reliability note if strace reported any problems.
+func (a *StraceAlerts) Warnings() []string {
+	events := a.Events()
+	if len(events) == 0 {
+		return nil
+	}
+	return []string{fmt.Sprintf("strace reported %d problem(s), the capture may be incomplete (first: %q)", len(events), events[0].Name)}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/replit/strace-perfetto/pkg/traceconv"
+)
+
+// CaptureRequest describes a trace to capture in the background.
+type CaptureRequest struct {
+	// Pid is the process to attach to. Either Pid or Command must be set.
+	Pid int `json:"pid,omitempty"`
+	// Command is the command to run and trace.
+	Command []string `json:"command,omitempty"`
+	// Syscalls is an strace -e expression limiting the traced syscalls.
+	Syscalls string `json:"syscalls,omitempty"`
+	// Duration is how long to trace for. Zero means until the command exits
+	// or the capture is stopped.
+	Duration time.Duration `json:"duration,omitempty"`
+}
+
+// CaptureState is the state of a background capture.
+type CaptureState string
+
+const (
+	CaptureRunning  CaptureState = "running"
+	CaptureFinished CaptureState = "finished"
+	CaptureFailed   CaptureState = "failed"
+)
+
+// CaptureStatus is a snapshot of the state of a background capture.
+type CaptureStatus struct {
+	ID       string         `json:"id"`
+	Request  CaptureRequest `json:"request"`
+	State    CaptureState   `json:"state"`
+	Error    string         `json:"error,omitempty"`
+	Started  time.Time      `json:"started"`
+	Finished time.Time      `json:"finished,omitzero"`
+}
+
+type capture struct {
+	status CaptureStatus
+	trace  []byte
+	cancel func()
+}
+
+// errTooManyCaptures is returned by Start when the service already holds as
+// many captures as it keeps, none of which has finished.
+var errTooManyCaptures = errors.New("too many captures running, stop one or wait for one to finish")
+
+// CaptureService runs strace captures in the background on behalf of remote
+// callers (see the serve subcommand) and keeps their traces around until
+// they are fetched.
+type CaptureService struct {
+	mu       sync.Mutex
+	nextID   int
+	captures map[string]*capture
+	// maxCaptures is the number of captures kept, running or finished: the
+	// oldest finished one is dropped to start another. keep is how long a
+	// finished capture is kept for.
+	maxCaptures int
+	keep        time.Duration
+}
+
+// NewCaptureService returns a new capture service.
+func NewCaptureService(maxCaptures int, keep time.Duration) *CaptureService {
+	return &CaptureService{
+		captures:    make(map[string]*capture),
+		maxCaptures: maxCaptures,
+		keep:        keep,
+	}
+}
+
+// Start starts a new capture and returns its status.
+func (s *CaptureService) Start(req CaptureRequest) (CaptureStatus, error) {
+	if (req.Pid == 0) == (len(req.Command) == 0) {
+		return CaptureStatus{}, errors.New("exactly one of pid or command must be set")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.captures) >= s.maxCaptures && !s.dropOldest() {
+		return CaptureStatus{}, errTooManyCaptures
+	}
+	s.nextID++
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &capture{
+		status: CaptureStatus{
+			ID:      strconv.Itoa(s.nextID),
+			Request: req,
+			State:   CaptureRunning,
+			Started: time.Now(),
+		},
+		cancel: cancel,
+	}
+	s.captures[c.status.ID] = c
+	go s.run(ctx, c)
+	return c.status, nil
+}
+
+// Stop stops a running capture. The trace is available once its state
+// changes to finished.
+func (s *CaptureService) Stop(id string) (CaptureStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.captures[id]
+	if !ok {
+		return CaptureStatus{}, fmt.Errorf("capture %q not found", id)
+	}
+	c.cancel()
+	return c.status, nil
+}
+
+// Get returns the status of a capture and, once it has finished, its trace.
+func (s *CaptureService) Get(id string) (CaptureStatus, []byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.captures[id]
+	if !ok {
+		return CaptureStatus{}, nil, fmt.Errorf("capture %q not found", id)
+	}
+	return c.status, c.trace, nil
+}
+
+// dropOldest drops the capture that finished first, if any has.
+func (s *CaptureService) dropOldest() bool {
+	var oldest *capture
+	for _, c := range s.captures {
+		if c.status.State != CaptureRunning && (oldest == nil || c.status.Finished.Before(oldest.status.Finished)) {
+			oldest = c
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	delete(s.captures, oldest.status.ID)
+	return true
+}
+
+func (s *CaptureService) run(ctx context.Context, c *capture) {
+	defer c.cancel()
+	trace, err := runCapture(ctx, c.status.Request)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c.status.Finished = time.Now()
+	time.AfterFunc(s.keep, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.captures, c.status.ID)
+	})
+	if err != nil {
+		c.status.State = CaptureFailed
+		c.status.Error = err.Error()
+		return
+	}
+	c.status.State = CaptureFinished
+	c.trace = trace
+}
+
+// runCapture runs strace as described by req and returns the encoded trace.
+func runCapture(ctx context.Context, req CaptureRequest) ([]byte, error) {
+	tmp, err := os.CreateTemp("", "stracefile")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	var userStraceArgs []string
+	if req.Syscalls != "" {
+		userStraceArgs = append(userStraceArgs, "-e", req.Syscalls)
+	}
+	if req.Pid != 0 {
+		userStraceArgs = append(userStraceArgs, "-p", strconv.Itoa(req.Pid))
+	} else {
+		userStraceArgs = append(userStraceArgs, req.Command...)
+	}
+	var stderr bytes.Buffer
+	strace := Strace{
+		DefaultArgs: defaultStraceArgs,
+		UserArgs:    userStraceArgs,
+		Timeout:     req.Duration,
+		Output:      tmp.Name(),
+		Stdout:      io.Discard,
+		Stderr:      &stderr,
+	}
+	var tree traceconv.ProcTree
+	if req.Pid != 0 {
+		tree = readProcTree(req.Pid)
+	}
+	clockSnapshots := []ClockSnapshot{TakeClockSnapshot()}
+	strace.RunContext(ctx)
+	clockSnapshots = append(clockSnapshots, TakeClockSnapshot())
+
+	events := convertStrace(tmp, tree)
+	if len(events) == 0 && stderr.Len() > 0 {
+		return nil, fmt.Errorf("strace: %s", bytes.TrimSpace(stderr.Bytes()))
+	}
+	return json.Marshal(TraceEvents{
+		Event: events,
+		Metadata: map[string]any{
+			"clockDomains": map[string]ClockDomain{
+				"strace": ClockRealtime,
+			},
+			"clockSnapshots": clockSnapshots,
+		},
+	})
+}
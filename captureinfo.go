@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// CaptureInfo describes how a trace was captured, for the traces shared
+// around to tell what they are of. It goes in the "capture" metadata.
+type CaptureInfo struct {
+	// Command is the traced command line, Pid the attached process, and
+	// Input the strace output that was converted.
+	Command []string `json:"command,omitempty"`
+	Pid     int      `json:"pid,omitempty"`
+	Input   string   `json:"input,omitempty"`
+	Cwd     string   `json:"cwd,omitempty"`
+	// Hostname and Kernel are left out for the captures run over ssh.
+	Hostname    string    `json:"hostname,omitempty"`
+	Kernel      string    `json:"kernel,omitempty"`
+	Tracer      string    `json:"tracer,omitempty"`
+	ToolVersion string    `json:"toolVersion"`
+	Start       time.Time `json:"start,omitzero"`
+}
+
+// NewCaptureInfo returns the description of a capture starting now on this
+// host with the given tracer.
+func NewCaptureInfo(tracer string) CaptureInfo {
+	info := CaptureInfo{
+		Tracer:      tracer,
+		ToolVersion: toolVersion(),
+		Start:       time.Now(),
+	}
+	info.Cwd, _ = os.Getwd()
+	info.Hostname, _ = os.Hostname()
+	if release, err := os.ReadFile("/proc/sys/kernel/osrelease"); err == nil {
+		info.Kernel = strings.TrimSpace(string(release))
+		if version, err := os.ReadFile("/proc/sys/kernel/version"); err == nil {
+			info.Kernel += " " + strings.TrimSpace(string(version))
+		}
+	}
+	return info
+}
+
+// tracerVersion returns the first line command prints, the version of the
+// tracer, or the name of the tracer if it prints none.
+func tracerVersion(tracer string, command ...string) string {
+	out, err := exec.Command(command[0], command[1:]...).Output()
+	first, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	if err != nil || first == "" {
+		return tracer
+	}
+	return first
+}
+
+// toolVersion returns the version strace-perfetto was built from: its module
+// version, or its commit when built from a checkout.
+func toolVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	version := info.Main.Version
+	var revision, modified string
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			revision = s.Value
+		case "vcs.modified":
+			modified = s.Value
+		}
+	}
+	if revision != "" && (version == "" || version == "(devel)") {
+		version = revision
+		if modified == "true" {
+			version += "-dirty"
+		}
+	}
+	return version
+}
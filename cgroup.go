@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// cgroupRoot is where the cgroup v2 hierarchy is mounted.
+const cgroupRoot = "/sys/fs/cgroup"
+
+// regexpContainerID matches a container ID, whole or abbreviated, as docker
+// and podman print them.
+var regexpContainerID = regexp.MustCompile(`^[0-9a-f]{12,64}$`)
+
+// systemdUnitSuffixes are the types of the systemd units that have a cgroup.
+var systemdUnitSuffixes = []string{".service", ".scope", ".slice"}
+
+// commandCgroupControllers are the controllers enabled in the cgroup of the
+// command, for the counters of the resource monitor. Only cpu and memory are
+// required, the io and pids counters are left out without theirs.
+var commandCgroupControllers = []string{"cpu", "memory", "io", "pids"}
+
+// CommandCgroup is a transient cgroup the traced command runs in, a child of
+// the one of this process, for the cpu / memory counters to be the ones of
+// the command and its descendants only, not of this tool or of whatever else
+// shares its cgroup. The tracer is started in it, and the command with it:
+// with the strace backend, the counters include strace.
+type CommandCgroup struct {
+	Path string
+	// dir is the directory of the cgroup, which the tracer is cloned into
+	// for it to be in it from its first allocation: the memory a process
+	// used stays charged to its cgroup when it moves.
+	dir *os.File
+	// subtreeControl is the cgroup.subtree_control file of the parent, and
+	// enabled the controllers enabled in it for the cgroup, which are
+	// disabled again once it is removed.
+	subtreeControl string
+	enabled        []string
+}
+
+// NewCommandCgroup creates the cgroup of the command. The kernel only
+// enables controllers for the children of a cgroup without processes of its
+// own, or of the root one, so this fails in most login sessions, where this
+// process shares its cgroup with the shell.
+func NewCommandCgroup() (*CommandCgroup, error) {
+	parent, err := cgroupOf(0)
+	if err != nil {
+		return nil, err
+	}
+	subtreeControl := filepath.Join(parent, "cgroup.subtree_control")
+	enabled, err := os.ReadFile(subtreeControl)
+	if err != nil {
+		return nil, err
+	}
+	c := &CommandCgroup{
+		Path:           filepath.Join(parent, fmt.Sprintf("strace-perfetto-%d", os.Getpid())),
+		subtreeControl: subtreeControl,
+	}
+	for _, controller := range commandCgroupControllers {
+		if slices.Contains(strings.Fields(string(enabled)), controller) {
+			continue
+		}
+		// Best effort, checked below.
+		if os.WriteFile(subtreeControl, []byte("+"+controller), 0) == nil {
+			c.enabled = append(c.enabled, controller)
+		}
+	}
+	if enabled, err = os.ReadFile(subtreeControl); err != nil {
+		c.restore()
+		return nil, err
+	}
+	for _, controller := range commandCgroupControllers[:2] {
+		if !slices.Contains(strings.Fields(string(enabled)), controller) {
+			c.restore()
+			return nil, fmt.Errorf("the %s controller can't be enabled in %s", controller, parent)
+		}
+	}
+	// Cloning a process into the cgroup needs write access to cgroup.procs
+	// of both cgroups and of their common ancestor, here the parent.
+	if err := syscall.Access(filepath.Join(parent, "cgroup.procs"), 2 /* W_OK */); err != nil {
+		c.restore()
+		return nil, fmt.Errorf("moving processes out of %s: %w", parent, err)
+	}
+	if err := os.Mkdir(c.Path, 0o755); err != nil {
+		c.restore()
+		return nil, err
+	}
+	if c.dir, err = os.Open(c.Path); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close removes the cgroup, unless processes the command left behind are
+// still in it, and disables the controllers NewCommandCgroup enabled.
+func (c *CommandCgroup) Close() {
+	if c.dir != nil {
+		c.dir.Close()
+	}
+	err := syscall.Rmdir(c.Path)
+	switch {
+	case errors.Is(err, syscall.EBUSY):
+		fmt.Printf("[!] Processes of the command are still running in %s, leaving it in place\n", c.Path)
+		return
+	case err != nil:
+		fmt.Printf("[!] Error removing the cgroup %s: %s\n", c.Path, err)
+		return
+	}
+	c.restore()
+}
+
+// restore disables the controllers NewCommandCgroup enabled in the parent.
+func (c *CommandCgroup) restore() {
+	for _, controller := range c.enabled {
+		if err := os.WriteFile(c.subtreeControl, []byte("-"+controller), 0); err != nil {
+			fmt.Printf("[!] Error disabling the %s controller in %s: %s\n", controller, c.subtreeControl, err)
+		}
+	}
+}
+
+// resolveCgroup returns the directory of the cgroup given to -cgroup: the
+// directory itself, a path in the cgroup hierarchy as /proc/<pid>/cgroup
+// shows them, a systemd unit, or the ID of a container, whose cgroup's name
+// contains it with the runtimes that use systemd (docker-<id>.scope,
+// libpod-<id>.scope) and those that don't (/docker/<id>).
+func resolveCgroup(cgroup string) (string, error) {
+	switch {
+	case strings.HasPrefix(cgroup, cgroupRoot+"/"):
+		return cgroup, nil
+	case strings.HasPrefix(cgroup, "/"):
+		return filepath.Join(cgroupRoot, cgroup), nil
+	case slices.ContainsFunc(systemdUnitSuffixes, func(suffix string) bool { return strings.HasSuffix(cgroup, suffix) }):
+		out, err := exec.Command("systemctl", "show", "--property=ControlGroup", "--value", cgroup).Output()
+		if err != nil {
+			return "", fmt.Errorf("finding the cgroup of %s: %w", cgroup, err)
+		}
+		controlGroup := strings.TrimSpace(string(out))
+		if controlGroup == "" {
+			return "", fmt.Errorf("%s has no cgroup, is it running?", cgroup)
+		}
+		return filepath.Join(cgroupRoot, controlGroup), nil
+	case regexpContainerID.MatchString(cgroup):
+		var matches []string
+		filepath.WalkDir(cgroupRoot, func(p string, d fs.DirEntry, err error) error {
+			if err == nil && d.IsDir() && strings.Contains(d.Name(), cgroup) {
+				matches = append(matches, p)
+				return filepath.SkipDir
+			}
+			return nil
+		})
+		switch len(matches) {
+		case 0:
+			return "", fmt.Errorf("no cgroup of container %s in %s", cgroup, cgroupRoot)
+		case 1:
+			return matches[0], nil
+		}
+		return "", fmt.Errorf("several cgroups match container %s: %s", cgroup, strings.Join(matches, ", "))
+	}
+	return "", fmt.Errorf("%q is neither a cgroup, a systemd unit nor a container ID", cgroup)
+}
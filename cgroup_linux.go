@@ -0,0 +1,16 @@
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// startIn makes cmd start in the cgroup: the kernel clones it into it
+// (CLONE_INTO_CGROUP, Linux 5.7 or later).
+func (c *CommandCgroup) startIn(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(c.dir.Fd())
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+import "os/exec"
+
+// startIn does nothing, cgroups are Linux's.
+func (c *CommandCgroup) startIn(cmd *exec.Cmd) {}
@@ -0,0 +1,99 @@
+package main
+
+// ClockDomain identifies the kernel clock an event source takes its
+// timestamps from.
+type ClockDomain string
+
+const (
+	// ClockRealtime is CLOCK_REALTIME, used by strace's -ttt timestamps.
+	ClockRealtime ClockDomain = "realtime"
+	// ClockMonotonic is CLOCK_MONOTONIC, used by the resource monitor.
+	ClockMonotonic ClockDomain = "monotonic"
+	// ClockBoottime is CLOCK_BOOTTIME, used by ftrace.
+	ClockBoottime ClockDomain = "boottime"
+)
+
+const (
+	clockIDRealtime  = 0
+	clockIDMonotonic = 1
+	clockIDBoottime  = 7
+)
+
+// ClockSnapshot is a reading of all the clocks taken at (nearly) the same
+// instant, which allows timestamps from one domain to be converted into
+// another.
+type ClockSnapshot struct {
+	Realtime  uint64 `json:"realtime"`
+	Monotonic uint64 `json:"monotonic"`
+	Boottime  uint64 `json:"boottime"`
+}
+
+// TakeClockSnapshot reads the realtime, monotonic and boottime clocks. All
+// values are in nanoseconds.
+func TakeClockSnapshot() ClockSnapshot {
+	return ClockSnapshot{
+		Realtime:  clockGettime(clockIDRealtime),
+		Monotonic: clockGettime(clockIDMonotonic),
+		Boottime:  clockGettime(clockIDBoottime),
+	}
+}
+
+// ToRealtime converts a timestamp in the given domain (in nanoseconds) to
+// CLOCK_REALTIME using this snapshot as the reference point.
+func (c ClockSnapshot) ToRealtime(domain ClockDomain, ts uint64) uint64 {
+	switch domain {
+	case ClockMonotonic:
+		return ts - c.Monotonic + c.Realtime
+	case ClockBoottime:
+		return ts - c.Boottime + c.Realtime
+	}
+	return ts
+}
+
+// rebaseTimestamps shifts the timestamps of the events so that the trace
+// starts at 0, for -relative-ts. The clock snapshots in the metadata are
+// shifted along (the ones taken before the trace starts are dropped, as they
+// would be negative) and the realtime microsecond the trace started at is
+// recorded as "timestampOffset".
+func rebaseTimestamps(events []*Event, metadata map[string]any) {
+	start := int64(-1)
+	for _, e := range events {
+		if e.Ph != "M" && (start < 0 || e.Ts < start) {
+			start = e.Ts
+		}
+	}
+	if start <= 0 {
+		return
+	}
+	shiftTimestamps(events, start)
+	if snapshots, ok := metadata["clockSnapshots"].([]ClockSnapshot); ok {
+		var rebased []ClockSnapshot
+		for _, s := range snapshots {
+			if s, ok := s.rebase(start); ok {
+				rebased = append(rebased, s)
+			}
+		}
+		metadata["clockSnapshots"] = rebased
+	}
+	metadata["timestampOffset"] = start
+}
+
+// shiftTimestamps moves the events, except for metadata, offset microseconds
+// back.
+func shiftTimestamps(events []*Event, offset int64) {
+	for _, e := range events {
+		if e.Ph != "M" {
+			e.Ts -= offset
+		}
+	}
+}
+
+// rebase shifts the realtime clock of the snapshot back by offset
+// microseconds, if it was taken after that.
+func (c ClockSnapshot) rebase(offset int64) (ClockSnapshot, bool) {
+	if c.Realtime < uint64(offset)*1000 {
+		return c, false
+	}
+	c.Realtime -= uint64(offset) * 1000
+	return c, true
+}
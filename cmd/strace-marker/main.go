@@ -0,0 +1,56 @@
+// Command strace-marker writes a marker of the strace-perfetto marker
+// protocol, for shell scripts:
+//
+//	strace-marker B compile
+//	make
+//	strace-marker E
+//
+// The markers are on behalf of the shell running it (its parent), so that
+// the slices begun and ended by separate strace-marker processes pair up; this
+// takes strace-perfetto -marker-fd, without it the markers are attributed to
+// the strace-marker processes.
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/replit/strace-perfetto/pkg/marker"
+)
+
+func usage() {
+	name := path.Base(os.Args[0])
+	fmt.Fprintf(os.Stderr, "Usage: %s B name | E | I name | C name value | s id | f id\n", name)
+	os.Exit(1)
+}
+
+func main() {
+	args := os.Args[1:]
+	if len(args) == 0 {
+		usage()
+	}
+	e := marker.For(os.Getppid())
+	switch {
+	case args[0] == "B" && len(args) == 2:
+		e.Begin(args[1])
+	case args[0] == "E" && len(args) == 1:
+		e.End()
+	case args[0] == "I" && len(args) == 2:
+		e.Instant(args[1])
+	case args[0] == "C" && len(args) == 3:
+		value, err := strconv.ParseFloat(args[2], 64)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid counter value %q\n", args[2])
+			os.Exit(1)
+		}
+		e.Counter(args[1], value)
+	case args[0] == "s" && len(args) == 2:
+		e.FlowStart(args[1])
+	case args[0] == "f" && len(args) == 2:
+		e.FlowEnd(args[1])
+	default:
+		usage()
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+)
+
+// coldStartPhaseGap is the longest pause between two syscalls of the same
+// phase for them to still be grouped into a single slice (in microseconds).
+const coldStartPhaseGap = 10000
+
+var (
+	rePath = `"(/[^"]*)"` // first absolute path in the args
+
+	regexpPath = regexp.MustCompile(rePath)
+
+	// coldStartPhasePatterns are the phases of a typical process start, along with
+	// the paths that give them away. They are checked in order.
+	coldStartPhasePatterns = []struct {
+		name string
+		re   *regexp.Regexp
+	}{
+		{"dynamic loading", regexp.MustCompile(`^/etc/ld\.so\.(?:cache|preload)$|\.so(?:\.[\d.]+)?$`)},
+		{"locale loading", regexp.MustCompile(`^/usr/(?:lib|share)/locale/|^/usr/lib/locale/|/gconv/`)},
+		{"timezone loading", regexp.MustCompile(`^/etc/localtime$|/zoneinfo/`)},
+		{"certificate loading", regexp.MustCompile(`^/etc/(?:ssl|pki)/|/ca-certificates|/ca-bundle|\.(?:pem|crt)$`)},
+		{"interpreter bootstrap", regexp.MustCompile(`/lib/python\d[\d.]*/|/lib/ruby/|/lib/node_modules/npm/|/lib/jvm/|/lib/modules$|\.pyc$`)},
+	}
+)
+
+// coldStartPhase returns the cold-start phase a syscall belongs to, if any.
+func coldStartPhase(e *Event) string {
+	m := regexpPath.FindStringSubmatch(e.Args.First)
+	if len(m) != 2 {
+		return ""
+	}
+	for _, phase := range coldStartPhasePatterns {
+		if phase.re.MatchString(m[1]) {
+			return phase.name
+		}
+	}
+	return ""
+}
+
+// coldStartPhases labels the characteristic sequences of a process cold
+// start (dynamic loading, locale/timezone loading, certificate store reads
+// and interpreter bootstrapping) with slices that contain the syscalls
+// making them up, so runtime startup can be told apart from the program's
+// own work.
+func coldStartPhases(syscallEvents []*Event) []*Event {
+	var phaseEvents []*Event
+	current := make(map[int]*Event) // [tid]*Event
+	for _, e := range syscallEvents {
+		if !isSyscall(e) {
+			continue
+		}
+		phase := coldStartPhase(e)
+		if phase == "" {
+			continue
+		}
+		p := current[e.Tid]
+		if p != nil && p.Name == phase && e.Ts-(p.Ts+p.Dur) <= coldStartPhaseGap {
+			if end := e.Ts + e.Dur; end > p.Ts+p.Dur {
+				p.Dur = end - p.Ts
+			}
+			p.Args.Data["syscalls"] = p.Args.Data["syscalls"].(int) + 1
+			continue
+		}
+		p = &Event{
+			Name: phase,
+			Cat:  "phase",
+			Ph:   "X",
+			Pid:  e.Pid,
+			Tid:  e.Tid,
+			Ts:   e.Ts,
+			Dur:  e.Dur,
+			Args: Args{
+				Data: map[string]any{"syscalls": 1},
+			},
+		}
+		current[e.Tid] = p
+		phaseEvents = append(phaseEvents, p)
+	}
+	sort.SliceStable(phaseEvents, func(i, j int) bool {
+		return phaseEvents[i].Ts < phaseEvents[j].Ts
+	})
+	return phaseEvents
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	reSockaddrIPv4     = `inet_addr\("([^"]+)"\)`               // address
+	reSockaddrIPv6     = `inet_pton\(AF_INET6, "([^"]+)"`       // address
+	reSockaddrUnix     = `sun_path=(@?"(?:[^"\\]|\\.)*")`       // path
+	reSocketAnnotation = `^([\w-]+):\[(?:(.+)->(.+)|[^\]]*)\]$` // protocol,local,peer
+
+	regexpSockaddrIPv4     = regexp.MustCompile(reSockaddrIPv4)
+	regexpSockaddrIPv6     = regexp.MustCompile(reSockaddrIPv6)
+	regexpSockaddrUnix     = regexp.MustCompile(reSockaddrUnix)
+	regexpSocketAnnotation = regexp.MustCompile(reSocketAnnotation)
+)
+
+// connectionIDBase is the first id of the connection spans and flows, past
+// the ids of the futex flows.
+const connectionIDBase = 1 << 41
+
+// connection is a socket followed from the syscall that opened it to its
+// close.
+type connection struct {
+	begin    *Event
+	last     *Event
+	protocol string
+	local    string
+	peer     string
+}
+
+// sockaddrString returns the address of a sockaddr strace printed, as
+// 1.2.3.4:80, [::1]:443 or a unix socket path, or "" if there is none.
+func sockaddrString(s string) string {
+	if m := regexpSockaddrUnix.FindStringSubmatch(s); len(m) == 2 {
+		abstract := strings.HasPrefix(m[1], "@")
+		path, err := strconv.Unquote(strings.TrimPrefix(m[1], "@"))
+		if err != nil {
+			path = strings.Trim(m[1], `@"`)
+		}
+		if abstract {
+			path = "@" + path
+		}
+		return path
+	}
+	port := regexpSocketPort.FindStringSubmatch(s)
+	if len(port) != 2 {
+		return ""
+	}
+	if m := regexpSockaddrIPv4.FindStringSubmatch(s); len(m) == 2 {
+		return m[1] + ":" + port[1]
+	}
+	if m := regexpSockaddrIPv6.FindStringSubmatch(s); len(m) == 2 {
+		return "[" + m[1] + "]:" + port[1]
+	}
+	return ""
+}
+
+// observe updates the connection with the socket annotation strace -yy
+// printed for its fd in e, e.g. TCP:[10.0.0.1:40000->93.184.216.34:80].
+func (c *connection) observe(e *Event) {
+	path, _ := e.Args.Data["fd_path"].(string)
+	m := regexpSocketAnnotation.FindStringSubmatch(path)
+	if len(m) != 4 {
+		return
+	}
+	c.protocol = m[1]
+	if m[2] != "" && c.local == "" {
+		c.local = m[2]
+	}
+	if m[3] != "" && c.peer == "" {
+		c.peer = m[3]
+	}
+}
+
+// name names the span of the connection after its peer, or after the address
+// it is bound to for listening sockets.
+func (c *connection) name() string {
+	switch {
+	case c.peer != "":
+		return c.protocol + " " + c.peer
+	case c.local != "":
+		return c.protocol + " " + c.local + " (local)"
+	}
+	return c.protocol + " socket"
+}
+
+// connectionSpans follows the sockets of the traced processes and returns an
+// async span per socket, from the socket, accept or accept4 that opened it to
+// its close, named after the peer address, and flows that chain the connect,
+// reads and writes and close on the socket, so the network life cycle of a
+// request shows up across threads. The addresses come from the sockaddr of
+// connect and bind, and from the socket annotations of strace -yy.
+func connectionSpans(syscallEvents []*Event) []*Event {
+	var spans, flows []*Event
+	id := uint64(connectionIDBase)
+	fds := newFdTracker()
+	conns := make(map[*openFd]*connection)
+	end := func(c *connection, e *Event, closed bool) {
+		c.begin.Name = c.name()
+		c.begin.Args.Data["protocol"] = c.protocol
+		if c.peer != "" {
+			c.begin.Args.Data["peer"] = c.peer
+		}
+		if c.local != "" {
+			c.begin.Args.Data["local"] = c.local
+		}
+		ts := e.EndNanos()
+		spans = append(spans, &Event{
+			Name: c.begin.Name,
+			Cat:  "net",
+			Ph:   "e",
+			Pid:  c.begin.Pid,
+			Tid:  e.Tid,
+			Ts:   ts / 1000,
+			TsNs: int(ts % 1000),
+			Id:   c.begin.Id,
+			Args: Args{
+				Data: map[string]any{
+					"closed": closed,
+				},
+			},
+		})
+	}
+	for _, e := range syscallEvents {
+		if !isSyscall(e) {
+			continue
+		}
+		// Non-blocking connects fail with EINPROGRESS, and then the
+		// fd tracker doesn't see them.
+		if e.Name == "connect" || e.Name == "bind" {
+			if m := regexpFdArg.FindStringSubmatch(e.Args.First); len(m) == 2 {
+				fd, _ := strconv.Atoi(m[1])
+				if c := conns[fds.open[fdKey(e.Pid, fd)]]; c != nil {
+					addr := sockaddrString(e.Args.First)
+					switch {
+					case addr == "":
+					case e.Name == "connect" && c.peer == "":
+						c.peer = addr
+					case e.Name == "bind" && c.local == "":
+						c.local = addr
+					}
+				}
+			}
+		}
+		f := fds.observe(e)
+		if f == nil {
+			continue
+		}
+		c := conns[f]
+		if c == nil {
+			if e.Name != "socket" && e.Name != "accept" && e.Name != "accept4" {
+				continue
+			}
+			// Sockets are named after their domain until their
+			// protocol is known.
+			c = &connection{protocol: strings.TrimPrefix(strings.TrimPrefix(f.Path, "socket:"), "AF_")}
+			if e.Name != "socket" {
+				c.protocol = "socket"
+			}
+			c.begin = &Event{
+				Cat:  "net",
+				Ph:   "b",
+				Pid:  e.Pid,
+				Tid:  e.Tid,
+				Ts:   e.Ts,
+				TsNs: e.TsNs,
+				Id:   id,
+				Args: Args{
+					Data: map[string]any{
+						"fd": f.Fd,
+					},
+				},
+			}
+			id++
+			spans = append(spans, c.begin)
+			conns[f] = c
+			c.observe(e)
+			c.last = e
+			continue
+		}
+		c.observe(e)
+		if e.Name == "connect" || e.Name == "close" || httpReadSyscalls[e.Name] || httpWriteSyscalls[e.Name] {
+			// The flow starts inside the previous syscall and ends
+			// at the start of this one, for it to bind to both.
+			start := c.last.TsNanos() + 1
+			flows = append(flows,
+				&Event{Name: "connection", Cat: "net", Ph: "s", Pid: c.last.Pid, Tid: c.last.Tid, Ts: start / 1000, TsNs: int(start % 1000), Id: id},
+				&Event{Name: "connection", Cat: "net", Ph: "f", Pid: e.Pid, Tid: e.Tid, Ts: e.Ts, TsNs: e.TsNs, Id: id},
+			)
+			id++
+			c.last = e
+		}
+		if e.Name == "close" {
+			end(c, e, true)
+			delete(conns, f)
+		}
+	}
+	// Sockets still open end with the last syscall made on them.
+	open := make([]*connection, 0, len(conns))
+	for _, c := range conns {
+		open = append(open, c)
+	}
+	sort.Slice(open, func(i, j int) bool { return open[i].begin.Id < open[j].begin.Id })
+	for _, c := range open {
+		end(c, c.last, false)
+	}
+	events := append(spans, flows...)
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].TsNanos() < events[j].TsNanos()
+	})
+	return events
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/replit/strace-perfetto/pkg/traceconv"
+)
+
+// parseProgressInterval is how often the progress of the parsing of large
+// strace outputs is printed.
+const parseProgressInterval = 5 * time.Second
+
+// convertStrace parses strace output and returns the syscall events merged
+// with all the events derived from them. tree describes the processes strace
+// attached to, if any.
+func convertStrace(r io.Reader, tree traceconv.ProcTree) []*Event {
+	end := selfTrace.Begin("parse")
+	syscallEvents, _ := parseStrace(r)
+	end(len(syscallEvents))
+	return convertSyscalls(syscallEvents, tree)
+}
+
+// convertSyscalls returns the syscall events, parsed from strace output or
+// recorded by the ptrace tracer, merged with all the events derived from
+// them.
+func convertSyscalls(syscallEvents []*Event, tree traceconv.ProcTree) []*Event {
+	syscallEvents = excludeSyscalls(syscallEvents, *flagExclude)
+	if *flagCoalesce {
+		syscallEvents = coalesceRestarts(syscallEvents)
+	}
+	end := selfTrace.Begin("tree-build")
+	metadataEvents := traceconv.BuildProcessTree(syscallEvents, tree)
+	labelEvents := traceconv.PersonalityLabels(syscallEvents)
+	end(len(syscallEvents))
+
+	end = selfTrace.Begin("enrich")
+	enrichEvents(syscallEvents)
+	fileOpEvents := fileOperations(syscallEvents)
+	phaseEvents := coldStartPhases(syscallEvents)
+	fitToFileOperations(phaseEvents, fileOpEvents)
+	httpEvents := httpSpans(syscallEvents)
+	futexEvents := futexFlows(syscallEvents)
+	connectionEvents := connectionSpans(syscallEvents)
+	throughputEvents := syscallThroughput(syscallEvents)
+	memoryEvents := anonymousMemory(syscallEvents)
+	fdEvents := liveFdCounters(syscallEvents)
+	end(len(syscallEvents))
+
+	// Enclosing slices go first, for them to be parents of the slices
+	// starting at the same time, and so do the connection flows ending at
+	// the syscalls.
+	return traceconv.Merge(metadataEvents, labelEvents, phaseEvents, fileOpEvents, connectionEvents, syscallEvents, httpEvents, futexEvents, throughputEvents, memoryEvents, fdEvents)
+}
+
+// enrichEvents adds derived information to the args of the syscall events.
+// It runs after the process tree has been reconstructed, so the events of all
+// the threads of a process share the same pid.
+func enrichEvents(syscallEvents []*Event) {
+	annotateNixPaths(syscallEvents)
+	annotateServices(syscallEvents)
+}
+
+// parseStrace parses strace output, printing its progress when it takes a
+// while and how many lines couldn't be parsed, and writes these lines to the
+// -unparsed file.
+func parseStrace(r io.Reader) ([]*Event, traceconv.ParseStats) {
+	start := time.Now()
+	parser := traceconv.Parser{
+		Progress: func(stats traceconv.ParseStats) {
+			elapsed := time.Since(start)
+			progressf("[+] Parsing: %d lines (%.0f lines/s), %d events\n", stats.Lines, float64(stats.Lines)/elapsed.Seconds(), stats.Events)
+		},
+		ProgressInterval: parseProgressInterval,
+		MaxLineSize:      int(flagMaxLineSize),
+		Strict:           *flagStrict,
+		Ltrace:           *flagLtrace,
+	}
+	if *flagVerbose {
+		parser.Logf = verbosef
+	}
+	if *flagUnparsed != "" {
+		f, err := os.Create(*flagUnparsed)
+		if err != nil {
+			log.Fatalf("[!] Error creating unparsed lines file: %s\n", err)
+		}
+		defer f.Close()
+		parser.Unparsed = f
+	}
+	events := parser.Parse(r)
+
+	stats := parser.Stats
+	elapsed := time.Since(start)
+	if elapsed >= parseProgressInterval {
+		progressf("[+] Parsed %d lines into %d events in %s (%.0f lines/s)\n", stats.Lines, stats.Events, elapsed.Round(time.Millisecond), float64(stats.Lines)/elapsed.Seconds())
+	}
+	var parseErr *traceconv.ParseError
+	switch {
+	case errors.As(parser.Err, &parseErr):
+		log.Fatalf("[!] Error parsing strace output: %s\n", parseErr)
+	case parser.Err != nil:
+		log.Printf("[!] Error reading strace output, the trace stops at line %d: %s", stats.Lines, parser.Err)
+	}
+	if stats.TooLong > 0 && *flagStrict {
+		log.Fatalf("[!] Error parsing strace output: %d lines longer than %s, raise -max-line-size to parse them\n", stats.TooLong, &flagMaxLineSize)
+	}
+	if stats.TooLong > 0 {
+		fmt.Printf("[!] %d lines longer than %s were left out, raise -max-line-size to parse them\n", stats.TooLong, &flagMaxLineSize)
+	}
+	switch {
+	case stats.Unparsed > 0 && *flagUnparsed != "":
+		fmt.Printf("[!] %d of %d lines couldn't be parsed, saved to: %s\n", stats.Unparsed, stats.Lines, *flagUnparsed)
+	case stats.Unparsed > 0:
+		fmt.Printf("[!] %d of %d lines couldn't be parsed, write them to a file with -unparsed\n", stats.Unparsed, stats.Lines)
+	}
+	return events, stats
+}
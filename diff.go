@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+)
+
+// SyscallDiff is the change in the calls of one syscall between two traces,
+// durations in microseconds.
+type SyscallDiff struct {
+	Syscall    string `json:"syscall"`
+	OldCalls   int    `json:"old_calls"`
+	NewCalls   int    `json:"new_calls"`
+	OldTotalUs int64  `json:"old_total_us"`
+	NewTotalUs int64  `json:"new_total_us"`
+}
+
+// ProcessDiff is the change in the number of processes at a place of the
+// process tree between two traces.
+type ProcessDiff struct {
+	// Path is the names of the process and of its ancestors, outermost
+	// first, e.g. "make > sh > cc1", as pids differ from one trace to the
+	// other.
+	Path     string `json:"path"`
+	OldCount int    `json:"old_count"`
+	NewCount int    `json:"new_count"`
+}
+
+// TraceDiff is what changed about the syscalls of a program from one trace
+// to another, e.g. before and after a dependency upgrade.
+type TraceDiff struct {
+	Syscalls     []SyscallDiff `json:"syscalls"`
+	NewFiles     []string      `json:"new_files"`
+	RemovedFiles []string      `json:"removed_files"`
+	Processes    []ProcessDiff `json:"processes"`
+}
+
+// diff runs the diff subcommand, which compares two traces.
+func diff(args []string) {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s diff [OPTIONS] old.json new.json\n", path.Base(os.Args[0]))
+		flags.PrintDefaults()
+	}
+	jsonOutput := flags.String("json", "", "also write the differences to this JSON file")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	var traces [2]TraceEvents
+	for i, input := range flags.Args() {
+		te, err := LoadTraceEvents(input)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading trace (diff needs JSON traces): %s\n", err)
+			os.Exit(1)
+		}
+		traces[i] = te
+	}
+	d := NewTraceDiff(traces[0].Event, traces[1].Event)
+	d.Print(os.Stdout)
+	if *jsonOutput != "" {
+		b, err := json.MarshalIndent(d, "", " ")
+		if err == nil {
+			err = os.WriteFile(*jsonOutput, b, 0644)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error saving diff: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("[+] Diff saved to: %s\n", *jsonOutput)
+	}
+}
+
+// NewTraceDiff compares the events of two traces.
+func NewTraceDiff(old, new []*Event) TraceDiff {
+	var d TraceDiff
+
+	syscalls := make(map[string]*SyscallDiff)
+	entry := func(name string) *SyscallDiff {
+		if syscalls[name] == nil {
+			syscalls[name] = &SyscallDiff{Syscall: name}
+		}
+		return syscalls[name]
+	}
+	for _, s := range NewSummary(old) {
+		entry(s.Syscall).OldCalls = s.Calls
+		entry(s.Syscall).OldTotalUs = s.TotalUs
+	}
+	for _, s := range NewSummary(new) {
+		entry(s.Syscall).NewCalls = s.Calls
+		entry(s.Syscall).NewTotalUs = s.TotalUs
+	}
+	for _, s := range syscalls {
+		d.Syscalls = append(d.Syscalls, *s)
+	}
+	// The syscalls whose time changed the most first.
+	sort.Slice(d.Syscalls, func(i, j int) bool {
+		a, b := d.Syscalls[i], d.Syscalls[j]
+		da, db := abs(a.NewTotalUs-a.OldTotalUs), abs(b.NewTotalUs-b.OldTotalUs)
+		if da != db {
+			return da > db
+		}
+		return a.Syscall < b.Syscall
+	})
+
+	oldFiles, newFiles := openedFiles(old), openedFiles(new)
+	for f := range newFiles {
+		if !oldFiles[f] {
+			d.NewFiles = append(d.NewFiles, f)
+		}
+	}
+	for f := range oldFiles {
+		if !newFiles[f] {
+			d.RemovedFiles = append(d.RemovedFiles, f)
+		}
+	}
+	sort.Strings(d.NewFiles)
+	sort.Strings(d.RemovedFiles)
+
+	oldProcesses, newProcesses := processPaths(old), processPaths(new)
+	for p, n := range newProcesses {
+		if n != oldProcesses[p] {
+			d.Processes = append(d.Processes, ProcessDiff{Path: p, OldCount: oldProcesses[p], NewCount: n})
+		}
+	}
+	for p, n := range oldProcesses {
+		if _, ok := newProcesses[p]; !ok {
+			d.Processes = append(d.Processes, ProcessDiff{Path: p, OldCount: n})
+		}
+	}
+	sort.Slice(d.Processes, func(i, j int) bool {
+		return d.Processes[i].Path < d.Processes[j].Path
+	})
+	return d
+}
+
+func abs(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// openedFiles returns the paths of the files the traced processes opened.
+func openedFiles(events []*Event) map[string]bool {
+	files := make(map[string]bool)
+	for _, e := range events {
+		if !isSyscall(e) || e.Cat == "failed" {
+			continue
+		}
+		switch e.Name {
+		case "open", "openat", "openat2", "creat":
+			// The traces written hold the parsed args, the older ones
+			// the args as strace printed them.
+			if path, ok := e.Args.Data["path"].(string); ok {
+				files[path] = true
+			} else if m := regexpPathArg.FindStringSubmatch(e.Args.First + e.Args.Second); len(m) == 2 {
+				files[m[1]] = true
+			}
+		}
+	}
+	return files
+}
+
+// processPaths counts the processes of a trace by their path in the process
+// tree, from the processes and the clones that created them.
+func processPaths(events []*Event) map[string]int {
+	names := make(map[int]string)
+	parents := make(map[int]int)
+	pids := make(map[int]bool)
+	forks := make(map[uint64]int) // [flow id]pid
+	for _, e := range events {
+		switch {
+		case e.Ph == "M" && e.Name == "process_name":
+			names[e.Pid] = e.Args.Name
+		case e.Cat == "clone" && e.Ph == "s":
+			forks[e.Id] = e.Pid
+		case e.Cat == "clone" && e.Ph == "f":
+			if parent, ok := forks[e.Id]; ok && parent != e.Pid {
+				parents[e.Pid] = parent
+			}
+		case isSyscall(e):
+			pids[e.Pid] = true
+		}
+	}
+	var processPath func(pid int, depth int) string
+	processPath = func(pid int, depth int) string {
+		name := names[pid]
+		if name == "" {
+			name = "?"
+		}
+		parent, ok := parents[pid]
+		// depth guards against cycles from reused pids.
+		if !ok || depth > 64 {
+			return name
+		}
+		return processPath(parent, depth+1) + " > " + name
+	}
+	paths := make(map[string]int)
+	for pid := range pids {
+		paths[processPath(pid, 0)]++
+	}
+	return paths
+}
+
+// Print writes the differences as tables.
+func (d TraceDiff) Print(w io.Writer) {
+	const format = "%-20s %10s %10s %10s %14s %14s %14s\n"
+	fmt.Fprintf(w, format, "syscall", "old calls", "new calls", "delta", "old time us", "new time us", "delta us")
+	for _, s := range d.Syscalls {
+		if s.OldCalls == s.NewCalls && s.OldTotalUs == s.NewTotalUs {
+			continue
+		}
+		fmt.Fprintf(w, "%-20s %10d %10d %+10d %14d %14d %+14d\n",
+			s.Syscall, s.OldCalls, s.NewCalls, s.NewCalls-s.OldCalls, s.OldTotalUs, s.NewTotalUs, s.NewTotalUs-s.OldTotalUs)
+	}
+	fmt.Fprintf(w, "\nfiles opened only in the new trace: %d\n", len(d.NewFiles))
+	for _, f := range d.NewFiles {
+		fmt.Fprintf(w, "  + %s\n", f)
+	}
+	fmt.Fprintf(w, "files opened only in the old trace: %d\n", len(d.RemovedFiles))
+	for _, f := range d.RemovedFiles {
+		fmt.Fprintf(w, "  - %s\n", f)
+	}
+	fmt.Fprintf(w, "\nprocesses whose count changed (old -> new): %d\n", len(d.Processes))
+	for _, p := range d.Processes {
+		fmt.Fprintf(w, "  %d -> %d  %s\n", p.OldCount, p.NewCount, p.Path)
+	}
+}
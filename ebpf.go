@@ -0,0 +1,572 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/replit/strace-perfetto/pkg/traceconv"
+)
+
+// bpftraceStrLen is the size of the strings bpftrace reads, the largest
+// older versions allow. The paths are cut at one byte less.
+const bpftraceStrLen = 200
+
+// bpftraceScript is the bpftrace program of the eBPF backend. The traced
+// threads are the ones in @traced, which BEGIN fills in and the children
+// they create join. Each probe prints a line starting with a letter for what
+// it saw, then the tid, the pid and the CLOCK_MONOTONIC timestamp:
+//
+//	E tid pid ns nr arg0..arg5   a syscall entry, followed by
+//	S tid string                 its path, or the name of PR_SET_NAME,
+//	A tid string                 the argv[0] of execve,
+//	B tid bytes                  or the buffer written, as %r escapes it
+//	X tid pid ns nr ret          a syscall exit
+//	N tid pid ns child flags     a thread or process created
+//	G tid pid ns sig code        a signal delivered
+//	D tid pid ns                 a thread exited
+//
+// The exit of the last traced thread ends the program.
+const bpftraceScript = `
+BEGIN {
+%s	@alive = %d;
+	printf("R\n");
+}
+tracepoint:raw_syscalls:sys_enter /@traced[tid]/ {
+	printf("E %%d %%d %%llu %%ld %%lu %%lu %%lu %%lu %%lu %%lu\n", tid, pid, nsecs, args.id,
+		args.args[0], args.args[1], args.args[2], args.args[3], args.args[4], args.args[5]);
+	if (%s) {
+		printf("S %%d %%s\n", tid, str(args.args[0]));
+	}
+	if (%s) {
+		printf("S %%d %%s\n", tid, str(args.args[1]));
+	}
+	if (args.id == %d && args.args[0] == 15) {
+		printf("S %%d %%s\n", tid, str(args.args[1]));
+	}
+	if (args.id == %d) {
+		printf("A %%d %%s\n", tid, str(*uptr((uint64 *)args.args[1])));
+	}
+	if (%s) {
+		$n = args.args[2] < %d ? args.args[2] : %d;
+		printf("B %%d %%r\n", tid, buf(args.args[1], $n));
+	}
+}
+tracepoint:raw_syscalls:sys_exit /@traced[tid]/ {
+	printf("X %%d %%d %%llu %%ld %%ld\n", tid, pid, nsecs, args.id, args.ret);
+}
+tracepoint:task:task_newtask /@traced[tid]/ {
+	@traced[args.pid] = 1;
+	@alive++;
+	printf("N %%d %%d %%llu %%d %%lu\n", tid, pid, nsecs, args.pid, args.clone_flags);
+}
+tracepoint:signal:signal_deliver /@traced[tid]/ {
+	printf("G %%d %%d %%llu %%d %%d\n", tid, pid, nsecs, args.sig, args.code);
+}
+tracepoint:sched:sched_process_exit /@traced[tid]/ {
+	delete(@traced[tid]);
+	@alive--;
+	printf("D %%d %%d %%llu\n", tid, pid, nsecs);
+	if (@alive == 0) {
+		exit();
+	}
+}
+END {
+	clear(@traced);
+	clear(@alive);
+}
+`
+
+// EbpfTracer traces a command, or attaches to a process, with bpftrace: an
+// eBPF program on the raw syscall tracepoints records the syscalls of the
+// traced threads without stopping them, as ptrace does twice per syscall.
+// The events it records are the ones of the ptrace tracer, minus what can't
+// be read from the tracepoints: the buffers read, the argv of execve past
+// argv[0] and the strings past bpftraceStrLen. The fd paths are read from
+// /proc as the events come in, once the syscalls returned, by which time the
+// fd may be closed or reused: they are best-effort, marked fd_path_late.
+type EbpfTracer struct {
+	// Command is the command to run, unless Pid is set, in which case the
+	// process and its threads and children are attached to.
+	Command []string
+	Pid     int
+	Timeout time.Duration
+	// StrSize is how many bytes of the buffers written are printed, 32 if
+	// 0, as strace -s.
+	StrSize     int
+	Nanoseconds bool
+	Stdin       io.Reader
+	Stdout      io.Writer
+	Stderr      io.Writer
+	// OnStart, if set, is called with the pid of this process once the
+	// tracing has started.
+	OnStart    func(pid int)
+	ExtraFiles []*os.File
+	Env        []string
+	// Cgroup, if set, is the cgroup the command is started in.
+	Cgroup *CommandCgroup
+
+	// rec records the events, as the ptrace tracer does.
+	rec PtraceTracer
+	// lost is the number of events bpftrace dropped.
+	lost int
+}
+
+// bpftraceRecord is a line of bpftrace output, with the strings that follow
+// a syscall entry and the path of the fd it is about.
+type bpftraceRecord struct {
+	kind   byte
+	tid    int
+	pid    int
+	ts     time.Time
+	fields []string
+	// str, argv0 and buf are the S, A and B lines following an entry.
+	str, argv0, buf *string
+	fdPath          string
+}
+
+// Events returns the events recorded by RunContext.
+func (t *EbpfTracer) Events() []*Event {
+	return t.rec.events
+}
+
+// Lost returns the number of events bpftrace dropped, its buffers having
+// filled up faster than they were read: the syscalls they were of are
+// missing from the events.
+func (t *EbpfTracer) Lost() int {
+	return t.lost
+}
+
+// RunContext traces until the traced processes exit, the timeout is reached
+// or ctx is done, as PtraceTracer.RunContext does. bpftrace has to be run as
+// root.
+func (t *EbpfTracer) RunContext(ctx context.Context) error {
+	if t.Timeout != time.Duration(0) {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, t.Timeout)
+		defer cancel()
+	}
+	if t.Stdout == nil {
+		t.Stdout = os.Stdout
+	}
+	if t.Stderr == nil {
+		t.Stderr = os.Stderr
+	}
+	if t.StrSize <= 0 {
+		t.StrSize = 32
+	}
+	t.rec = PtraceTracer{StrSize: t.StrSize, Nanoseconds: t.Nanoseconds}
+	if err := t.trace(ctx); err != nil {
+		fmt.Fprintf(t.Stdout, "[!] Error tracing: %s\n", err)
+		return err
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		fmt.Fprintf(t.Stdout, "[!] Tracing timeout reached: %s\n", ctx.Err())
+	}
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	return nil
+}
+
+func (t *EbpfTracer) trace(ctx context.Context) error {
+	var roots []int
+	var cmd *exec.Cmd
+	if t.Pid != 0 {
+		for tid := range readProcTree(t.Pid).Threads {
+			roots = append(roots, tid)
+		}
+		if len(roots) == 0 {
+			return fmt.Errorf("attach to pid %d: no such process", t.Pid)
+		}
+	} else {
+		// The command stops itself until bpftrace is tracing it, and
+		// its execve is the first syscall traced.
+		cmd = exec.Command("sh", append([]string{"-c", `kill -STOP $$ && exec "$@"`, "sh"}, t.Command...)...)
+		cmd.Stdin = t.Stdin
+		cmd.Stdout = t.Stdout
+		cmd.Stderr = t.Stderr
+		cmd.ExtraFiles = t.ExtraFiles
+		if len(t.Env) > 0 {
+			cmd.Env = append(os.Environ(), t.Env...)
+		}
+		if t.Cgroup != nil {
+			t.Cgroup.startIn(cmd)
+		}
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+		var ws syscall.WaitStatus
+		if _, err := syscall.Wait4(cmd.Process.Pid, &ws, syscall.WUNTRACED, nil); err != nil {
+			return err
+		}
+		if !ws.Stopped() {
+			cmd.Wait()
+			return fmt.Errorf("run %s: %s", t.Command[0], ptraceExit(ws))
+		}
+		roots = []int{cmd.Process.Pid}
+	}
+
+	bpftrace := exec.Command("bpftrace", "-q", "-e", bpftraceProgram(roots, t.StrSize))
+	bpftrace.Env = append(os.Environ(), "BPFTRACE_STRLEN="+strconv.Itoa(bpftraceStrLen))
+	bpftrace.Stderr = t.Stderr
+	stdout, err := bpftrace.StdoutPipe()
+	if err == nil {
+		err = bpftrace.Start()
+	}
+	if err != nil {
+		if cmd != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+		}
+		return err
+	}
+	lines := traceconv.NewLineScanner(stdout, 0)
+	for lines.Scan() && lines.Text() != "R" {
+	}
+	if lines.Err() != nil || lines.Text() != "R" {
+		err := bpftrace.Wait()
+		if cmd != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+		}
+		return fmt.Errorf("bpftrace didn't start tracing: %v", err)
+	}
+	// Its clock is CLOCK_MONOTONIC.
+	clock := TakeClockSnapshot()
+	if cmd != nil {
+		cmd.Process.Signal(syscall.SIGCONT)
+	}
+	if t.OnStart != nil {
+		t.OnStart(os.Getpid())
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+			return
+		}
+		if cmd == nil {
+			bpftrace.Process.Signal(os.Interrupt)
+			return
+		}
+		signal := os.Signal(os.Interrupt)
+		var interrupted Interrupted
+		if errors.As(context.Cause(ctx), &interrupted) {
+			signal = interrupted.Signal
+		}
+		cmd.Process.Signal(signal)
+		time.AfterFunc(straceWaitDelay, func() {
+			cmd.Process.Kill()
+			// The processes the command left behind aren't waited
+			// for.
+			bpftrace.Process.Signal(os.Interrupt)
+		})
+	}()
+
+	var records []*bpftraceRecord
+	entries := make(map[int]*bpftraceRecord) // [tid], the last entry
+	for lines.Scan() {
+		var lost int
+		if _, err := fmt.Sscanf(lines.Text(), "Lost %d events", &lost); err == nil {
+			t.lost += lost
+			continue
+		}
+		r := t.parseRecord(lines.Text(), clock, entries)
+		if r != nil {
+			records = append(records, r)
+		}
+	}
+	bpftraceErr := bpftrace.Wait()
+	if cmd != nil {
+		cmd.Wait()
+	}
+	if bpftraceErr != nil && ctx.Err() == nil {
+		return fmt.Errorf("bpftrace: %w", bpftraceErr)
+	}
+	// bpftrace prints the lines of each CPU in turn, a thread that
+	// moved to another one may have its syscalls exit before they
+	// enter.
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].ts.Before(records[j].ts)
+	})
+	t.record(records)
+	return nil
+}
+
+// bpftraceProgram returns bpftraceScript for the given threads, with the
+// syscall numbers of this architecture.
+func bpftraceProgram(tids []int, strSize int) string {
+	numbers := make(map[string]int, len(ptraceSyscallNames))
+	for nr, name := range ptraceSyscallNames {
+		if name != "" {
+			numbers[name] = nr
+		}
+	}
+	// ids is the condition on args.id for the syscalls.
+	ids := func(syscalls []string) string {
+		var conditions []string
+		for _, name := range syscalls {
+			if nr, ok := numbers[name]; ok {
+				conditions = append(conditions, "args.id == "+strconv.Itoa(nr))
+			}
+		}
+		if len(conditions) == 0 {
+			return "0"
+		}
+		return strings.Join(conditions, " || ")
+	}
+	var paths [2][]string // by argument
+	for _, name := range ptraceSyscallNames {
+		for i, arg := range traceconv.ArgNames(name) {
+			if arg == "path" && i < len(paths) {
+				paths[i] = append(paths[i], name)
+			}
+		}
+	}
+	var begin strings.Builder
+	for _, tid := range tids {
+		fmt.Fprintf(&begin, "\t@traced[%d] = 1;\n", tid)
+	}
+	size := min(strSize, bpftraceStrLen)
+	return fmt.Sprintf(bpftraceScript, begin.String(), len(tids), ids(paths[0]), ids(paths[1]),
+		numbers["prctl"], numbers["execve"], ids([]string{"write", "pwrite64", "sendto"}), size, size)
+}
+
+// parseRecord parses a line of bpftrace output. The S, A and B lines are
+// added to the entry they follow, entries being the last entry of each
+// thread, and nil is returned for them.
+func (t *EbpfTracer) parseRecord(line string, clock ClockSnapshot, entries map[int]*bpftraceRecord) *bpftraceRecord {
+	kind, rest, _ := strings.Cut(line, " ")
+	if len(kind) != 1 {
+		return nil
+	}
+	switch kind[0] {
+	case 'S', 'A', 'B':
+		tid, value, ok := strings.Cut(rest, " ")
+		if !ok {
+			return nil
+		}
+		n, err := strconv.Atoi(tid)
+		entry := entries[n]
+		if err != nil || entry == nil {
+			return nil
+		}
+		switch kind[0] {
+		case 'S':
+			entry.str = &value
+		case 'A':
+			entry.argv0 = &value
+		case 'B':
+			entry.buf = &value
+		}
+		return nil
+	}
+	fields := strings.Fields(rest)
+	if len(fields) < 3 {
+		return nil
+	}
+	tid, err1 := strconv.Atoi(fields[0])
+	pid, err2 := strconv.Atoi(fields[1])
+	ns, err3 := strconv.ParseUint(fields[2], 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return nil
+	}
+	r := &bpftraceRecord{
+		kind:   kind[0],
+		tid:    tid,
+		pid:    pid,
+		ts:     time.Unix(0, int64(clock.ToRealtime(ClockMonotonic, ns))),
+		fields: fields[3:],
+	}
+	switch {
+	case r.kind == 'E' && len(r.fields) == 7:
+		entries[tid] = r
+		// The paths of the fds are read while they are open, soon
+		// after the syscalls.
+		nr, _ := strconv.ParseUint(r.fields[0], 10, 64)
+		if names := traceconv.ArgNames(ptraceSyscallName(nr)); len(names) > 0 && names[0] == "fd" {
+			fd, _ := strconv.ParseUint(r.fields[1], 10, 64)
+			r.fdPath = fdPath(tid, int(int32(fd)))
+		}
+	case r.kind == 'X' && len(r.fields) == 2:
+		nr, _ := strconv.ParseUint(r.fields[0], 10, 64)
+		ret, _ := strconv.Atoi(r.fields[1])
+		if ptraceFdSyscalls[ptraceSyscallName(nr)] && ret >= 0 {
+			r.fdPath = fdPath(tid, ret)
+		}
+	case r.kind == 'N' && len(r.fields) == 2,
+		r.kind == 'G' && len(r.fields) == 2,
+		r.kind == 'D':
+	default:
+		return nil
+	}
+	return r
+}
+
+// record turns the records, in the order of their timestamps, into events.
+func (t *EbpfTracer) record(records []*bpftraceRecord) {
+	threads := make(map[int]*ptraceThread)
+	cloneFlags := make(map[int]uint64) // [child tid]
+	exitCodes := make(map[int]int)     // [pid], of exit_group
+	signals := make(map[int]syscall.Signal)
+	for _, r := range records {
+		th := threads[r.tid]
+		if th == nil {
+			th = &ptraceThread{lifetime: t.rec.lifetime(r.tid, r.ts)}
+			threads[r.tid] = th
+		}
+		switch r.kind {
+		case 'E':
+			s := t.syscall(r)
+			th.syscall = s
+			if s.name == "exit_group" {
+				exitCodes[r.pid] = int(s.raw[0] & 0xff)
+			}
+		case 'X':
+			s := th.syscall
+			nr, _ := strconv.ParseUint(r.fields[0], 10, 64)
+			if s == nil || s.nr != nr {
+				// Entered before it was traced.
+				continue
+			}
+			th.syscall = nil
+			ret, _ := strconv.ParseInt(r.fields[1], 10, 64)
+			isError := ret < 0 && ret >= -4095
+			if flags, ok := cloneFlags[int(ret)]; ok && (s.name == "clone" || s.name == "clone3") {
+				if s.name == "clone" {
+					s.args = []string{"flags=" + ptraceCloneFlagNames(flags), "child_stack=0x" + strconv.FormatUint(s.raw[1], 16)}
+				} else {
+					s.args[0] = "{flags=" + ptraceCloneFlagNames(flags) + "}"
+				}
+			}
+			if r.fdPath != "" {
+				s.fdPath = r.fdPath
+			}
+			t.rec.events = append(t.rec.events, t.rec.ended(r.tid, s, ret, isError, r.ts))
+		case 'N':
+			child, _ := strconv.Atoi(r.fields[0])
+			flags, _ := strconv.ParseUint(r.fields[1], 10, 64)
+			cloneFlags[child] = flags
+		case 'G':
+			sig, _ := strconv.Atoi(r.fields[0])
+			signals[r.tid] = syscall.Signal(sig)
+			e := &Event{
+				Name:  ptraceSignalName(syscall.Signal(sig)),
+				Cat:   "signal",
+				Ph:    "i",
+				Scope: "t",
+				Pid:   r.tid,
+				Tid:   r.tid,
+				Args: Args{
+					Data: map[string]any{
+						"si_signo": ptraceSignalName(syscall.Signal(sig)),
+						"si_code":  r.fields[1],
+					},
+				},
+			}
+			e.Ts, e.TsNs = t.rec.micros(r.ts.UnixNano())
+			t.rec.events = append(t.rec.events, e)
+		case 'D':
+			// The wait status the parent gets isn't in the
+			// tracepoint: it is the code of the exit, or the signal
+			// delivered last if the thread didn't exit itself.
+			var ws syscall.WaitStatus
+			code, exited := exitCodes[r.pid]
+			switch {
+			case th.syscall != nil && th.syscall.name == "exit":
+				ws = syscall.WaitStatus((th.syscall.raw[0] & 0xff) << 8)
+			case exited:
+				ws = syscall.WaitStatus(code << 8)
+			case signals[r.tid] != 0:
+				ws = syscall.WaitStatus(signals[r.tid])
+			}
+			t.rec.exited(r.tid, th, ws, r.ts)
+			delete(threads, r.tid)
+		}
+	}
+	// The syscalls still running are recorded in the order they started,
+	// as the ones of strace never resumed.
+	var running []int
+	for tid, th := range threads {
+		if th.syscall != nil {
+			running = append(running, tid)
+		}
+	}
+	sort.Slice(running, func(i, j int) bool {
+		si, sj := threads[running[i]].syscall, threads[running[j]].syscall
+		if !si.start.Equal(sj.start) {
+			return si.start.Before(sj.start)
+		}
+		return running[i] < running[j]
+	})
+	for _, tid := range running {
+		t.rec.unfinished(tid, threads[tid], records[len(records)-1].ts)
+	}
+}
+
+// syscall returns the syscall a thread entered, with its arguments formatted
+// as the ptrace tracer does with what bpftrace read.
+func (t *EbpfTracer) syscall(r *bpftraceRecord) *ptraceSyscall {
+	nr, _ := strconv.ParseUint(r.fields[0], 10, 64)
+	s := &ptraceSyscall{name: ptraceSyscallName(nr), nr: nr, paths: make(map[int]string), start: r.ts, fdPath: r.fdPath, fdPathLate: true}
+	for i := range s.raw {
+		s.raw[i], _ = strconv.ParseUint(r.fields[i+1], 10, 64)
+	}
+	s.args = ptraceNumbers(s.name, s.raw)
+	names := traceconv.ArgNames(s.name)
+	if r.str != nil {
+		// The string read is cut at one byte less than its size.
+		truncated := len(*r.str) >= bpftraceStrLen-1
+		switch {
+		case s.name == "prctl":
+			s.args = []string{"PR_SET_NAME", ptraceQuote([]byte(*r.str), truncated, t.StrSize)}
+		default:
+			for i, name := range names {
+				if name == "path" {
+					s.paths[i] = *r.str
+					s.args[i] = ptraceQuote([]byte(*r.str), truncated, ptracePathMax)
+					break
+				}
+			}
+		}
+	}
+	if r.argv0 != nil && s.name == "execve" {
+		s.args[1] = "[" + ptraceQuote([]byte(*r.argv0), false, ptracePathMax) + ", ...]"
+	}
+	if r.buf != nil && len(s.args) > 2 {
+		buf := bpftraceUnescape(*r.buf)
+		s.args[1] = ptraceQuote(buf, s.raw[2] > uint64(len(buf)), t.StrSize)
+	}
+	return s
+}
+
+// bpftraceUnescape returns the bytes bpftrace printed with %r, which escapes
+// the unprintable ones as \xNN.
+func bpftraceUnescape(s string) []byte {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && s[i+1] == 'x' {
+			if c, err := strconv.ParseUint(s[i+2:i+4], 16, 8); err == nil {
+				b = append(b, byte(c))
+				i += 3
+				continue
+			}
+		}
+		b = append(b, s[i])
+	}
+	return b
+}
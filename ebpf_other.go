@@ -0,0 +1,39 @@
+//go:build !linux || !(amd64 || arm64)
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// EbpfTracer stands in for the eBPF tracer where it isn't supported.
+type EbpfTracer struct {
+	Command     []string
+	Pid         int
+	Timeout     time.Duration
+	StrSize     int
+	Nanoseconds bool
+	Stdin       io.Reader
+	Stdout      io.Writer
+	Stderr      io.Writer
+	OnStart     func(pid int)
+	ExtraFiles  []*os.File
+	Env         []string
+	Cgroup      *CommandCgroup
+}
+
+func (t *EbpfTracer) Events() []*Event {
+	return nil
+}
+
+func (t *EbpfTracer) Lost() int {
+	return 0
+}
+
+func (t *EbpfTracer) RunContext(ctx context.Context) error {
+	return errors.New("the eBPF backend needs Linux on amd64 or arm64")
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/replit/strace-perfetto/pkg/traceconv"
+)
+
+// faultSample is the number of page faults a process had at ts: the minor
+// ones, served from memory, and the major ones, which had to read from disk.
+type faultSample struct {
+	ts           time.Time
+	minor, major uint64
+}
+
+// sampleFaults reads the page fault counts of a traced process.
+func (r *ResourceMonitor) sampleFaults(pid int) {
+	minor, major, ok := readFaults(pid)
+	if !ok {
+		return
+	}
+	r.mu.Lock()
+	r.faults[pid] = append(r.faults[pid], faultSample{ts: time.Now(), minor: minor, major: major})
+	r.mu.Unlock()
+}
+
+// readFaults returns the minflt and majflt counts of /proc/<pid>/stat, which
+// are the ones of the threads of the process, alive or exited.
+func readFaults(pid int) (minor, major uint64, ok bool) {
+	contents, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, 0, false
+	}
+	// The fields after the command name, which can contain spaces, start
+	// with the state; minflt and majflt are the 10th and 12th.
+	s := string(contents)
+	fields := strings.Fields(s[strings.LastIndexByte(s, ')')+1:])
+	if len(fields) < 10 {
+		return 0, 0, false
+	}
+	minor, err1 := strconv.ParseUint(fields[7], 10, 64)
+	major, err2 := strconv.ParseUint(fields[9], 10, 64)
+	return minor, major, err1 == nil && err2 == nil
+}
+
+// faultEvents returns a "Page faults" counter track per traced process, with
+// the minor and major faults per second since the previous sample. Major
+// faults stall the process on the disk, which explains reads of mmapped
+// files, or of memory that was swapped out, slower than their syscalls. The
+// samples that don't change the rates are left out.
+func (r *ResourceMonitor) faultEvents() []*Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var tracks [][]*Event
+	for pid, samples := range r.faults {
+		var track []*Event
+		var last [2]float64
+		for i := 1; i < len(samples); i++ {
+			prev, cur := samples[i-1], samples[i]
+			seconds := cur.ts.Sub(prev.ts).Seconds()
+			if seconds <= 0 {
+				continue
+			}
+			rates := [2]float64{counterRate(prev.minor, cur.minor, seconds), counterRate(prev.major, cur.major, seconds)}
+			if i > 1 && rates == last && i < len(samples)-1 {
+				continue
+			}
+			last = rates
+			track = append(track, &Event{
+				Name: "Page faults",
+				Ph:   "C",
+				Pid:  pid,
+				Ts:   r.ts(prev.ts),
+				Args: Args{
+					Counters: map[string]float64{
+						"minor/s": rates[0],
+						"major/s": rates[1],
+					},
+				},
+			})
+		}
+		tracks = append(tracks, track)
+	}
+	return traceconv.Merge(tracks...)
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/replit/strace-perfetto/pkg/traceconv"
+)
+
+var (
+	rePathArg   = `"((?:[^"\\]|\\.)*)"`    // first quoted string
+	reFdPair    = `\[(\d+), (\d+)\]`       // pipe fds
+	reSocketArg = `^\((AF_\w+|PF_\w+|\d+)` // socket domain
+
+	regexpPathArg   = regexp.MustCompile(rePathArg)
+	regexpFdPair    = regexp.MustCompile(reFdPair)
+	regexpSocketArg = regexp.MustCompile(reSocketArg)
+)
+
+// openFd is a file descriptor opened during the trace.
+type openFd struct {
+	Pid     int    `json:"pid"`
+	Fd      int    `json:"fd"`
+	Path    string `json:"path"`
+	Ts      int64  `json:"ts"`
+	Syscall string `json:"syscall"`
+}
+
+// fdTracker follows the lifecycle of the file descriptors of the traced
+// processes, from the syscall that opened them (open, socket, pipe, dup, ...)
+// to their close, so that the syscalls taking an fd can be tied back to what
+// it refers to.
+type fdTracker struct {
+	open map[string]*openFd // [pid:fd]
+	live map[int]int        // [pid], the number of open fds
+}
+
+func newFdTracker() *fdTracker {
+	return &fdTracker{
+		open: make(map[string]*openFd),
+		live: make(map[int]int),
+	}
+}
+
+func fdKey(pid, fd int) string {
+	return strconv.Itoa(pid) + ":" + strconv.Itoa(fd)
+}
+
+// observe updates the open fds with a syscall event and returns the fd it
+// operates on or opened, or nil if it's neither (or the fd was opened before
+// the trace started). Events must be observed in order.
+func (t *fdTracker) observe(e *Event) *openFd {
+	if !isSyscall(e) || e.Cat == "failed" {
+		return nil
+	}
+	ret, _ := strconv.Atoi(strings.Fields(e.Args.ReturnValue + " ")[0])
+	args := e.Args.First + e.Args.Second
+	opened := func(fd int, path string) *openFd {
+		f := &openFd{Pid: e.Pid, Fd: fd, Path: path, Ts: e.Ts, Syscall: e.Name}
+		if t.open[fdKey(e.Pid, fd)] == nil {
+			// Not an fd dup2 replaced.
+			t.live[e.Pid]++
+		}
+		t.open[fdKey(e.Pid, fd)] = f
+		return f
+	}
+	argFd := func() *openFd {
+		m := regexpFdArg.FindStringSubmatch(args)
+		if len(m) != 2 {
+			return nil
+		}
+		fd, _ := strconv.Atoi(m[1])
+		return t.open[fdKey(e.Pid, fd)]
+	}
+
+	switch e.Name {
+	case "open", "openat", "openat2", "creat", "memfd_create":
+		m := regexpPathArg.FindStringSubmatch(args)
+		if len(m) != 2 {
+			return nil
+		}
+		path := m[1]
+		if e.Name == "memfd_create" {
+			path = "memfd:" + path
+		}
+		return opened(ret, path)
+	case "socket":
+		domain := "socket"
+		if m := regexpSocketArg.FindStringSubmatch(args); len(m) == 2 {
+			domain = "socket:" + m[1]
+		}
+		return opened(ret, domain)
+	case "accept", "accept4":
+		path := "socket:accepted"
+		if f := argFd(); f != nil {
+			path = f.Path + " (accepted)"
+		}
+		return opened(ret, path)
+	case "pipe", "pipe2", "socketpair":
+		m := regexpFdPair.FindStringSubmatch(args)
+		if len(m) != 3 {
+			return nil
+		}
+		r, _ := strconv.Atoi(m[1])
+		w, _ := strconv.Atoi(m[2])
+		opened(w, e.Name)
+		return opened(r, e.Name)
+	case "eventfd", "eventfd2", "epoll_create", "epoll_create1", "signalfd", "signalfd4", "timerfd_create", "inotify_init", "inotify_init1", "pidfd_open":
+		return opened(ret, e.Name)
+	case "dup", "dup2", "dup3":
+		f := argFd()
+		if f == nil {
+			return nil
+		}
+		return opened(ret, f.Path)
+	case "fcntl":
+		if !strings.Contains(args, "F_DUPFD") {
+			return argFd()
+		}
+		f := argFd()
+		if f == nil {
+			return nil
+		}
+		return opened(ret, f.Path)
+	case "close":
+		f := argFd()
+		if f != nil {
+			delete(t.open, fdKey(f.Pid, f.Fd))
+			t.live[f.Pid]--
+		}
+		return f
+	}
+	return argFd()
+}
+
+// leaked returns the fds that are still open.
+func (t *fdTracker) leaked() []*openFd {
+	fds := make([]*openFd, 0, len(t.open))
+	for _, f := range t.open {
+		fds = append(fds, f)
+	}
+	sort.Slice(fds, func(i, j int) bool {
+		if fds[i].Ts != fds[j].Ts {
+			return fds[i].Ts < fds[j].Ts
+		}
+		return fdKey(fds[i].Pid, fds[i].Fd) < fdKey(fds[j].Pid, fds[j].Fd)
+	})
+	return fds
+}
+
+// FdLeaks are the fds opened on a path that were never closed.
+type FdLeaks struct {
+	Path  string    `json:"path"`
+	Count int       `json:"count"`
+	Fds   []*openFd `json:"fds"`
+}
+
+// FdLeakReport lists the fds that were opened but not closed by the end of the
+// trace, grouped by path, the paths leaking the most fds first.
+type FdLeakReport []FdLeaks
+
+// NewFdLeakReport follows the fds through the syscall events and reports the
+// ones still open at the end.
+func NewFdLeakReport(events []*Event) FdLeakReport {
+	t := newFdTracker()
+	for _, e := range events {
+		t.observe(e)
+	}
+	byPath := make(map[string]*FdLeaks)
+	var report FdLeakReport
+	for _, f := range t.leaked() {
+		if byPath[f.Path] == nil {
+			byPath[f.Path] = &FdLeaks{Path: f.Path}
+		}
+		byPath[f.Path].Count++
+		byPath[f.Path].Fds = append(byPath[f.Path].Fds, f)
+	}
+	for _, l := range byPath {
+		report = append(report, *l)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Count != report[j].Count {
+			return report[i].Count > report[j].Count
+		}
+		return report[i].Path < report[j].Path
+	})
+	return report
+}
+
+// Count returns the total number of leaked fds.
+func (r FdLeakReport) Count() int {
+	n := 0
+	for _, l := range r {
+		n += l.Count
+	}
+	return n
+}
+
+// Save writes the report as JSON.
+func (r FdLeakReport) Save(output string) error {
+	b, err := json.MarshalIndent(r, "", " ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(output, b, 0644)
+}
+
+// Print writes the paths leaking the most fds, one per line.
+func (r FdLeakReport) Print(max int) {
+	for i, l := range r {
+		if i == max {
+			fmt.Printf("    ... %d more paths\n", len(r)-max)
+			break
+		}
+		fmt.Printf("    %5d %s\n", l.Count, l.Path)
+	}
+}
+
+const (
+	// fdGrowthBuckets is the number of time buckets the live fds of a
+	// process are split into to look for a count that only grows.
+	fdGrowthBuckets = 10
+	// fdGrowthMin is the smallest growth of the live fds flagged as a
+	// possible leak.
+	fdGrowthMin = 10
+)
+
+// fdCount is the number of live fds of a process from ts on.
+type fdCount struct {
+	ts int64
+	n  uint64
+}
+
+// liveFds follows the fds through the syscall events and returns, for each
+// process, the number of the fds it opened during the trace that are open,
+// every time it changes.
+func liveFds(syscallEvents []*Event) map[int][]fdCount {
+	t := newFdTracker()
+	series := make(map[int][]fdCount)
+	for _, e := range syscallEvents {
+		f := t.observe(e)
+		if f == nil {
+			continue
+		}
+		n := uint64(t.live[f.Pid])
+		if points := series[f.Pid]; len(points) > 0 && points[len(points)-1].n == n {
+			continue
+		}
+		series[f.Pid] = append(series[f.Pid], fdCount{ts: e.Ts + e.Dur, n: n})
+	}
+	return series
+}
+
+// liveFdCounters returns a "fds live" counter track per process, with the
+// number of the fds it opened during the trace that are still open (the ones
+// it inherited or had opened before aren't known).
+func liveFdCounters(syscallEvents []*Event) []*Event {
+	var tracks [][]*Event
+	for pid, points := range liveFds(syscallEvents) {
+		track := make([]*Event, 0, len(points))
+		for _, p := range points {
+			track = append(track, &Event{
+				Name: "fds",
+				Ph:   "C",
+				Pid:  pid,
+				Ts:   p.ts,
+				Args: Args{
+					Counters: map[string]float64{"live": float64(p.n)},
+				},
+			})
+		}
+		tracks = append(tracks, track)
+	}
+	return traceconv.Merge(tracks...)
+}
+
+// fdGrowth looks for the processes whose live fds only grow, and returns an
+// annotation slice and a warning for each. The fds of a process are split
+// into fdGrowthBuckets buckets of equal duration, and the lowest count of
+// every bucket must be at least the one of the previous bucket: the fds that
+// are opened and closed again don't hide a leak.
+func fdGrowth(syscallEvents []*Event) ([]*Event, []string) {
+	var events []*Event
+	var warnings []string
+	series := liveFds(syscallEvents)
+	pids := make([]int, 0, len(series))
+	for pid := range series {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	for _, pid := range pids {
+		points := series[pid]
+		first, last := points[0], points[len(points)-1]
+		if last.ts <= first.ts {
+			continue
+		}
+		lowest := make([]uint64, fdGrowthBuckets)
+		current := first.n
+		i := 0
+		for b := range lowest {
+			bucketEnd := first.ts + (last.ts-first.ts)*int64(b+1)/fdGrowthBuckets
+			lowest[b] = current
+			for ; i < len(points) && points[i].ts <= bucketEnd; i++ {
+				current = points[i].n
+				lowest[b] = min(lowest[b], current)
+			}
+		}
+		growing := lowest[len(lowest)-1] >= lowest[0]+fdGrowthMin
+		for b := 1; b < len(lowest); b++ {
+			growing = growing && lowest[b] >= lowest[b-1]
+		}
+		if !growing {
+			continue
+		}
+		events = append(events, &Event{
+			Name: "possible fd leak",
+			Cat:  "annotation",
+			Ph:   "X",
+			Pid:  pid,
+			Tid:  pid,
+			Ts:   first.ts,
+			Dur:  last.ts - first.ts,
+			Args: Args{
+				Data: map[string]any{
+					"from_fds": lowest[0],
+					"to_fds":   last.n,
+				},
+			},
+		})
+		warnings = append(warnings, fmt.Sprintf("The open fds of process %d only grew, from %d to %d, possible fd leak (-fd-leaks lists them)", pid, lowest[0], last.n))
+	}
+	return events, warnings
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	// pathSyscalls are the syscalls looking up a path without opening it,
+	// which typically precede opening it.
+	pathSyscalls = map[string]bool{
+		"stat": true, "lstat": true, "newfstatat": true, "fstatat64": true, "statx": true,
+		"access": true, "faccessat": true, "faccessat2": true, "readlink": true, "readlinkat": true,
+	}
+	// openSyscalls are the syscalls opening a path.
+	openSyscalls = map[string]bool{
+		"open": true, "openat": true, "openat2": true, "creat": true,
+	}
+)
+
+// fileOperation is a sequence of syscalls of one thread on the same path.
+type fileOperation struct {
+	path     string
+	fd       int
+	opened   bool
+	syscalls []*Event
+}
+
+// fileOperations groups the stat → open → read/write/... → close sequences
+// made by a thread on the same path into "access <path>" slices containing
+// the syscalls, so that traces can be read at the level of file operations.
+// A sequence is only grouped when the thread makes no other syscall in the
+// middle of it, which keeps the slices properly nested.
+func fileOperations(syscallEvents []*Event) []*Event {
+	var ops []*Event
+	fds := newFdTracker()
+	current := make(map[int]*fileOperation) // [tid]
+	for _, e := range syscallEvents {
+		if !isSyscall(e) {
+			continue
+		}
+		f := fds.observe(e)
+		op := current[e.Tid]
+		if op != nil && op.add(e, f) {
+			if op.opened && e.Name == "close" {
+				ops = append(ops, op.event())
+				delete(current, e.Tid)
+			}
+			continue
+		}
+		delete(current, e.Tid)
+
+		// Start a new operation with a lookup or an open.
+		if e.Cat == "failed" {
+			continue
+		}
+		switch {
+		case pathSyscalls[e.Name]:
+			if m := regexpPathArg.FindStringSubmatch(e.Args.First); len(m) == 2 {
+				current[e.Tid] = &fileOperation{path: m[1], syscalls: []*Event{e}}
+			}
+		case openSyscalls[e.Name] && f != nil:
+			current[e.Tid] = &fileOperation{path: f.Path, fd: f.Fd, opened: true, syscalls: []*Event{e}}
+		}
+	}
+	sort.SliceStable(ops, func(i, j int) bool {
+		return ops[i].Ts < ops[j].Ts
+	})
+	return ops
+}
+
+// add adds a syscall to the operation if it belongs to it. f is the fd the
+// syscall operates on, if any.
+func (op *fileOperation) add(e *Event, f *openFd) bool {
+	switch {
+	case !op.opened && pathSyscalls[e.Name]:
+		m := regexpPathArg.FindStringSubmatch(e.Args.First)
+		if len(m) != 2 || m[1] != op.path {
+			return false
+		}
+	case !op.opened && openSyscalls[e.Name]:
+		if f == nil || f.Path != op.path {
+			return false
+		}
+		op.fd = f.Fd
+		op.opened = true
+	case op.opened && e.Name == "mmap":
+		// The fd is the fifth argument of mmap.
+		args := strings.Split(strings.Trim(e.Args.First, "()"), ", ")
+		if len(args) != 6 || args[4] != strconv.Itoa(op.fd) {
+			return false
+		}
+	case op.opened:
+		if f == nil || f.Fd != op.fd || f.Path != op.path {
+			return false
+		}
+	default:
+		return false
+	}
+	op.syscalls = append(op.syscalls, e)
+	return true
+}
+
+func (op *fileOperation) event() *Event {
+	first := op.syscalls[0]
+	last := op.syscalls[len(op.syscalls)-1]
+	return &Event{
+		Name: "access " + op.path,
+		Cat:  "file_op",
+		Ph:   "X",
+		Pid:  first.Pid,
+		Tid:  first.Tid,
+		Ts:   first.Ts,
+		Dur:  last.Ts + last.Dur - first.Ts,
+		Args: Args{
+			Data: map[string]any{
+				"path":     op.path,
+				"syscalls": len(op.syscalls),
+			},
+		},
+	}
+}
+
+// fitToFileOperations widens the slices that partially overlap a file
+// operation of the same thread to contain it, so that both nest.
+func fitToFileOperations(slices []*Event, ops []*Event) {
+	byTid := make(map[int][]*Event)
+	for _, op := range ops {
+		byTid[op.Tid] = append(byTid[op.Tid], op)
+	}
+	for _, s := range slices {
+		for _, op := range byTid[s.Tid] {
+			start, end := s.Ts, s.Ts+s.Dur
+			opEnd := op.Ts + op.Dur
+			if op.Ts >= end || opEnd <= start {
+				continue
+			}
+			if op.Ts < start {
+				s.Ts = op.Ts
+			}
+			if opEnd > end {
+				end = opEnd
+			}
+			s.Dur = end - s.Ts
+		}
+	}
+}
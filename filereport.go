@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// FileAccess is the syscalls made on a path: the lookups and opens of the
+// path, and the syscalls made on the fds those opened.
+type FileAccess struct {
+	Path string `json:"path"`
+	// NixPackage and NixVersion are the derivation of a /nix/store path,
+	// and NixPath the path stripped of its hash.
+	NixPackage string `json:"nix_package,omitempty"`
+	NixVersion string `json:"nix_version,omitempty"`
+	NixPath    string `json:"nix_path,omitempty"`
+	Syscalls   int    `json:"syscalls"`
+	Failed     int    `json:"failed"`
+	DurUs      int64  `json:"dur_us"`
+	Pids       []int  `json:"pids"`
+}
+
+// FileAccessReport lists the files accessed during the trace, the most
+// accessed first.
+type FileAccessReport []*FileAccess
+
+// NewFileAccessReport follows the paths and fds through the syscall events.
+func NewFileAccessReport(events []*Event) FileAccessReport {
+	fds := newFdTracker()
+	byPath := make(map[string]*FileAccess)
+	pids := make(map[string]map[int]bool) // [path][pid]
+	for _, e := range events {
+		if !isSyscall(e) {
+			continue
+		}
+		f := fds.observe(e)
+		var path string
+		switch {
+		case pathSyscalls[e.Name] || openSyscalls[e.Name] || e.Name == "execve":
+			m := regexpPathArg.FindStringSubmatch(e.Args.First)
+			if len(m) != 2 {
+				continue
+			}
+			path = m[1]
+		case f != nil && openSyscalls[f.Syscall]:
+			path = f.Path
+		default:
+			continue
+		}
+		a := byPath[path]
+		if a == nil {
+			a = &FileAccess{Path: path}
+			if m := regexpNixStorePath.FindStringSubmatch(path); len(m) == 3 {
+				a.NixPackage, a.NixVersion = parseNixDerivation(m[1])
+				a.NixPath = m[1] + m[2]
+			}
+			byPath[path] = a
+			pids[path] = make(map[int]bool)
+		}
+		a.Syscalls++
+		if e.Cat == "failed" {
+			a.Failed++
+		}
+		a.DurUs += e.Dur
+		if !pids[path][e.Pid] {
+			pids[path][e.Pid] = true
+			a.Pids = append(a.Pids, e.Pid)
+		}
+	}
+	report := make(FileAccessReport, 0, len(byPath))
+	for _, a := range byPath {
+		sort.Ints(a.Pids)
+		report = append(report, a)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Syscalls != report[j].Syscalls {
+			return report[i].Syscalls > report[j].Syscalls
+		}
+		return report[i].Path < report[j].Path
+	})
+	return report
+}
+
+// Save writes the report as JSON.
+func (r FileAccessReport) Save(output string) error {
+	b, err := json.MarshalIndent(r, "", " ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(output, b, 0644)
+}
+
+// Print writes the most accessed paths, one per line, the /nix/store ones
+// without their hash.
+func (r FileAccessReport) Print(max int) {
+	for i, a := range r {
+		if i == max {
+			fmt.Printf("    ... %d more paths\n", len(r)-max)
+			break
+		}
+		path := a.Path
+		if a.NixPath != "" {
+			path = "/nix/store/…-" + a.NixPath
+		}
+		fmt.Printf("    %5d %s\n", a.Syscalls, path)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/replit/strace-perfetto/pkg/traceconv"
+)
+
+// syscallClasses are the presets of -only, and the strace syscall classes they
+// expand to.
+var syscallClasses = map[string]string{
+	"file":    "%file",
+	"desc":    "%desc",
+	"network": "%network",
+	"process": "%process",
+	"signal":  "%signal",
+	"ipc":     "%ipc",
+	"memory":  "%memory",
+	"creds":   "%creds",
+	"clock":   "%clock",
+	"stat":    "%stat",
+}
+
+// straceFilter returns the strace -e expression for the comma-separated -only
+// presets and -exclude syscalls, or "" if there are neither.
+//
+// strace can't combine the two in one trace= expression, a negation applies to
+// all of it; with both, -only is left to strace and the excluded syscalls are
+// dropped by excludeSyscalls.
+func straceFilter(only, exclude string) (string, error) {
+	if only == "" {
+		if exclude == "" {
+			return "", nil
+		}
+		return "trace=!" + exclude, nil
+	}
+	var classes []string
+	for _, preset := range strings.Split(only, ",") {
+		class, ok := syscallClasses[preset]
+		if !ok {
+			presets := make([]string, 0, len(syscallClasses))
+			for p := range syscallClasses {
+				presets = append(presets, p)
+			}
+			sort.Strings(presets)
+			return "", fmt.Errorf("unknown -only preset %q, must be one of %s", preset, strings.Join(presets, ", "))
+		}
+		classes = append(classes, class)
+	}
+	return "trace=" + strings.Join(classes, ","), nil
+}
+
+// excludeSyscalls drops the events of the comma-separated syscalls from the
+// parsed strace events, keeping the thread lifetimes and signals.
+func excludeSyscalls(events []*Event, exclude string) []*Event {
+	if exclude == "" {
+		return events
+	}
+	excluded := make(map[string]bool)
+	for _, name := range strings.Split(exclude, ",") {
+		excluded[name] = true
+	}
+	kept := events[:0]
+	for _, e := range events {
+		if e.Cat != "lifetime" && e.Cat != "signal" && excluded[e.Name] {
+			continue
+		}
+		kept = append(kept, e)
+	}
+	return kept
+}
+
+// shortSyscallBucket is the interval the syscalls left out by -min-dur are
+// counted over, in microseconds.
+const shortSyscallBucket = 1000000
+
+// dropShortSyscalls removes the syscall slices shorter than minDur (in
+// microseconds). With counters, the syscalls removed are counted instead, per
+// process and per second of the trace, on a "short syscalls" counter track.
+func dropShortSyscalls(events []*Event, minDur int64, counters bool) []*Event {
+	type bucket struct {
+		pid   int
+		start int64
+	}
+	type tally struct {
+		count int
+		dur   int64
+	}
+	tallies := make(map[bucket]*tally)
+	kept := make([]*Event, 0, len(events))
+	// The seconds are counted from the first syscall, and the counters
+	// end with the trace, so they don't stretch the timeline.
+	first, last := int64(-1), int64(0)
+	for _, e := range events {
+		if isSyscall(e) {
+			if first < 0 {
+				first = e.Ts
+			}
+			last = max(last, e.Ts+e.Dur)
+		}
+		if !isSyscall(e) || e.Dur >= minDur {
+			kept = append(kept, e)
+			continue
+		}
+		if counters {
+			b := bucket{pid: e.Pid, start: e.Ts - (e.Ts-first)%shortSyscallBucket}
+			if tallies[b] == nil {
+				tallies[b] = &tally{}
+			}
+			tallies[b].count++
+			tallies[b].dur += e.Dur
+		}
+	}
+	if len(tallies) == 0 {
+		return kept
+	}
+
+	buckets := make([]bucket, 0, len(tallies))
+	for b := range tallies {
+		buckets = append(buckets, b)
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		if buckets[i].start != buckets[j].start {
+			return buckets[i].start < buckets[j].start
+		}
+		return buckets[i].pid < buckets[j].pid
+	})
+	counterEvents := make([]*Event, 0, 2*len(buckets))
+	for _, b := range buckets {
+		counterEvents = append(counterEvents, shortSyscallsCounter(b.pid, b.start, tallies[b].count, tallies[b].dur))
+		// Back to zero after a second without short syscalls.
+		next := bucket{pid: b.pid, start: b.start + shortSyscallBucket}
+		if tallies[next] == nil {
+			counterEvents = append(counterEvents, shortSyscallsCounter(next.pid, min(next.start, last), 0, 0))
+		}
+	}
+	sort.SliceStable(counterEvents, func(i, j int) bool {
+		return counterEvents[i].Ts < counterEvents[j].Ts
+	})
+	return traceconv.Merge(kept, counterEvents)
+}
+
+func shortSyscallsCounter(pid int, ts int64, count int, dur int64) *Event {
+	return &Event{
+		Name: "short syscalls",
+		Ph:   "C",
+		Pid:  pid,
+		Ts:   ts,
+		Args: Args{
+			Counters: map[string]float64{
+				"calls/s":   float64(count),
+				"time ms/s": float64(dur) / 1000,
+			},
+		},
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// foldedStack is the total time spent in syscalls under a stack of frames,
+// outermost first, in microseconds.
+type foldedStack struct {
+	frames []string
+	dur    int64
+}
+
+// syscallStacks sums up the time spent in each syscall by each thread, as
+// process → thread → syscall stacks, the stacks taking the most time first.
+func syscallStacks(events []*Event) []foldedStack {
+	processNames := make(map[int]string)
+	threadNames := make(map[int]string)
+	for _, e := range events {
+		switch {
+		case e.Ph == "M" && e.Name == "process_name":
+			processNames[e.Pid] = e.Args.Name
+		case e.Ph == "M" && e.Name == "thread_name":
+			threadNames[e.Tid] = e.Args.Name
+		}
+	}
+
+	totals := make(map[[3]string]int64)
+	for _, e := range events {
+		if !isSyscall(e) {
+			continue
+		}
+		k := [3]string{
+			stackFrameName(processNames[e.Pid], "pid", e.Pid),
+			stackFrameName(threadNames[e.Tid], "tid", e.Tid),
+			e.Name,
+		}
+		totals[k] += e.Dur
+	}
+	stacks := make([]foldedStack, 0, len(totals))
+	for k, dur := range totals {
+		stacks = append(stacks, foldedStack{frames: k[:], dur: dur})
+	}
+	sort.Slice(stacks, func(i, j int) bool {
+		if stacks[i].dur != stacks[j].dur {
+			return stacks[i].dur > stacks[j].dur
+		}
+		return strings.Join(stacks[i].frames, ";") < strings.Join(stacks[j].frames, ";")
+	})
+	return stacks
+}
+
+func stackFrameName(name, kind string, id int) string {
+	if name == "" {
+		return fmt.Sprintf("%s %d", kind, id)
+	}
+	return fmt.Sprintf("%s (%d)", name, id)
+}
+
+// SaveFolded writes the time spent in syscalls as folded stacks, one
+// "process;thread;syscall microseconds" line per stack, the input of
+// flamegraph.pl and the like.
+func (te TraceEvents) SaveFolded(output string) {
+	f, err := os.Create(output)
+	if err != nil {
+		log.Fatalf("[!] Error creating folded stacks file: %s\n", err)
+	}
+	w := bufio.NewWriter(f)
+	for _, s := range syscallStacks(te.Event) {
+		frames := make([]string, len(s.frames))
+		for i, frame := range s.frames {
+			frames[i] = strings.ReplaceAll(frame, ";", ":")
+		}
+		fmt.Fprintf(w, "%s %d\n", strings.Join(frames, ";"), s.dur)
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatalf("[!] Error creating folded stacks file: %s\n", err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatalf("[!] Error creating folded stacks file: %s\n", err)
+	}
+}
+
+// speedscopeFile is the speedscope file format
+// (https://www.speedscope.app/file-format-schema.json), with a single sampled
+// profile whose samples are the stacks and whose weights are their durations.
+type speedscopeFile struct {
+	Schema   string              `json:"$schema"`
+	Shared   speedscopeShared    `json:"shared"`
+	Profiles []speedscopeProfile `json:"profiles"`
+	Name     string              `json:"name"`
+	Exporter string              `json:"exporter"`
+}
+
+type speedscopeShared struct {
+	Frames []speedscopeFrame `json:"frames"`
+}
+
+type speedscopeFrame struct {
+	Name string `json:"name"`
+}
+
+type speedscopeProfile struct {
+	Type       string  `json:"type"`
+	Name       string  `json:"name"`
+	Unit       string  `json:"unit"`
+	StartValue int64   `json:"startValue"`
+	EndValue   int64   `json:"endValue"`
+	Samples    [][]int `json:"samples"`
+	Weights    []int64 `json:"weights"`
+}
+
+// SaveSpeedscope writes the time spent in syscalls as a speedscope profile,
+// to view as a flamegraph of where the wall time went.
+func (te TraceEvents) SaveSpeedscope(output string) {
+	profile := speedscopeProfile{
+		Type: "sampled",
+		Name: "syscall time",
+		Unit: "microseconds",
+	}
+	var frames []speedscopeFrame
+	frameIndex := make(map[string]int)
+	for _, s := range syscallStacks(te.Event) {
+		sample := make([]int, len(s.frames))
+		for i, frame := range s.frames {
+			idx, ok := frameIndex[frame]
+			if !ok {
+				idx = len(frames)
+				frameIndex[frame] = idx
+				frames = append(frames, speedscopeFrame{Name: frame})
+			}
+			sample[i] = idx
+		}
+		profile.Samples = append(profile.Samples, sample)
+		profile.Weights = append(profile.Weights, s.dur)
+		profile.EndValue += s.dur
+	}
+	b, err := json.Marshal(speedscopeFile{
+		Schema:   "https://www.speedscope.app/file-format-schema.json",
+		Shared:   speedscopeShared{Frames: frames},
+		Profiles: []speedscopeProfile{profile},
+		Name:     output,
+		Exporter: "strace-perfetto",
+	})
+	if err != nil {
+		log.Fatalf("[!] Error encoding speedscope profile: %s\n", err)
+	}
+	if err := os.WriteFile(output, b, 0644); err != nil {
+		log.Fatalf("[!] Error creating speedscope file: %s\n", err)
+	}
+}
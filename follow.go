@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/replit/strace-perfetto/pkg/traceconv"
+)
+
+// followReader reads a file that another process is still writing to. When
+// it reaches the end of the file it waits for more data instead of returning
+// io.EOF, until its context is done. A file truncated in place, or renamed and
+// replaced by a new one, as log rotation does, is followed from the start of
+// its new content. With spooling, what is read is also kept in spool until the
+// next snapshot of the trace takes it.
+type followReader struct {
+	ctx          context.Context
+	path         string
+	f            *os.File
+	pollInterval time.Duration
+	spooling     bool
+
+	offset  int64
+	partial bool // the last line read has no newline yet
+	spoolMu sync.Mutex
+	spool   bytes.Buffer
+}
+
+func (r *followReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.f.Read(p)
+		if n > 0 {
+			r.offset += int64(n)
+			r.partial = p[n-1] != '\n'
+			r.spooled(p[:n])
+			return n, nil
+		}
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		if r.reopen() {
+			if r.partial && len(p) > 0 {
+				// The line cut short by the rotation ends here.
+				p[0], r.partial = '\n', false
+				r.spooled(p[:1])
+				return 1, nil
+			}
+			continue
+		}
+		select {
+		case <-r.ctx.Done():
+			return 0, io.EOF
+		case <-time.After(r.pollInterval):
+		}
+	}
+}
+
+// reopen reports whether the file was truncated or replaced since it was
+// read to its end, starting over from the start of its new content if so.
+func (r *followReader) reopen() bool {
+	info, err := os.Stat(r.path)
+	if err != nil {
+		// Renamed away, and not replaced yet.
+		return false
+	}
+	current, err := r.f.Stat()
+	if err != nil {
+		return false
+	}
+	switch {
+	case !os.SameFile(info, current):
+		f, err := os.Open(r.path)
+		if err != nil {
+			return false
+		}
+		r.f.Close()
+		r.f = f
+		progressf("[+] %s was replaced, following the new file\n", r.path)
+	case info.Size() < r.offset:
+		if _, err := r.f.Seek(0, io.SeekStart); err != nil {
+			return false
+		}
+		progressf("[+] %s was truncated, following it from its start\n", r.path)
+	default:
+		return false
+	}
+	r.offset = 0
+	return true
+}
+
+// spooled keeps b in the spool, with spooling.
+func (r *followReader) spooled(b []byte) {
+	if !r.spooling {
+		return
+	}
+	r.spoolMu.Lock()
+	r.spool.Write(b)
+	r.spoolMu.Unlock()
+}
+
+// take returns what was read since the last call, and empties the spool.
+func (r *followReader) take() []byte {
+	r.spoolMu.Lock()
+	defer r.spoolMu.Unlock()
+	b := bytes.Clone(r.spool.Bytes())
+	r.spool.Reset()
+	return b
+}
+
+// followParser parses the strace output followed as it is read, for the
+// snapshots, each line once. The lines of the syscalls still unfinished, and
+// the last line until its newline is read, are held back until they are
+// complete.
+type followParser struct {
+	partial       string
+	carried       []string
+	personalities []string
+	events        []*Event
+	// lifetimes are the lifetime begin events of the threads that haven't
+	// exited yet, which each chunk parsed begins again.
+	lifetimes map[int]*Event // [tid]
+}
+
+// parse parses the lines completed by b.
+func (p *followParser) parse(b []byte) {
+	text := p.partial + string(b)
+	end := strings.LastIndexByte(text, '\n') + 1
+	p.partial = text[end:]
+	if end == 0 {
+		return
+	}
+	lines := append(p.carried, strings.SplitAfter(text[:end], "\n")...)
+	lines = lines[:len(lines)-1] // after the last newline
+	unfinished := unfinishedLines(lines)
+	var chunk strings.Builder
+	for _, line := range p.personalities {
+		chunk.WriteString(line)
+	}
+	var carried []string
+	for i, line := range lines {
+		if strings.HasPrefix(line, "[ Process PID=") {
+			p.personalities = append(p.personalities, line)
+		}
+		if unfinished[i] {
+			carried = append(carried, line)
+			continue
+		}
+		chunk.WriteString(line)
+	}
+	p.carried = carried
+	parser := traceconv.Parser{
+		MaxLineSize: int(flagMaxLineSize),
+		Ltrace:      *flagLtrace,
+	}
+	if p.lifetimes == nil {
+		p.lifetimes = make(map[int]*Event)
+	}
+	for _, e := range parser.Parse(strings.NewReader(chunk.String())) {
+		if e.Cat == "lifetime" {
+			begin := p.lifetimes[e.Tid]
+			switch {
+			case e.Ph == "B" && begin != nil:
+				// The name of an abnormal exit is the begin's.
+				if e.Name != begin.Name {
+					begin.Name, begin.Cname = e.Name, e.Cname
+				}
+				continue
+			case e.Ph == "B":
+				p.lifetimes[e.Tid] = e
+			case e.Ph == "E":
+				delete(p.lifetimes, e.Tid)
+			}
+		}
+		p.events = append(p.events, e)
+	}
+}
+
+// snapshot returns a copy of the events parsed so far, for their conversion
+// to leave them as they are.
+func (p *followParser) snapshot() []*Event {
+	events := make([]*Event, len(p.events))
+	for i, e := range p.events {
+		c := *e
+		c.Args.Data = maps.Clone(e.Args.Data)
+		events[i] = &c
+	}
+	return events
+}
+
+// follow tails an strace output file written by another process, converting
+// it until the user interrupts the tool. The trace of what was read so far is
+// saved every -follow-interval in the meantime.
+func follow(input string) {
+	f, err := os.Open(input)
+	if err != nil {
+		log.Fatalf("[!] Error opening strace file: %s\n", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	signalMarkers := NewSignalMarkers(*flagUsr1, *flagUsr2)
+	go signalMarkers.Run(ctx)
+
+	fmt.Printf("[+] Following %s, press Ctrl-C to stop\n", input)
+	clockSnapshots := []ClockSnapshot{TakeClockSnapshot()}
+	capture := NewCaptureInfo("")
+	capture.Input, capture.Cwd = input, ""
+	r := &followReader{
+		ctx:          ctx,
+		path:         input,
+		f:            f,
+		pollInterval: 100 * time.Millisecond,
+	}
+	defer func() { r.f.Close() }()
+	var snapshotsDone sync.WaitGroup
+	if *flagFollowSave > 0 && !*flagAppend && (*flagFormat == "json" || *flagFormat == "proto") {
+		r.spooling = true
+		snapshotsDone.Add(1)
+		go func() {
+			defer snapshotsDone.Done()
+			saveSnapshots(ctx, r, signalMarkers, clockSnapshots, capture)
+		}()
+	}
+	straceEvents := convertStrace(r, traceconv.ProcTree{})
+	snapshotsDone.Wait()
+	clockSnapshots = append(clockSnapshots, TakeClockSnapshot())
+	saveStraceFile(straceEvents, signalMarkers.Events(), clockSnapshots, capture)
+}
+
+// saveSnapshots saves the trace of what r read so far every
+// -follow-interval, until ctx is done, for the trace to be looked at while
+// the file is being followed. Each snapshot replaces the previous one at
+// once, and is converted without the reports and the -format outputs other
+// than json and proto, which are left to the final trace. The lines are
+// parsed once, as they are read, and the syscalls still unfinished are left
+// out until they are resumed.
+func saveSnapshots(ctx context.Context, r *followReader, signalMarkers *SignalMarkers, clockSnapshots []ClockSnapshot, capture CaptureInfo) {
+	ticker := time.NewTicker(*flagFollowSave)
+	defer ticker.Stop()
+	var parser followParser
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		parser.parse(r.take())
+		straceEvents := convertSyscalls(parser.snapshot(), traceconv.ProcTree{})
+		snapshots := append(slices.Clone(clockSnapshots), TakeClockSnapshot())
+		events, metadata, _ := straceFileTrace(straceEvents, signalMarkers.Events(), snapshots, capture)
+		te := TraceEvents{Event: events, Metadata: metadata}
+		tmp := *flagOutput + ".tmp"
+		switch *flagFormat {
+		case "proto":
+			te.SaveProto(tmp)
+		case "json":
+			te.Save(tmp)
+		}
+		if err := os.Rename(tmp, *flagOutput); err != nil {
+			log.Printf("[!] Error saving the snapshot of the trace: %s", err)
+			continue
+		}
+		progressf("[+] Snapshot of %d events saved to: %s\n", len(events), *flagOutput)
+	}
+}
+
+// convertFile converts a complete strace output file, e.g. one recorded on a
+// host where this tool isn't installed.
+func convertFile(input string) {
+	if *flagFF {
+		r, err := perPidOutput(input)
+		if err != nil {
+			log.Fatalf("[!] Error reading strace -ff output: %s\n", err)
+		}
+		progressf("[+] Converting %s.*\n", input)
+		saveStraceFile(convertStrace(r, traceconv.ProcTree{}), nil, nil, CaptureInfo{Input: input + ".*", ToolVersion: toolVersion()})
+		return
+	}
+	f, err := os.Open(input)
+	if err != nil {
+		log.Fatalf("[!] Error opening strace file: %s\n", err)
+	}
+	defer f.Close()
+
+	progressf("[+] Converting %s\n", input)
+	saveStraceFile(convertStrace(f, traceconv.ProcTree{}), nil, nil, CaptureInfo{Input: input, ToolVersion: toolVersion()})
+}
+
+// saveStraceFile merges the events converted from an strace file with the
+// other event sources given on the command line, and saves the trace. The
+// clock snapshots are the ones taken while the file was being written, if it
+// was written on this host, which capture then describes.
+func saveStraceFile(straceEvents []*Event, markerEvents []*Event, clockSnapshots []ClockSnapshot, capture CaptureInfo) {
+	events, metadata, warnings := straceFileTrace(straceEvents, markerEvents, clockSnapshots, capture)
+	saveTrace(events, metadata)
+	for _, warning := range warnings {
+		fmt.Printf("[!] %s\n", warning)
+	}
+}
+
+// straceFileTrace returns the events of the trace of an strace file, as
+// saveStraceFile saves them, with its metadata and warnings.
+func straceFileTrace(straceEvents []*Event, markerEvents []*Event, clockSnapshots []ClockSnapshot, capture CaptureInfo) ([]*Event, map[string]any, []string) {
+	clock := TakeClockSnapshot()
+	if len(clockSnapshots) > 0 {
+		clock = clockSnapshots[len(clockSnapshots)-1]
+	}
+	mergeTraces, err := loadMergeTraces(flagMergeTrace, clock)
+	if err != nil {
+		log.Fatalf("[!] Error loading trace to merge: %s\n", err)
+	}
+	fdGrowthEvents, warnings := fdGrowth(straceEvents)
+	eventSources := [][]*Event{straceEvents, markerEvents, fdGrowthEvents}
+	if *flagIdleGap > 0 {
+		eventSources = append(eventSources, idleGaps(straceEvents, flagIdleGap.Microseconds(), classifyIdleGap(nil)))
+	}
+	goTraces, err := loadGoTraces(flagGoTrace, clock, straceEvents)
+	if err != nil {
+		log.Fatalf("[!] Error loading Go trace to merge: %s\n", err)
+	}
+	eventSources = append(eventSources, goTraces...)
+	renumberIDs(mergeTraces, eventSources...)
+	eventSources = append(eventSources, mergeTraces...)
+	metadata := map[string]any{
+		"clockDomains": map[string]ClockDomain{
+			"strace": ClockRealtime,
+		},
+		"capture": capture,
+	}
+	if len(clockSnapshots) > 0 {
+		metadata["clockSnapshots"] = clockSnapshots
+	}
+	if len(warnings) > 0 {
+		metadata["warnings"] = warnings
+	}
+	return traceconv.Merge(eventSources...), metadata, warnings
+}
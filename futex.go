@@ -0,0 +1,100 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// futexFlowIDBase is the first id of the futex flows, past the ids of the
+// clone flows.
+const futexFlowIDBase = 1 << 40
+
+// futexOp returns the address and the operation of a futex syscall, from
+// its parsed args, the operation without its _PRIVATE and
+// FUTEX_CLOCK_REALTIME modifiers.
+func futexOp(e *Event) (addr, op string, ok bool) {
+	addr, _ = e.Args.Data["uaddr"].(string)
+	op, _ = e.Args.Data["futex_op"].(string)
+	if addr == "" || op == "" {
+		return "", "", false
+	}
+	op, _, _ = strings.Cut(op, "|")
+	return addr, strings.TrimSuffix(op, "_PRIVATE"), true
+}
+
+// futexKey identifies a futex: private futexes are per address space, and
+// processes don't usually share futexes at the same address.
+func futexKey(pid int, addr string) string {
+	return strconv.Itoa(pid) + ":" + addr
+}
+
+// futexFlows connects the futex wakes to the waits they ended: every wait
+// on an address that returned 0 was woken by a thread that made a
+// FUTEX_WAKE on the same address while it waited, the last one to do so
+// before it returned, as far as the number of threads the wake says it woke
+// allows. The flows go from the waker's wake to the end of the woken
+// thread's wait, making lock contention visible.
+func futexFlows(syscallEvents []*Event) []*Event {
+	type wake struct {
+		e    *Event
+		left int
+	}
+	wakes := make(map[string][]*wake) // [pid:addr]
+	var waits []*Event
+	for _, e := range syscallEvents {
+		if e.Name != "futex" || !isSyscall(e) || e.Cat == "failed" {
+			continue
+		}
+		addr, op, ok := futexOp(e)
+		if !ok {
+			continue
+		}
+		switch op {
+		case "FUTEX_WAIT", "FUTEX_WAIT_BITSET":
+			if e.Args.ReturnValue == "0" {
+				waits = append(waits, e)
+			}
+		case "FUTEX_WAKE", "FUTEX_WAKE_BITSET":
+			if n, err := strconv.Atoi(e.Args.ReturnValue); err == nil && n > 0 {
+				key := futexKey(e.Pid, addr)
+				wakes[key] = append(wakes[key], &wake{e: e, left: n})
+			}
+		}
+	}
+	// The waits that returned first were woken first.
+	sort.SliceStable(waits, func(i, j int) bool {
+		return waits[i].EndNanos() < waits[j].EndNanos()
+	})
+
+	var flows []*Event
+	id := uint64(futexFlowIDBase)
+	for _, w := range waits {
+		addr, _, _ := futexOp(w)
+		var waker *wake
+		for _, c := range wakes[futexKey(w.Pid, addr)] {
+			if c.e.Tid == w.Tid || c.left == 0 || c.e.TsNanos() < w.TsNanos() {
+				continue
+			}
+			if c.e.TsNanos() > w.EndNanos() {
+				break
+			}
+			waker = c
+		}
+		if waker == nil {
+			continue
+		}
+		waker.left--
+		data := map[string]any{"addr": addr}
+		end := w.EndNanos()
+		flows = append(flows,
+			&Event{Name: "futex wake", Cat: "futex", Ph: "s", Pid: waker.e.Pid, Tid: waker.e.Tid, Ts: waker.e.Ts, TsNs: waker.e.TsNs, Id: id, Args: Args{Data: data}},
+			&Event{Name: "futex wake", Cat: "futex", Ph: "f", Pid: w.Pid, Tid: w.Tid, Ts: end / 1000, TsNs: int(end % 1000), Id: id, Args: Args{Data: data}},
+		)
+		id++
+	}
+	sort.SliceStable(flows, func(i, j int) bool {
+		return flows[i].TsNanos() < flows[j].TsNanos()
+	})
+	return flows
+}
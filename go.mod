@@ -1,3 +1,3 @@
 module github.com/replit/strace-perfetto
 
-go 1.18
+go 1.24
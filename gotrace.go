@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var (
+	reGoTraceEvent      = `^M=(-?\d+) P=(-?\d+) G=(-?\d+) (\w+) Time=(\d+)(.*)$` // m,p,g,kind,time,rest
+	reGoTraceTransition = ` GoID=(\d+) (\w+)->(\w+) Reason="([^"]*)"`            // goid,from,to,reason
+	reGoTraceRange      = ` Name="([^"]*)"`                                      // range name
+	reGoTraceSync       = ` Mono=(\d+) Wall=(\S+)`                               // monotonic,wall clock
+
+	regexpGoTraceEvent      = regexp.MustCompile(reGoTraceEvent)
+	regexpGoTraceTransition = regexp.MustCompile(reGoTraceTransition)
+	regexpGoTraceRange      = regexp.MustCompile(reGoTraceRange)
+	regexpGoTraceSync       = regexp.MustCompile(reGoTraceSync)
+)
+
+// goroutineState is the state a goroutine entered at some point in time.
+type goroutineState struct {
+	state  string
+	reason string
+	ts     int64
+	m      int
+}
+
+// LoadGoTrace reads a Go runtime execution trace (as written by runtime/trace
+// or `go test -trace`) and returns the goroutine scheduling and runtime
+// ranges (GC, stop-the-world, ...) in it as async slices. The trace is decoded
+// with `go tool trace`, so a Go toolchain of at least the version of the
+// traced program must be in PATH.
+//
+// Go traces identify threads by their OS thread id, so the events are placed
+// in the process that owns those threads according to threadPids.
+func LoadGoTrace(input string, snapshot ClockSnapshot, threadPids map[int]int) ([]*Event, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("go", "tool", "trace", "-d=parsed", input)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("go tool trace: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	// Go traces are timed with the monotonic clock. Sync events carry a wall
+	// clock reading, which is preferred over our own clock snapshot.
+	toRealtime := func(t uint64) int64 {
+		return int64(snapshot.ToRealtime(ClockMonotonic, t) / 1000)
+	}
+
+	pid := 0
+	var events []*Event
+	// Ids start at 1, a zero id is left out of the JSON output.
+	nextID := uint64(1)
+	states := make(map[int]goroutineState) // [goid]
+	ranges := make(map[string]*Event)      // [name]
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		m := regexpGoTraceEvent.FindStringSubmatch(scanner.Text())
+		if len(m) != 7 {
+			continue
+		}
+		thread, _ := strconv.Atoi(m[1])
+		t, _ := strconv.ParseUint(m[5], 10, 64)
+		if p, ok := threadPids[thread]; ok && pid == 0 {
+			pid = p
+		}
+		switch m[4] {
+		case "Sync":
+			s := regexpGoTraceSync.FindStringSubmatch(m[6])
+			if len(s) != 3 {
+				continue
+			}
+			mono, _ := strconv.ParseUint(s[1], 10, 64)
+			wall, err := time.Parse(time.RFC3339Nano, s[2])
+			if err != nil {
+				continue
+			}
+			goSnapshot := ClockSnapshot{Realtime: uint64(wall.UnixNano()), Monotonic: mono}
+			toRealtime = func(t uint64) int64 {
+				return int64(goSnapshot.ToRealtime(ClockMonotonic, t) / 1000)
+			}
+		case "StateTransition":
+			s := regexpGoTraceTransition.FindStringSubmatch(m[6])
+			if len(s) != 5 {
+				continue
+			}
+			goid, _ := strconv.Atoi(s[1])
+			ts := toRealtime(t)
+			if prev, ok := states[goid]; ok {
+				events = append(events, goroutineSlice(goid, prev, ts)...)
+			}
+			states[goid] = goroutineState{state: s[3], reason: s[4], ts: ts, m: thread}
+		case "RangeBegin":
+			s := regexpGoTraceRange.FindStringSubmatch(m[6])
+			if len(s) != 2 {
+				continue
+			}
+			begin := &Event{
+				Name: s[1],
+				Cat:  "go.runtime",
+				Ph:   "b",
+				Ts:   toRealtime(t),
+				Id:   nextID,
+			}
+			nextID++
+			ranges[s[1]] = begin
+			events = append(events, begin)
+		case "RangeEnd":
+			s := regexpGoTraceRange.FindStringSubmatch(m[6])
+			if len(s) != 2 {
+				continue
+			}
+			begin, ok := ranges[s[1]]
+			if !ok {
+				continue
+			}
+			delete(ranges, s[1])
+			end := *begin
+			end.Ph = "e"
+			end.Ts = toRealtime(t)
+			events = append(events, &end)
+		}
+	}
+	if pid == 0 {
+		return nil, fmt.Errorf("none of the threads in %s were traced by strace", input)
+	}
+	for _, e := range events {
+		e.Pid = pid
+		if e.Tid == 0 {
+			e.Tid = pid
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Ts < events[j].Ts
+	})
+	return events, nil
+}
+
+// goroutineSlice returns the async slice of a goroutine being in a state
+// until ts. Only running, runnable and in-syscall periods are shown, a
+// goroutine with no slice is waiting or doesn't exist.
+func goroutineSlice(goid int, s goroutineState, ts int64) []*Event {
+	switch s.state {
+	case "Running", "Runnable", "Syscall":
+	default:
+		return nil
+	}
+	name := fmt.Sprintf("goroutine %d", goid)
+	data := map[string]any{"state": s.state}
+	if s.reason != "" {
+		data["reason"] = s.reason
+	}
+	if s.m != -1 {
+		data["thread"] = s.m
+	}
+	return []*Event{
+		{Name: name, Cat: "go.goroutine", Ph: "b", Ts: s.ts, Id: uint64(goid), Args: Args{Data: data}},
+		{Name: name, Cat: "go.goroutine", Ph: "e", Ts: ts, Id: uint64(goid)},
+	}
+}
+
+// loadGoTraces loads the traces given with -merge-go-trace, correlating their
+// threads with the ones in the strace events.
+func loadGoTraces(inputs []string, snapshot ClockSnapshot, straceEvents []*Event) ([][]*Event, error) {
+	if len(inputs) == 0 {
+		return nil, nil
+	}
+	threadPids := make(map[int]int)
+	for _, e := range straceEvents {
+		if e.Tid != 0 && e.Ph != "M" {
+			threadPids[e.Tid] = e.Pid
+		}
+	}
+	var traces [][]*Event
+	for _, input := range inputs {
+		events, err := LoadGoTrace(input, snapshot, threadPids)
+		if err != nil {
+			return nil, err
+		}
+		traces = append(traces, events)
+	}
+	return traces, nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gRPC status codes.
+const (
+	grpcOK                = 0
+	grpcInvalidArgument   = 3
+	grpcNotFound          = 5
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+	grpcInternal          = 13
+	grpcUnauthenticated   = 16
+)
+
+// grpcError is an error carrying a gRPC status code.
+type grpcError struct {
+	code int
+	err  error
+}
+
+func (e grpcError) Error() string {
+	return e.err.Error()
+}
+
+// grpcHandler serves the Tracer service described in tracer.proto. It
+// implements just enough of the gRPC protocol (unary calls, uncompressed
+// messages) to be used by standard gRPC clients. The calls must carry the
+// token in their "authorization: Bearer" metadata.
+type grpcHandler struct {
+	service *CaptureService
+	token   string
+}
+
+func (h grpcHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "only gRPC requests are supported", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	if !validToken(r, h.token) {
+		writeGRPCStatus(w, grpcError{grpcUnauthenticated, errors.New("missing or invalid token")})
+		return
+	}
+
+	req, err := readGRPCMessage(r.Body)
+	if err != nil {
+		writeGRPCStatus(w, grpcError{grpcInternal, err})
+		return
+	}
+	var resp []byte
+	switch r.URL.Path {
+	case "/straceperfetto.Tracer/StartTrace":
+		resp, err = h.startTrace(req)
+	case "/straceperfetto.Tracer/StopTrace":
+		resp, err = h.stopTrace(req)
+	case "/straceperfetto.Tracer/GetTrace":
+		resp, err = h.getTrace(req)
+	default:
+		err = grpcError{grpcUnimplemented, fmt.Errorf("unknown method %s", r.URL.Path)}
+	}
+	if err != nil {
+		writeGRPCStatus(w, err)
+		return
+	}
+
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	frame := make([]byte, 5, 5+len(resp))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(resp)))
+	w.Write(append(frame, resp...))
+	w.Header().Set("Grpc-Status", strconv.Itoa(grpcOK))
+	w.Header().Set("Grpc-Message", "")
+}
+
+func (h grpcHandler) startTrace(b []byte) ([]byte, error) {
+	var req CaptureRequest
+	err := parseProto(b, func(field int, wireType int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			req.Pid = int(v)
+		case 2:
+			req.Command = append(req.Command, string(data))
+		case 3:
+			req.Syscalls = string(data)
+		case 4:
+			req.Duration = time.Duration(v) * time.Millisecond
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, grpcError{grpcInvalidArgument, err}
+	}
+	status, err := h.service.Start(req)
+	if errors.Is(err, errTooManyCaptures) {
+		return nil, grpcError{grpcResourceExhausted, err}
+	}
+	if err != nil {
+		return nil, grpcError{grpcInvalidArgument, err}
+	}
+	return appendTraceStatus(nil, status), nil
+}
+
+func (h grpcHandler) stopTrace(b []byte) ([]byte, error) {
+	id, err := parseCaptureID(b)
+	if err != nil {
+		return nil, err
+	}
+	status, err := h.service.Stop(id)
+	if err != nil {
+		return nil, grpcError{grpcNotFound, err}
+	}
+	return appendTraceStatus(nil, status), nil
+}
+
+func (h grpcHandler) getTrace(b []byte) ([]byte, error) {
+	id, err := parseCaptureID(b)
+	if err != nil {
+		return nil, err
+	}
+	status, trace, err := h.service.Get(id)
+	if err != nil {
+		return nil, grpcError{grpcNotFound, err}
+	}
+	resp := appendProtoBytes(nil, 1, appendTraceStatus(nil, status))
+	if trace != nil {
+		resp = appendProtoBytes(resp, 2, trace)
+	}
+	return resp, nil
+}
+
+// parseCaptureID parses a StopTraceRequest or GetTraceRequest.
+func parseCaptureID(b []byte) (string, error) {
+	var id string
+	err := parseProto(b, func(field int, wireType int, v uint64, data []byte) error {
+		if field == 1 {
+			id = string(data)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", grpcError{grpcInvalidArgument, err}
+	}
+	return id, nil
+}
+
+// appendTraceStatus encodes a TraceStatus message.
+func appendTraceStatus(b []byte, status CaptureStatus) []byte {
+	b = appendProtoString(b, 1, status.ID)
+	b = appendProtoString(b, 2, string(status.State))
+	if status.Error != "" {
+		b = appendProtoString(b, 3, status.Error)
+	}
+	b = appendProtoVarint(b, 4, uint64(status.Started.UnixMilli()))
+	if !status.Finished.IsZero() {
+		b = appendProtoVarint(b, 5, uint64(status.Finished.UnixMilli()))
+	}
+	return b
+}
+
+// readGRPCMessage reads a single length-prefixed message from a request.
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, fmt.Errorf("read message prefix: %w", err)
+	}
+	if prefix[0] != 0 {
+		return nil, errors.New("compressed messages are not supported")
+	}
+	msg := make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, fmt.Errorf("read message: %w", err)
+	}
+	return msg, nil
+}
+
+// writeGRPCStatus writes a trailers-only response for a failed call.
+func writeGRPCStatus(w http.ResponseWriter, err error) {
+	code := grpcInternal
+	var gerr grpcError
+	if errors.As(err, &gerr) {
+		code = gerr.code
+	}
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", err.Error())
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	pageSize = 4096
+
+	// mapAnonymous is MAP_ANONYMOUS, for the tracers that print the mmap
+	// flags as a number.
+	mapAnonymous = 0x20
+)
+
+// addressRange is a range of addresses, from start to end excluded.
+type addressRange struct {
+	start, end uint64
+}
+
+// addressSpace is the anonymous memory a process mapped: its heap, grown
+// with brk, and its anonymous mappings.
+type addressSpace struct {
+	brkStart, brk uint64
+	mappings      []addressRange // sorted, not overlapping
+}
+
+// add maps the range, merging it with the mappings it overlaps or touches.
+func (a *addressSpace) add(r addressRange) {
+	var mappings []addressRange
+	for _, m := range a.mappings {
+		if m.end < r.start || m.start > r.end {
+			mappings = append(mappings, m)
+			continue
+		}
+		r.start, r.end = min(r.start, m.start), max(r.end, m.end)
+	}
+	mappings = append(mappings, r)
+	sort.Slice(mappings, func(i, j int) bool {
+		return mappings[i].start < mappings[j].start
+	})
+	a.mappings = mappings
+}
+
+// remove unmaps the range, splitting the mappings it is in the middle of, and
+// returns how many bytes of it were mapped.
+func (a *addressSpace) remove(r addressRange) uint64 {
+	var mappings []addressRange
+	var removed uint64
+	for _, m := range a.mappings {
+		if m.end <= r.start || m.start >= r.end {
+			mappings = append(mappings, m)
+			continue
+		}
+		removed += min(m.end, r.end) - max(m.start, r.start)
+		if m.start < r.start {
+			mappings = append(mappings, addressRange{m.start, r.start})
+		}
+		if m.end > r.end {
+			mappings = append(mappings, addressRange{r.end, m.end})
+		}
+	}
+	a.mappings = mappings
+	return removed
+}
+
+// bytes returns the anonymous memory mapped.
+func (a *addressSpace) bytes() uint64 {
+	total := a.brk - a.brkStart
+	for _, m := range a.mappings {
+		total += m.end - m.start
+	}
+	return total
+}
+
+// anonymousMemory follows the brk, anonymous mmap, mremap and munmap syscalls
+// of each process, and returns a "Memory mapped anon bytes" counter track per
+// process with the anonymous memory it mapped: an allocation timeline, as
+// malloc gets its memory from them, without a heap profiler. The mappings a
+// process inherited from its parent aren't counted, the ones of a process
+// that executes a program are forgotten.
+func anonymousMemory(syscallEvents []*Event) []*Event {
+	spaces := make(map[int]*addressSpace)
+	var events []*Event
+	for _, e := range syscallEvents {
+		if !isSyscall(e) || e.Cat == "failed" {
+			continue
+		}
+		space := spaces[e.Pid]
+		if e.Name == "execve" || e.Name == "execveat" {
+			if space != nil {
+				delete(spaces, e.Pid)
+				events = append(events, anonymousMemoryCounter(e, 0))
+			}
+			continue
+		}
+		if space == nil {
+			space = &addressSpace{}
+		}
+		ret, retOk := parseAddress(strings.Fields(e.Args.ReturnValue + " ")[0])
+		switch e.Name {
+		case "brk":
+			if !retOk {
+				continue
+			}
+			if space.brkStart == 0 {
+				space.brkStart = ret
+			}
+			space.brk = max(ret, space.brkStart)
+		case "mmap", "mmap2":
+			length, ok := e.Args.Data["length"].(int)
+			if !ok || !retOk || !isAnonymousMapping(e) {
+				continue
+			}
+			space.add(addressRange{ret, ret + pageAlign(uint64(length))})
+		case "munmap":
+			addr, ok1 := argAddress(e, "addr")
+			length, ok2 := e.Args.Data["length"].(int)
+			if !ok1 || !ok2 || space.remove(addressRange{addr, addr + pageAlign(uint64(length))}) == 0 {
+				continue
+			}
+		case "mremap":
+			addr, ok1 := argAddress(e, "arg0")
+			oldSize, ok2 := argAddress(e, "arg1")
+			newSize, ok3 := argAddress(e, "arg2")
+			if !ok1 || !ok2 || !ok3 || !retOk {
+				continue
+			}
+			// Only the anonymous mappings are known.
+			if space.remove(addressRange{addr, addr + pageAlign(oldSize)}) == 0 {
+				continue
+			}
+			space.add(addressRange{ret, ret + pageAlign(newSize)})
+		default:
+			continue
+		}
+		spaces[e.Pid] = space
+		events = append(events, anonymousMemoryCounter(e, space.bytes()))
+	}
+	return events
+}
+
+// anonymousMemoryCounter returns the counter of the anonymous memory of the
+// process of e, once it returned.
+func anonymousMemoryCounter(e *Event, bytes uint64) *Event {
+	return &Event{
+		Name: "Memory",
+		Ph:   "C",
+		Pid:  e.Pid,
+		Ts:   e.Ts + e.Dur,
+		Args: Args{
+			Counters: map[string]float64{"mapped anon bytes": float64(bytes)},
+		},
+	}
+}
+
+// isAnonymousMapping reports whether an mmap mapped anonymous memory, from
+// its flags as strace names them or as a number.
+func isAnonymousMapping(e *Event) bool {
+	flags, _ := e.Args.Data["flags"].(string)
+	if strings.Contains(flags, "MAP_ANONYMOUS") {
+		return true
+	}
+	n, err := strconv.ParseUint(flags, 0, 64)
+	return err == nil && n&mapAnonymous != 0
+}
+
+// argAddress returns an argument of a syscall that is an address or a size.
+func argAddress(e *Event, name string) (uint64, bool) {
+	switch v := e.Args.Data[name].(type) {
+	case int:
+		return uint64(v), v >= 0
+	case string:
+		return parseAddress(v)
+	}
+	return 0, false
+}
+
+// parseAddress parses an address, in hex, or a number.
+func parseAddress(s string) (uint64, bool) {
+	if s == "NULL" {
+		return 0, true
+	}
+	n, err := strconv.ParseUint(s, 0, 64)
+	return n, err == nil
+}
+
+func pageAlign(n uint64) uint64 {
+	return (n + pageSize - 1) &^ (pageSize - 1)
+}
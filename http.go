@@ -0,0 +1,120 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+var (
+	reHTTPRequest = `^\((\d+)[^"]*"(GET|HEAD|POST|PUT|DELETE|CONNECT|OPTIONS|TRACE|PATCH) (\S+) HTTP/\d(?:\.\d)?\\r\\n` // fd,method,path
+	reHTTPStatus  = `^\((\d+)[^"]*"HTTP/\d(?:\.\d)? (\d{3})`                                                            // fd,status
+
+	regexpHTTPRequest = regexp.MustCompile(reHTTPRequest)
+	regexpHTTPStatus  = regexp.MustCompile(reHTTPStatus)
+
+	httpWriteSyscalls = map[string]bool{
+		"write": true, "writev": true, "send": true, "sendto": true, "sendmsg": true,
+	}
+	httpReadSyscalls = map[string]bool{
+		"read": true, "readv": true, "recv": true, "recvfrom": true, "recvmsg": true,
+	}
+)
+
+type httpRequest struct {
+	begin  *Event
+	server bool
+}
+
+// httpSpans detects HTTP/1.x traffic in the data read from and written to
+// file descriptors (request lines and status lines) and returns an async span
+// per request, from the request being sent or received to the response, so
+// request boundaries show up without instrumenting the application.
+func httpSpans(syscallEvents []*Event) []*Event {
+	var spans []*Event
+	// Ids start at 1, a zero id is left out of the JSON output.
+	nextID := uint64(1)
+	pending := make(map[string][]httpRequest) // [pid:fd]
+	for _, e := range syscallEvents {
+		write := httpWriteSyscalls[e.Name]
+		if !isSyscall(e) || e.Cat == "failed" || !(write || httpReadSyscalls[e.Name]) {
+			continue
+		}
+		args := e.Args.First + e.Args.Second
+		if m := regexpHTTPRequest.FindStringSubmatch(args); len(m) == 4 {
+			// A client writes the request, a server reads it.
+			ts := e.Ts
+			if !write {
+				ts = e.Ts + e.Dur
+			}
+			begin := &Event{
+				Name: m[2] + " " + m[3],
+				Cat:  "http",
+				Ph:   "b",
+				Pid:  e.Pid,
+				Tid:  e.Tid,
+				Ts:   ts,
+				Id:   nextID,
+				Args: Args{
+					Data: map[string]any{
+						"fd":     m[1],
+						"method": m[2],
+						"path":   m[3],
+						"server": !write,
+					},
+				},
+			}
+			nextID++
+			spans = append(spans, begin)
+			k := strconv.Itoa(e.Pid) + ":" + m[1]
+			pending[k] = append(pending[k], httpRequest{begin: begin, server: !write})
+			continue
+		}
+		m := regexpHTTPStatus.FindStringSubmatch(args)
+		if len(m) != 3 {
+			continue
+		}
+		k := strconv.Itoa(e.Pid) + ":" + m[1]
+		requests := pending[k]
+		if len(requests) == 0 {
+			continue
+		}
+		req := requests[0]
+		pending[k] = requests[1:]
+		// A server's response ends when it has been written, a client's when
+		// it has been read.
+		ts := e.Ts + e.Dur
+		if write {
+			ts = e.Ts
+		}
+		status, _ := strconv.Atoi(m[2])
+		spans = append(spans, &Event{
+			Name: req.begin.Name,
+			Cat:  "http",
+			Ph:   "e",
+			Pid:  req.begin.Pid,
+			Tid:  e.Tid,
+			Ts:   ts,
+			Id:   req.begin.Id,
+			Args: Args{
+				Data: map[string]any{
+					"status": status,
+				},
+			},
+		})
+	}
+	// Requests that never got a response end right away.
+	for _, requests := range pending {
+		for _, req := range requests {
+			req.begin.Args.Data["status"] = "no response"
+			end := *req.begin
+			end.Ph = "e"
+			end.Args = Args{}
+			spans = append(spans, &end)
+		}
+	}
+	sort.SliceStable(spans, func(i, j int) bool {
+		return spans[i].Ts < spans[j].Ts
+	})
+	return spans
+}
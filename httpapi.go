@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// httpCaptureRequest is the body of POST /traces.
+type httpCaptureRequest struct {
+	Pid      int      `json:"pid"`
+	Command  []string `json:"command"`
+	Syscalls string   `json:"syscalls"`
+	// Duration is a Go duration string, e.g. "30s".
+	Duration string `json:"duration"`
+}
+
+// newHTTPHandler returns the handler of the REST API, whose requests must
+// carry the token in an "Authorization: Bearer" header:
+//
+//	POST /traces               start a capture, returns its status
+//	GET  /traces/{id}          status of a capture
+//	POST /traces/{id}/stop     stop a capture
+//	GET  /traces/{id}/trace    download the trace of a finished capture
+func newHTTPHandler(service *CaptureService, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /traces", func(w http.ResponseWriter, r *http.Request) {
+		var req httpCaptureRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %s", err), http.StatusBadRequest)
+			return
+		}
+		var duration time.Duration
+		if req.Duration != "" {
+			var err error
+			duration, err = time.ParseDuration(req.Duration)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid duration: %s", err), http.StatusBadRequest)
+				return
+			}
+		}
+		status, err := service.Start(CaptureRequest{
+			Pid:      req.Pid,
+			Command:  req.Command,
+			Syscalls: req.Syscalls,
+			Duration: duration,
+		})
+		if errors.Is(err, errTooManyCaptures) {
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Location", "/traces/"+status.ID)
+		writeJSON(w, http.StatusCreated, status)
+	})
+	mux.HandleFunc("GET /traces/{id}", func(w http.ResponseWriter, r *http.Request) {
+		status, _, err := service.Get(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+	})
+	mux.HandleFunc("POST /traces/{id}/stop", func(w http.ResponseWriter, r *http.Request) {
+		status, err := service.Stop(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, status)
+	})
+	mux.HandleFunc("GET /traces/{id}/trace", func(w http.ResponseWriter, r *http.Request) {
+		status, trace, err := service.Get(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if status.State != CaptureFinished {
+			http.Error(w, fmt.Sprintf("capture is %s", status.State), http.StatusConflict)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=stracefile-%s.json", status.ID))
+		w.Write(trace)
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !validToken(r, token) {
+			http.Error(w, "missing or invalid token", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// validToken reports whether the request carries the token of the service.
+func validToken(r *http.Request, token string) bool {
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) == 1
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"sort"
+)
+
+// isSyscall reports whether an event is a completed syscall slice.
+func isSyscall(e *Event) bool {
+	if e.Ph != "X" {
+		return false
+	}
+	switch e.Cat {
+	case "successful", "failed", "detached":
+		return true
+	}
+	return false
+}
+
+// idleGaps finds the intervals longer than minGap (in microseconds) during
+// which a thread neither made a syscall nor was blocked in one, which a
+// syscall-only trace otherwise shows as blank. Each gap is annotated with a
+// slice named by classify, which gets the bounds of the gap.
+func idleGaps(events []*Event, minGap int64, classify func(start, end int64) string) []*Event {
+	lastEnd := make(map[int]int64) // [tid]
+	var gaps []*Event
+	for _, e := range events {
+		if !isSyscall(e) {
+			continue
+		}
+		end, ok := lastEnd[e.Tid]
+		if ok && e.Ts-end >= minGap {
+			gaps = append(gaps, &Event{
+				Name: classify(end, e.Ts),
+				Cat:  "idle",
+				Ph:   "X",
+				Pid:  e.Pid,
+				Tid:  e.Tid,
+				Ts:   end,
+				Dur:  e.Ts - end,
+			})
+		}
+		if e.Ts+e.Dur > end {
+			lastEnd[e.Tid] = e.Ts + e.Dur
+		}
+	}
+	sort.SliceStable(gaps, func(i, j int) bool {
+		return gaps[i].Ts < gaps[j].Ts
+	})
+	return gaps
+}
+
+// classifyIdleGap names an idle gap using the CPU usage of the cgroup at the
+// time, if known: a thread that makes no syscalls while at least half a core
+// is busy is most likely computing, otherwise it was probably descheduled
+// (waiting for CPU, page faults, swapped out, ...).
+func classifyIdleGap(r *ResourceMonitor) func(start, end int64) string {
+	return func(start, end int64) string {
+		if r == nil {
+			return "no syscalls"
+		}
+		cpu, ok := r.AverageCPU(start, end)
+		if !ok {
+			return "no syscalls"
+		}
+		if cpu >= r.CoreShare()/2 {
+			return "compute-bound"
+		}
+		return "possibly descheduled"
+	}
+}
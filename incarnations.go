@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/replit/strace-perfetto/pkg/traceconv"
+)
+
+// incarnation is one start of a supervised service, i.e. one execve of its
+// executable.
+type incarnation struct {
+	start int64
+	pid   int
+}
+
+// findIncarnations detects the restarts of a service in a restart loop. The
+// service is taken to be the executable that is executed the most times (at
+// least twice), and every execve of it starts a new incarnation.
+func findIncarnations(events []*Event) (string, []incarnation) {
+	var executables []string
+	execs := make(map[string][]incarnation)
+	for _, e := range events {
+		if e.Name != "execve" || e.Ph != "X" || e.Cat != "successful" {
+			continue
+		}
+		executable, ok := traceconv.ExecutablePath(e)
+		if !ok {
+			continue
+		}
+		if _, ok := execs[executable]; !ok {
+			executables = append(executables, executable)
+		}
+		execs[executable] = append(execs[executable], incarnation{start: e.Ts, pid: e.Pid})
+	}
+	var service string
+	for _, exe := range executables {
+		if len(execs[exe]) > len(execs[service]) {
+			service = exe
+		}
+	}
+	if len(execs[service]) < 2 {
+		return "", nil
+	}
+	return service, execs[service]
+}
+
+// labelIncarnations prefixes the name of the processes belonging to each
+// incarnation (the process that executed the service and its descendants)
+// with the incarnation number. When the service re-executes itself in the
+// same process, the events following the execve are moved to a new pid so
+// that every incarnation is its own process group.
+func labelIncarnations(events []*Event, incarnations []incarnation) []*Event {
+	nextPid := 0
+	for _, e := range events {
+		if e.Pid >= nextPid {
+			nextPid = e.Pid + 1
+		}
+		if e.Tid >= nextPid {
+			nextPid = e.Tid + 1
+		}
+	}
+
+	// Processes that re-execute the service are split at each execve.
+	renumbered := make(map[int][]incarnation) // [pid][]{start, new pid}
+	owner := make(map[int]int)                // [pid]incarnation
+	for i, inc := range incarnations {
+		if _, ok := owner[inc.pid]; ok {
+			renumbered[inc.pid] = append(renumbered[inc.pid], incarnation{start: inc.start, pid: nextPid})
+			owner[nextPid] = i
+			nextPid++
+			continue
+		}
+		owner[inc.pid] = i
+	}
+	processNames := make(map[int]string)
+	var extraEvents []*Event
+	for _, e := range events {
+		splits := renumbered[e.Pid]
+		if e.Name == "process_name" {
+			processNames[e.Pid] = e.Args.Name
+		}
+		if len(splits) == 0 {
+			continue
+		}
+		if e.Ph == "M" {
+			// Every part of a split process needs its own names.
+			for _, split := range splits {
+				m := *e
+				m.Pid = split.pid
+				if m.Tid == e.Pid {
+					m.Tid = split.pid
+				}
+				extraEvents = append(extraEvents, &m)
+			}
+			continue
+		}
+		for i := len(splits) - 1; i >= 0; i-- {
+			if e.Ts < splits[i].start {
+				continue
+			}
+			if e.Tid == e.Pid {
+				e.Tid = splits[i].pid
+			}
+			e.Pid = splits[i].pid
+			break
+		}
+	}
+	events = traceconv.Merge(extraEvents, events)
+
+	// Descendants belong to the same incarnation as their parent.
+	parents := make(map[uint64]int) // [flow id]pid
+	for _, e := range events {
+		if e.Cat != "clone" {
+			continue
+		}
+		switch e.Ph {
+		case "s":
+			parents[e.Id] = e.Pid
+		case "f":
+			parent, ok := parents[e.Id]
+			if !ok || parent == e.Pid {
+				continue
+			}
+			if i, ok := owner[parent]; ok {
+				if _, ok := owner[e.Pid]; !ok {
+					owner[e.Pid] = i
+				}
+			}
+		}
+	}
+
+	for _, e := range events {
+		if e.Name != "process_name" {
+			continue
+		}
+		if i, ok := owner[e.Pid]; ok {
+			e.Args.Name = fmt.Sprintf("incarnation %d: %s", i+1, e.Args.Name)
+		}
+	}
+	return events
+}
+
+// splitIncarnations splits the events into one list per incarnation, each
+// covering the time from the start of the incarnation to the start of the
+// next one. Events preceding the first incarnation (e.g. the supervisor
+// starting up) go with the first one, and metadata events go with all of them.
+func splitIncarnations(events []*Event, incarnations []incarnation) [][]*Event {
+	splits := make([][]*Event, len(incarnations))
+	for _, e := range events {
+		if e.Ph == "M" {
+			for i := range splits {
+				splits[i] = append(splits[i], e)
+			}
+			continue
+		}
+		i := len(incarnations) - 1
+		for i > 0 && e.Ts < incarnations[i].start {
+			i--
+		}
+		splits[i] = append(splits[i], e)
+	}
+	return splits
+}
+
+// incarnationOutput returns the output file of the given incarnation, e.g.
+// stracefile-2.json.
+func incarnationOutput(output string, i int) string {
+	ext := path.Ext(output)
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(output, ext), i+1, ext)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+)
+
+// LatencyBucket is a histogram bucket counting the syscalls that took at most
+// LeUs microseconds (and more than the previous bucket's bound).
+type LatencyBucket struct {
+	LeUs  int64 `json:"le_us"`
+	Count int   `json:"count"`
+}
+
+// LatencyStats summarizes the durations of a set of syscalls, in
+// microseconds.
+type LatencyStats struct {
+	Count   int             `json:"count"`
+	P50     int64           `json:"p50_us"`
+	P90     int64           `json:"p90_us"`
+	P99     int64           `json:"p99_us"`
+	Max     int64           `json:"max_us"`
+	Buckets []LatencyBucket `json:"buckets"`
+}
+
+// LatencyReport holds latency histograms per syscall, overall and per
+// process.
+type LatencyReport struct {
+	BySyscall map[string]LatencyStats         `json:"by_syscall"`
+	ByProcess map[int]map[string]LatencyStats `json:"by_process"`
+}
+
+// NewLatencyReport computes the latency histograms of the syscall events.
+func NewLatencyReport(events []*Event) LatencyReport {
+	bySyscall := make(map[string][]int64)
+	byProcess := make(map[int]map[string][]int64)
+	for _, e := range events {
+		if !isSyscall(e) {
+			continue
+		}
+		bySyscall[e.Name] = append(bySyscall[e.Name], e.Dur)
+		if byProcess[e.Pid] == nil {
+			byProcess[e.Pid] = make(map[string][]int64)
+		}
+		byProcess[e.Pid][e.Name] = append(byProcess[e.Pid][e.Name], e.Dur)
+	}
+
+	report := LatencyReport{
+		BySyscall: make(map[string]LatencyStats, len(bySyscall)),
+		ByProcess: make(map[int]map[string]LatencyStats, len(byProcess)),
+	}
+	for name, durs := range bySyscall {
+		report.BySyscall[name] = latencyStats(durs)
+	}
+	for pid, syscalls := range byProcess {
+		report.ByProcess[pid] = make(map[string]LatencyStats, len(syscalls))
+		for name, durs := range syscalls {
+			report.ByProcess[pid][name] = latencyStats(durs)
+		}
+	}
+	return report
+}
+
+// Save writes the report as JSON.
+func (r LatencyReport) Save(output string) error {
+	b, err := json.MarshalIndent(r, "", " ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(output, b, 0644)
+}
+
+// latencyStats computes the percentiles and the histogram of durations, using
+// power-of-two buckets (≤1us, ≤2us, ≤4us, ...).
+func latencyStats(durs []int64) LatencyStats {
+	sorted := append([]int64(nil), durs...)
+	sortDurations(sorted)
+	stats := LatencyStats{
+		Count: len(sorted),
+		P50:   percentile(sorted, 50),
+		P90:   percentile(sorted, 90),
+		P99:   percentile(sorted, 99),
+		Max:   sorted[len(sorted)-1],
+	}
+	le := int64(1)
+	for _, d := range sorted {
+		for d > le {
+			le *= 2
+		}
+		if n := len(stats.Buckets); n > 0 && stats.Buckets[n-1].LeUs == le {
+			stats.Buckets[n-1].Count++
+			continue
+		}
+		stats.Buckets = append(stats.Buckets, LatencyBucket{LeUs: le, Count: 1})
+	}
+	return stats
+}
+
+// percentile returns the p-th percentile of sorted values, using the
+// nearest-rank method.
+func percentile(sorted []int64, p int) int64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func sortDurations(durs []int64) {
+	sort.Slice(durs, func(i, j int) bool { return durs[i] < durs[j] })
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+)
+
+const (
+	// memoryGrowthBuckets is the number of time buckets a memory series is
+	// split into to look for sustained growth.
+	memoryGrowthBuckets = 10
+	// memoryGrowthMinDuration is the shortest series (in microseconds) that is
+	// considered, anything shorter is too noisy.
+	memoryGrowthMinDuration = 500000
+	// memoryGrowthMinBytes and memoryGrowthMinRatio are the minimum absolute
+	// and relative growth for a series to be flagged.
+	memoryGrowthMinBytes = 1 << 20
+	memoryGrowthMinRatio = 0.1
+)
+
+// memoryPoint is a memory usage sample.
+type memoryPoint struct {
+	ts    int64 // microseconds
+	bytes uint64
+}
+
+// memoryGrowth is a sustained increase of memory usage.
+type memoryGrowth struct {
+	start, end int64
+	from, to   uint64
+	// rate is the growth in bytes per second, from a least-squares fit.
+	rate float64
+}
+
+// detectMemoryGrowth flags series that keep growing for their whole
+// duration: the series is split into memoryGrowthBuckets buckets of equal
+// duration, and the average of (nearly) every bucket must be higher than the
+// previous one. This catches slow leaks while ignoring the usual
+// allocate-then-free sawtooth.
+func detectMemoryGrowth(points []memoryPoint) (memoryGrowth, bool) {
+	if len(points) < memoryGrowthBuckets*2 {
+		return memoryGrowth{}, false
+	}
+	start, end := points[0].ts, points[len(points)-1].ts
+	if end-start < memoryGrowthMinDuration {
+		return memoryGrowth{}, false
+	}
+
+	var sums [memoryGrowthBuckets]float64
+	var counts [memoryGrowthBuckets]int
+	for _, p := range points {
+		i := (p.ts - start) * memoryGrowthBuckets / (end - start + 1)
+		sums[i] += float64(p.bytes)
+		counts[i]++
+	}
+	increases, buckets := 0, 0
+	prev := -1.0
+	for i := range sums {
+		if counts[i] == 0 {
+			continue
+		}
+		mean := sums[i] / float64(counts[i])
+		if prev >= 0 && mean > prev {
+			increases++
+		}
+		prev = mean
+		buckets++
+	}
+	if increases < buckets-2 {
+		return memoryGrowth{}, false
+	}
+
+	g := memoryGrowth{
+		start: start,
+		end:   end,
+		from:  points[0].bytes,
+		to:    points[len(points)-1].bytes,
+	}
+	if g.to < g.from+memoryGrowthMinBytes || float64(g.to-g.from) < float64(g.from)*memoryGrowthMinRatio {
+		return memoryGrowth{}, false
+	}
+
+	// Least-squares slope, in bytes per microsecond.
+	var sx, sy, sxx, sxy float64
+	for _, p := range points {
+		x, y := float64(p.ts-start), float64(p.bytes)
+		sx += x
+		sy += y
+		sxx += x * x
+		sxy += x * y
+	}
+	n := float64(len(points))
+	g.rate = (n*sxy - sx*sy) / (n*sxx - sx*sx) * 1e6
+	return g, true
+}
+
+// memoryGrowthAnnotation returns a slice covering a memory growth on the
+// given track, and a warning describing it.
+func memoryGrowthAnnotation(g memoryGrowth, what string, pid, tid int) (*Event, string) {
+	e := &Event{
+		Name: "possible memory leak",
+		Cat:  "annotation",
+		Ph:   "X",
+		Pid:  pid,
+		Tid:  tid,
+		Ts:   g.start,
+		Dur:  g.end - g.start,
+		Args: Args{
+			Data: map[string]any{
+				"from_bytes":            g.from,
+				"to_bytes":              g.to,
+				"growth_bytes_per_sec":  int64(g.rate),
+				"growth_mib_per_minute": g.rate * 60 / (1 << 20),
+			},
+		},
+	}
+	warning := fmt.Sprintf("%s grew steadily from %.1f MiB to %.1f MiB (%.2f MiB/s), possible memory leak",
+		what, float64(g.from)/(1<<20), float64(g.to)/(1<<20), g.rate/(1<<20))
+	return e, warning
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var (
+	// procLimits are the names of the captured resource limits in
+	// /proc/<pid>/limits.
+	procLimits = map[string]string{
+		"nofile":  "Max open files",
+		"nproc":   "Max processes",
+		"memlock": "Max locked memory",
+		"stack":   "Max stack size",
+		"as":      "Max address space",
+	}
+
+	// capturedSysctls are the kernel tunables captured in the trace metadata, relative
+	// to /proc/sys.
+	capturedSysctls = []string{
+		"fs/file-max",
+		"fs/nr_open",
+		"fs/inotify/max_user_watches",
+		"kernel/pid_max",
+		"kernel/threads-max",
+		"net/core/somaxconn",
+		"vm/max_map_count",
+		"vm/overcommit_memory",
+		"vm/swappiness",
+	}
+)
+
+// Rlimit is the soft and hard value of a resource limit. Unlimited values are
+// reported as "unlimited".
+type Rlimit struct {
+	Soft string `json:"soft"`
+	Hard string `json:"hard"`
+}
+
+// CaptureRlimits returns the resource limits of the process pid, or of the
+// current process, which will be inherited by the traced command, if pid is 0.
+func CaptureRlimits(pid int) map[string]Rlimit {
+	if pid != 0 {
+		return procRlimits(pid)
+	}
+	limits := make(map[string]Rlimit, len(capturedRlimits))
+	for name, resource := range capturedRlimits {
+		var rlim syscall.Rlimit
+		if err := syscall.Getrlimit(resource, &rlim); err != nil {
+			continue
+		}
+		limits[name] = Rlimit{
+			Soft: formatRlimit(rlim.Cur),
+			Hard: formatRlimit(rlim.Max),
+		}
+	}
+	return limits
+}
+
+// procRlimits returns the resource limits of another process, read from
+// /proc/<pid>/limits, whose lines are the name of the limit, its soft and hard
+// values and its unit, in columns.
+func procRlimits(pid int) map[string]Rlimit {
+	limits := make(map[string]Rlimit, len(procLimits))
+	contents, err := os.ReadFile(fmt.Sprintf("/proc/%d/limits", pid))
+	if err != nil {
+		return limits
+	}
+	for _, line := range strings.Split(string(contents), "\n") {
+		for name, procName := range procLimits {
+			rest, ok := strings.CutPrefix(line, procName+" ")
+			if !ok {
+				continue
+			}
+			if fields := strings.Fields(rest); len(fields) >= 2 {
+				limits[name] = Rlimit{Soft: fields[0], Hard: fields[1]}
+			}
+		}
+	}
+	return limits
+}
+
+// CaptureSysctls returns the values of the kernel tunables in capturedSysctls, keyed
+// by their dotted name (e.g. "fs.file-max"). Unreadable entries are skipped.
+func CaptureSysctls() map[string]string {
+	values := make(map[string]string, len(capturedSysctls))
+	for _, name := range capturedSysctls {
+		contents, err := os.ReadFile(path.Join("/proc/sys", name))
+		if err != nil {
+			continue
+		}
+		values[strings.ReplaceAll(name, "/", ".")] = strings.Join(strings.Fields(string(contents)), " ")
+	}
+	return values
+}
+
+func formatRlimit(v uint64) string {
+	if v == ^uint64(0) {
+		return "unlimited"
+	}
+	return strconv.FormatUint(v, 10)
+}
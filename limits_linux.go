@@ -0,0 +1,19 @@
+package main
+
+import "syscall"
+
+// Resource limits that are not exported by the syscall package.
+const (
+	rlimitNproc   = 0x6
+	rlimitMemlock = 0x8
+)
+
+// capturedRlimits are the resource limits captured in the trace metadata. The
+// traced command inherits them from this process.
+var capturedRlimits = map[string]int{
+	"nofile":  syscall.RLIMIT_NOFILE,
+	"nproc":   rlimitNproc,
+	"memlock": rlimitMemlock,
+	"stack":   syscall.RLIMIT_STACK,
+	"as":      syscall.RLIMIT_AS,
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import "syscall"
+
+// capturedRlimits are the resource limits captured in the trace metadata, the
+// ones the syscall package has everywhere.
+var capturedRlimits = map[string]int{
+	"nofile": syscall.RLIMIT_NOFILE,
+	"stack":  syscall.RLIMIT_STACK,
+	"as":     syscall.RLIMIT_AS,
+}
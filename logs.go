@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// pidMaxLimit is the highest pid Linux can hand out. The pids above it are
+	// used for the tracks of event sources that aren't processes.
+	pidMaxLimit = 1 << 22
+
+	logsPid = pidMaxLimit + 1
+
+	// logEventNameLength is how much of a log line is used as the name of its
+	// event. The full line is in the args.
+	logEventNameLength = 80
+)
+
+// stringList is a flag that can be given several times.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// LogTailer tails an application log file during the capture and turns its
+// lines into instant events, so they can be lined up with the syscalls
+// beneath them.
+type LogTailer struct {
+	path   string
+	format string
+	tid    int
+	f      *os.File
+
+	mu     sync.Mutex
+	events []*Event
+}
+
+// NewLogTailers returns a tailer for each path[:format] spec. The format is
+// one of "plain" (lines are timestamped when they are read, the default),
+// "rfc3339" (lines start with an RFC 3339 timestamp) or "json" (lines are
+// JSON objects with a "time", "ts" or "timestamp" field).
+func NewLogTailers(specs []string) ([]*LogTailer, error) {
+	var tailers []*LogTailer
+	for i, spec := range specs {
+		p, format := spec, "plain"
+		if i := strings.LastIndex(spec, ":"); i != -1 {
+			switch spec[i+1:] {
+			case "plain", "rfc3339", "json":
+				p, format = spec[:i], spec[i+1:]
+			}
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		// Only the lines written during the capture are of interest.
+		if _, err := f.Seek(0, io.SeekEnd); err != nil {
+			return nil, err
+		}
+		tailers = append(tailers, &LogTailer{
+			path:   p,
+			format: format,
+			tid:    logsPid + 1 + i,
+			f:      f,
+		})
+	}
+	return tailers, nil
+}
+
+func (t *LogTailer) Run(ctx context.Context) {
+	defer t.f.Close()
+	scanner := bufio.NewScanner(&followReader{
+		ctx:          ctx,
+		f:            t.f,
+		pollInterval: 10 * time.Millisecond,
+	})
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		ts, ok := t.timestamp(line)
+		if !ok {
+			ts = time.Now()
+		}
+		name := line
+		if len(name) > logEventNameLength {
+			name = name[:logEventNameLength] + "…"
+		}
+		t.mu.Lock()
+		t.events = append(t.events, &Event{
+			Name:  name,
+			Cat:   "log",
+			Ph:    "i",
+			Scope: "t",
+			Pid:   logsPid,
+			Tid:   t.tid,
+			Ts:    ts.UnixMicro(),
+			Args: Args{
+				Data: map[string]any{
+					"line": line,
+				},
+			},
+		})
+		t.mu.Unlock()
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("error tailing %s: %v", t.path, err)
+	}
+}
+
+// timestamp extracts the timestamp of a log line according to the format of
+// the log.
+func (t *LogTailer) timestamp(line string) (time.Time, bool) {
+	switch t.format {
+	case "rfc3339":
+		field, _, _ := strings.Cut(line, " ")
+		ts, err := time.Parse(time.RFC3339Nano, strings.Trim(field, "[]"))
+		return ts, err == nil
+	case "json":
+		var fields map[string]any
+		if err := json.Unmarshal([]byte(line), &fields); err != nil {
+			return time.Time{}, false
+		}
+		for _, k := range []string{"time", "ts", "timestamp"} {
+			switch v := fields[k].(type) {
+			case string:
+				ts, err := time.Parse(time.RFC3339Nano, v)
+				return ts, err == nil
+			case float64:
+				// Unix seconds with a fractional part.
+				return time.Unix(0, int64(v*1e9)), true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+func (t *LogTailer) Events() []*Event {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	events := []*Event{
+		{
+			Name: "process_name",
+			Ph:   "M",
+			Cat:  "__metadata",
+			Pid:  logsPid,
+			Tid:  logsPid,
+			Args: Args{
+				Name: "Logs",
+			},
+		},
+		{
+			Name: "thread_name",
+			Ph:   "M",
+			Cat:  "__metadata",
+			Pid:  logsPid,
+			Tid:  t.tid,
+			Args: Args{
+				Name: fmt.Sprintf("%s (%s)", t.path, t.format),
+			},
+		},
+	}
+	events = append(events, t.events...)
+	// Timestamps taken from the lines themselves aren't necessarily in order.
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Ts < events[j].Ts
+	})
+	return events
+}
@@ -1,307 +1,985 @@
 package main
 
 import (
-	"bufio"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
 	"os"
 	"os/exec"
 	"path"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
+
+	"github.com/replit/strace-perfetto/pkg/traceconv"
 )
 
 var (
-	flagSyscalls = flag.String("e", "", "only trace specified syscalls")
-	flagOutput   = flag.String("o", "stracefile.json", "json output file")
-	flagTimeout  = flag.Duration("t", time.Duration(0), "strace timeout")
+	flagSyscalls     = flag.String("e", "", "only trace specified syscalls")
+	flagOnly         = flag.String("only", "", "only trace the syscalls of these classes, separated by commas: file, desc, network, process, signal, ipc, memory, creds, clock, stat")
+	flagExclude      = flag.String("exclude", "", "leave out these syscalls, separated by commas (e.g. futex,epoll_wait)")
+	flagStrSize      = flag.Int("s", 0, "maximum length of the strings strace prints, e.g. execve argv and read buffers (strace's -s, 32 by default)")
+	flagNoAbbrev     = flag.Bool("v", false, "print structures, arrays and environments in full (strace's -v)")
+	flagOutput       = flag.String("o", "stracefile.json", "json output file")
+	flagFormat       = flag.String("format", "json", "output format: \"json\" (Chrome JSON), \"proto\" (Perfetto protobuf, loads faster), \"speedscope\" / \"folded\" / \"pprof\" (profile of the time spent in syscalls), or \"sqlite\" (database to query with SQL, needs sqlite3)")
+	flagTimeout      = flag.Duration("t", time.Duration(0), "strace timeout")
+	flagPid          = flag.Int("p", 0, "attach to this running process (and its children) instead of running a command, until it exits or Ctrl-C")
+	flagFast         = flag.Bool("fast", false, "stop only on the traced syscalls with strace --seccomp-bpf, if strace supports it, for less overhead with -e, -only or -exclude")
+	flagFF           = flag.Bool("ff", false, "run strace with -ff, one output file per thread, and merge the files (no interleaved unfinished / resumed syscalls); with convert, the argument is the prefix of the files")
+	flagRuns         = flag.Int("runs", 1, "run the command this many times in one trace, each run a process group of its own, and print the wall time and syscalls of each run")
+	flagMarkerFd     = flag.Bool("marker-fd", false, "give the command a pipe on fd 3 ($STRACE_PERFETTO_MARKER_FD) to write its markers to, one per line")
+	flagFollow       = flag.String("follow", "", "tail an strace output file written by another process instead of running a command")
+	flagFollowSave   = flag.Duration("follow-interval", 10*time.Second, "with -follow, save the trace of what was read so far this often, in the json and proto formats (0 to only save it on Ctrl-C)")
+	flagAppend       = flag.Bool("append", false, "merge the capture into the existing output file as a new session")
+	flagRelativeTs   = flag.Bool("relative-ts", false, "rebase the timestamps so that the trace starts at 0")
+	flagSession      = flag.String("session", "", "label of the session added with -append")
+	flagRestarts     = flag.String("restarts", "", "detect restarts of a supervised service and \"label\" each incarnation or \"split\" them into separate files")
+	flagSSH          = flag.String("ssh", "", "run the command under strace on this ssh destination (e.g. user@host) and convert the result locally")
+	flagMetrics      = flag.String("metrics", "", "run SQL queries against the saved trace with trace_processor_shell: \"default\" and/or .sql files, separated by commas")
+	flagServe        = flag.Bool("serve", false, "serve the saved trace over HTTP and print the link that opens it in the Perfetto UI, until Ctrl-C")
+	flagServeAddr    = flag.String("serve-addr", defaultServeAddr, "address -serve listens on")
+	flagOTLP         = flag.String("otlp", "", "also send the syscalls as spans to this OTLP/HTTP endpoint, e.g. http://localhost:4318 (one resource per process, one scope per thread)")
+	flagMetricsOut   = flag.String("metrics-out", "", "also write the results of -metrics to this file")
+	flagOOMThreshold = flag.Float64("oom-threshold", 90, "warn when memory usage goes above this percentage of the cgroup's memory.max")
+	flagMinDur       = flag.Duration("min-dur", 0, "leave out the syscalls shorter than this (e.g. 100us) from the trace")
+	flagMinDurCount  = flag.Bool("min-dur-counters", false, "count the syscalls left out by -min-dur on a per-second counter track of each process")
+	flagIdleGap      = flag.Duration("idle-gap", 0, "annotate intervals longer than this (e.g. 10ms) in which a thread makes no syscalls")
+	flagLatency      = flag.String("latency-report", "", "write per-syscall and per-process latency histograms (p50/p90/p99/max) to this JSON file")
+	flagLatencyMeta  = flag.Bool("latency-metadata", false, "also add the per-syscall latency histograms to the trace metadata")
+	flagSummary      = flag.Bool("summary", false, "print an strace -c style summary of the syscalls (calls, errors, total time, p50/p95/p99 latency)")
+	flagSummaryJSON  = flag.String("summary-json", "", "write the summary of the syscalls to this JSON file")
+	flagCgroup       = flag.String("cgroup", "", "read the cpu / memory counters from this cgroup: its directory, its path (as in /proc/<pid>/cgroup), a systemd unit or a container ID, instead of the cgroup of the command")
+	flagNewCgroup    = flag.Bool("new-cgroup", false, "run the command (and the tracer) in a cgroup of its own, created under the one of this process, for the cpu / memory counters to be the ones of the command only; needs the cpu and memory controllers to be available there and Linux 5.7")
+	flagCoalesce     = flag.Bool("coalesce-restarts", false, "merge each syscall interrupted by a signal (ERESTARTSYS, ...) with its restarts into one slice, with the interruptions in its args")
+	flagSlowest      = flag.Int("slowest", 0, "print the N slowest syscalls, with their process, arguments and start time, once the trace is saved")
+	flagFdLeaks      = flag.String("fd-leaks", "", "write the fds that were opened but never closed, grouped by path, to this JSON file")
+	flagFileReport   = flag.String("file-report", "", "write the files accessed, with the syscalls made on each and the Nix package of the /nix/store ones, to this JSON file")
+	flagSampling     = flag.Duration("sample-interval", time.Millisecond, "interval between two samples of the cpu / memory counters")
+	flagAdaptive     = flag.Bool("adaptive-sampling", false, "sample the cpu / memory counters less often while they are stable, up to 64 times -sample-interval")
+	flagNetwork      = flag.Bool("network", false, "sample the rx / tx throughput of the network interfaces of the traced process from /proc/<pid>/net/dev")
+	flagNs           = flag.Bool("ns", false, "record timestamps and durations with nanosecond precision, if strace supports it")
+	flagBackend      = flag.String("backend", "strace", "how the syscalls are traced: \"strace\", \"ptrace\" to trace them with the ptrace syscall directly, without the strace binary, or \"ebpf\" to trace them with bpftrace, without stopping the traced processes")
+	flagLtrace       = flag.Bool("ltrace", false, "trace the library calls of the command (malloc, pthread_*, SSL_*, ...) along with its syscalls, by running it under ltrace -S instead of strace; with convert, the file is ltrace -f -ttt -T -S output")
+	flagStacks       = flag.Bool("stacks", false, "record the user stack of each syscall with strace -k, as the events' stack frames")
+	flagThreadStates = flag.Bool("thread-states", false, "sample the scheduler state (running, sleeping, D state, ...) of the traced threads from /proc")
+	flagSched        = flag.Bool("sched", false, "record when the traced threads are woken up and run on which CPU with ftrace's sched_switch and sched_wakeup events, as tracks per CPU and per thread (needs root)")
+	flagStrict       = flag.Bool("strict", false, "stop with an error at the first line of strace output that can't be parsed, instead of leaving it out of the trace")
+	flagParseOnly    = flag.Bool("parse-only", false, "with convert, only parse the strace output and report how much of it was parsed, without writing a trace")
+	flagUnparsed     = flag.String("unparsed", "", "write the lines of the strace output that couldn't be parsed, and so were left out of the trace, to this file")
+	flagSelfTrace    = flag.Bool("self-trace", false, "add the phases of strace-perfetto itself (strace, parse, tree-build, enrich, export) to the trace")
+	flagTailLogs     stringList
+	flagMergeTrace   stringList
+	flagMaxOutput    byteSize
+	flagMaxLineSize  = byteSize(traceconv.DefaultMaxLineSize)
+	flagGoTrace      stringList
+	flagUsr1         = flag.String("usr1-label", "SIGUSR1", "name of the marker inserted when the tool receives SIGUSR1")
+	flagUsr2         = flag.String("usr2-label", "SIGUSR2", "name of the marker inserted when the tool receives SIGUSR2")
+	flagQuiet        = flag.Bool("quiet", false, "only print the results and the problems: leave out the stderr of strace and the command, and the progress of the tool")
+	flagVerbose      = flag.Bool("verbose", false, "also log what is done with the lines of strace output that don't make an event, and the errors of the cpu / memory monitor")
 )
 
+// formatOutputs are the output formats of -format, and their default output
+// files.
+var formatOutputs = map[string]string{
+	"json":       "stracefile.json",
+	"proto":      "stracefile.pftrace",
+	"speedscope": "stracefile.speedscope.json",
+	"folded":     "stracefile.folded",
+	"sqlite":     "stracefile.db",
+	"pprof":      "stracefile.pb.gz",
+}
+
 var (
 	// -f trace child processes
 	// -T time spent in each syscall
 	// -ttt timestamp of each event (microseconds)
 	// -q don't display process attach / personality changes
-	defaultStraceArgs = []string{"-f", "-T", "-ttt", "-q"}
+	// -yy print the paths of fds, and the addresses of sockets
+	defaultStraceArgs = []string{"-f", "-T", "-ttt", "-q", "-yy"}
+
+	// The same as -T and -ttt, with nanosecond precision, for the strace
+	// versions that support it.
+	nsStraceArgs = []string{"-f", "--syscall-times=ns", "--absolute-timestamps=format:unix,precision:ns", "-q", "-yy"}
+
+	// The same for ltrace. A process has a single tracer, so -S has ltrace
+	// trace the syscalls along with the library calls, instead of strace.
+	ltraceArgs = []string{"-f", "-T", "-ttt", "-S"}
 )
 
+func init() {
+	flag.Var(&flagMaxLineSize, "max-line-size", "leave out the lines of strace output longer than this, e.g. 64M, instead of running out of memory on them")
+	flag.Var(&flagMaxOutput, "max-output-size", "rotate the trace into segments of at most this size, e.g. 500M, each a trace of its own (stracefile-001.json, -002, ...)")
+	flag.Var(&flagGoTrace, "merge-go-trace", "merge a Go runtime execution trace (runtime/trace, go test -trace) produced by the traced program (can be repeated)")
+	flag.Var(&flagMergeTrace, "merge-trace", "merge a Chrome JSON trace produced by the traced program, as path[:auto|realtime|monotonic|boottime] (can be repeated)")
+	flag.Var(&flagTailLogs, "tail-log", "tail a log file during the capture and add its lines to the trace, as path[:plain|rfc3339|json] (can be repeated)")
+}
+
 func main() {
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [OPTIONS] command\n", path.Base(os.Args[0]))
+		fmt.Fprintf(os.Stderr, "       %s [OPTIONS] -p PID\n", path.Base(os.Args[0]))
+		fmt.Fprintf(os.Stderr, "       %s convert [OPTIONS] strace-file\n", path.Base(os.Args[0]))
+		fmt.Fprintf(os.Stderr, "       %s serve [OPTIONS]\n", path.Base(os.Args[0]))
+		fmt.Fprintf(os.Stderr, "       %s diff [OPTIONS] old.json new.json\n", path.Base(os.Args[0]))
 		flag.PrintDefaults()
 	}
 
-	flag.Parse()
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		serve(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "diff" {
+		diff(os.Args[2:])
+		return
+	}
 
-	if len(flag.Args()) == 0 {
-		flag.Usage()
+	// convert takes the same options, to convert a file recorded with
+	// `strace -f -T -ttt` instead of running strace.
+	args := os.Args[1:]
+	convertMode := len(args) > 0 && args[0] == "convert"
+	if convertMode {
+		args = args[1:]
+	}
+	flag.CommandLine.Parse(args)
+	if *flagSelfTrace {
+		selfTrace = NewSelfTrace()
+	}
+
+	defaultOutput, ok := formatOutputs[*flagFormat]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Invalid -format %q, must be \"json\", \"proto\", \"speedscope\", \"folded\", \"pprof\" or \"sqlite\"\n", *flagFormat)
+		os.Exit(1)
+	}
+	if *flagFormat != "json" {
+		if *flagAppend {
+			fmt.Fprintf(os.Stderr, "-append only works with -format json\n")
+			os.Exit(1)
+		}
+		outputSet := false
+		flag.Visit(func(f *flag.Flag) {
+			outputSet = outputSet || f.Name == "o"
+		})
+		if !outputSet {
+			*flagOutput = defaultOutput
+		}
+	}
+	if *flagFormat == "sqlite" {
+		// Fail before the capture rather than after it.
+		if _, err := exec.LookPath(sqliteBinary); err != nil {
+			fmt.Fprintf(os.Stderr, "-format sqlite needs %s, which isn't in PATH\n", sqliteBinary)
+			os.Exit(1)
+		}
+	}
+	if *flagMetrics != "" && *flagFormat != "json" && *flagFormat != "proto" {
+		fmt.Fprintf(os.Stderr, "-metrics needs a trace, -format json or proto\n")
+		os.Exit(1)
+	}
+	if *flagAppend && *flagSession != "" {
+		// Fail before the capture rather than after it.
+		if te, err := LoadTraceEvents(*flagOutput); err == nil && te.HasSession(*flagSession) {
+			fmt.Fprintf(os.Stderr, "Session %q is already in %s, pick another -session\n", *flagSession, *flagOutput)
+			os.Exit(1)
+		}
+	}
+	if flagMaxOutput > 0 && (*flagFormat != "json" || *flagAppend) {
+		fmt.Fprintf(os.Stderr, "-max-output-size only works with -format json, and can't be combined with -append\n")
+		os.Exit(1)
+	}
+	if *flagRestarts != "" && *flagRestarts != "label" && *flagRestarts != "split" {
+		fmt.Fprintf(os.Stderr, "Invalid -restarts mode %q, must be \"label\" or \"split\"\n", *flagRestarts)
+		os.Exit(1)
+	}
+	if *flagFF && (*flagSSH != "" || *flagFollow != "") {
+		fmt.Fprintf(os.Stderr, "-ff can't be combined with -ssh or -follow\n")
+		os.Exit(1)
+	}
+	if *flagCgroup != "" && *flagSSH != "" {
+		fmt.Fprintf(os.Stderr, "-cgroup monitors a cgroup of this host, it can't be combined with -ssh\n")
+		os.Exit(1)
+	}
+	if *flagNewCgroup && (*flagCgroup != "" || *flagSSH != "" || *flagPid != 0) {
+		fmt.Fprintf(os.Stderr, "-new-cgroup runs a local command in a cgroup, it can't be combined with -cgroup, -ssh or -p\n")
+		os.Exit(1)
+	}
+	var monitoredCgroup string
+	if *flagCgroup != "" {
+		var err error
+		monitoredCgroup, err = resolveCgroup(*flagCgroup)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -cgroup: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	if *flagSched && *flagSSH != "" {
+		fmt.Fprintf(os.Stderr, "-sched records the scheduler of this host, it can't be combined with -ssh\n")
+		os.Exit(1)
+	}
+	if *flagRuns < 1 {
+		fmt.Fprintf(os.Stderr, "Invalid -runs %d, must be at least 1\n", *flagRuns)
+		os.Exit(1)
+	}
+	if *flagQuiet && *flagVerbose {
+		fmt.Fprintf(os.Stderr, "-quiet and -verbose can't be used together\n")
+		os.Exit(1)
+	}
+	if *flagSlowest < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid -slowest %d, must be positive\n", *flagSlowest)
+		os.Exit(1)
+	}
+	if *flagStrSize < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid -s %d, must be positive\n", *flagStrSize)
+		os.Exit(1)
+	}
+	if *flagSampling <= 0 {
+		fmt.Fprintf(os.Stderr, "Invalid -sample-interval %s, must be positive\n", *flagSampling)
 		os.Exit(1)
 	}
 
-	_, err := exec.LookPath("strace")
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "The strace binary was not found! Please make sure it exists in your PATH: %v\n", err)
+	if *flagLtrace && (*flagSyscalls != "" || *flagOnly != "" || *flagExclude != "" || *flagFast || *flagFF || *flagNs || *flagStacks || *flagNoAbbrev || *flagSSH != "" || *flagFollow != "") {
+		fmt.Fprintf(os.Stderr, "-ltrace can't be combined with -e, -only, -exclude, -fast, -ff, -ns, -stacks, -v, -ssh or -follow, which are strace's\n")
 		os.Exit(1)
 	}
 
+	if *flagBackend != "strace" && *flagBackend != "ptrace" && *flagBackend != "ebpf" {
+		fmt.Fprintf(os.Stderr, "Invalid -backend %q, must be \"strace\", \"ptrace\" or \"ebpf\"\n", *flagBackend)
+		os.Exit(1)
+	}
+	if *flagBackend != "strace" && (convertMode || *flagSyscalls != "" || *flagOnly != "" || *flagFast || *flagFF || *flagStacks || *flagNoAbbrev || *flagLtrace || *flagSSH != "" || *flagFollow != "") {
+		fmt.Fprintf(os.Stderr, "-backend %s traces locally without strace, it can't be combined with convert, -e, -only, -fast, -ff, -stacks, -v, -ltrace, -ssh or -follow\n", *flagBackend)
+		os.Exit(1)
+	}
+
+	if *flagFollow != "" {
+		follow(*flagFollow)
+		return
+	}
+	if convertMode {
+		if flag.NArg() != 1 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		if *flagParseOnly {
+			parseOnly(flag.Arg(0))
+			return
+		}
+		convertFile(flag.Arg(0))
+		return
+	}
+	if *flagMarkerFd && (*flagPid != 0 || *flagSSH != "") {
+		fmt.Fprintf(os.Stderr, "-marker-fd only works with a command run locally\n")
+		os.Exit(1)
+	}
+	if *flagPid != 0 && (flag.NArg() > 0 || *flagRuns > 1) {
+		fmt.Fprintf(os.Stderr, "-p attaches to a running process, it can't be combined with a command or -runs\n")
+		os.Exit(1)
+	}
+
+	if len(flag.Args()) == 0 && *flagPid == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	straceBinary := "strace"
+	switch {
+	case *flagSSH != "":
+		straceBinary = "ssh"
+	case *flagLtrace:
+		straceBinary = "ltrace"
+	}
+	if *flagBackend == "ebpf" {
+		straceBinary = "bpftrace"
+	}
+	if *flagBackend != "ptrace" {
+		if _, err := exec.LookPath(straceBinary); err != nil {
+			fmt.Fprintf(os.Stderr, "The %s binary was not found! Please make sure it exists in your PATH: %v\n", straceBinary, err)
+			os.Exit(1)
+		}
+	}
+
 	// run strace
 	userStraceArgs := []string{}
 	if *flagSyscalls != "" {
 		userStraceArgs = append(userStraceArgs, "-e", *flagSyscalls)
 	}
-	userStraceArgs = append(userStraceArgs, flag.Args()...)
+	filter, err := straceFilter(*flagOnly, *flagExclude)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	if filter != "" {
+		if *flagSyscalls != "" {
+			fmt.Fprintf(os.Stderr, "-only and -exclude can't be combined with -e\n")
+			os.Exit(1)
+		}
+		userStraceArgs = append(userStraceArgs, "-e", filter)
+	}
+	if *flagStacks {
+		userStraceArgs = append(userStraceArgs, "-k")
+	}
+	if *flagStrSize > 0 {
+		userStraceArgs = append(userStraceArgs, "-s", strconv.Itoa(*flagStrSize))
+	}
+	if *flagNoAbbrev {
+		userStraceArgs = append(userStraceArgs, "-v")
+	}
+	if *flagFast {
+		// Without seccomp-bpf, strace stops the tracees on every
+		// syscall, and filters the ones to print itself.
+		switch {
+		case *flagSyscalls == "" && filter == "":
+			log.Printf("-fast only speeds up tracing a subset of the syscalls (-e, -only or -exclude)")
+		case *flagPid != 0:
+			log.Printf("-fast doesn't apply to attached processes")
+		case !(Strace{Host: *flagSSH}).Supports("-f", "--seccomp-bpf"):
+			log.Printf("strace doesn't support --seccomp-bpf, tracing without it")
+		default:
+			userStraceArgs = append(userStraceArgs, "--seccomp-bpf")
+		}
+	}
+	command := flag.Args()
+	if *flagRuns > 1 {
+		command = runsArgs(*flagRuns, command)
+	}
+	// The counters are the ones of the command alone when it runs in a
+	// cgroup of its own. Fail before the capture rather than after it.
+	var commandCgroup *CommandCgroup
+	if *flagNewCgroup {
+		commandCgroup, err = NewCommandCgroup()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "-new-cgroup can't create the cgroup of the command: %s\n", err)
+			os.Exit(1)
+		}
+		defer commandCgroup.Close()
+	}
+	if *flagPid != 0 {
+		userStraceArgs = append(userStraceArgs, "-p", strconv.Itoa(*flagPid))
+	} else {
+		userStraceArgs = append(userStraceArgs, command...)
+	}
 
 	tmp, err := os.CreateTemp("", "stracefile")
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer os.Remove(tmp.Name())
+	if *flagFF {
+		defer removePerPidFiles(tmp.Name())
+	}
 
-	defaultStraceArgs = append(defaultStraceArgs, "-o", tmp.Name())
-
-	resourceMonitor, err := NewResourceMonitor()
-	if err != nil {
-		log.Printf("cpu / memory will not be available: %v", err)
+	// The local resources and limits say nothing about a remote host.
+	var resourceMonitor *ResourceMonitor
+	var rlimits map[string]Rlimit
+	var sysctls map[string]string
+	if *flagSSH == "" {
+		switch {
+		case monitoredCgroup != "":
+			resourceMonitor, err = NewCgroupResourceMonitor(monitoredCgroup)
+		case commandCgroup != nil:
+			resourceMonitor, err = NewCgroupResourceMonitor(commandCgroup.Path)
+		default:
+			resourceMonitor, err = NewResourceMonitor(*flagPid)
+		}
+		if err != nil {
+			log.Printf("cpu / memory will not be available: %v", err)
+		}
+		rlimits = CaptureRlimits(*flagPid)
+		sysctls = CaptureSysctls()
+	}
+	straceArgs := defaultStraceArgs
+	if *flagNs && *flagBackend == "strace" {
+		if (Strace{Host: *flagSSH}).Supports(nsStraceArgs...) {
+			straceArgs = nsStraceArgs
+		} else {
+			log.Printf("strace doesn't support nanosecond timestamps, recording microseconds")
+		}
+	}
+	if *flagFF {
+		straceArgs = perPidArgs(straceArgs)
+	}
+	tracer := "strace"
+	if *flagLtrace {
+		tracer = "ltrace"
+		straceArgs = ltraceArgs
 	}
 	ctx, cancel := context.WithCancel(context.Background())
+	straceAlerts := NewStraceAlerts(straceStderr())
 	strace := Strace{
-		DefaultArgs: defaultStraceArgs,
+		Tracer:      tracer,
+		DefaultArgs: straceArgs,
 		UserArgs:    userStraceArgs,
 		Timeout:     *flagTimeout,
+		Output:      tmp.Name(),
+		Host:        *flagSSH,
+		Stdin:       os.Stdin,
+		Stderr:      straceAlerts,
+		Cgroup:      commandCgroup,
+	}
+	var markerPipe *MarkerPipe
+	if *flagMarkerFd {
+		markerPipe, err = NewMarkerPipe()
+		if err != nil {
+			log.Fatalf("[!] Error creating the marker pipe: %s\n", err)
+		}
+		strace.ExtraFiles = []*os.File{markerPipe.Writer()}
+		strace.Env = []string{fmt.Sprintf("%s=%d", markerFdEnv, markerFd)}
 	}
+	// The resource monitor takes a last sample once cancelled.
+	var resourceMonitorDone sync.WaitGroup
 	if resourceMonitor != nil {
-		go resourceMonitor.Run(ctx)
+		resourceMonitor.Interval = *flagSampling
+		resourceMonitor.Adaptive = *flagAdaptive
+		resourceMonitorDone.Add(1)
+		go func() {
+			defer resourceMonitorDone.Done()
+			resourceMonitor.Run(ctx)
+		}()
 	}
-	strace.Run()
+	var processIOMonitor *ProcessIOMonitor
+	var threadStateMonitor *ThreadStateMonitor
+	var networkMonitor *NetworkMonitor
+	var threadNameMonitor *ThreadNameMonitor
+	if *flagSSH == "" {
+		processIOMonitor = NewProcessIOMonitor()
+		threadNameMonitor = NewThreadNameMonitor()
+		if *flagThreadStates {
+			threadStateMonitor = NewThreadStateMonitor()
+		}
+		if *flagNetwork {
+			networkMonitor = NewNetworkMonitor()
+		}
+		strace.OnStart = func(pid int) {
+			if markerPipe != nil {
+				// Only the traced processes hold the pipe open
+				// now, it reaches EOF once they are gone.
+				markerPipe.Writer().Close()
+			}
+			// The traced processes are the descendants of strace, or the
+			// attached process and its descendants.
+			tracees := func() []int {
+				return procDescendants(pid)
+			}
+			if *flagPid != 0 {
+				tracees = func() []int {
+					return append([]int{*flagPid}, procDescendants(*flagPid)...)
+				}
+			}
+			go processIOMonitor.Run(ctx, tracees)
+			go threadNameMonitor.Run(ctx, tracees)
+			if resourceMonitor != nil {
+				go resourceMonitor.RunProcesses(ctx, tracees)
+			}
+			if threadStateMonitor != nil {
+				go threadStateMonitor.Run(ctx, tracees)
+			}
+			if networkMonitor != nil {
+				// strace runs in the network namespace of the
+				// command, and outlives it.
+				netnsPid := pid
+				if *flagPid != 0 {
+					netnsPid = *flagPid
+				}
+				go networkMonitor.Run(ctx, netnsPid)
+			}
+		}
+	}
+	signalMarkers := NewSignalMarkers(*flagUsr1, *flagUsr2)
+	go signalMarkers.Run(ctx)
+	logTailers, err := NewLogTailers(flagTailLogs)
+	if err != nil {
+		log.Fatalf("[!] Error opening log file: %s\n", err)
+	}
+	var logTailersDone sync.WaitGroup
+	if markerPipe != nil {
+		logTailersDone.Add(1)
+		go func() {
+			defer logTailersDone.Done()
+			markerPipe.Run(ctx)
+		}()
+	}
+	for _, t := range logTailers {
+		logTailersDone.Add(1)
+		go func() {
+			defer logTailersDone.Done()
+			t.Run(ctx)
+		}()
+	}
+	var schedMonitor *SchedMonitor
+	if *flagSched {
+		// The traced processes are the descendants of this one, or
+		// the attached process and its descendants.
+		tids := []int{os.Getpid()}
+		if *flagPid != 0 {
+			tids = nil
+			for tid := range readProcTree(*flagPid).Threads {
+				tids = append(tids, tid)
+			}
+		}
+		schedMonitor, err = NewSchedMonitor(tids)
+		if err != nil {
+			log.Printf("scheduler events will not be available: %v", err)
+		} else {
+			defer schedMonitor.Close()
+			logTailersDone.Add(1)
+			go func() {
+				defer logTailersDone.Done()
+				schedMonitor.Run(ctx)
+			}()
+		}
+	}
+	var captureTracer string
+	switch {
+	case *flagBackend == "ptrace":
+		captureTracer = "ptrace (built in)"
+	case *flagBackend == "ebpf":
+		captureTracer = tracerVersion("bpftrace", "bpftrace", "--version")
+	case *flagSSH != "":
+		captureTracer = tracerVersion(tracer, "ssh", *flagSSH, tracer+" -V")
+	default:
+		captureTracer = tracerVersion(tracer, tracer, "-V")
+	}
+	capture := NewCaptureInfo(captureTracer)
+	capture.Command, capture.Pid = flag.Args(), *flagPid
+	if *flagSSH != "" {
+		// The command runs on the remote host, in the home directory.
+		capture.Cwd, capture.Hostname, capture.Kernel = "", "", ""
+	}
+	clockSnapshots := []ClockSnapshot{TakeClockSnapshot()}
+	// Ctrl-C or SIGTERM stop strace, which detaches from the traced
+	// processes, and the trace captured so far is saved. An attached
+	// process is traced until then.
+	straceCtx, stopStrace := NotifyInterrupt(context.Background())
+	var tree traceconv.ProcTree
+	if *flagPid != 0 && *flagSSH == "" {
+		tree = readProcTree(*flagPid)
+	}
+	if *flagPid != 0 {
+		progressf("[+] Attaching to pid %d, press Ctrl-C to stop\n", *flagPid)
+	}
+	// With strace writing its output locally, the trace is rotated as it
+	// grows, the other outputs once the capture ends.
+	var rotator *straceRotator
+	var rotatorDone sync.WaitGroup
+	rotatorCtx, stopRotator := context.WithCancel(context.Background())
+	if flagMaxOutput > 0 && *flagBackend == "strace" && !*flagFF && !*flagLtrace && *flagSSH == "" && *flagRuns == 1 && *flagRestarts == "" {
+		rotator = &straceRotator{
+			f:        tmp,
+			segments: segmentsOf(*flagOutput),
+			metadata: map[string]any{
+				"clockDomains": map[string]ClockDomain{"strace": ClockRealtime},
+				"capture":      capture,
+			},
+			tree:         tree,
+			pollInterval: 100 * time.Millisecond,
+		}
+		rotatorDone.Add(1)
+		go func() {
+			defer rotatorDone.Done()
+			rotator.Run(rotatorCtx)
+		}()
+	}
+	end := selfTrace.Begin("strace")
+	// backendEvents are the syscalls the ptrace and eBPF backends
+	// recorded, which have no strace output to parse.
+	var backendEvents func() []*Event
+	var backendLost func() int
+	var straceErr error
+	switch *flagBackend {
+	case "ptrace":
+		ptraceTracer := &PtraceTracer{
+			Command:     command,
+			Pid:         *flagPid,
+			Timeout:     strace.Timeout,
+			StrSize:     *flagStrSize,
+			Nanoseconds: *flagNs,
+			Stdin:       strace.Stdin,
+			Stderr:      strace.Stderr,
+			OnStart:     strace.OnStart,
+			ExtraFiles:  strace.ExtraFiles,
+			Env:         strace.Env,
+			Cgroup:      strace.Cgroup,
+		}
+		straceErr = ptraceTracer.RunContext(straceCtx)
+		backendEvents = ptraceTracer.Events
+	case "ebpf":
+		ebpfTracer := &EbpfTracer{
+			Command:     command,
+			Pid:         *flagPid,
+			Timeout:     strace.Timeout,
+			StrSize:     *flagStrSize,
+			Nanoseconds: *flagNs,
+			Stdin:       strace.Stdin,
+			Stderr:      strace.Stderr,
+			OnStart:     strace.OnStart,
+			ExtraFiles:  strace.ExtraFiles,
+			Env:         strace.Env,
+			Cgroup:      strace.Cgroup,
+		}
+		straceErr = ebpfTracer.RunContext(straceCtx)
+		backendEvents = ebpfTracer.Events
+		backendLost = ebpfTracer.Lost
+	default:
+		straceErr = strace.RunContext(straceCtx)
+	}
+	straceEnd := time.Now()
+	end(0)
+	stopStrace()
+	clockSnapshots = append(clockSnapshots, TakeClockSnapshot())
 	cancel()
+	logTailersDone.Wait()
+	resourceMonitorDone.Wait()
+	stopRotator()
+	rotatorDone.Wait()
 
 	// parse results
-	var syscallEvents []*Event
-	preserved := make(map[string]*Event) // [pid+syscall]*Event
-	scanner := bufio.NewScanner(tmp)
+	var straceOutput io.Reader = tmp
+	if *flagFF {
+		straceOutput, err = perPidOutput(tmp.Name())
+		if err != nil {
+			log.Fatalf("[!] Error reading strace -ff output: %s\n", err)
+		}
+	}
+	if rotator != nil {
+		straceOutput, tree, err = rotator.Rest()
+		if err != nil {
+			log.Fatalf("[!] Error reading strace output: %s\n", err)
+		}
+	}
+	if threadNameMonitor != nil {
+		threadNameMonitor.AddTo(&tree)
+	}
+	var straceEvents []*Event
+	if backendEvents != nil {
+		straceEvents = convertSyscalls(backendEvents(), tree)
+	} else {
+		straceEvents = convertStrace(straceOutput, tree)
+	}
+	truncated := truncation(straceErr, straceEvents, *flagPid != 0)
+	if *flagRuns > 1 {
+		runs := findRuns(straceEvents)
+		labelRuns(straceEvents, runs)
+		printRuns(os.Stdout, straceEvents, runs)
+	}
 
 	var resourceMonitorEvents []*Event
+	warnings := straceAlerts.Warnings()
 	if resourceMonitor != nil {
 		resourceMonitorEvents = resourceMonitor.Events()
+		growthEvents, growthWarnings := resourceMonitor.MemoryGrowth()
+		oomEvents, oomWarnings := resourceMonitor.OOMRisk(*flagOOMThreshold)
+		throttleEvents, throttleWarnings := resourceMonitor.Throttling()
+		memoryEventAlerts, memoryEventWarnings := resourceMonitor.MemoryEvents(straceEvents)
+		resourceMonitorEvents = traceconv.Merge(resourceMonitorEvents, growthEvents, oomEvents, throttleEvents, memoryEventAlerts)
+		warnings = append(warnings, growthWarnings...)
+		warnings = append(warnings, oomWarnings...)
+		warnings = append(warnings, throttleWarnings...)
+		warnings = append(warnings, memoryEventWarnings...)
 	}
 
-	liveThreads := make(map[int]bool)
-	for scanner.Scan() {
-		e := NewEvent(scanner.Text())
-		if e.Cat == "other" {
-			continue
-		}
-		alive := liveThreads[e.Tid]
-		if !alive {
-			syscallEvents = append(syscallEvents, &Event{
-				Name: "lifetime",
-				Cat:  "lifetime",
-				Ph:   "B",
-				Ts:   e.Ts,
-				Pid:  e.Pid,
-				Tid:  e.Tid,
-			})
-			liveThreads[e.Tid] = true
-		}
-		switch {
-		case e.Cat == "unfinished":
-			k := strconv.Itoa(e.Pid) + e.Name
-			preserved[k] = e
-		case e.Cat == "detached":
-			k := strconv.Itoa(e.Pid) + e.Name
-			p := preserved[k]
-			e.Dur = e.Ts - p.Ts
-			e.Ts = p.Ts
-			e.Args.First = p.Args.First
-			syscallEvents = append(syscallEvents, e)
-			delete(preserved, k)
-		case e.Cat == "lifetime":
-			syscallEvents = append(syscallEvents, e)
-		case e.Cat == "other":
-			break
-		default:
-			syscallEvents = append(syscallEvents, e)
-		}
-	}
-	// add any unfinished/preserved traces to events
-	for _, p := range preserved {
-		p.Ph = "i" // instant event
-		syscallEvents = append(syscallEvents, p)
-	}
-
-	processNames := make(map[int]string)
-	threadNames := make(map[int]string)
-	processThreads := make(map[int]int)
-	processThreads[syscallEvents[0].Tid] = syscallEvents[0].Pid
-	// First construct the process tree. This is needed because sometimes the
-	// fork/clone syscall returns after the thread has started executing and
-	// some syscalls have been called.
-	for _, e := range syscallEvents {
-		pid, ok := processThreads[e.Tid]
-		if ok {
-			e.Pid = pid
-		}
-		if e.Name == "fork" || strings.HasPrefix(e.Name, "clone") {
-			childTid, err := strconv.Atoi(e.Args.ReturnValue)
-			if err == nil {
-				if strings.Contains(e.Args.First, "CLONE_THREAD") {
-					processThreads[childTid] = e.Pid
-				} else {
-					processThreads[childTid] = childTid
-				}
+	fdGrowthEvents, fdGrowthWarnings := fdGrowth(straceEvents)
+	warnings = append(warnings, fdGrowthWarnings...)
+
+	// Finally, merge all the event sources
+	eventSources := [][]*Event{straceEvents, resourceMonitorEvents, signalMarkers.Events(), straceAlerts.Events(), fdGrowthEvents}
+	if truncated != "" {
+		eventSources = append(eventSources, []*Event{truncatedEvent(truncated, straceEnd)})
+	}
+	if markerPipe != nil {
+		eventSources = append(eventSources, markerPipe.Events(straceEvents))
+	}
+	if threadStateMonitor != nil {
+		eventSources = append(eventSources, threadStateMonitor.Events())
+	}
+	if networkMonitor != nil {
+		eventSources = append(eventSources, networkMonitor.Events())
+	}
+	if schedMonitor != nil {
+		// The scheduler events are the ones of the whole system.
+		tids := make(map[int]bool)
+		for _, e := range straceEvents {
+			if e.Tid < pidMaxLimit {
+				tids[e.Tid] = true
 			}
 		}
+		eventSources = append(eventSources, schedMonitor.Events(tids))
+		if schedMonitor.Lost() {
+			warnings = append(warnings, "ftrace lost scheduler events, its buffer filled up faster than it was read")
+		}
+	}
+	if *flagIdleGap > 0 {
+		eventSources = append(eventSources, idleGaps(straceEvents, flagIdleGap.Microseconds(), classifyIdleGap(resourceMonitor)))
+	}
+	for _, t := range logTailers {
+		eventSources = append(eventSources, t.Events())
+	}
+	mergeTraces, err := loadMergeTraces(flagMergeTrace, clockSnapshots[len(clockSnapshots)-1])
+	if err != nil {
+		log.Fatalf("[!] Error loading trace to merge: %s\n", err)
+	}
+	goTraces, err := loadGoTraces(flagGoTrace, clockSnapshots[len(clockSnapshots)-1], straceEvents)
+	if err != nil {
+		log.Fatalf("[!] Error loading Go trace to merge: %s\n", err)
+	}
+	eventSources = append(eventSources, goTraces...)
+	renumberIDs(mergeTraces, eventSources...)
+	eventSources = append(eventSources, mergeTraces...)
+	events := traceconv.Merge(eventSources...)
+
+	// save results
+	clockDomains := map[string]ClockDomain{
+		"strace": ClockRealtime,
+	}
+	if resourceMonitor != nil {
+		clockDomains["System resources"] = resourceMonitor.Clock()
+	}
+	if len(logTailers) > 0 {
+		clockDomains["Logs"] = ClockRealtime
+	}
+	if threadStateMonitor != nil {
+		clockDomains["Thread states"] = ClockRealtime
+	}
+	if networkMonitor != nil {
+		clockDomains["Network"] = ClockRealtime
+	}
+	if schedMonitor != nil {
+		clockDomains["CPU scheduling"] = ClockBoottime
+	}
+	metadata := map[string]any{
+		"clockDomains":   clockDomains,
+		"clockSnapshots": clockSnapshots,
+		"capture":        capture,
+		"rlimits":        rlimits,
+		"sysctls":        sysctls,
+	}
+	if *flagSSH != "" {
+		metadata["host"] = *flagSSH
+	}
+	if processIOMonitor != nil {
+		metadata["processIO"] = processIOMonitor.Totals(straceEvents)
+	}
+	if truncated != "" {
+		metadata["truncated"] = truncated
+		warnings = append(warnings, "The trace is truncated: "+truncated)
+	}
+	if backendLost != nil && backendLost() > 0 {
+		metadata["lostEvents"] = backendLost()
+		warnings = append(warnings, fmt.Sprintf("bpftrace lost %d events, its buffers filled up faster than they were read: syscalls are missing from the trace", backendLost()))
+	}
+	if len(warnings) > 0 {
+		metadata["warnings"] = warnings
+	}
+	saveTrace(events, metadata)
+	for _, warning := range warnings {
+		fmt.Printf("[!] %s\n", warning)
+	}
+}
+
+// saveTrace writes the events to the output file(s) and tells the user where
+// to find them.
+func saveTrace(events []*Event, metadata map[string]any) {
+	// The spans are sent with their wall clock time, to line up with the
+	// other spans of the collector.
+	if *flagOTLP != "" {
+		if n, err := exportOTLP(*flagOTLP, events); err != nil {
+			log.Printf("[!] Error sending spans to %s: %s", *flagOTLP, err)
+		} else {
+			fmt.Printf("[+] %d spans sent to: %s\n", n, *flagOTLP)
+		}
+	}
+	if *flagRelativeTs {
+		rebaseTimestamps(events, metadata)
 	}
-	for _, e := range syscallEvents {
-		pid, ok := processThreads[e.Tid]
-		if ok {
-			e.Pid = pid
+	if *flagLatency != "" || *flagLatencyMeta {
+		report := NewLatencyReport(events)
+		if *flagLatencyMeta {
+			metadata["latency"] = report.BySyscall
 		}
-		if e.Name == "fork" || strings.HasPrefix(e.Name, "clone") {
-			childTid, err := strconv.Atoi(e.Args.ReturnValue)
-			if err == nil {
-				if strings.Contains(e.Args.First, "CLONE_THREAD") {
-					processThreads[childTid] = e.Pid
-				} else {
-					processThreads[childTid] = childTid
-				}
+		if *flagLatency != "" {
+			if err := report.Save(*flagLatency); err != nil {
+				log.Printf("[!] Error saving latency report: %s", err)
+			} else {
+				fmt.Printf("[+] Latency report saved to: %s\n", *flagLatency)
 			}
 		}
 	}
-	// Now we can get the process names and flows between parent/children.
-	var metadataEvents []*Event
-	var nextFlowId uint64
-	for _, e := range syscallEvents {
-		pid, ok := processThreads[e.Tid]
-		if ok {
-			e.Pid = pid
+	if *flagSummary || *flagSummaryJSON != "" {
+		summary := NewSummary(events)
+		if *flagSummary {
+			summary.Print(os.Stdout)
 		}
-		if e.Name == "prctl" && strings.Contains(e.Args.First, "PR_SET_NAME") {
-			threadName := e.Args.First
-			m := regexpPrctl.FindStringSubmatch(threadName)
-			if len(m) == 2 {
-				threadName = m[1]
+		if *flagSummaryJSON != "" {
+			if err := summary.Save(*flagSummaryJSON); err != nil {
+				log.Printf("[!] Error saving summary: %s", err)
+			} else {
+				fmt.Printf("[+] Summary saved to: %s\n", *flagSummaryJSON)
 			}
-			threadNames[e.Tid] = threadName
-		}
-		if e.Name == "execve" {
-			processName := e.Args.First
-			m := regexpExecve.FindStringSubmatch(processName)
-			if len(m) == 4 {
-				processName = m[2]
-				if m[3] == "..." {
-					processName = path.Base(m[1])
+		}
+	}
+	if *flagFdLeaks != "" {
+		report := NewFdLeakReport(events)
+		if err := report.Save(*flagFdLeaks); err != nil {
+			log.Printf("[!] Error saving fd leak report: %s", err)
+		} else {
+			fmt.Printf("[+] %d fds never closed, report saved to: %s\n", report.Count(), *flagFdLeaks)
+			report.Print(10)
+		}
+	}
+	if *flagFileReport != "" {
+		report := NewFileAccessReport(events)
+		if err := report.Save(*flagFileReport); err != nil {
+			log.Printf("[!] Error saving file access report: %s", err)
+		} else {
+			fmt.Printf("[+] %d files accessed, report saved to: %s\n", len(report), *flagFileReport)
+			report.Print(10)
+		}
+	}
+	if *flagRestarts != "" {
+		service, incarnations := findIncarnations(events)
+		if incarnations == nil {
+			log.Printf("no restarts detected, saving a single trace")
+		} else {
+			fmt.Printf("[+] Detected %d incarnations of %s\n", len(incarnations), service)
+			metadata["service"] = service
+			switch *flagRestarts {
+			case "label":
+				events = labelIncarnations(events, incarnations)
+			case "split":
+				var outputs []string
+				for i, split := range splitIncarnations(events, incarnations) {
+					outputs = append(outputs, writeTraces(incarnationOutput(*flagOutput, i), split, metadata)...)
 				}
-			}
-			processNames[e.Pid] = processName
-			threadNames[e.Tid] = processName
-		}
-		if e.Name == "write" {
-			m := regexpGlobalEvent.FindStringSubmatch(e.Args.First)
-			if len(m) == 2 {
-				metadataEvents = append(
-					metadataEvents,
-					&Event{
-						Name:  strings.TrimSpace(m[1]),
-						Cat:   "event",
-						Ph:    "i",
-						Pid:   e.Pid,
-						Tid:   e.Tid,
-						Scope: "g",
-						Ts:    e.Ts,
-					},
-				)
+				if *flagSlowest > 0 {
+					printSlowest(os.Stdout, events, *flagSlowest)
+				}
+				if *flagServe {
+					serveTraces(*flagServeAddr, outputs)
+				}
+				return
 			}
 		}
-		if e.Name == "fork" || strings.HasPrefix(e.Name, "clone") {
-			childTid, err := strconv.Atoi(e.Args.ReturnValue)
-			if err == nil {
-				metadataEvents = append(
-					metadataEvents,
-					&Event{
-						Name: e.Name,
-						Cat:  "clone",
-						Ph:   "s",
-						Pid:  e.Pid,
-						Tid:  e.Tid,
-						Ts:   e.Ts + 1,
-						Id:   nextFlowId,
-					},
-				)
-				threadNames[childTid] = threadNames[e.Tid]
-				if strings.Contains(e.Args.First, "CLONE_THREAD") {
-					metadataEvents = append(
-						metadataEvents,
-						&Event{
-							Name: e.Name,
-							Cat:  "clone",
-							Ph:   "f",
-							Pid:  e.Pid,
-							Tid:  childTid,
-							Ts:   e.Ts + 1,
-							Id:   nextFlowId,
-						},
-					)
-				} else {
-					metadataEvents = append(
-						metadataEvents,
-						&Event{
-							Name: e.Name,
-							Cat:  "clone",
-							Ph:   "f",
-							Pid:  childTid,
-							Tid:  childTid,
-							Ts:   e.Ts + 1,
-							Id:   nextFlowId,
-						},
-					)
-					processNames[childTid] = processNames[e.Pid]
-				}
-				nextFlowId++
+	}
+	outputs := writeTraces(*flagOutput, events, metadata)
+	if *flagSlowest > 0 {
+		printSlowest(os.Stdout, events, *flagSlowest)
+	}
+	if *flagServe {
+		serveTraces(*flagServeAddr, outputs)
+	}
+}
+
+// writeTraces writes the trace, rotated into segments with -max-output-size,
+// and returns the files written.
+func writeTraces(output string, events []*Event, metadata map[string]any) []string {
+	if flagMaxOutput == 0 {
+		writeTrace(output, events, metadata)
+		return []string{output}
+	}
+	if *flagMinDur > 0 {
+		events = dropShortSyscalls(events, flagMinDur.Microseconds(), *flagMinDurCount)
+	}
+	segments := segmentsOf(output)
+	end := selfTrace.Begin("export")
+	if err := segments.write(events, metadata, selfTraceTail(end, len(events), metadata)); err != nil {
+		log.Fatalf("[!] Error writing the trace: %s\n", err)
+	}
+	progressf("[+] Analyze results: https://ui.perfetto.dev/\n")
+	if *flagMetrics != "" {
+		printMetrics(segments.outputs[len(segments.outputs)-1])
+	}
+	return segments.outputs
+}
+
+func writeTrace(output string, events []*Event, metadata map[string]any) {
+	// The reports and annotations above see all the syscalls, only the
+	// trace leaves out the short ones.
+	if *flagMinDur > 0 {
+		events = dropShortSyscalls(events, flagMinDur.Microseconds(), *flagMinDurCount)
+	}
+	te := TraceEvents{
+		Event:    events,
+		Metadata: metadata,
+	}
+	if *flagAppend {
+		existing, err := LoadTraceEvents(output)
+		switch {
+		case err == nil:
+			if session := existing.AppendSession(*flagSession, events, metadata); *flagSession != "" && session != *flagSession {
+				progressf("[!] Session %q was added to %s meanwhile, this one is %q\n", *flagSession, output, session)
 			}
+			te = existing
+		case errors.Is(err, fs.ErrNotExist):
+			// Nothing to append to yet, this is the first session.
+			if *flagSession != "" {
+				te = TraceEvents{}
+				te.AppendSession(*flagSession, events, metadata)
+			}
+		default:
+			log.Fatalf("[!] Error reading trace file to append to: %s\n", err)
 		}
 	}
-	for pid, name := range processNames {
-		metadataEvents = append(
-			metadataEvents,
-			&Event{
-				Name: "process_name",
-				Ph:   "M",
-				Pid:  pid,
-				Tid:  pid,
-				Cat:  "__metadata",
-				Args: Args{
-					Name: name,
-				},
-			},
-		)
-	}
-	for tid, name := range threadNames {
-		metadataEvents = append(
-			metadataEvents,
-			&Event{
-				Name: "thread_name",
-				Ph:   "M",
-				Tid:  tid,
-				Pid:  processThreads[tid],
-				Cat:  "__metadata",
-				Args: Args{
-					Name: name,
-				},
-			},
-		)
+	end := selfTrace.Begin("export")
+	te.tail = selfTraceTail(end, len(te.Event), metadata)
+	viewer := "https://ui.perfetto.dev/"
+	switch *flagFormat {
+	case "proto":
+		te.SaveProto(output)
+	case "speedscope":
+		te.SaveSpeedscope(output)
+		viewer = "https://www.speedscope.app/"
+	case "folded":
+		te.SaveFolded(output)
+		viewer = "https://www.speedscope.app/ or flamegraph.pl"
+	case "pprof":
+		te.SavePprof(output)
+		viewer = "go tool pprof -http=: " + output
+	case "sqlite":
+		te.SaveSQLite(output)
+		viewer = "sqlite3 " + output
+	default:
+		te.Save(output)
 	}
 
-	// Finally, merge all the event sources
-	events := merge(metadataEvents, syscallEvents, resourceMonitorEvents)
+	fmt.Printf("[+] Trace file saved to: %s\n", output)
+	progressf("[+] Analyze results: %s\n", viewer)
 
-	// save results
-	te := TraceEvents{events}
-	te.Save(*flagOutput)
+	if *flagMetrics != "" {
+		printMetrics(output)
+	}
+}
+
+// selfTraceTail returns the phases of the tool to write at the end of a trace
+// of n events, once its export phase ends.
+func selfTraceTail(end func(events int), n int, metadata map[string]any) func() []*Event {
+	return func() []*Event {
+		end(n)
+		events := selfTrace.Events()
+		if offset, ok := metadata["timestampOffset"].(int64); ok {
+			// The phases are timed as the trace is written, after
+			// the other events were rebased.
+			shiftTimestamps(events, offset)
+		}
+		return events
+	}
+}
 
-	fmt.Printf("[+] Trace file saved to: %s\n", *flagOutput)
-	fmt.Printf("[+] Analyze results: %s\n", "https://ui.perfetto.dev/")
+func printMetrics(output string) {
+	queries, err := metricQueries(*flagMetrics)
+	if err != nil {
+		log.Printf("[!] Error loading metric queries: %s", err)
+		return
+	}
+	results, err := runMetrics(output, queries)
+	if err != nil {
+		log.Printf("[!] Error running metric queries: %s", err)
+		return
+	}
+	fmt.Print(results)
+	if *flagMetricsOut != "" {
+		if err := os.WriteFile(*flagMetricsOut, []byte(results), 0644); err != nil {
+			log.Printf("[!] Error saving metric results: %s", err)
+		}
+	}
 }
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/replit/strace-perfetto/pkg/marker"
+	"github.com/replit/strace-perfetto/pkg/traceconv"
+)
+
+const (
+	markersPid = pidMaxLimit + 6
+
+	// markerFd is the fd of the marker pipe in the traced command, the
+	// first one after stdin, stdout and stderr, which it finds in
+	// markerFdEnv.
+	markerFd    = 3
+	markerFdEnv = marker.FdEnv
+
+	// markerDrainTimeout is how long the markers still in the pipe are read
+	// for once the capture is over, if a process outliving strace keeps the
+	// pipe open.
+	markerDrainTimeout = 100 * time.Millisecond
+)
+
+// markerLine is a line read from the marker pipe, timestamped when read: its
+// write syscall, if strace recorded it, times it more precisely.
+type markerLine struct {
+	ts     int64 // nanoseconds
+	tid    int
+	marker string
+	text   string // the line as written
+}
+
+// regexpWriteString matches the string a write syscall writes.
+var regexpWriteString = regexp.MustCompile(`^\(\d+(?:<[^>]*>)?, ("(?:[^"\\]|\\.)*")(\.\.\.)?`)
+
+// MarkerPipe is a pipe the traced command writes its markers to, one per
+// line, instead of having them picked out of all its writes. A line is a
+// marker of the marker protocol, "PERFETTO:<type>[:<arg>]", or anything else
+// for a global instant, optionally preceded by the tid of the thread it is
+// about ("1234 PERFETTO:B:compile"); the markers without one go on a track of
+// their own.
+type MarkerPipe struct {
+	r, w *os.File
+
+	mu    sync.Mutex
+	lines []markerLine
+}
+
+// NewMarkerPipe returns a new marker pipe.
+func NewMarkerPipe() (*MarkerPipe, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	return &MarkerPipe{r: r, w: w}, nil
+}
+
+// Writer returns the end of the pipe the traced command writes to, to close
+// once strace started.
+func (m *MarkerPipe) Writer() *os.File {
+	return m.w
+}
+
+// Run reads the markers until the traced processes closed the pipe, or
+// shortly after ctx is done.
+func (m *MarkerPipe) Run(ctx context.Context) {
+	defer m.r.Close()
+	go func() {
+		<-ctx.Done()
+		m.r.SetReadDeadline(time.Now().Add(markerDrainTimeout))
+	}()
+	scanner := bufio.NewScanner(m.r)
+	for scanner.Scan() {
+		ts := time.Now().UnixNano()
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		text, tid := line, 0
+		if field, rest, ok := strings.Cut(line, " "); ok {
+			if n, err := strconv.Atoi(field); err == nil && n > 0 {
+				tid, line = n, strings.TrimSpace(rest)
+			}
+		}
+		m.mu.Lock()
+		m.lines = append(m.lines, markerLine{ts: ts, tid: tid, marker: line, text: text})
+		m.mu.Unlock()
+	}
+	if err := scanner.Err(); err != nil && !os.IsTimeout(err) {
+		log.Printf("error reading markers: %v", err)
+	}
+}
+
+// markerWrite is a line of a write syscall, which may have written a marker.
+type markerWrite struct {
+	e         *Event
+	line      string
+	truncated bool // strace printed the start of the line only
+}
+
+// markerWrites returns the lines written by the write syscalls, in the order
+// they were written.
+func markerWrites(syscallEvents []*Event) []markerWrite {
+	var writes []markerWrite
+	for _, e := range syscallEvents {
+		if e.Name != "write" || !isSyscall(e) {
+			continue
+		}
+		m := regexpWriteString.FindStringSubmatch(e.Args.First)
+		if m == nil {
+			continue
+		}
+		s, err := strconv.Unquote(m[1])
+		if err != nil {
+			s = m[1][1 : len(m[1])-1]
+		}
+		lines := strings.Split(s, "\n")
+		for i, line := range lines {
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+			writes = append(writes, markerWrite{e: e, line: line, truncated: m[2] != "" && i == len(lines)-1})
+		}
+	}
+	sort.SliceStable(writes, func(i, j int) bool {
+		return writes[i].e.TsNanos() < writes[j].e.TsNanos()
+	})
+	return writes
+}
+
+// Events returns the events of the markers. The markers of a thread go on
+// its track, in the process the syscall events say it belongs to. A marker
+// is timed by the write syscall that wrote it, when strace recorded it, as the
+// markers written to other fds are, rather than when it was read.
+func (m *MarkerPipe) Events(syscallEvents []*Event) []*Event {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pids := make(map[int]int)
+	for _, e := range syscallEvents {
+		if e.Ph == "X" {
+			pids[e.Tid] = e.Pid
+		}
+	}
+	// The lines are written and read in the same order: each is matched
+	// with the first line written after the previous match, before it was
+	// read.
+	writes := markerWrites(syscallEvents)
+	next := 0
+	events := []*Event{
+		{
+			Name: "process_name",
+			Ph:   "M",
+			Cat:  "__metadata",
+			Pid:  markersPid,
+			Tid:  markersPid,
+			Args: Args{
+				Name: "Markers",
+			},
+		},
+	}
+	for _, l := range m.lines {
+		start, end := l.ts, l.ts
+		for i := next; i < len(writes) && writes[i].e.TsNanos() <= l.ts; i++ {
+			w := writes[i]
+			if w.line == l.text || w.truncated && strings.HasPrefix(l.text, w.line) {
+				start, end, next = w.e.TsNanos(), w.e.EndNanos(), i+1
+				break
+			}
+		}
+		pid, tid := markersPid, markersPid
+		if l.tid != 0 {
+			pid, tid = l.tid, l.tid
+			if p, ok := pids[l.tid]; ok {
+				pid = p
+			}
+		}
+		if markerEvents := traceconv.MarkerEvents(l.marker, pid, tid, start, end); markerEvents != nil {
+			events = append(events, markerEvents...)
+			continue
+		}
+		events = append(events, &Event{
+			Name:  l.marker,
+			Cat:   "event",
+			Ph:    "i",
+			Pid:   pid,
+			Tid:   tid,
+			Scope: "g",
+			Ts:    start / 1000,
+			TsNs:  int(start % 1000),
+		})
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Ts < events[j].Ts
+	})
+	return events
+}
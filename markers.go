@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// SignalMarkers inserts a named global instant event into the trace every
+// time the tool receives SIGUSR1 or SIGUSR2, so that phases of a manual
+// experiment can be marked without touching the traced program.
+type SignalMarkers struct {
+	labels  map[os.Signal]string
+	signals chan os.Signal
+
+	mu     sync.Mutex
+	events []*Event
+}
+
+// NewSignalMarkers returns a new set of signal markers using the given labels
+// for SIGUSR1 and SIGUSR2. The signals are handled from this point on, so
+// they no longer terminate the tool.
+func NewSignalMarkers(usr1Label, usr2Label string) *SignalMarkers {
+	m := &SignalMarkers{
+		labels: map[os.Signal]string{
+			syscall.SIGUSR1: usr1Label,
+			syscall.SIGUSR2: usr2Label,
+		},
+		signals: make(chan os.Signal, 16),
+	}
+	signal.Notify(m.signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	return m
+}
+
+// Run records the markers until ctx is done, and stops handling the signals
+// then.
+func (m *SignalMarkers) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			// The signals take their default action again, but
+			// for the ones already received.
+			signal.Stop(m.signals)
+			for {
+				select {
+				case sig := <-m.signals:
+					m.mark(sig)
+				default:
+					return
+				}
+			}
+		case sig := <-m.signals:
+			m.mark(sig)
+		}
+	}
+}
+
+// mark records the marker of sig, received now.
+func (m *SignalMarkers) mark(sig os.Signal) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.events = append(m.events, &Event{
+		Name:  m.labels[sig],
+		Cat:   "event",
+		Ph:    "i",
+		Scope: "g",
+		Ts:    time.Now().UnixMicro(),
+	})
+}
+
+func (m *SignalMarkers) Events() []*Event {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.events)
+}
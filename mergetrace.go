@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// chromeEvent is an event of a Chrome JSON trace produced by another tool.
+// The fields vary in type between producers, so they are decoded loosely.
+type chromeEvent struct {
+	Name  string          `json:"name"`
+	Cat   string          `json:"cat"`
+	Ph    string          `json:"ph"`
+	Pid   json.RawMessage `json:"pid"`
+	Tid   json.RawMessage `json:"tid"`
+	Ts    json.Number     `json:"ts"`
+	Dur   json.Number     `json:"dur"`
+	Id    json.RawMessage `json:"id"`
+	Scope string          `json:"s"`
+	Args  map[string]any  `json:"args"`
+}
+
+// namedIDBase is the first id given to the processes and threads the merged
+// traces name rather than number, past the pids of the tracks of the event
+// sources that aren't processes.
+const namedIDBase = pidMaxLimit + 1<<20
+
+// LoadChromeTrace reads a Chrome JSON trace written by the traced program
+// (e.g. node --trace-events-enabled) so it can be merged into ours. The
+// args of its events end up in Args.Data. Processes and threads with a name
+// instead of a number as their pid or tid are given an id from nextID on,
+// and named after it.
+func LoadChromeTrace(input string, nextID *int) ([]*Event, error) {
+	b, err := os.ReadFile(input)
+	if err != nil {
+		return nil, err
+	}
+	var trace struct {
+		TraceEvents []chromeEvent `json:"traceEvents"`
+	}
+	if err := json.Unmarshal(b, &trace); err != nil {
+		if err := json.Unmarshal(b, &trace.TraceEvents); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", input, err)
+		}
+	}
+
+	events := make([]*Event, 0, len(trace.TraceEvents))
+	named := make(map[string]int)
+	var names []*Event
+	id := func(raw json.RawMessage, metadata string, pid int) int {
+		var name string
+		if err := json.Unmarshal(raw, &name); err != nil {
+			return int(jsonNumber(json.Number(raw)))
+		}
+		if n, err := strconv.Atoi(name); err == nil {
+			return n
+		}
+		if id, ok := named[metadata+name]; ok {
+			return id
+		}
+		id := *nextID
+		*nextID++
+		named[metadata+name] = id
+		if metadata == "process_name" {
+			pid = id
+		}
+		names = append(names, &Event{Name: metadata, Ph: "M", Pid: pid, Tid: id, Args: Args{Name: name}})
+		return id
+	}
+	for _, ce := range trace.TraceEvents {
+		pid := id(ce.Pid, "process_name", 0)
+		e := &Event{
+			Name:  ce.Name,
+			Cat:   ce.Cat,
+			Ph:    ce.Ph,
+			Pid:   pid,
+			Tid:   id(ce.Tid, "thread_name", pid),
+			Ts:    int64(jsonNumber(ce.Ts)),
+			Dur:   int64(jsonNumber(ce.Dur)),
+			Id:    chromeEventID(ce.Id),
+			Scope: ce.Scope,
+		}
+		if ce.Ph == "M" {
+			if name, ok := ce.Args["name"].(string); ok {
+				e.Args.Name = name
+			}
+		} else if len(ce.Args) > 0 {
+			e.Args.Data = ce.Args
+		}
+		events = append(events, e)
+	}
+	events = append(names, events...)
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Ts < events[j].Ts
+	})
+	return events, nil
+}
+
+// AlignClock converts the timestamps of events recorded in the given clock
+// domain to the realtime clock used by strace. With "auto", timestamps within
+// a day of the snapshot are taken to be realtime already and the others to be
+// monotonic, which is what Chromium and node use.
+func AlignClock(events []*Event, domain string, snapshot ClockSnapshot) error {
+	clock := ClockDomain(domain)
+	switch clock {
+	case "auto":
+		clock = ClockMonotonic
+		const day = 24 * 60 * 60 * 1000000
+		for _, e := range events {
+			if e.Ph == "M" {
+				continue
+			}
+			if realtime := int64(snapshot.Realtime / 1000); e.Ts > realtime-day && e.Ts < realtime+day {
+				clock = ClockRealtime
+			}
+			break
+		}
+	case ClockRealtime, ClockMonotonic, ClockBoottime:
+	default:
+		return fmt.Errorf("unknown clock %q", domain)
+	}
+	if clock == ClockRealtime {
+		return nil
+	}
+	for _, e := range events {
+		if e.Ph == "M" {
+			continue
+		}
+		e.Ts = int64(snapshot.ToRealtime(clock, uint64(e.Ts)*1000) / 1000)
+	}
+	return nil
+}
+
+// loadMergeTraces loads the traces given with -merge-trace, as
+// path[:realtime|monotonic|boottime|auto], aligned to strace's clock.
+func loadMergeTraces(specs []string, snapshot ClockSnapshot) ([][]*Event, error) {
+	var traces [][]*Event
+	nextID := namedIDBase
+	for _, spec := range specs {
+		p, clock := spec, "auto"
+		if i := strings.LastIndex(spec, ":"); i != -1 {
+			switch ClockDomain(spec[i+1:]) {
+			case "auto", ClockRealtime, ClockMonotonic, ClockBoottime:
+				p, clock = spec[:i], spec[i+1:]
+			}
+		}
+		events, err := LoadChromeTrace(p, &nextID)
+		if err != nil {
+			return nil, err
+		}
+		if err := AlignClock(events, clock, snapshot); err != nil {
+			return nil, err
+		}
+		traces = append(traces, events)
+	}
+	return traces, nil
+}
+
+// renumberIDs gives the flow and async events of the merged traces ids past
+// the ones of the other events, so that they don't join the flows of the
+// syscalls, or of each other. Equal ids within a trace stay equal.
+func renumberIDs(traces [][]*Event, others ...[]*Event) {
+	var next uint64
+	for _, events := range others {
+		for _, e := range events {
+			next = max(next, e.Id)
+		}
+	}
+	for _, events := range traces {
+		ids := make(map[uint64]uint64)
+		for _, e := range events {
+			if e.Id == 0 {
+				continue
+			}
+			if ids[e.Id] == 0 {
+				next++
+				ids[e.Id] = next
+			}
+			e.Id = ids[e.Id]
+		}
+	}
+}
+
+func jsonNumber(n json.Number) float64 {
+	f, _ := n.Float64()
+	return f
+}
+
+// chromeEventID decodes the id of an async or flow event, which is either a
+// number or a (usually hexadecimal) string.
+func chromeEventID(raw json.RawMessage) uint64 {
+	if len(raw) == 0 {
+		return 0
+	}
+	var n uint64
+	if err := json.Unmarshal(raw, &n); err == nil {
+		return n
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return 0
+	}
+	n, err := strconv.ParseUint(s, 0, 64)
+	if err != nil {
+		n, _ = strconv.ParseUint(s, 16, 64)
+	}
+	return n
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+const traceProcessorBinary = "trace_processor_shell"
+
+// metricQuery is an SQL query run against the saved trace with Perfetto's
+// trace processor.
+type metricQuery struct {
+	name string
+	sql  string
+}
+
+var defaultMetricQueries = []metricQuery{
+	{
+		name: "syscalls by total time",
+		sql: `SELECT name, COUNT(*) AS calls, SUM(dur) / 1000 AS total_us, MAX(dur) / 1000 AS max_us
+FROM slice
+WHERE category IN ('successful', 'failed', 'detached')
+GROUP BY name
+ORDER BY SUM(dur) DESC
+LIMIT 20`,
+	},
+	{
+		name: "failed syscalls",
+		sql: `SELECT name, COUNT(*) AS errors
+FROM slice
+WHERE category = 'failed'
+GROUP BY name
+ORDER BY errors DESC
+LIMIT 20`,
+	},
+	{
+		name: "syscall time by process",
+		sql: `SELECT process.pid, process.name, COUNT(slice.id) AS syscalls, SUM(slice.dur) / 1000 AS total_us
+FROM slice
+JOIN thread_track ON slice.track_id = thread_track.id
+JOIN thread USING (utid)
+LEFT JOIN process USING (upid)
+WHERE slice.category IN ('successful', 'failed', 'detached')
+GROUP BY upid
+ORDER BY total_us DESC
+LIMIT 20`,
+	},
+}
+
+// metricQueries returns the queries selected by the -metrics flag: "default"
+// for the built-in ones, and/or paths to .sql files, separated by commas.
+func metricQueries(spec string) ([]metricQuery, error) {
+	var queries []metricQuery
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		if name == "default" {
+			queries = append(queries, defaultMetricQueries...)
+			continue
+		}
+		sql, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		queries = append(queries, metricQuery{
+			name: path.Base(name),
+			sql:  string(sql),
+		})
+	}
+	return queries, nil
+}
+
+// runMetrics runs the queries against a saved trace with trace_processor_shell
+// and returns their results as text tables.
+func runMetrics(trace string, queries []metricQuery) (string, error) {
+	binary, err := exec.LookPath(traceProcessorBinary)
+	if err != nil {
+		return "", fmt.Errorf("%s not found in PATH: %w", traceProcessorBinary, err)
+	}
+	var results strings.Builder
+	for _, query := range queries {
+		out, err := runTraceProcessorQuery(binary, trace, query.sql)
+		if err != nil {
+			return "", fmt.Errorf("query %q: %w", query.name, err)
+		}
+		fmt.Fprintf(&results, "### %s\n%s\n", query.name, out)
+	}
+	return results.String(), nil
+}
+
+func runTraceProcessorQuery(binary, trace, sql string) ([]byte, error) {
+	queryFile, err := os.CreateTemp("", "query*.sql")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(queryFile.Name())
+	_, err = queryFile.WriteString(sql)
+	queryFile.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(binary, "-q", queryFile.Name(), trace)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return out, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	networkPid = pidMaxLimit + 4
+
+	// networkInterval is how often the interface counters are read. They
+	// are cumulative, so a coarser interval only smooths the throughput.
+	networkInterval = 10 * time.Millisecond
+)
+
+// netDevSample is a reading of the byte counters of every interface.
+type netDevSample struct {
+	ts time.Time
+	rx map[string]uint64
+	tx map[string]uint64
+}
+
+// NetworkMonitor samples the byte counters of the network interfaces in the
+// network namespace of the traced process, so that network-bound phases show
+// up next to the connect/read/write syscalls.
+type NetworkMonitor struct {
+	mu      sync.Mutex
+	samples []netDevSample
+}
+
+// NewNetworkMonitor returns a new network monitor.
+func NewNetworkMonitor() *NetworkMonitor {
+	return &NetworkMonitor{}
+}
+
+// Run samples /proc/<pid>/net/dev, the interfaces of the network namespace of
+// pid, until ctx is done or pid exits.
+func (m *NetworkMonitor) Run(ctx context.Context, pid int) {
+	timer := time.NewTicker(networkInterval)
+	defer timer.Stop()
+	p := fmt.Sprintf("/proc/%d/net/dev", pid)
+	for {
+		rx, tx, err := readNetDev(p)
+		if err != nil {
+			return
+		}
+		m.mu.Lock()
+		m.samples = append(m.samples, netDevSample{ts: time.Now(), rx: rx, tx: tx})
+		m.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// Events returns rx and tx throughput counters, in bytes per second, for the
+// interfaces that had any traffic, in a "Network" process.
+func (m *NetworkMonitor) Events() []*Event {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.samples) < 2 {
+		return nil
+	}
+	first, last := m.samples[0], m.samples[len(m.samples)-1]
+	var ifaces []string
+	for iface := range last.rx {
+		if last.rx[iface] != first.rx[iface] || last.tx[iface] != first.tx[iface] {
+			ifaces = append(ifaces, iface)
+		}
+	}
+	if len(ifaces) == 0 {
+		return nil
+	}
+	sort.Strings(ifaces)
+
+	events := []*Event{
+		{
+			Name: "process_name",
+			Ph:   "M",
+			Cat:  "__metadata",
+			Pid:  networkPid,
+			Tid:  networkPid,
+			Args: Args{
+				Name: "Network",
+			},
+		},
+	}
+	for i := 1; i < len(m.samples); i++ {
+		prev, cur := m.samples[i-1], m.samples[i]
+		seconds := cur.ts.Sub(prev.ts).Seconds()
+		for _, iface := range ifaces {
+			events = append(events, &Event{
+				Name: iface,
+				Ph:   "C",
+				Pid:  networkPid,
+				Tid:  networkPid,
+				Ts:   cur.ts.UnixMicro(),
+				Args: Args{
+					Counters: map[string]float64{
+						"rx bytes/s": counterRate(prev.rx[iface], cur.rx[iface], seconds),
+						"tx bytes/s": counterRate(prev.tx[iface], cur.tx[iface], seconds),
+					},
+				},
+			})
+		}
+	}
+	return events
+}
+
+// readNetDev reads the received and transmitted bytes of every interface from
+// a /proc/net/dev file.
+func readNetDev(p string) (map[string]uint64, map[string]uint64, error) {
+	contents, err := os.ReadFile(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	rx := make(map[string]uint64)
+	tx := make(map[string]uint64)
+	// The first two lines are headers; the counters follow the interface
+	// name, the received bytes first and the transmitted bytes 9th.
+	for _, line := range strings.Split(strings.TrimSpace(string(contents)), "\n") {
+		iface, counters, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(counters)
+		if len(fields) < 9 {
+			continue
+		}
+		iface = strings.TrimSpace(iface)
+		if rx[iface], err = parseUint64(fields[0]); err != nil {
+			return nil, nil, fmt.Errorf("parse %s: %w", p, err)
+		}
+		if tx[iface], err = parseUint64(fields[8]); err != nil {
+			return nil, nil, fmt.Errorf("parse %s: %w", p, err)
+		}
+	}
+	return rx, tx, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"regexp"
+)
+
+var (
+	reNixStorePath = `/nix/store/[0-9a-df-np-sv-z]{32}-([^/"\s]+)((?:/[^"\s]*)?)` // derivation,subpath
+	reNixVersion   = `^(.+?)-(\d.*)$`                                             // name,version
+
+	regexpNixStorePath = regexp.MustCompile(reNixStorePath)
+	regexpNixVersion   = regexp.MustCompile(reNixVersion)
+)
+
+// annotateNixPaths adds the name and version of the Nix derivation to the
+// events whose arguments refer to a /nix/store path, or whose fd is one of a
+// /nix/store path (strace -yy), along with the path stripped of its hash,
+// which is otherwise nearly unreadable.
+func annotateNixPaths(events []*Event) {
+	for _, e := range events {
+		m := regexpNixStorePath.FindStringSubmatch(e.Args.First)
+		if len(m) != 3 {
+			fdPath, _ := e.Args.Data["fd_path"].(string)
+			m = regexpNixStorePath.FindStringSubmatch(fdPath)
+		}
+		if len(m) != 3 {
+			continue
+		}
+		name, version := parseNixDerivation(m[1])
+		if e.Args.Data == nil {
+			e.Args.Data = make(map[string]any)
+		}
+		e.Args.Data["nix_package"] = name
+		if version != "" {
+			e.Args.Data["nix_version"] = version
+		}
+		e.Args.Data["nix_path"] = m[1] + m[2]
+	}
+}
+
+// parseNixDerivation splits a derivation name like "python3-3.10.8" into its
+// package name and version, following Nix's convention that the version
+// starts at the first dash followed by a digit.
+func parseNixDerivation(derivation string) (name, version string) {
+	m := regexpNixVersion.FindStringSubmatch(derivation)
+	if len(m) != 3 {
+		return derivation, ""
+	}
+	return m[1], m[2]
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"time"
+)
+
+// memoryEvents are the counters of a cgroup's memory.events: the times its
+// memory usage hit memory.max and had to be reclaimed, the times it ran out
+// of memory anyway, and the processes the OOM killer killed in it.
+type memoryEvents struct {
+	max, oom, oomKill uint64
+}
+
+func readMemoryEvents(cgroupPath string) (memoryEvents, error) {
+	var e memoryEvents
+	err := readFlatKeyed(path.Join(cgroupPath, "memory.events"), map[string]*uint64{
+		"max":      &e.max,
+		"oom":      &e.oom,
+		"oom_kill": &e.oomKill,
+	})
+	return e, err
+}
+
+// oomKillSlack is how long after the sample that counted an OOM kill the
+// killed process can be seen exiting: it frees its memory first.
+const oomKillSlack = time.Second
+
+// OOMRisk returns the intervals during which the anonymous memory of the
+// cgroup was above thresholdPercent of memory.max, each as a warning instant
+// at its start and a slice shading it, along with a summary warning. Nothing
+// is returned if the cgroup has no memory limit.
+func (r *ResourceMonitor) OOMRisk(thresholdPercent float64) ([]*Event, []string) {
+	if r.memoryMax == 0 || r.memoryMax == ^uint64(0) || thresholdPercent <= 0 {
+		return nil, nil
+	}
+	threshold := uint64(float64(r.memoryMax) * thresholdPercent / 100)
+
+	var events []*Event
+	var current *Event
+	var peak uint64
+	for _, sample := range r.samples {
+		ts := r.sampleTs(sample)
+		if sample.memory > peak {
+			peak = sample.memory
+		}
+		if sample.memory < threshold {
+			current = nil
+			continue
+		}
+		if current == nil {
+			events = append(events, &Event{
+				Name:  fmt.Sprintf("memory above %.0f%% of limit", thresholdPercent),
+				Cat:   "warning",
+				Ph:    "i",
+				Scope: "g",
+				Ts:    ts,
+				Args: Args{
+					Data: map[string]any{
+						"memory_bytes": sample.memory,
+						"limit_bytes":  r.memoryMax,
+					},
+				},
+			})
+			current = &Event{
+				Name: "near memory limit",
+				Cat:  "warning",
+				Ph:   "X",
+				Ts:   ts,
+				Args: Args{
+					Data: map[string]any{
+						"peak_bytes":  sample.memory,
+						"limit_bytes": r.memoryMax,
+					},
+				},
+			}
+			events = append(events, current)
+		}
+		current.Dur = ts - current.Ts
+		if sample.memory > current.Args.Data["peak_bytes"].(uint64) {
+			current.Args.Data["peak_bytes"] = sample.memory
+		}
+	}
+	if len(events) == 0 {
+		return nil, nil
+	}
+	warning := fmt.Sprintf("Memory usage went above %.0f%% of the %.1f MiB limit %d time(s), peaking at %.1f MiB",
+		thresholdPercent, float64(r.memoryMax)/(1<<20), len(events)/2, float64(peak)/(1<<20))
+	return events, []string{warning}
+}
+
+// MemoryEvents returns an alert for each sample in which the memory.events
+// counters of the cgroup went up: its memory hit memory.max, it ran out of
+// memory, or the OOM killer killed a process. The traced processes killed by
+// SIGKILL then were the ones killed: their lifetimes are renamed "lifetime
+// (OOM killed)". Warnings sum it up.
+func (r *ResourceMonitor) MemoryEvents(syscallEvents []*Event) ([]*Event, []string) {
+	type interval struct {
+		start, end int64
+	}
+	var events []*Event
+	var kills []interval
+	var total memoryEvents
+	for i := 1; i < len(r.samples); i++ {
+		prev, cur := r.samples[i-1].oom, r.samples[i].oom
+		ts := r.sampleTs(r.samples[i])
+		counters := []struct {
+			name string
+			n    uint64
+		}{
+			{"memory.max hit", counterDelta(prev.max, cur.max)},
+			{"out of memory", counterDelta(prev.oom, cur.oom)},
+			{"OOM kill", counterDelta(prev.oomKill, cur.oomKill)},
+		}
+		for _, c := range counters {
+			if c.n == 0 {
+				continue
+			}
+			events = append(events, &Event{
+				Name:  c.name,
+				Cat:   "alert",
+				Ph:    "i",
+				Scope: "g",
+				Ts:    ts,
+				Args: Args{
+					Data: map[string]any{"count": c.n},
+				},
+			})
+		}
+		total.max += counters[0].n
+		total.oom += counters[1].n
+		total.oomKill += counters[2].n
+		if counters[2].n > 0 {
+			kills = append(kills, interval{r.sampleTs(r.samples[i-1]), ts + oomKillSlack.Microseconds()})
+		}
+	}
+	if total == (memoryEvents{}) {
+		return nil, nil
+	}
+	warnings := []string{fmt.Sprintf("The memory of the cgroup hit memory.max %d time(s), ran out %d time(s), and the OOM killer killed %d process(es)",
+		total.max, total.oom, total.oomKill)}
+
+	begins := make(map[int]*Event) // [tid]
+	var killed []int
+	for _, e := range syscallEvents {
+		if e.Cat != "lifetime" {
+			continue
+		}
+		if e.Ph == "B" {
+			begins[e.Tid] = e
+			continue
+		}
+		inKill := slices.ContainsFunc(kills, func(k interval) bool {
+			return e.Ts >= k.start && e.Ts <= k.end
+		})
+		if e.Args.Data["signal"] != "SIGKILL" || !inKill {
+			continue
+		}
+		e.Args.Data["oom_killed"] = true
+		if begin := begins[e.Tid]; begin != nil {
+			begin.Name = "lifetime (OOM killed)"
+		}
+		if !slices.Contains(killed, e.Pid) {
+			killed = append(killed, e.Pid)
+			warnings = append(warnings, fmt.Sprintf("Process %d was killed by the OOM killer", e.Pid))
+		}
+	}
+	return events, warnings
+}
+
+// counterDelta returns how much a cumulative counter went up.
+func counterDelta(prev, cur uint64) uint64 {
+	if cur < prev {
+		return 0
+	}
+	return cur - prev
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// otlpBatchSize is the number of spans sent per OTLP request, below the
+// default request size limit of the collectors.
+const otlpBatchSize = 2000
+
+// The OTLP/HTTP JSON encoding of the trace export request
+// (opentelemetry/proto/collector/trace/v1), with just the fields we set.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name       string          `json:"name"`
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+func otlpString(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: &value}}
+}
+
+func otlpInt(key string, value int) otlpAttribute {
+	v := strconv.Itoa(value)
+	return otlpAttribute{Key: key, Value: otlpValue{IntValue: &v}}
+}
+
+const (
+	otlpSpanKindInternal = 1
+	otlpStatusError      = 2
+)
+
+// otlpBatches converts the syscalls to OTLP spans, all in one trace: each
+// process is a resource, each of its threads an instrumentation scope, and
+// each syscall a span, in requests of at most otlpBatchSize spans. Each
+// process and each thread also is a span, from its first syscall to its last,
+// the process span the parent of its thread spans, and each thread span the
+// parent of its syscall spans, so that the trace views nest them.
+func otlpBatches(events []*Event) []otlpRequest {
+	processNames := make(map[int]string)
+	threadNames := make(map[int]string)
+	for _, e := range events {
+		switch {
+		case e.Ph == "M" && e.Name == "process_name":
+			processNames[e.Pid] = e.Args.Name
+		case e.Ph == "M" && e.Name == "thread_name":
+			threadNames[e.Tid] = e.Args.Name
+		}
+	}
+	traceID := randomHex(16)
+
+	var requests []otlpRequest
+	spans := make(map[int]map[int][]otlpSpan) // [pid][tid]
+	count := 0
+	flush := func() {
+		var req otlpRequest
+		pids := make([]int, 0, len(spans))
+		for pid := range spans {
+			pids = append(pids, pid)
+		}
+		sort.Ints(pids)
+		for _, pid := range pids {
+			rs := otlpResourceSpans{Resource: otlpResource{Attributes: []otlpAttribute{
+				otlpString("service.name", stackFrameName(processNames[pid], "pid", pid)),
+				otlpInt("process.pid", pid),
+			}}}
+			tids := make([]int, 0, len(spans[pid]))
+			for tid := range spans[pid] {
+				tids = append(tids, tid)
+			}
+			sort.Ints(tids)
+			for _, tid := range tids {
+				rs.ScopeSpans = append(rs.ScopeSpans, otlpScopeSpans{
+					Scope: otlpScope{
+						Name:       stackFrameName(threadNames[tid], "tid", tid),
+						Attributes: []otlpAttribute{otlpInt("thread.id", tid)},
+					},
+					Spans: spans[pid][tid],
+				})
+			}
+			req.ResourceSpans = append(req.ResourceSpans, rs)
+		}
+		requests = append(requests, req)
+		spans = make(map[int]map[int][]otlpSpan)
+		count = 0
+	}
+	add := func(pid, tid int, span otlpSpan) {
+		if spans[pid] == nil {
+			spans[pid] = make(map[int][]otlpSpan)
+		}
+		spans[pid][tid] = append(spans[pid][tid], span)
+		count++
+		if count == otlpBatchSize {
+			flush()
+		}
+	}
+
+	// The processes and threads, spanning their syscalls and lifetimes.
+	type extent struct {
+		pid        int
+		start, end int64
+		spanID     string
+	}
+	processes := make(map[int]*extent) // [pid]
+	threads := make(map[int]*extent)   // [tid]
+	var pids, tids []int
+	for _, e := range events {
+		if !isSyscall(e) && e.Cat != "lifetime" {
+			continue
+		}
+		if p := processes[e.Pid]; p == nil {
+			processes[e.Pid] = &extent{pid: e.Pid, start: e.TsNanos(), end: e.EndNanos(), spanID: randomHex(8)}
+			pids = append(pids, e.Pid)
+		} else {
+			p.start, p.end = min(p.start, e.TsNanos()), max(p.end, e.EndNanos())
+		}
+		if t := threads[e.Tid]; t == nil {
+			threads[e.Tid] = &extent{pid: e.Pid, start: e.TsNanos(), end: e.EndNanos(), spanID: randomHex(8)}
+			tids = append(tids, e.Tid)
+		} else {
+			t.start, t.end = min(t.start, e.TsNanos()), max(t.end, e.EndNanos())
+		}
+	}
+	for _, pid := range pids {
+		p := processes[pid]
+		add(pid, pid, otlpSpan{
+			TraceID:           traceID,
+			SpanID:            p.spanID,
+			Name:              stackFrameName(processNames[pid], "pid", pid),
+			Kind:              otlpSpanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(p.start, 10),
+			EndTimeUnixNano:   strconv.FormatInt(p.end, 10),
+			Attributes:        []otlpAttribute{otlpInt("process.pid", pid)},
+		})
+	}
+	for _, tid := range tids {
+		t := threads[tid]
+		add(t.pid, tid, otlpSpan{
+			TraceID:           traceID,
+			SpanID:            t.spanID,
+			ParentSpanID:      processes[t.pid].spanID,
+			Name:              stackFrameName(threadNames[tid], "tid", tid),
+			Kind:              otlpSpanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(t.start, 10),
+			EndTimeUnixNano:   strconv.FormatInt(t.end, 10),
+			Attributes:        []otlpAttribute{otlpInt("thread.id", tid)},
+		})
+	}
+
+	for _, e := range events {
+		if !isSyscall(e) {
+			continue
+		}
+		span := otlpSpan{
+			TraceID:           traceID,
+			SpanID:            randomHex(8),
+			ParentSpanID:      threads[e.Tid].spanID,
+			Name:              e.Name,
+			Kind:              otlpSpanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(e.TsNanos(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(e.EndNanos(), 10),
+			Attributes: []otlpAttribute{
+				otlpString("syscall.args", e.Args.First+e.Args.Second),
+				otlpString("syscall.return_value", e.Args.ReturnValue),
+				otlpString("syscall.status", e.Cat),
+			},
+		}
+		if e.Cat == "failed" {
+			span.Status = otlpStatus{Code: otlpStatusError, Message: e.Args.ReturnValue}
+		}
+		add(e.Pid, e.Tid, span)
+	}
+	if count > 0 {
+		flush()
+	}
+	return requests
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// exportOTLP sends the syscalls as spans to an OTLP/HTTP endpoint, such as
+// an OpenTelemetry collector or Jaeger / Tempo with OTLP enabled, and
+// returns the number of spans sent.
+func exportOTLP(endpoint string, events []*Event) (int, error) {
+	url := strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url += "/v1/traces"
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	sent := 0
+	for _, req := range otlpBatches(events) {
+		body, err := json.Marshal(req)
+		if err != nil {
+			return sent, err
+		}
+		resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return sent, err
+		}
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return sent, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+		}
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				sent += len(ss.Spans)
+			}
+		}
+	}
+	return sent, nil
+}
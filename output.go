@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// progressf prints what the tool is doing, unless -quiet.
+func progressf(format string, args ...any) {
+	if !*flagQuiet {
+		fmt.Printf(format, args...)
+	}
+}
+
+// verbosef logs the details that are only worth seeing with -verbose.
+func verbosef(format string, args ...any) {
+	if *flagVerbose {
+		log.Printf(format, args...)
+	}
+}
+
+// straceStderr returns where the stderr of strace and the traced command
+// goes: the terminal, unless -quiet.
+func straceStderr() io.Writer {
+	if *flagQuiet {
+		return io.Discard
+	}
+	return os.Stderr
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+)
+
+// parseCategoryNames are the names parseOnly reports the categories of the
+// parsed lines under.
+var parseCategoryNames = map[string]string{
+	"successful":  "syscalls",
+	"failed":      "failed syscalls",
+	"unfinished":  "unfinished",
+	"detached":    "resumed",
+	"lifetime":    "exits",
+	"signal":      "signals",
+	"stack":       "stack frames",
+	"personality": "personality changes",
+}
+
+// parseOnly parses an strace output file, or the -ff files of a prefix, and
+// prints how much of it was parsed without converting it. It exits with 1
+// when lines were left out, to check changes to the parser against recorded
+// outputs.
+func parseOnly(input string) {
+	var r io.Reader
+	if *flagFF {
+		var err error
+		r, err = perPidOutput(input)
+		if err != nil {
+			log.Fatalf("[!] Error reading strace -ff output: %s\n", err)
+		}
+	} else {
+		f, err := os.Open(input)
+		if err != nil {
+			log.Fatalf("[!] Error opening strace file: %s\n", err)
+		}
+		defer f.Close()
+		r = f
+	}
+	progressf("[+] Parsing %s\n", input)
+	events, stats := parseStrace(r)
+	fmt.Printf("[+] %d lines, %d events\n", stats.Lines, len(events))
+
+	categories := make([]string, 0, len(stats.Categories))
+	for c := range stats.Categories {
+		categories = append(categories, c)
+	}
+	sort.Slice(categories, func(i, j int) bool {
+		ci, cj := stats.Categories[categories[i]], stats.Categories[categories[j]]
+		if ci != cj {
+			return ci > cj
+		}
+		return categories[i] < categories[j]
+	})
+	for _, c := range categories {
+		name := parseCategoryNames[c]
+		if name == "" {
+			name = c
+		}
+		fmt.Printf("    %-28s %10d\n", name, stats.Categories[c])
+	}
+	fmt.Printf("    %-28s %10d\n", "unparsed", stats.Unparsed)
+	fmt.Printf("    %-28s %10d\n", "too long", stats.TooLong)
+	fmt.Printf("    %-28s %10d\n", "unfinished, never resumed", stats.Unresumed)
+	fmt.Printf("    %-28s %10d\n", "resumed, start not seen", stats.Orphaned)
+	if stats.Unparsed > 0 || stats.TooLong > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,601 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Field numbers and enum values of the Perfetto trace protos
+// (https://github.com/google/perfetto/tree/master/protos/perfetto/trace).
+const (
+	traceFieldPacket = 1
+
+	packetFieldChromeEvents     = 5
+	packetFieldClockSnapshot    = 6
+	packetFieldTimestamp        = 8
+	packetFieldSequenceID       = 10
+	packetFieldTrackEvent       = 11
+	packetFieldInternedData     = 12
+	packetFieldSequenceFlags    = 13
+	packetFieldTimestampClockID = 58
+	packetFieldTrackDescriptor  = 60
+
+	seqIncrementalStateCleared = 1
+	seqNeedsIncrementalState   = 2
+
+	clockSnapshotFieldClocks       = 1
+	clockSnapshotFieldPrimaryClock = 2
+	clockFieldID                   = 1
+	clockFieldTimestamp            = 2
+
+	builtinClockRealtime  = 1
+	builtinClockMonotonic = 3
+	builtinClockBoottime  = 6
+
+	chromeEventsFieldMetadata = 2
+	chromeMetadataFieldName   = 1
+	chromeMetadataFieldString = 2
+
+	trackFieldUUID             = 1
+	trackFieldName             = 2
+	trackFieldProcess          = 3
+	trackFieldThread           = 4
+	trackFieldParentUUID       = 5
+	trackFieldCounter          = 8
+	trackFieldSiblingOrderRank = 12
+
+	processFieldPid    = 1
+	processFieldName   = 6
+	processFieldLabels = 8
+
+	threadFieldPid  = 1
+	threadFieldTid  = 2
+	threadFieldName = 5
+
+	trackEventFieldCategoryIids       = 3
+	trackEventFieldDebugAnnotations   = 4
+	trackEventFieldType               = 9
+	trackEventFieldNameIid            = 10
+	trackEventFieldTrackUUID          = 11
+	trackEventFieldDoubleCounterValue = 44
+	trackEventFieldFlowIDs            = 47
+	trackEventFieldTerminatingFlowIDs = 48
+
+	trackEventSliceBegin = 1
+	trackEventSliceEnd   = 2
+	trackEventInstant    = 3
+	trackEventCounter    = 4
+
+	internedFieldEventCategories      = 1
+	internedFieldEventNames           = 2
+	internedFieldDebugAnnotationNames = 3
+	internedFieldIid                  = 1
+	internedFieldName                 = 2
+
+	debugAnnotationFieldNameIid = 1
+	debugAnnotationFieldBool    = 2
+	debugAnnotationFieldInt     = 4
+	debugAnnotationFieldDouble  = 5
+	debugAnnotationFieldString  = 6
+
+	// perfettoSequenceID is the id of the only packet sequence this tool
+	// writes.
+	perfettoSequenceID = 1
+)
+
+// protoSlice is a slice being converted, with its end (in nanoseconds)
+// resolved from the matching end event for B/E and b/e pairs.
+type protoSlice struct {
+	e           *Event
+	end         int64
+	flows       []uint64
+	terminating []uint64
+}
+
+// protoEvent is a track event to be written, at ts nanoseconds.
+type protoEvent struct {
+	ts    int64
+	typ   uint64
+	track uint64
+	e     *Event
+	value float64
+	slice *protoSlice
+}
+
+// perfettoEncoder converts events to Perfetto TracePackets. Event names,
+// categories and arg names are interned, and every process, thread, async
+// slice stack and counter gets its own track descriptor.
+type perfettoEncoder struct {
+	w   io.Writer
+	buf []byte
+
+	trackUUIDs map[string]uint64
+	trackOrder []string
+	described  map[uint64]bool
+	interned   map[int]map[string]uint64
+
+	processNames map[int]string
+	processLabel map[int]string
+	threadNames  map[[2]int]string
+	sortIndexes  map[[2]int]int // [pid, tid], tid 0 for the process
+}
+
+func newPerfettoEncoder(w io.Writer) *perfettoEncoder {
+	return &perfettoEncoder{
+		w:            w,
+		trackUUIDs:   make(map[string]uint64),
+		described:    make(map[uint64]bool),
+		interned:     make(map[int]map[string]uint64),
+		processNames: make(map[int]string),
+		processLabel: make(map[int]string),
+		threadNames:  make(map[[2]int]string),
+		sortIndexes:  make(map[[2]int]int),
+	}
+}
+
+// SaveProto writes the trace as Perfetto protobuf TracePackets instead of
+// Chrome JSON. It loads faster in ui.perfetto.dev for large traces.
+func (te TraceEvents) SaveProto(output string) {
+	f, err := os.Create(output)
+	if err != nil {
+		log.Fatalf("[!] Error creating trace file: %s\n", err)
+	}
+	w := bufio.NewWriter(f)
+	p := newPerfettoEncoder(w)
+	if err := p.writeHeader(te.Metadata); err != nil {
+		log.Fatalf("[!] Error encoding events to protobuf: %s\n", err)
+	}
+	if err := p.writeEvents(te.Event); err != nil {
+		log.Fatalf("[!] Error encoding events to protobuf: %s\n", err)
+	}
+	if te.tail != nil {
+		if err := p.writeEvents(te.tail()); err != nil {
+			log.Fatalf("[!] Error encoding events to protobuf: %s\n", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatalf("[!] Error creating trace file: %s\n", err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatalf("[!] Error creating trace file: %s\n", err)
+	}
+}
+
+func (p *perfettoEncoder) writePacket(packet []byte) error {
+	p.buf = appendProtoBytes(p.buf[:0], traceFieldPacket, packet)
+	_, err := p.w.Write(p.buf)
+	return err
+}
+
+// writeHeader writes the clock snapshots, which make realtime (strace's
+// clock) the trace clock, and the metadata.
+func (p *perfettoEncoder) writeHeader(metadata map[string]any) error {
+	snapshots, _ := metadata["clockSnapshots"].([]ClockSnapshot)
+	now := TakeClockSnapshot()
+	if offset, ok := metadata["timestampOffset"].(int64); ok {
+		now, _ = now.rebase(offset)
+	}
+	snapshots = append(snapshots, now)
+	for i, s := range snapshots {
+		var snapshot []byte
+		for _, c := range []struct {
+			id uint64
+			ts uint64
+		}{
+			{builtinClockRealtime, s.Realtime},
+			{builtinClockMonotonic, s.Monotonic},
+			{builtinClockBoottime, s.Boottime},
+		} {
+			var clock []byte
+			clock = appendProtoVarint(clock, clockFieldID, c.id)
+			clock = appendProtoVarint(clock, clockFieldTimestamp, c.ts)
+			snapshot = appendProtoBytes(snapshot, clockSnapshotFieldClocks, clock)
+		}
+		snapshot = appendProtoVarint(snapshot, clockSnapshotFieldPrimaryClock, builtinClockRealtime)
+		var packet []byte
+		packet = appendProtoVarint(packet, packetFieldSequenceID, perfettoSequenceID)
+		if i == 0 {
+			packet = appendProtoVarint(packet, packetFieldSequenceFlags, seqIncrementalStateCleared)
+		}
+		packet = appendProtoBytes(packet, packetFieldClockSnapshot, snapshot)
+		if err := p.writePacket(packet); err != nil {
+			return err
+		}
+	}
+
+	if len(metadata) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(metadata))
+	for k := range metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var bundle []byte
+	for _, k := range keys {
+		v, err := json.Marshal(metadata[k])
+		if err != nil {
+			return err
+		}
+		var m []byte
+		m = appendProtoString(m, chromeMetadataFieldName, k)
+		m = appendProtoString(m, chromeMetadataFieldString, string(v))
+		bundle = appendProtoBytes(bundle, chromeEventsFieldMetadata, m)
+	}
+	var packet []byte
+	packet = appendProtoVarint(packet, packetFieldSequenceID, perfettoSequenceID)
+	packet = appendProtoBytes(packet, packetFieldChromeEvents, bundle)
+	return p.writePacket(packet)
+}
+
+// track returns the uuid of the track with the given key, allocating it the
+// first time.
+func (p *perfettoEncoder) track(key string) uint64 {
+	uuid, ok := p.trackUUIDs[key]
+	if !ok {
+		uuid = uint64(len(p.trackUUIDs) + 1)
+		p.trackUUIDs[key] = uuid
+		p.trackOrder = append(p.trackOrder, key)
+	}
+	return uuid
+}
+
+func processTrackKey(pid int) string {
+	return "p:" + strconv.Itoa(pid)
+}
+
+func (p *perfettoEncoder) threadTrack(pid, tid int) uint64 {
+	p.track(processTrackKey(pid))
+	return p.track(fmt.Sprintf("t:%d:%d", pid, tid))
+}
+
+func (p *perfettoEncoder) instantTrack(e *Event) uint64 {
+	switch e.Scope {
+	case "g":
+		return p.track("g")
+	case "p":
+		return p.track(processTrackKey(e.Pid))
+	}
+	return p.threadTrack(e.Pid, e.Tid)
+}
+
+// writeEvents converts and writes a batch of events.
+func (p *perfettoEncoder) writeEvents(events []*Event) error {
+	threadSlices := make(map[uint64][]*protoSlice)
+	asyncSlices := make(map[uint64][]*protoSlice)
+	openSlices := make(map[uint64][]*protoSlice)
+	asyncNames := make(map[uint64]string)
+	var out []protoEvent
+	var flows []*Event
+	var maxTs int64
+	for _, e := range events {
+		maxTs = max(maxTs, e.EndNanos())
+		switch e.Ph {
+		case "M":
+			switch e.Name {
+			case "process_name":
+				p.processNames[e.Pid] = e.Args.Name
+			case "process_labels":
+				p.processLabel[e.Pid] = e.Args.Labels
+			case "thread_name":
+				p.threadNames[[2]int{e.Pid, e.Tid}] = e.Args.Name
+			case "process_sort_index":
+				p.sortIndexes[[2]int{e.Pid, 0}] = e.Args.SortIndex
+			case "thread_sort_index":
+				p.sortIndexes[[2]int{e.Pid, e.Tid}] = e.Args.SortIndex
+			}
+		case "X":
+			track := p.threadTrack(e.Pid, e.Tid)
+			threadSlices[track] = append(threadSlices[track], &protoSlice{e: e, end: e.EndNanos()})
+		case "B":
+			track := p.threadTrack(e.Pid, e.Tid)
+			s := &protoSlice{e: e, end: -1}
+			threadSlices[track] = append(threadSlices[track], s)
+			openSlices[track] = append(openSlices[track], s)
+		case "b":
+			p.track(processTrackKey(e.Pid))
+			track := p.track(fmt.Sprintf("a:%d:%s:%d", e.Pid, e.Cat, e.Id))
+			if _, ok := asyncNames[track]; !ok {
+				asyncNames[track] = e.Name
+			}
+			s := &protoSlice{e: e, end: -1}
+			asyncSlices[track] = append(asyncSlices[track], s)
+			openSlices[track] = append(openSlices[track], s)
+		case "E", "e":
+			var track uint64
+			if e.Ph == "E" {
+				track = p.threadTrack(e.Pid, e.Tid)
+			} else {
+				track = p.track(fmt.Sprintf("a:%d:%s:%d", e.Pid, e.Cat, e.Id))
+			}
+			stack := openSlices[track]
+			if len(stack) == 0 {
+				continue
+			}
+			stack[len(stack)-1].end = e.TsNanos()
+			openSlices[track] = stack[:len(stack)-1]
+		case "i", "I":
+			out = append(out, protoEvent{ts: e.TsNanos(), typ: trackEventInstant, track: p.instantTrack(e), e: e})
+		case "C":
+			p.track(processTrackKey(e.Pid))
+			keys := make([]string, 0, len(e.Args.Counters))
+			for k := range e.Args.Counters {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				track := p.track(fmt.Sprintf("c:%d:%s %s", e.Pid, e.Name, k))
+				out = append(out, protoEvent{ts: e.TsNanos(), typ: trackEventCounter, track: track, value: e.Args.Counters[k]})
+			}
+		case "s", "t", "f":
+			flows = append(flows, e)
+		}
+	}
+	// Slices still open at the end of the trace end with it.
+	for _, stack := range openSlices {
+		for _, s := range stack {
+			s.end = maxTs
+		}
+	}
+	p.bindFlows(flows, threadSlices)
+
+	for _, slices := range []map[uint64][]*protoSlice{threadSlices, asyncSlices} {
+		tracks := make([]uint64, 0, len(slices))
+		for track := range slices {
+			tracks = append(tracks, track)
+		}
+		sort.Slice(tracks, func(i, j int) bool { return tracks[i] < tracks[j] })
+		for _, track := range tracks {
+			out = append(out, nestSlices(track, slices[track])...)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].ts < out[j].ts
+	})
+
+	if err := p.writeDescriptors(asyncNames); err != nil {
+		return err
+	}
+	for _, ev := range out {
+		if err := p.writeTrackEvent(ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bindFlows attaches the flow events to the slices they belong to: the
+// innermost slice enclosing them, or for flow ends outside any slice the next
+// slice of the thread.
+func (p *perfettoEncoder) bindFlows(flows []*Event, threadSlices map[uint64][]*protoSlice) {
+	for _, f := range flows {
+		slices := threadSlices[p.threadTrack(f.Pid, f.Tid)]
+		var bound *protoSlice
+		for _, s := range slices {
+			if s.e.TsNanos() > f.TsNanos() {
+				if bound == nil && f.Ph == "f" {
+					bound = s
+				}
+				break
+			}
+			if f.TsNanos() <= s.end {
+				bound = s
+			}
+		}
+		if bound == nil {
+			continue
+		}
+		if f.Ph == "f" {
+			bound.terminating = append(bound.terminating, f.Id)
+		} else {
+			bound.flows = append(bound.flows, f.Id)
+		}
+	}
+}
+
+// nestSlices turns the slices of a track, in the order they start, into
+// begin and end events. Slices that end after their parent are cut short, as
+// a track can only hold properly nested slices.
+func nestSlices(track uint64, slices []*protoSlice) []protoEvent {
+	var events []protoEvent
+	var stack []*protoSlice
+	pop := func() {
+		s := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		events = append(events, protoEvent{ts: s.end, typ: trackEventSliceEnd, track: track})
+	}
+	for _, s := range slices {
+		for len(stack) > 0 && stack[len(stack)-1].end <= s.e.TsNanos() {
+			pop()
+		}
+		if len(stack) > 0 && s.end > stack[len(stack)-1].end {
+			s.end = stack[len(stack)-1].end
+		}
+		events = append(events, protoEvent{ts: s.e.TsNanos(), typ: trackEventSliceBegin, track: track, e: s.e, slice: s})
+		stack = append(stack, s)
+	}
+	for len(stack) > 0 {
+		pop()
+	}
+	return events
+}
+
+// writeDescriptors writes the descriptors of the tracks that haven't been
+// described yet, processes first.
+func (p *perfettoEncoder) writeDescriptors(asyncNames map[uint64]string) error {
+	for _, key := range p.trackOrder {
+		uuid := p.trackUUIDs[key]
+		if p.described[uuid] {
+			continue
+		}
+		p.described[uuid] = true
+		var d []byte
+		d = appendProtoVarint(d, trackFieldUUID, uuid)
+		switch key[0] {
+		case 'p':
+			pid, _ := strconv.Atoi(key[2:])
+			var process []byte
+			process = appendProtoVarint(process, processFieldPid, uint64(pid))
+			if name := p.processNames[pid]; name != "" {
+				process = appendProtoString(process, processFieldName, name)
+			}
+			if label := p.processLabel[pid]; label != "" {
+				process = appendProtoString(process, processFieldLabels, label)
+			}
+			d = appendProtoBytes(d, trackFieldProcess, process)
+			if rank := p.sortIndexes[[2]int{pid, 0}]; rank != 0 {
+				d = appendProtoVarint(d, trackFieldSiblingOrderRank, uint64(rank))
+			}
+		case 't':
+			var pid, tid int
+			fmt.Sscanf(key, "t:%d:%d", &pid, &tid)
+			var thread []byte
+			thread = appendProtoVarint(thread, threadFieldPid, uint64(pid))
+			thread = appendProtoVarint(thread, threadFieldTid, uint64(tid))
+			if name := p.threadNames[[2]int{pid, tid}]; name != "" {
+				thread = appendProtoString(thread, threadFieldName, name)
+			}
+			d = appendProtoBytes(d, trackFieldThread, thread)
+			if rank := p.sortIndexes[[2]int{pid, tid}]; rank != 0 {
+				d = appendProtoVarint(d, trackFieldSiblingOrderRank, uint64(rank))
+			}
+		case 'a':
+			var pid int
+			fmt.Sscanf(key, "a:%d:", &pid)
+			d = appendProtoVarint(d, trackFieldParentUUID, p.trackUUIDs[processTrackKey(pid)])
+			d = appendProtoString(d, trackFieldName, asyncNames[uuid])
+		case 'c':
+			var pid int
+			fmt.Sscanf(key, "c:%d:", &pid)
+			d = appendProtoVarint(d, trackFieldParentUUID, p.trackUUIDs[processTrackKey(pid)])
+			d = appendProtoString(d, trackFieldName, key[len(fmt.Sprintf("c:%d:", pid)):])
+			d = appendProtoBytes(d, trackFieldCounter, nil)
+		case 'g':
+			d = appendProtoString(d, trackFieldName, "Global")
+		}
+		var packet []byte
+		packet = appendProtoVarint(packet, packetFieldSequenceID, perfettoSequenceID)
+		packet = appendProtoBytes(packet, packetFieldTrackDescriptor, d)
+		if err := p.writePacket(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// intern returns the interning id of a string, adding it to interned the
+// first time it's seen.
+func (p *perfettoEncoder) intern(interned *[]byte, field int, s string) uint64 {
+	ids := p.interned[field]
+	if ids == nil {
+		ids = make(map[string]uint64)
+		p.interned[field] = ids
+	}
+	iid, ok := ids[s]
+	if !ok {
+		iid = uint64(len(ids) + 1)
+		ids[s] = iid
+		var entry []byte
+		entry = appendProtoVarint(entry, internedFieldIid, iid)
+		entry = appendProtoString(entry, internedFieldName, s)
+		*interned = appendProtoBytes(*interned, field, entry)
+	}
+	return iid
+}
+
+func (p *perfettoEncoder) writeTrackEvent(ev protoEvent) error {
+	var interned, te []byte
+	te = appendProtoVarint(te, trackEventFieldType, ev.typ)
+	te = appendProtoVarint(te, trackEventFieldTrackUUID, ev.track)
+	if ev.e != nil {
+		te = appendProtoVarint(te, trackEventFieldNameIid, p.intern(&interned, internedFieldEventNames, ev.e.Name))
+		if ev.e.Cat != "" {
+			te = appendProtoVarint(te, trackEventFieldCategoryIids, p.intern(&interned, internedFieldEventCategories, ev.e.Cat))
+		}
+		te = p.appendArgs(te, &interned, ev.e.Args, ev.e.Stack)
+	}
+	if ev.typ == trackEventCounter {
+		te = appendProtoDouble(te, trackEventFieldDoubleCounterValue, ev.value)
+	}
+	if ev.slice != nil {
+		for _, id := range ev.slice.flows {
+			te = appendProtoFixed64(te, trackEventFieldFlowIDs, id)
+		}
+		for _, id := range ev.slice.terminating {
+			te = appendProtoFixed64(te, trackEventFieldTerminatingFlowIDs, id)
+		}
+	}
+
+	var packet []byte
+	packet = appendProtoVarint(packet, packetFieldTimestamp, uint64(ev.ts))
+	packet = appendProtoVarint(packet, packetFieldTimestampClockID, builtinClockRealtime)
+	packet = appendProtoVarint(packet, packetFieldSequenceID, perfettoSequenceID)
+	packet = appendProtoVarint(packet, packetFieldSequenceFlags, seqNeedsIncrementalState)
+	if len(interned) > 0 {
+		packet = appendProtoBytes(packet, packetFieldInternedData, interned)
+	}
+	packet = appendProtoBytes(packet, packetFieldTrackEvent, te)
+	return p.writePacket(packet)
+}
+
+// appendArgs adds the args and the stack of an event as debug annotations.
+func (p *perfettoEncoder) appendArgs(te []byte, interned *[]byte, args Args, stack []string) []byte {
+	annotate := func(name string, v any) {
+		var a []byte
+		a = appendProtoVarint(a, debugAnnotationFieldNameIid, p.intern(interned, internedFieldDebugAnnotationNames, name))
+		switch v := v.(type) {
+		case string:
+			a = appendProtoString(a, debugAnnotationFieldString, v)
+		case bool:
+			b := uint64(0)
+			if v {
+				b = 1
+			}
+			a = appendProtoVarint(a, debugAnnotationFieldBool, b)
+		case int:
+			a = appendProtoVarint(a, debugAnnotationFieldInt, uint64(v))
+		case uint64:
+			a = appendProtoVarint(a, debugAnnotationFieldInt, v)
+		case float64:
+			a = appendProtoDouble(a, debugAnnotationFieldDouble, v)
+		default:
+			b, _ := json.Marshal(v)
+			a = appendProtoString(a, debugAnnotationFieldString, string(b))
+		}
+		te = appendProtoBytes(te, trackEventFieldDebugAnnotations, a)
+	}
+	if args.Name != "" {
+		annotate("name", args.Name)
+	}
+	if args.First != "" && !args.Parsed() {
+		annotate("first", args.First)
+	}
+	if args.Second != "" && !args.Parsed() {
+		annotate("second", args.Second)
+	}
+	if args.ReturnValue != "" {
+		annotate("returnValue", args.ReturnValue)
+	}
+	if args.DetachedDur != 0 {
+		annotate("detachedDur", args.DetachedDur)
+	}
+	keys := make([]string, 0, len(args.Data))
+	for k := range args.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		annotate(k, args.Data[k])
+	}
+	if len(stack) > 0 {
+		annotate("stack", strings.Join(stack, "\n"))
+	}
+	return te
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/replit/strace-perfetto/pkg/traceconv"
+)
+
+// perPidFiles returns the files strace -ff wrote for the output file prefix,
+// one prefix.PID file per traced thread, by pid.
+func perPidFiles(prefix string) (map[int]string, error) {
+	matches, err := filepath.Glob(prefix + ".*")
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[int]string)
+	for _, m := range matches {
+		pid, err := strconv.Atoi(strings.TrimPrefix(m, prefix+"."))
+		if err == nil && pid > 0 {
+			files[pid] = m
+		}
+	}
+	return files, nil
+}
+
+// perPidRecord is a line of a strace -ff file, along with the lines that
+// continue it, such as the stack printed by -k.
+type perPidRecord struct {
+	sec, ns int64
+	pid     int
+	lines   string
+}
+
+// perPidOutput reads the files strace -ff wrote for the output file prefix
+// and returns their content in the format of strace -f: the lines of all the
+// threads in timestamp order, each prefixed with the pid of its thread.
+func perPidOutput(prefix string) (io.Reader, error) {
+	files, err := perPidFiles(prefix)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no %s.PID files found", prefix)
+	}
+	var records []perPidRecord
+	for pid, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		scanner := traceconv.NewLineScanner(f, int(flagMaxLineSize))
+		for scanner.Scan() {
+			line := scanner.Text()
+			sec, ns, ok := lineTimestamp(line)
+			if !ok {
+				if len(records) > 0 && records[len(records)-1].pid == pid {
+					records[len(records)-1].lines += "\n" + line
+				}
+				continue
+			}
+			records = append(records, perPidRecord{sec: sec, ns: ns, pid: pid, lines: strconv.Itoa(pid) + " " + line})
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", file, err)
+		}
+		if n := scanner.TooLong(); n > 0 {
+			log.Printf("[!] %d lines of %s longer than %s were left out, raise -max-line-size", n, file, &flagMaxLineSize)
+		}
+	}
+	// Each file is in order already, the stable sort keeps it that way for
+	// the lines with the same timestamp.
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].sec != records[j].sec {
+			return records[i].sec < records[j].sec
+		}
+		return records[i].ns < records[j].ns
+	})
+	var b bytes.Buffer
+	for _, r := range records {
+		b.WriteString(r.lines)
+		b.WriteByte('\n')
+	}
+	return &b, nil
+}
+
+// lineTimestamp parses the -ttt timestamp a line of strace output starts
+// with, in seconds and nanoseconds.
+func lineTimestamp(line string) (int64, int64, bool) {
+	field, _, _ := strings.Cut(line, " ")
+	sec, frac, ok := strings.Cut(field, ".")
+	if !ok {
+		return 0, 0, false
+	}
+	s, err := strconv.ParseInt(sec, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	ns, err := strconv.ParseInt((frac + "000000000")[:9], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return s, ns, true
+}
+
+// removePerPidFiles removes the files strace -ff wrote for the output file
+// prefix.
+func removePerPidFiles(prefix string) {
+	files, _ := perPidFiles(prefix)
+	for _, file := range files {
+		os.Remove(file)
+	}
+}
+
+// perPidArgs returns the strace args with -f replaced by -ff.
+func perPidArgs(args []string) []string {
+	ff := make([]string, len(args))
+	for i, arg := range args {
+		if arg == "-f" {
+			arg = "-ff"
+		}
+		ff[i] = arg
+	}
+	return ff
+}
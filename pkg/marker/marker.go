@@ -0,0 +1,125 @@
+// Package marker lets a program traced by strace-perfetto add its own slices,
+// instants, counters and flows to the trace, in the format of the marker
+// protocol the converter recognizes:
+//
+//	defer marker.Span("compile")()
+//	marker.Counter("queue", float64(len(queue)))
+//
+// Under strace-perfetto -marker-fd, the markers go to the pipe it sets up,
+// tagged with the tid of the calling thread, as long as the fd in
+// STRACE_PERFETTO_MARKER_FD still is a pipe. Otherwise they are written to
+// /dev/null, where strace sees them in the write syscalls; strace shows the
+// first 32 characters of the strings written by default (-s for more), so
+// keep the names short.
+//
+// Outside of strace-perfetto, a marker costs a write to /dev/null.
+package marker
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// FdEnv is the environment variable strace-perfetto -marker-fd sets to the fd
+// of the marker pipe.
+const FdEnv = "STRACE_PERFETTO_MARKER_FD"
+
+var (
+	openOnce sync.Once
+	out      *os.File
+	viaPipe  bool
+)
+
+// open opens the marker pipe, if FdEnv names one. The variable is inherited
+// by the children of the traced command along with the pipe, whose markers go
+// to it too; a child that closed the fd, or reused it for a file or a socket,
+// writes to /dev/null instead.
+func open() {
+	if fd, err := strconv.Atoi(os.Getenv(FdEnv)); err == nil {
+		f := os.NewFile(uintptr(fd), "strace-perfetto markers")
+		if info, err := f.Stat(); err == nil && info.Mode()&os.ModeNamedPipe != 0 {
+			out, viaPipe = f, true
+			return
+		}
+	}
+	out, _ = os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+}
+
+// Emitter writes the markers of a thread. The package functions write the
+// markers of the calling thread; an Emitter is for markers on behalf of
+// another one, such as the parent of a short-lived process.
+type Emitter struct {
+	tid int
+}
+
+// For returns an Emitter of markers for the thread tid. Without -marker-fd,
+// the markers are attributed to the thread writing them all the same.
+func For(tid int) Emitter {
+	return Emitter{tid: tid}
+}
+
+func (e Emitter) emit(format string, args ...any) {
+	openOnce.Do(open)
+	if out == nil {
+		return
+	}
+	marker := "PERFETTO:" + fmt.Sprintf(format, args...)
+	// Each marker is a single write, which pipes keep whole.
+	if viaPipe {
+		out.WriteString(strconv.Itoa(e.tid) + " " + marker + "\n")
+	} else {
+		out.WriteString("!!" + marker)
+	}
+}
+
+// Begin begins a slice on the thread's track.
+func (e Emitter) Begin(name string) { e.emit("B:%s", name) }
+
+// End ends the thread's last slice.
+func (e Emitter) End() { e.emit("E") }
+
+// Span begins a slice and returns the function that ends it.
+func (e Emitter) Span(name string) func() {
+	e.Begin(name)
+	return e.End
+}
+
+// Instant adds an instant on the thread's track.
+func (e Emitter) Instant(name string) { e.emit("I:%s", name) }
+
+// Counter sets the value of a counter of the process.
+func (e Emitter) Counter(name string, value float64) {
+	e.emit("C:%s=%s", name, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// FlowStart starts a flow, which FlowEnd with the same id finishes, e.g. on
+// the thread that picks up a job.
+func (e Emitter) FlowStart(id string) { e.emit("s:%s", id) }
+
+// FlowEnd finishes the flow started by FlowStart with the same id.
+func (e Emitter) FlowEnd(id string) { e.emit("f:%s", id) }
+
+// Begin begins a slice on the calling thread's track.
+func Begin(name string) { For(gettid()).Begin(name) }
+
+// End ends the calling thread's last slice.
+func End() { For(gettid()).End() }
+
+// Span begins a slice on the calling thread's track and returns the function
+// that ends it. Goroutines move between threads: lock the goroutine to its
+// thread (runtime.LockOSThread) for spans that block.
+func Span(name string) func() { return For(gettid()).Span(name) }
+
+// Instant adds an instant on the calling thread's track.
+func Instant(name string) { For(gettid()).Instant(name) }
+
+// Counter sets the value of a counter of the process.
+func Counter(name string, value float64) { For(gettid()).Counter(name, value) }
+
+// FlowStart starts a flow from the calling thread.
+func FlowStart(id string) { For(gettid()).FlowStart(id) }
+
+// FlowEnd finishes a flow on the calling thread.
+func FlowEnd(id string) { For(gettid()).FlowEnd(id) }
@@ -0,0 +1,7 @@
+package marker
+
+import "syscall"
+
+func gettid() int {
+	return syscall.Gettid()
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package marker
+
+import "os"
+
+// gettid stands in for the tid where there's no gettid; strace only runs on
+// Linux anyway.
+func gettid() int {
+	return os.Getpid()
+}
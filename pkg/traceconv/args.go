@@ -0,0 +1,215 @@
+package traceconv
+
+import (
+	"maps"
+	"strconv"
+	"strings"
+)
+
+// syscallArgNames are the names of the arguments of common syscalls, as in
+// their man pages. The arguments of other syscalls are named by position,
+// arg0, arg1, ...
+var syscallArgNames = map[string][]string{
+	"read":       {"fd", "buf", "count"},
+	"write":      {"fd", "buf", "count"},
+	"pread64":    {"fd", "buf", "count", "offset"},
+	"pwrite64":   {"fd", "buf", "count", "offset"},
+	"readv":      {"fd", "iov", "iovcnt"},
+	"writev":     {"fd", "iov", "iovcnt"},
+	"preadv":     {"fd", "iov", "iovcnt", "offset"},
+	"pwritev":    {"fd", "iov", "iovcnt", "offset"},
+	"open":       {"path", "flags", "mode"},
+	"openat":     {"dirfd", "path", "flags", "mode"},
+	"openat2":    {"dirfd", "path", "how", "size"},
+	"creat":      {"path", "mode"},
+	"close":      {"fd"},
+	"stat":       {"path", "statbuf"},
+	"lstat":      {"path", "statbuf"},
+	"fstat":      {"fd", "statbuf"},
+	"newfstatat": {"dirfd", "path", "statbuf", "flags"},
+	"statx":      {"dirfd", "path", "flags", "mask", "statxbuf"},
+	"access":     {"path", "mode"},
+	"faccessat":  {"dirfd", "path", "mode"},
+	"faccessat2": {"dirfd", "path", "mode", "flags"},
+	"readlink":   {"path", "buf", "bufsiz"},
+	"readlinkat": {"dirfd", "path", "buf", "bufsiz"},
+	"unlink":     {"path"},
+	"unlinkat":   {"dirfd", "path", "flags"},
+	"mkdir":      {"path", "mode"},
+	"mkdirat":    {"dirfd", "path", "mode"},
+	"chdir":      {"path"},
+	"execve":     {"path", "argv", "envp"},
+	"execveat":   {"dirfd", "path", "argv", "envp", "flags"},
+	"getdents64": {"fd", "dirp", "count"},
+	"lseek":      {"fd", "offset", "whence"},
+	"fsync":      {"fd"},
+	"fdatasync":  {"fd"},
+	"ioctl":      {"fd", "request", "argp"},
+	"fcntl":      {"fd", "cmd", "arg"},
+	"dup":        {"fd"},
+	"dup2":       {"fd", "newfd"},
+	"dup3":       {"fd", "newfd", "flags"},
+	"mmap":       {"addr", "length", "prot", "flags", "fd", "offset"},
+	"munmap":     {"addr", "length"},
+	"socket":     {"domain", "type", "protocol"},
+	"connect":    {"fd", "addr", "addrlen"},
+	"bind":       {"fd", "addr", "addrlen"},
+	"listen":     {"fd", "backlog"},
+	"accept":     {"fd", "addr", "addrlen"},
+	"accept4":    {"fd", "addr", "addrlen", "flags"},
+	"sendto":     {"fd", "buf", "count", "flags", "dest_addr", "addrlen"},
+	"recvfrom":   {"fd", "buf", "count", "flags", "src_addr", "addrlen"},
+	"sendmsg":    {"fd", "msg", "flags"},
+	"recvmsg":    {"fd", "msg", "flags"},
+	"epoll_wait": {"epfd", "events", "maxevents", "timeout"},
+	"futex":      {"uaddr", "futex_op", "val", "timeout", "uaddr2", "val3"},
+	"wait4":      {"pid", "wstatus", "options", "rusage"},
+	"kill":       {"pid", "sig"},
+	"tgkill":     {"tgid", "tid", "sig"},
+}
+
+// numericArgs are the named arguments that are stored as numbers, so that
+// they can be compared and aggregated in queries.
+var numericArgs = map[string]bool{
+	"fd":        true,
+	"dirfd":     true,
+	"newfd":     true,
+	"epfd":      true,
+	"count":     true,
+	"iovcnt":    true,
+	"bufsiz":    true,
+	"maxevents": true,
+	"offset":    true,
+	"length":    true,
+	"pid":       true,
+	"tid":       true,
+	"tgid":      true,
+}
+
+// ArgNames returns the names of the arguments of a syscall, or nil if it isn't
+// one of the common syscalls they are known for.
+func ArgNames(syscall string) []string {
+	return syscallArgNames[syscall]
+}
+
+// NumericArg reports whether the argument of that name is an fd, a count or
+// a size, which ParseArgs makes a number.
+func NumericArg(name string) bool {
+	return numericArgs[name]
+}
+
+// SetArgs sets the arguments of a syscall event in Args.Data, for the tracers
+// that decode them from their raw values rather than from strace's text, as
+// ParseArgs would have split them: by name, the paths unquoted and the fds,
+// counts and sizes numbers.
+func (e *Event) SetArgs(data map[string]any) {
+	if e.Args.Data == nil {
+		e.Args.Data = make(map[string]any, len(data))
+	}
+	maps.Copy(e.Args.Data, data)
+	e.Args.parsed = true
+}
+
+// ParseArgs splits the arguments of a syscall event into Args.Data, by name
+// for the syscalls in syscallArgNames and the arguments strace names, and by
+// position for the others. Paths are unquoted and fds, counts and sizes are
+// numbers. Args.First and Args.Second are left as they are for the analyses
+// of the syscalls, but no longer written to the trace, Args.Data holding the
+// args there. Parse calls it on the events it returns, tracers that build
+// syscall events themselves call it once Args.First is set, or SetArgs.
+func (e *Event) ParseArgs() {
+	args := splitArgs(e.Args.First + e.Args.Second)
+	if len(args) == 0 {
+		return
+	}
+	names := syscallArgNames[e.Name]
+	e.Args.parsed = true
+	if e.Args.Data == nil {
+		e.Args.Data = make(map[string]any, len(args))
+	}
+	for i, arg := range args {
+		if i >= len(names) {
+			// strace names some arguments itself, as in
+			// clone(child_stack=NULL, flags=...).
+			if name, value, ok := strings.Cut(arg, "="); ok && isIdentifier(name) {
+				e.Args.Data[name] = value
+			} else {
+				e.Args.Data["arg"+strconv.Itoa(i)] = arg
+			}
+			continue
+		}
+		name := names[i]
+		switch {
+		case name == "path":
+			e.Args.Data[name] = unquoteArg(arg)
+		case numericArgs[name]:
+			if n, err := strconv.Atoi(arg); err == nil {
+				e.Args.Data[name] = n
+			} else {
+				// e.g. AT_FDCWD
+				e.Args.Data[name] = arg
+			}
+		default:
+			e.Args.Data[name] = arg
+		}
+	}
+}
+
+// splitArgs splits the parenthesized arguments strace printed at their
+// top-level commas, leaving the commas inside strings, arrays, structs and
+// nested calls such as htons(80).
+func splitArgs(s string) []string {
+	s = strings.TrimSpace(s)
+	s = strings.TrimPrefix(s, "(")
+	s = strings.TrimSuffix(s, ")")
+	if strings.TrimSpace(s) == "" {
+		return nil
+	}
+	var args []string
+	depth := 0
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			i = closingQuote(s, i) - 1
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				args = append(args, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	last := strings.TrimSpace(s[start:])
+	if last == "" {
+		// The args of an unfinished syscall stop after a comma.
+		return args
+	}
+	return append(args, last)
+}
+
+func isIdentifier(s string) bool {
+	for i, c := range s {
+		if c != '_' && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (i == 0 || c < '0' || c > '9') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// unquoteArg returns the content of a quoted string argument, or the
+// argument as is if it isn't one (e.g. NULL). strace's C escapes are kept
+// when they aren't valid Go escapes.
+func unquoteArg(arg string) string {
+	arg = strings.TrimSuffix(arg, "...")
+	if len(arg) < 2 || arg[0] != '"' || arg[len(arg)-1] != '"' {
+		return arg
+	}
+	if s, err := strconv.Unquote(arg); err == nil {
+		return s
+	}
+	return arg[1 : len(arg)-1]
+}
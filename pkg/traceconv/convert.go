@@ -0,0 +1,12 @@
+package traceconv
+
+import "io"
+
+// Convert parses strace output and returns the syscall events along with the
+// names of the processes and threads and the flows from parents to children,
+// sorted by timestamp.
+func Convert(r io.Reader) []*Event {
+	syscallEvents := Parse(r)
+	metadataEvents := BuildProcessTree(syscallEvents, ProcTree{})
+	return Merge(metadataEvents, PersonalityLabels(syscallEvents), syscallEvents)
+}
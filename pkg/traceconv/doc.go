@@ -0,0 +1,17 @@
+// Package traceconv converts the output of `strace -f -T -ttt` into Chrome
+// Trace Event Format events, which the Perfetto UI (https://ui.perfetto.dev/)
+// and chrome://tracing load.
+//
+// Convert does the whole conversion:
+//
+//	f, _ := os.Open("app.strace")
+//	events := traceconv.Convert(f)
+//	traceconv.Write(os.Stdout, events, nil)
+//
+// Parse, BuildProcessTree and Merge are the steps it's made of, for callers
+// that want to add their own events in between.
+//
+// Event timestamps and durations are in microseconds, as in the trace format,
+// with the nanoseconds past them in TsNs and DurNs for strace output with
+// nanosecond precision (--absolute-timestamps=precision:ns).
+package traceconv
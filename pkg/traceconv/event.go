@@ -0,0 +1,390 @@
+package traceconv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	reExecve      = `^\(\"([^"]+)\", \[\"([^"]+)\"(\.\.\.)?.*`   // executable name
+	rePrctl       = `^\(PR_SET_NAME, \"([^"]+)\"`                // thread name
+	reGlobalEvent = `^\(\d+(?:<[^>]*>)?, \"(?:XXX:|!!)([^"]+)\"` // event name
+
+	regexpExecve      = regexp.MustCompile(reExecve)
+	regexpPrctl       = regexp.MustCompile(rePrctl)
+	regexpGlobalEvent = regexp.MustCompile(reGlobalEvent)
+)
+
+// Event is a Chrome Trace Event Format event. The events parsed from strace
+// output are syscall slices (ph X), thread lifetime slices (ph B/E) and signal
+// deliveries (ph i).
+type Event struct {
+	fullTrace string
+	Name      string `json:"name"`
+	Cat       string `json:"cat"`
+	Ph        string `json:"ph"`
+	Pid       int    `json:"pid"`
+	Tid       int    `json:"tid"`
+	Ts        int64  `json:"ts"`
+	Dur       int64  `json:"dur,omitempty"`
+	Id        uint64 `json:"id,omitempty"`
+	Scope     string `json:"s,omitempty"`
+	Cname     string `json:"cname,omitempty"`
+	Sf        string `json:"sf,omitempty"`
+	Args      Args   `json:"args,omitempty"`
+
+	// TsNs and DurNs are the nanoseconds past Ts and Dur, for the events of
+	// strace output with nanosecond timestamps. They are written as the
+	// fractional part of ts and dur.
+	TsNs  int `json:"-"`
+	DurNs int `json:"-"`
+
+	// Stack is the backtrace strace -k printed for a syscall, innermost
+	// frame first. Writer refers to it in Sf.
+	Stack []string `json:"-"`
+}
+
+// TsNanos returns the timestamp of the event in nanoseconds.
+func (e *Event) TsNanos() int64 {
+	return e.Ts*1000 + int64(e.TsNs)
+}
+
+// EndNanos returns the end of the event in nanoseconds, its timestamp for
+// events without a duration.
+func (e *Event) EndNanos() int64 {
+	return e.TsNanos() + e.Dur*1000 + int64(e.DurNs)
+}
+
+// MarshalJSON writes ts and dur as fractional microseconds when they have
+// nanoseconds past them.
+func (e Event) MarshalJSON() ([]byte, error) {
+	type event Event
+	if e.TsNs == 0 && e.DurNs == 0 {
+		return json.Marshal(event(e))
+	}
+	return json.Marshal(struct {
+		event
+		Ts  json.Number `json:"ts"`
+		Dur json.Number `json:"dur,omitempty"`
+	}{event(e), formatMicros(e.Ts, e.TsNs), formatMicros(e.Dur, e.DurNs)})
+}
+
+func (e *Event) UnmarshalJSON(b []byte) error {
+	type event Event
+	v := struct {
+		*event
+		Ts  json.Number `json:"ts"`
+		Dur json.Number `json:"dur"`
+	}{event: (*event)(e)}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	var err error
+	if e.Ts, e.TsNs, err = parseMicros(v.Ts); err != nil {
+		return fmt.Errorf("invalid ts %q: %w", v.Ts, err)
+	}
+	if e.Dur, e.DurNs, err = parseMicros(v.Dur); err != nil {
+		return fmt.Errorf("invalid dur %q: %w", v.Dur, err)
+	}
+	if e.Ph != "C" && len(e.Args.Counters) > 0 {
+		// Only counter events have counters, the numbers other
+		// producers put in the args of the other events are data.
+		if e.Args.Data == nil {
+			e.Args.Data = make(map[string]any, len(e.Args.Counters))
+		}
+		for k, v := range e.Args.Counters {
+			e.Args.Data[k] = v
+		}
+		e.Args.Counters = nil
+	}
+	return nil
+}
+
+// formatMicros formats microseconds and the nanoseconds past them as a JSON
+// number, empty for zero. Negative values, such as the timestamps rebased to
+// before the start of the trace, are formatted from their absolute value.
+func formatMicros(us int64, ns int) json.Number {
+	switch {
+	case ns != 0:
+		sign, total := "", us*1000+int64(ns)
+		if total < 0 {
+			sign, total = "-", -total
+		}
+		return json.Number(fmt.Sprintf("%s%d.%03d", sign, total/1000, total%1000))
+	case us != 0:
+		return json.Number(strconv.FormatInt(us, 10))
+	}
+	return ""
+}
+
+// parseMicros parses a JSON number of microseconds into whole microseconds
+// and the nanoseconds past them.
+func parseMicros(n json.Number) (int64, int, error) {
+	if n == "" {
+		return 0, 0, nil
+	}
+	if strings.ContainsAny(n.String(), "eE-") {
+		f, err := n.Float64()
+		if err != nil {
+			return 0, 0, err
+		}
+		us, ns := splitNanos(int64(math.Round(f * 1000)))
+		return us, ns, nil
+	}
+	whole, frac, _ := strings.Cut(n.String(), ".")
+	us, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	ns, err := strconv.Atoi((frac + "000")[:3])
+	if err != nil {
+		return 0, 0, err
+	}
+	return us, ns, nil
+}
+
+// Args are the args of an event. Syscall events carry the syscall's
+// arguments and return value as strace printed them.
+type Args struct {
+	Data        map[string]any `json:"data,omitempty"`
+	Name        string         `json:"name,omitempty"`
+	Labels      string         `json:"labels,omitempty"`
+	First       string         `json:"first,omitempty"`
+	Second      string         `json:"second,omitempty"`
+	ReturnValue string         `json:"returnValue,omitempty"`
+	DetachedDur int            `json:"detachedDur,omitempty"`
+	// SortIndex orders the processes and threads of process_sort_index and
+	// thread_sort_index metadata events, from 1.
+	SortIndex int `json:"sort_index,omitempty"`
+
+	// Counters are the values of a counter event, written as top-level args
+	// since that's where the trace viewers look for them.
+	Counters map[string]float64 `json:"-"`
+
+	// parsed is set once ParseArgs split First and Second into Data.
+	parsed bool
+}
+
+// Parsed reports whether ParseArgs split the args into Data, which then holds
+// them in the written trace instead of First and Second.
+func (a Args) Parsed() bool {
+	return a.parsed
+}
+
+func (a Args) MarshalJSON() ([]byte, error) {
+	type args Args
+	if a.parsed {
+		a.First, a.Second = "", ""
+	}
+	b, err := json.Marshal(args(a))
+	if err != nil || len(a.Counters) == 0 {
+		return b, err
+	}
+	var m map[string]any
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	for k, v := range a.Counters {
+		m[k] = v
+	}
+	return json.Marshal(m)
+}
+
+// argsFields are the JSON names of the fields of Args, the other top-level
+// args being counters.
+var argsFields = func() map[string]bool {
+	fields := make(map[string]bool)
+	t := reflect.TypeFor[Args]()
+	for i := range t.NumField() {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			fields[name] = true
+		}
+	}
+	return fields
+}()
+
+func (a *Args) UnmarshalJSON(b []byte) error {
+	type args Args
+	if err := json.Unmarshal(b, (*args)(a)); err != nil {
+		return err
+	}
+	var m map[string]any
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	for k, v := range m {
+		if argsFields[k] {
+			continue
+		}
+		if f, ok := v.(float64); ok {
+			if a.Counters == nil {
+				a.Counters = make(map[string]float64)
+			}
+			a.Counters[k] = f
+		}
+	}
+	return nil
+}
+
+// errNotEvent is the error parsing a line that isn't a syscall, an exit or a
+// signal.
+var errNotEvent = errors.New("not a syscall, exit or signal")
+
+// NewEvent parses a line of strace output. Lines that aren't syscalls, exits
+// or signals, or whose numbers are malformed, are returned with the "other"
+// category.
+func NewEvent(content string) *Event {
+	e, err := parseEvent(content)
+	if err != nil {
+		return &Event{fullTrace: content, Cat: "other"}
+	}
+	return e
+}
+
+// parseEvent parses a line of strace output, as NewEvent, but returns an
+// error for the lines that aren't events.
+func parseEvent(content string) (*Event, error) {
+	e := &Event{fullTrace: content}
+	l, ok := parseLine(content)
+	if !ok {
+		return nil, errNotEvent
+	}
+	var err error
+	e.Cat = l.cat
+	e.Name = l.name
+	if e.Ts, e.TsNs, err = convertTS(l.ts); err != nil {
+		return nil, fmt.Errorf("timestamp: %w", err)
+	}
+	if e.Pid, err = convertID(l.pid); err != nil {
+		return nil, fmt.Errorf("pid: %w", err)
+	}
+	e.Tid = e.Pid
+	if e.Dur, e.DurNs, err = convertTS(l.dur); err != nil {
+		return nil, fmt.Errorf("duration: %w", err)
+	}
+	switch e.Cat {
+	case "successful", "failed":
+		e.Ph = "X"
+		e.Args.First = l.args
+		e.Args.ReturnValue = l.returnValue
+	case "detached":
+		e.Ph = "X"
+		e.Args.Second = l.args
+		e.Args.ReturnValue = l.returnValue
+	case "unfinished":
+		e.Args.First = l.args
+		e.Ph = "B"
+	case "lifetime":
+		e.Name = "lifetime"
+		e.Ph = "E"
+		e.Args.First = l.args
+		e.Args.Data = exitStatus(l.args)
+		return e, nil
+	case "signal":
+		// An instant on the thread the signal is delivered to, with
+		// the siginfo fields as args.
+		e.Ph = "i"
+		e.Scope = "t"
+		e.Args.Data = make(map[string]any)
+		for _, field := range splitArgs(strings.Trim(l.args, "{}")) {
+			if name, value, ok := strings.Cut(field, "="); ok {
+				e.Args.Data[name] = value
+			}
+		}
+		return e, nil
+	}
+	e.decodeFdPaths()
+	return e, nil
+}
+
+// EndUnfinished makes e, a syscall still running at end (in nanoseconds since
+// the epoch) when its thread exited or tracing stopped, a slice of the
+// "unfinished" category lasting until then, with a did_not_complete arg: the
+// time a thread spent blocked in it is often what the trace is taken for.
+func (e *Event) EndUnfinished(end int64) {
+	e.Cat = "unfinished"
+	e.Ph = "X"
+	e.Dur, e.DurNs = splitNanos(max(end-e.TsNanos(), 0))
+	if e.Args.Data == nil {
+		e.Args.Data = make(map[string]any)
+	}
+	e.Args.Data["did_not_complete"] = true
+}
+
+// splitNanos splits nanoseconds into microseconds and the nanoseconds past
+// them.
+func splitNanos(ns int64) (int64, int) {
+	return ns / 1000, int(ns % 1000)
+}
+
+func convertID(id string) (int, error) {
+	return strconv.Atoi(id)
+}
+
+// convertTS converts a timestamp or duration strace printed in seconds, with
+// microsecond (-ttt, -T) or nanosecond (-ns) precision, to microseconds and
+// the nanoseconds past them. An empty ts is 0.
+func convertTS(ts string) (int64, int, error) {
+	sec, frac, ok := strings.Cut(ts, ".")
+	if !ok {
+		return 0, 0, nil
+	}
+	frac = (frac + "000000000")[:9]
+	s, err := strconv.ParseInt(sec, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	ns, err := strconv.ParseInt(frac, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	us, rest := splitNanos(ns)
+	return s*1000000 + us, rest, nil
+}
+
+// exitStatus returns the exit code, or the signal that killed the thread, from
+// the status of a "+++ exited with 1 +++" or "+++ killed by SIGKILL +++" line.
+func exitStatus(status string) map[string]any {
+	if code, ok := strings.CutPrefix(status, "exited with "); ok {
+		if n, err := strconv.Atoi(code); err == nil {
+			return map[string]any{"exit_code": n}
+		}
+	}
+	if signal, ok := strings.CutPrefix(status, "killed by "); ok {
+		data := map[string]any{"signal": signal}
+		if signal, ok := strings.CutSuffix(signal, " (core dumped)"); ok {
+			data["signal"] = signal
+			data["core_dumped"] = true
+		}
+		return data
+	}
+	return nil
+}
+
+// abnormalExit returns a description of the exit status of a lifetime end
+// event, or "" if the thread exited with 0.
+func abnormalExit(e *Event) string {
+	if signal, ok := e.Args.Data["signal"]; ok {
+		return fmt.Sprintf("killed by %s", signal)
+	}
+	if code, ok := e.Args.Data["exit_code"]; ok && code != 0 {
+		return fmt.Sprintf("exit %d", code)
+	}
+	return ""
+}
+
+// ExecutablePath returns the path of the executable run by an execve event.
+func ExecutablePath(e *Event) (string, bool) {
+	m := regexpExecve.FindStringSubmatch(e.Args.First)
+	if len(m) != 4 {
+		return "", false
+	}
+	return m[1], true
+}
@@ -0,0 +1,100 @@
+package traceconv
+
+import "strings"
+
+// decodeFdPaths strips the <path> annotations that strace -y adds after fds
+// from the args and return value of e, so that they read the same as without
+// -y, and records the path in Data["fd_path"]: the path of the returned fd, or
+// else of the first fd argument.
+func (e *Event) decodeFdPaths() {
+	var paths []string
+	var returned []string
+	e.Args.ReturnValue, returned = stripFdPaths(e.Args.ReturnValue)
+	e.Args.First, paths = stripFdPaths(e.Args.First)
+	if e.Args.Second != "" {
+		var second []string
+		e.Args.Second, second = stripFdPaths(e.Args.Second)
+		paths = append(paths, second...)
+	}
+	paths = append(returned, paths...)
+	if len(paths) == 0 {
+		return
+	}
+	if e.Args.Data == nil {
+		e.Args.Data = make(map[string]any)
+	}
+	e.Args.Data["fd_path"] = paths[0]
+}
+
+// stripFdPaths removes the <path> annotations following fds (and AT_FDCWD)
+// outside of quoted strings in s, and returns them in order. strace escapes
+// '<' and '>' in the paths, but socket annotations of -yy such as
+// TCP:[1.2.3.4:5->6.7.8.9:10] can contain '>' inside brackets.
+func stripFdPaths(s string) (string, []string) {
+	if !strings.Contains(s, "<") {
+		return s, nil
+	}
+	var b strings.Builder
+	var paths []string
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"':
+			end := closingQuote(s, i)
+			b.WriteString(s[i:end])
+			i = end - 1
+			continue
+		case c == '<' && followsFd(s[:i]) && i+1 < len(s) && s[i+1] != '<':
+			if end := closingAngle(s, i); end > 0 {
+				paths = append(paths, s[i+1:end])
+				i = end
+				continue
+			}
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), paths
+}
+
+// followsFd returns whether s ends with an fd, a number or AT_FDCWD.
+func followsFd(s string) bool {
+	if strings.HasSuffix(s, "AT_FDCWD") {
+		return true
+	}
+	return s != "" && s[len(s)-1] >= '0' && s[len(s)-1] <= '9'
+}
+
+// closingQuote returns the index just past the quoted string starting at
+// s[start], or len(s) if it isn't closed.
+func closingQuote(s string, start int) int {
+	for i := start + 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1
+		}
+	}
+	return len(s)
+}
+
+// closingAngle returns the index of the '>' closing the annotation starting
+// at s[start], or -1 if there is none.
+func closingAngle(s string, start int) int {
+	depth := 0
+	for i := start + 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case '>':
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
@@ -0,0 +1,200 @@
+package traceconv
+
+import "strings"
+
+// straceLine holds the fields of a line of strace output, as strace printed
+// them.
+type straceLine struct {
+	cat  string // successful, failed, unfinished, detached, lifetime or signal
+	pid  string
+	ts   string
+	name string // the syscall, or the signal
+	// args are the parenthesized args of a syscall, without the closing
+	// parenthesis for an unfinished one and without the opening one for a
+	// resumed one, the exit status of a lifetime line or the siginfo of a
+	// signal.
+	args        string
+	returnValue string
+	dur         string
+}
+
+// tokenizer reads the tokens of a line of strace output.
+type tokenizer struct {
+	s string
+	i int
+}
+
+func (t *tokenizer) done() bool {
+	return t.i >= len(t.s)
+}
+
+// skip skips prefix, and returns whether it was there.
+func (t *tokenizer) skip(prefix string) bool {
+	if !strings.HasPrefix(t.s[t.i:], prefix) {
+		return false
+	}
+	t.i += len(prefix)
+	return true
+}
+
+// spaces skips spaces, and returns whether there were any.
+func (t *tokenizer) spaces() bool {
+	start := t.i
+	for !t.done() && t.s[t.i] == ' ' {
+		t.i++
+	}
+	return t.i > start
+}
+
+// token reads the bytes for which ok is true.
+func (t *tokenizer) token(ok func(c byte) bool) string {
+	start := t.i
+	for !t.done() && ok(t.s[t.i]) {
+		t.i++
+	}
+	return t.s[start:t.i]
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isWordChar(c byte) bool {
+	return c == '_' || isDigit(c) || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// seconds reads a timestamp or duration in seconds, such as 1651010489.100000.
+func (t *tokenizer) seconds() string {
+	start := t.i
+	if t.token(isDigit) == "" || !t.skip(".") || t.token(isDigit) == "" {
+		t.i = start
+		return ""
+	}
+	return t.s[start:t.i]
+}
+
+// args reads args up to the parenthesis that closes the depth-th one opened
+// before them, skipping quoted strings, and returns them with it. It returns
+// false if the line ends before.
+func (t *tokenizer) args(depth int) (string, bool) {
+	start := t.i
+	for ; !t.done(); t.i++ {
+		switch t.s[t.i] {
+		case '"':
+			t.i = closingQuote(t.s, t.i) - 1
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				t.i++
+				return t.s[start:t.i], true
+			}
+		}
+	}
+	return t.s[start:], false
+}
+
+// result reads the " = retval <duration>" ending a syscall. The duration is
+// left empty when strace didn't print one, as for exit_group.
+func (t *tokenizer) result() (returnValue, dur string, ok bool) {
+	t.spaces()
+	if !t.skip("= ") {
+		return "", "", false
+	}
+	rest := strings.TrimRight(t.s[t.i:], " ")
+	t.i = len(t.s)
+	if open := strings.LastIndex(rest, " <"); open >= 0 && strings.HasSuffix(rest, ">") {
+		d := tokenizer{s: rest[open+2 : len(rest)-1]}
+		if d.seconds() != "" && d.done() {
+			returnValue, dur = strings.TrimRight(rest[:open], " "), d.s
+			return returnValue, dur, returnValue != ""
+		}
+	}
+	return rest, "", rest != ""
+}
+
+// parseLine splits a line of strace -f output into its fields: a pid, a
+// timestamp and a syscall, a resumed syscall, an exit or a signal. Strings in
+// the args are skipped over, so the parentheses, braces and " = " in them
+// don't matter.
+func parseLine(line string) (straceLine, bool) {
+	var l straceLine
+	t := tokenizer{s: line}
+	if l.pid = t.token(isDigit); l.pid == "" || !t.spaces() {
+		return l, false
+	}
+	if l.ts = t.seconds(); l.ts == "" || !t.spaces() {
+		return l, false
+	}
+
+	switch {
+	case t.skip("+++ "):
+		status, ok := strings.CutSuffix(strings.TrimRight(t.s[t.i:], " "), "+++")
+		if !ok {
+			return l, false
+		}
+		l.cat = "lifetime"
+		l.args = strings.TrimSpace(status)
+		return l, l.args != ""
+	case t.skip("--- "):
+		l.name = t.token(isWordChar)
+		if !strings.HasPrefix(l.name, "SIG") || !t.skip(" {") {
+			return l, false
+		}
+		start := t.i - 1
+		depth := 1
+		for ; !t.done() && depth > 0; t.i++ {
+			switch t.s[t.i] {
+			case '"':
+				t.i = closingQuote(t.s, t.i) - 1
+			case '{':
+				depth++
+			case '}':
+				depth--
+			}
+		}
+		if depth > 0 || !t.skip(" ---") {
+			return l, false
+		}
+		l.cat = "signal"
+		l.args = t.s[start : t.i-len(" ---")]
+		return l, true
+	case t.skip("<... "):
+		l.name = t.token(isWordChar)
+		if l.name == "" || !t.skip(" resumed>") {
+			return l, false
+		}
+		args, ok := t.args(1)
+		if !ok {
+			return l, false
+		}
+		l.args = args
+		l.returnValue, l.dur, ok = t.result()
+		l.cat = "detached"
+		return l, ok
+	}
+
+	l.name = t.token(isWordChar)
+	if l.name == "" || !strings.HasPrefix(t.s[t.i:], "(") {
+		return l, false
+	}
+	args, closed := t.args(0)
+	if rest := strings.TrimSpace(t.s[t.i:]); closed && rest == "<unfinished ...>" {
+		args, closed = args+" "+rest, false
+	}
+	if !closed {
+		args, ok := strings.CutSuffix(args, "<unfinished ...>")
+		l.cat = "unfinished"
+		l.args = args
+		return l, ok
+	}
+	l.args = args
+	var ok bool
+	l.returnValue, l.dur, ok = t.result()
+	l.cat = "successful"
+	if strings.HasPrefix(l.returnValue, "-") {
+		l.cat = "failed"
+	}
+	return l, ok
+}
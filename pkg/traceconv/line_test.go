@@ -0,0 +1,101 @@
+package traceconv
+
+import "testing"
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want straceLine
+		ok   bool
+	}{
+		{
+			line: `1000 1651010489.100000 close(3) = 0 <0.000005>`,
+			want: straceLine{cat: "successful", pid: "1000", ts: "1651010489.100000", name: "close", args: "(3)", returnValue: "0", dur: "0.000005"},
+			ok:   true,
+		},
+		{
+			line: `1000 1651010489.100000123 close(3) = 0 <0.000005123>`,
+			want: straceLine{cat: "successful", pid: "1000", ts: "1651010489.100000123", name: "close", args: "(3)", returnValue: "0", dur: "0.000005123"},
+			ok:   true,
+		},
+		{
+			// Parentheses, braces, " = " and " <" in a string.
+			line: `1000 1651010489.100000 write(1, "f(x) = {1} <0.5>\n", 17) = 17 <0.000010>`,
+			want: straceLine{cat: "successful", pid: "1000", ts: "1651010489.100000", name: "write", args: `(1, "f(x) = {1} <0.5>\n", 17)`, returnValue: "17", dur: "0.000010"},
+			ok:   true,
+		},
+		{
+			// Escaped quotes in a string.
+			line: `1000 1651010489.100000 write(1, "\"(\" = \\", 6) = 6 <0.000010>`,
+			want: straceLine{cat: "successful", pid: "1000", ts: "1651010489.100000", name: "write", args: `(1, "\"(\" = \\", 6)`, returnValue: "6", dur: "0.000010"},
+			ok:   true,
+		},
+		{
+			line: `1000 1651010489.100000 openat(AT_FDCWD, "/nonexistent", O_RDONLY) = -1 ENOENT (No such file or directory) <0.000008>`,
+			want: straceLine{cat: "failed", pid: "1000", ts: "1651010489.100000", name: "openat", args: `(AT_FDCWD, "/nonexistent", O_RDONLY)`, returnValue: "-1 ENOENT (No such file or directory)", dur: "0.000008"},
+			ok:   true,
+		},
+		{
+			// -yy fd paths, with a '>' in a socket.
+			line: `1001 1651010489.101000 connect(4<TCP:[127.0.0.1:5000->127.0.0.1:80]>, {sa_family=AF_INET, sin_port=htons(80)}, 16) = 0 <0.000050>`,
+			want: straceLine{cat: "successful", pid: "1001", ts: "1651010489.101000", name: "connect", args: `(4<TCP:[127.0.0.1:5000->127.0.0.1:80]>, {sa_family=AF_INET, sin_port=htons(80)}, 16)`, returnValue: "0", dur: "0.000050"},
+			ok:   true,
+		},
+		{
+			line: `1000 1651010489.100000 exit_group(0) = ?`,
+			want: straceLine{cat: "successful", pid: "1000", ts: "1651010489.100000", name: "exit_group", args: "(0)", returnValue: "?"},
+			ok:   true,
+		},
+		{
+			line: `1000 1651010489.101100 wait4(-1,  <unfinished ...>`,
+			want: straceLine{cat: "unfinished", pid: "1000", ts: "1651010489.101100", name: "wait4", args: "(-1,  "},
+			ok:   true,
+		},
+		{
+			// Unfinished after its last arg.
+			line: `1000 1651010489.101100 futex(0x7f10, FUTEX_WAIT_PRIVATE, 0, NULL) <unfinished ...>`,
+			want: straceLine{cat: "unfinished", pid: "1000", ts: "1651010489.101100", name: "futex", args: "(0x7f10, FUTEX_WAIT_PRIVATE, 0, NULL) "},
+			ok:   true,
+		},
+		{
+			line: `1000 1651010489.101500 <... wait4 resumed>[{WIFEXITED(s) && WEXITSTATUS(s) == 2}], 0, NULL) = 1001 <0.000400>`,
+			want: straceLine{cat: "detached", pid: "1000", ts: "1651010489.101500", name: "wait4", args: "[{WIFEXITED(s) && WEXITSTATUS(s) == 2}], 0, NULL)", returnValue: "1001", dur: "0.000400"},
+			ok:   true,
+		},
+		{
+			line: `1000 1651010489.101600 --- SIGCHLD {si_signo=SIGCHLD, si_code=CLD_EXITED, si_pid=1001} ---`,
+			want: straceLine{cat: "signal", pid: "1000", ts: "1651010489.101600", name: "SIGCHLD", args: "{si_signo=SIGCHLD, si_code=CLD_EXITED, si_pid=1001}"},
+			ok:   true,
+		},
+		{
+			// A brace in a string of the siginfo.
+			line: `1000 1651010489.101600 --- SIGSEGV {si_signo=SIGSEGV, si_comm="a}b"} ---`,
+			want: straceLine{cat: "signal", pid: "1000", ts: "1651010489.101600", name: "SIGSEGV", args: `{si_signo=SIGSEGV, si_comm="a}b"}`},
+			ok:   true,
+		},
+		{
+			line: `1001 1651010489.101400 +++ exited with 2 +++`,
+			want: straceLine{cat: "lifetime", pid: "1001", ts: "1651010489.101400", args: "exited with 2"},
+			ok:   true,
+		},
+		{
+			line: `1000 1651010489.101900 +++ killed by SIGKILL (core dumped) +++`,
+			want: straceLine{cat: "lifetime", pid: "1000", ts: "1651010489.101900", args: "killed by SIGKILL (core dumped)"},
+			ok:   true,
+		},
+		{line: `strace: Process 1000 attached`},
+		{line: `1000 close(3) = 0 <0.000005>`},
+		{line: `1000 1651010489.100000 close(3) <detached ...>`},
+		{line: `1000 1651010489.100000 +++ exited with 0`},
+	}
+	for _, tt := range tests {
+		got, ok := parseLine(tt.line)
+		if ok != tt.ok {
+			t.Errorf("parseLine(%q) ok = %v, want %v", tt.line, ok, tt.ok)
+			continue
+		}
+		if ok && got != tt.want {
+			t.Errorf("parseLine(%q) = %+v, want %+v", tt.line, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package traceconv
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// DefaultMaxLineSize is the default maximum size of a line of strace output,
+// far above what strace prints for the -s 65536 buffers of large writes.
+const DefaultMaxLineSize = 16 << 20
+
+// LineScanner reads lines as bufio.Scanner does, but without its 64 KiB
+// limit: lines longer than its maximum size are skipped and counted, instead
+// of ending the scan.
+type LineScanner struct {
+	r       *bufio.Reader
+	maxSize int
+	line    string
+	tooLong int
+	err     error
+}
+
+// NewLineScanner returns a LineScanner reading r, skipping the lines longer
+// than maxSize bytes, or DefaultMaxLineSize if maxSize is 0.
+func NewLineScanner(r io.Reader, maxSize int) *LineScanner {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxLineSize
+	}
+	return &LineScanner{r: bufio.NewReader(r), maxSize: maxSize}
+}
+
+// Scan advances to the next line, which is then available through Text. It
+// returns false at the end of the input or on an error.
+func (s *LineScanner) Scan() bool {
+	for {
+		var line []byte
+		long := false
+		for {
+			chunk, err := s.r.ReadSlice('\n')
+			if len(line)+len(chunk) <= s.maxSize {
+				line = append(line, chunk...)
+			} else {
+				long = true
+			}
+			if err == bufio.ErrBufferFull {
+				continue
+			}
+			if err != nil && err != io.EOF {
+				s.err = err
+				return false
+			}
+			if err == io.EOF && len(chunk) == 0 && len(line) == 0 && !long {
+				return false
+			}
+			break
+		}
+		if long {
+			s.tooLong++
+			continue
+		}
+		text := strings.TrimSuffix(string(line), "\n")
+		s.line = strings.TrimSuffix(text, "\r")
+		return true
+	}
+}
+
+// Text returns the current line, without its line ending.
+func (s *LineScanner) Text() string {
+	return s.line
+}
+
+// Err returns the error reading the input, if any.
+func (s *LineScanner) Err() error {
+	return s.err
+}
+
+// TooLong returns the number of lines skipped so far for being longer than
+// the maximum size.
+func (s *LineScanner) TooLong() int {
+	return s.tooLong
+}
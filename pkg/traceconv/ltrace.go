@@ -0,0 +1,80 @@
+package traceconv
+
+import (
+	"strings"
+)
+
+// ltraceLine rewrites a line of `ltrace -f -ttt -T -S` output the way strace
+// prints the same event, for parseLine to parse it:
+//
+//	123 1651010489.100000 libc.so.6->malloc(16) = 0x55d0c2b0 <0.000050>
+//	123 1651010489.100100 exit(0 <no return ...>
+//	123 1651010489.100200 --- SIGCHLD (Child exited) ---
+//	123 1651010489.100300 +++ exited (status 0) +++
+//
+// become "malloc(16) = ...", "exit(0 <unfinished ...>", "--- SIGCHLD {} ---"
+// and "+++ exited with 0 +++". The "--- Called exec() ---" lines, which the
+// execve syscall already shows, become empty.
+func ltraceLine(line string) string {
+	t := tokenizer{s: line}
+	if t.token(isDigit) == "" || !t.spaces() || t.seconds() == "" || !t.spaces() {
+		return line
+	}
+	prefix, rest := line[:t.i], strings.TrimRight(line[t.i:], " ")
+	switch {
+	case rest == "--- Called exec() ---":
+		return ""
+	case strings.HasPrefix(rest, "--- SIG"):
+		signal, _, _ := strings.Cut(strings.TrimPrefix(rest, "--- "), " ")
+		return prefix + "--- " + signal + " {} ---"
+	case strings.HasPrefix(rest, "+++ exited (status "):
+		status, ok := strings.CutSuffix(strings.TrimPrefix(rest, "+++ exited (status "), ") +++")
+		if !ok {
+			return line
+		}
+		return prefix + "+++ exited with " + status + " +++"
+	case strings.HasPrefix(rest, "+++ "):
+		return line
+	case strings.HasPrefix(rest, "<... "):
+		name, args, ok := strings.Cut(strings.TrimPrefix(rest, "<... "), " resumed>")
+		if !ok {
+			return line
+		}
+		return prefix + "<... " + ltraceName(name) + " resumed>" + args
+	}
+	open := strings.IndexByte(rest, '(')
+	if open < 0 {
+		return line
+	}
+	rest = ltraceName(rest[:open]) + rest[open:]
+	if args, ok := strings.CutSuffix(rest, "<no return ...>"); ok {
+		rest = args + "<unfinished ...>"
+	}
+	return prefix + rest
+}
+
+// ltraceName returns the name of a function ltrace printed, without the
+// library it was called from (libc.so.6->malloc) or found in
+// (malloc@libc.so.6).
+func ltraceName(name string) string {
+	if i := strings.LastIndex(name, "->"); i >= 0 {
+		name = name[i+len("->"):]
+	}
+	name, _, _ = strings.Cut(name, "@")
+	return name
+}
+
+// ltraceCategory tells the syscalls of ltrace output from its library calls,
+// once the unfinished and resumed calls are paired up: the syscalls lose the
+// SYS_ prefix ltrace -S prints them with, and the library calls get the
+// "library" category, so that they are told apart from the syscalls they
+// make, which are nested in them.
+func ltraceCategory(e *Event) {
+	if name, ok := strings.CutPrefix(e.Name, "SYS_"); ok {
+		e.Name = name
+		return
+	}
+	if e.Ph == "X" && e.Cat != "unfinished" {
+		e.Cat = "library"
+	}
+}
@@ -0,0 +1,62 @@
+package traceconv
+
+import (
+	"hash/fnv"
+	"strconv"
+	"strings"
+)
+
+// markerPrefix starts the markers of the marker protocol, which a traced
+// program writes (anywhere, e.g. to stderr or /dev/null) after the "!!"
+// of a global event, as "!!PERFETTO:<type>[:<arg>]":
+//
+//	B:name        begins a slice on the thread's track
+//	E[:name]      ends the thread's last slice
+//	I:name        an instant on the thread's track
+//	C:name=value  sets the counter of the process named name
+//	s:id, f:id    start / finish of a flow from one thread to another
+const markerPrefix = "PERFETTO:"
+
+// MarkerEvents returns the events of a marker of the marker protocol,
+// "PERFETTO:<type>[:<arg>]", written by thread tid of process pid between
+// start and end (in nanoseconds), or nil if it isn't one. Slices begin at
+// the end of the write of their marker and end at the start of the write of
+// theirs, not to overlap with the write syscalls.
+func MarkerEvents(marker string, pid, tid int, start, end int64) []*Event {
+	marker = strings.TrimSpace(strings.TrimSuffix(marker, `\n`))
+	rest, ok := strings.CutPrefix(marker, markerPrefix)
+	if !ok {
+		return nil
+	}
+	typ, arg, _ := strings.Cut(rest, ":")
+	ts, tsNs := splitNanos(start)
+	endTs, endTsNs := splitNanos(end)
+	switch typ {
+	case "B":
+		return []*Event{{Name: arg, Cat: "marker", Ph: "B", Pid: pid, Tid: tid, Ts: endTs, TsNs: endTsNs}}
+	case "E":
+		return []*Event{{Name: arg, Cat: "marker", Ph: "E", Pid: pid, Tid: tid, Ts: ts, TsNs: tsNs}}
+	case "I":
+		return []*Event{{Name: arg, Cat: "marker", Ph: "i", Pid: pid, Tid: tid, Scope: "t", Ts: ts, TsNs: tsNs}}
+	case "C":
+		name, value, _ := strings.Cut(arg, "=")
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil
+		}
+		return []*Event{{Name: name, Cat: "marker", Ph: "C", Pid: pid, Tid: tid, Ts: ts, TsNs: tsNs, Args: Args{Counters: map[string]float64{"value": v}}}}
+	case "s", "f":
+		// The flow binds to the write syscall, which encloses it.
+		return []*Event{{Name: "marker flow", Cat: "marker", Ph: typ, Pid: pid, Tid: tid, Ts: ts, TsNs: tsNs, Id: markerFlowID(arg)}}
+	}
+	return nil
+}
+
+// markerFlowID maps the id of a marker flow to the id of its flow events,
+// from 2^52 up to stay clear of the ids of the clone flows, and below 2^53
+// for the JSON readers that parse numbers as doubles.
+func markerFlowID(id string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	return h.Sum64()&(1<<52-1) | 1<<52
+}
@@ -0,0 +1,41 @@
+package traceconv
+
+// Merge merges lists of events sorted by timestamp into a single sorted list.
+// Events with the same timestamp are taken from the earlier lists first.
+func Merge(events ...[]*Event) []*Event {
+	if len(events) == 0 {
+		return nil
+	}
+	l := 0
+	{
+		i := 0
+		for i < len(events) {
+			if len(events[i]) == 0 {
+				// If this event list is empty, skip it.
+				events = append(events[:i], events[i+1:]...)
+				continue
+			}
+			l += len(events[i])
+			i++
+		}
+	}
+	merged := make([]*Event, 0, l)
+	for len(events) > 0 {
+		eventIndex := 0
+		firstEvent := events[eventIndex][0]
+		for i, e := range events[1:] {
+			if firstEvent.TsNanos() <= e[0].TsNanos() {
+				continue
+			}
+			eventIndex = i + 1
+			firstEvent = e[0]
+		}
+		merged = append(merged, events[eventIndex][0])
+		if len(events[eventIndex]) == 1 {
+			events = append(events[:eventIndex], events[eventIndex+1:]...)
+		} else {
+			events[eventIndex] = events[eventIndex][1:]
+		}
+	}
+	return merged
+}
@@ -0,0 +1,305 @@
+package traceconv
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// progressLines is how many lines Parser reads between two checks of whether
+// it is time to report its progress.
+const progressLines = 4096
+
+// ParseStats are the numbers of lines read and events emitted by a Parser.
+type ParseStats struct {
+	// Lines is the number of lines read.
+	Lines int
+	// Events is the number of events emitted so far.
+	Events int
+	// Unparsed is the number of non-empty lines that are neither syscalls,
+	// exits, signals, stack frames nor personality changes, and so were
+	// left out.
+	Unparsed int
+	// TooLong is the number of lines left out for being longer than the
+	// maximum line size. They aren't counted in Lines.
+	TooLong int
+	// Categories counts the parsed lines by the category of their event
+	// (successful, failed, unfinished, detached, lifetime, signal), and
+	// the stack frame and personality lines.
+	Categories map[string]int
+	// Unresumed is the number of unfinished syscalls that were never
+	// resumed, and Orphaned the number of resumed syscalls that strace
+	// didn't print the start of, e.g. when it attached during the syscall.
+	Unresumed int
+	Orphaned  int
+}
+
+func (s *ParseStats) count(category string) {
+	if s.Categories == nil {
+		s.Categories = make(map[string]int)
+	}
+	s.Categories[category]++
+}
+
+// Parser parses strace output, reporting its progress on the way.
+type Parser struct {
+	// Stats are updated as the input is parsed.
+	Stats ParseStats
+	// Progress, if set, is called with the stats every ProgressInterval
+	// while parsing.
+	Progress         func(ParseStats)
+	ProgressInterval time.Duration
+	// Unparsed, if set, receives the lines that were left out, one per
+	// line.
+	Unparsed io.Writer
+	// MaxLineSize is the size of the longest line that is parsed,
+	// DefaultMaxLineSize if 0. Longer lines are counted in Stats.TooLong.
+	MaxLineSize int
+	// Strict stops parsing at the first line that can't be parsed, with a
+	// *ParseError in Err, instead of leaving it out.
+	Strict bool
+	// Ltrace parses the output of `ltrace -f -ttt -T -S` instead: the
+	// library calls are events of the "library" category, and the
+	// syscalls ltrace prints with a SYS_ prefix syscall events.
+	Ltrace bool
+	// Logf, if set, is called with what is done with the lines that don't
+	// end up as an event of their own: the lines left out, the syscalls
+	// resumed without their start and the ones never resumed.
+	Logf func(format string, args ...any)
+	// Err is the error reading the input stopped at, if any.
+	Err error
+}
+
+func (p *Parser) logf(format string, args ...any) {
+	if p.Logf != nil {
+		p.Logf(format, args...)
+	}
+}
+
+// resume returns the unfinished call the resumed e is the end of, the latest
+// one of the same name on its thread, and stops preserving it. Two threads
+// commonly have the same syscall, such as futex or epoll_wait, unfinished at
+// the same time.
+func resume(preserved map[int][]*Event, e *Event) *Event {
+	unfinished := preserved[e.Tid]
+	for i := len(unfinished) - 1; i >= 0; i-- {
+		if unfinished[i].Name == e.Name {
+			u := unfinished[i]
+			preserved[e.Tid] = append(unfinished[:i], unfinished[i+1:]...)
+			if len(preserved[e.Tid]) == 0 {
+				delete(preserved, e.Tid)
+			}
+			return u
+		}
+	}
+	return nil
+}
+
+// insertByTs returns events with inserted, sorted by their start, inserted
+// before the first event that starts after them: events are in the order of
+// the lines, so the calls never resumed come before the exit of their thread
+// rather than after the end of the trace.
+func insertByTs(events, inserted []*Event) []*Event {
+	if len(inserted) == 0 {
+		return events
+	}
+	merged := make([]*Event, 0, len(events)+len(inserted))
+	for _, e := range events {
+		for len(inserted) > 0 && inserted[0].TsNanos() < e.TsNanos() {
+			merged = append(merged, inserted[0])
+			inserted = inserted[1:]
+		}
+		merged = append(merged, e)
+	}
+	return append(merged, inserted...)
+}
+
+// ParseError is the error of a line of strace output that couldn't be
+// parsed.
+type ParseError struct {
+	Line int
+	Text string
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d: %s: %q", e.Line, e.Err, e.Text)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// Parse reads the output of `strace -f -T -ttt` and returns the syscall and
+// lifetime events in it, pairing up unfinished and resumed syscalls. The pids
+// of the events are the tids strace printed, BuildProcessTree fixes them up.
+func Parse(r io.Reader) []*Event {
+	return new(Parser).Parse(r)
+}
+
+// Parse parses r as the package-level Parse does, updating p.Stats.
+func (p *Parser) Parse(r io.Reader) []*Event {
+	var syscallEvents []*Event
+	// The unfinished calls of each thread, innermost last: with ltrace,
+	// the syscalls a library call makes are unfinished inside it.
+	preserved := make(map[int][]*Event) // [tid]
+	personalities := make(personalities)
+	scanner := NewLineScanner(r, p.MaxLineSize)
+
+	lifetimes := make(map[int]*Event) // [tid]lifetime begin
+	var last *Event
+	lastProgress := time.Now()
+	for scanner.Scan() {
+		p.Stats.Lines++
+		p.Stats.TooLong = scanner.TooLong()
+		if p.Progress != nil && p.Stats.Lines%progressLines == 0 && time.Since(lastProgress) >= p.ProgressInterval {
+			p.Stats.Events = len(syscallEvents)
+			p.Progress(p.Stats)
+			lastProgress = time.Now()
+		}
+		text := scanner.Text()
+		if p.Ltrace {
+			text = ltraceLine(text)
+		}
+		if personalities.notice(text) {
+			p.Stats.count("personality")
+			continue
+		}
+		if frame, ok := strings.CutPrefix(text, stackFramePrefix); ok {
+			p.Stats.count("stack")
+			if last != nil {
+				last.Stack = append(last.Stack, frame)
+			}
+			continue
+		}
+		e, err := parseEvent(text)
+		if err != nil {
+			if strings.TrimSpace(text) == "" {
+				continue
+			}
+			if p.Strict {
+				p.Err = &ParseError{Line: p.Stats.Lines, Text: scanner.Text(), Err: err}
+				break
+			}
+			p.Stats.Unparsed++
+			p.logf("line %d left out: %s: %q", p.Stats.Lines, err, scanner.Text())
+			if p.Unparsed != nil {
+				io.WriteString(p.Unparsed, scanner.Text()+"\n")
+			}
+			continue
+		}
+		p.Stats.count(e.Cat)
+		last = e
+		personalities.normalize(e)
+		begin := lifetimes[e.Tid]
+		if begin == nil {
+			begin = &Event{
+				Name: "lifetime",
+				Cat:  "lifetime",
+				Ph:   "B",
+				Ts:   e.Ts,
+				TsNs: e.TsNs,
+				Pid:  e.Pid,
+				Tid:  e.Tid,
+			}
+			syscallEvents = append(syscallEvents, begin)
+			lifetimes[e.Tid] = begin
+		}
+		switch {
+		case e.Cat == "unfinished":
+			preserved[e.Tid] = append(preserved[e.Tid], e)
+		case e.Cat == "detached":
+			u := resume(preserved, e)
+			if u == nil {
+				// The syscall started before strace attached, it
+				// ends at the resume and lasted the duration strace
+				// printed.
+				p.Stats.Orphaned++
+				p.logf("line %d: %s of %d resumed without its start, %dus earlier", p.Stats.Lines, e.Name, e.Tid, e.Dur)
+				e.Ts, e.TsNs = splitNanos(e.TsNanos() - e.Dur*1000 - int64(e.DurNs))
+				if begin.TsNanos() > e.TsNanos() {
+					begin.Ts, begin.TsNs = e.Ts, e.TsNs
+				}
+				syscallEvents = append(syscallEvents, e)
+				continue
+			}
+			e.Dur, e.DurNs = splitNanos(e.TsNanos() - u.TsNanos())
+			e.Ts, e.TsNs = u.Ts, u.TsNs
+			e.Args.First = u.Args.First
+			if e.Stack == nil {
+				e.Stack = u.Stack
+			}
+			if path, ok := u.Args.Data["fd_path"]; ok && e.Args.Data["fd_path"] == nil {
+				if e.Args.Data == nil {
+					e.Args.Data = make(map[string]any)
+				}
+				e.Args.Data["fd_path"] = path
+			}
+			syscallEvents = append(syscallEvents, e)
+		case e.Cat == "lifetime":
+			// Threads that exit with an error or are killed get a
+			// lifetime slice of their own name, and so of another
+			// color.
+			if exit := abnormalExit(e); exit != "" {
+				begin.Name = "lifetime (" + exit + ")"
+				begin.Cname = "terrible"
+				e.Cname = "terrible"
+			}
+			syscallEvents = append(syscallEvents, e)
+		case e.Cat == "signal":
+			syscallEvents = append(syscallEvents, e)
+		case e.Cat == "other":
+			break
+		default:
+			syscallEvents = append(syscallEvents, e)
+		}
+	}
+	// The syscalls never resumed were still running when their thread
+	// exited, or when tracing stopped.
+	var traceEnd int64
+	exits := make(map[int]int64) // [tid]
+	for _, e := range syscallEvents {
+		traceEnd = max(traceEnd, e.EndNanos())
+		if e.Cat == "lifetime" && e.Ph == "E" {
+			exits[e.Tid] = e.TsNanos()
+		}
+	}
+	// They are kept in the order they started, whatever the order of the
+	// threads in the map.
+	var unresumed []*Event
+	for _, unfinished := range preserved {
+		unresumed = append(unresumed, unfinished...)
+	}
+	sort.SliceStable(unresumed, func(i, j int) bool {
+		if unresumed[i].TsNanos() != unresumed[j].TsNanos() {
+			return unresumed[i].TsNanos() < unresumed[j].TsNanos()
+		}
+		return unresumed[i].Tid < unresumed[j].Tid
+	})
+	for _, u := range unresumed {
+		end, until := traceEnd, "the end of the trace"
+		if exit, ok := exits[u.Tid]; ok && exit >= u.TsNanos() {
+			end, until = exit, "its thread exited"
+		}
+		p.logf("%s of %d never resumed, kept as a slice until %s", u.Name, u.Tid, until)
+		u.EndUnfinished(end)
+		p.Stats.Unresumed++
+	}
+	syscallEvents = insertByTs(syscallEvents, unresumed)
+	for _, e := range syscallEvents {
+		if p.Ltrace {
+			ltraceCategory(e)
+		}
+		if e.Cat != "lifetime" && e.Cat != "signal" {
+			e.ParseArgs()
+		}
+	}
+	p.Stats.Events = len(syscallEvents)
+	p.Stats.TooLong = scanner.TooLong()
+	if p.Err == nil {
+		p.Err = scanner.Err()
+	}
+	return syscallEvents
+}
@@ -0,0 +1,128 @@
+package traceconv
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// errnoOf returns the errno of a failed syscall's return value, e.g. ENOENT.
+func errnoOf(returnValue string) string {
+	if fields := strings.Fields(returnValue); len(fields) >= 2 && strings.HasPrefix(fields[1], "E") {
+		return fields[1]
+	}
+	return ""
+}
+
+func TestParse(t *testing.T) {
+	f, err := os.Open("testdata/syntax.strace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	events := Parse(f)
+
+	want := []struct {
+		ph, cat, name string
+		tid           int
+		args          string
+		returnValue   string
+		errno         string
+		dur           int64 // microseconds
+	}{
+		{"B", "lifetime", "lifetime (killed by SIGKILL)", 1000, "", "", "", 0},
+		{"X", "successful", "execve", 1000, `("/bin/sh", ["sh", "-c", "echo \"(a = b)\" {x}"], 0x7ffd5a0b0e08 /* 20 vars */)`, "0", "", 300},
+		{"X", "successful", "openat", 1000, `(AT_FDCWD, "/etc/ld.so.cache", O_RDONLY|O_CLOEXEC)`, "3", "", 20},
+		{"X", "successful", "write", 1000, `(1, "a) = 1 <0.5>\n", 13)`, "13", "", 10},
+		{"X", "failed", "openat", 1000, `(AT_FDCWD, "/nonexistent", O_RDONLY)`, "-1 ENOENT (No such file or directory)", "ENOENT", 8},
+		{"X", "successful", "fstat", 1000, `(3, {st_mode=S_IFREG|0644, st_size=1234, ...})`, "0", "", 5},
+		{"X", "successful", "clone", 1000, `(child_stack=NULL, flags=CLONE_CHILD_CLEARTID|CLONE_CHILD_SETTID|SIGCHLD, child_tidptr=0x7f3c1a2b3a10)`, "1001", "", 100},
+		{"B", "lifetime", "lifetime (exit 2)", 1001, "", "", "", 0},
+		{"X", "successful", "connect", 1001, `(4, {sa_family=AF_INET, sin_port=htons(80), sin_addr=inet_addr("127.0.0.1")}, 16)`, "0", "", 50},
+		{"X", "successful", "read", 1001, `(0, "{\"k\": \"v = (w)\"}", 4096)`, "16", "", 20},
+		{"X", "successful", "exit_group", 1001, "(2)", "?", "", 0},
+		{"E", "lifetime", "lifetime", 1001, "exited with 2", "", "", 0},
+		// Resumed: its start, args and all, is the unfinished call's.
+		{"X", "detached", "wait4", 1000, "(-1,  [{WIFEXITED(s) && WEXITSTATUS(s) == 2}], 0, NULL)", "1001", "", 400},
+		{"i", "signal", "SIGCHLD", 1000, "", "", "", 0},
+		{"X", "successful", "rt_sigreturn", 1000, "({mask=[]})", "61", "", 4},
+		{"X", "successful", "kill", 1000, "(1000, SIGKILL)", "?", "", 0},
+		{"E", "lifetime", "lifetime", 1000, "killed by SIGKILL", "", "", 0},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("Parse returned %d events, want %d", len(events), len(want))
+	}
+	for i, w := range want {
+		e := events[i]
+		args := e.Args.First + e.Args.Second
+		if e.Ph != w.ph || e.Cat != w.cat || e.Name != w.name || e.Tid != w.tid || args != w.args || e.Args.ReturnValue != w.returnValue || errnoOf(e.Args.ReturnValue) != w.errno || e.Dur != w.dur {
+			t.Errorf("event %d = %s %s %s tid %d %q = %q (%s) %dus, want %s %s %s tid %d %q = %q (%s) %dus", i,
+				e.Ph, e.Cat, e.Name, e.Tid, args, e.Args.ReturnValue, errnoOf(e.Args.ReturnValue), e.Dur,
+				w.ph, w.cat, w.name, w.tid, w.args, w.returnValue, w.errno, w.dur)
+		}
+	}
+
+	// The -yy paths are taken out of the args.
+	for i, path := range map[int]string{2: "/etc/ld.so.cache", 3: "pipe:[4242]", 5: "/etc/ld.so.cache", 8: "TCP:[127.0.0.1:5000->127.0.0.1:80]"} {
+		if got := events[i].Args.Data["fd_path"]; got != path {
+			t.Errorf("event %d (%s) fd_path = %v, want %s", i, events[i].Name, got, path)
+		}
+	}
+	if got := events[13].Args.Data["si_pid"]; got != "1001" {
+		t.Errorf("SIGCHLD si_pid = %v, want 1001", got)
+	}
+	if got := events[11].Args.Data["exit_code"]; got != 2 {
+		t.Errorf("exit of 1001 exit_code = %v, want 2", got)
+	}
+}
+
+func TestParseThreads(t *testing.T) {
+	f, err := os.Open("testdata/threads.strace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	p := new(Parser)
+	events := p.Parse(f)
+
+	// The resumed calls are paired on their thread, with the latest
+	// unfinished call of their name when the thread has several; the ones
+	// never resumed last until the end of the trace, and are inserted
+	// where they started.
+	want := []struct {
+		cat, name string
+		tid       int
+		first     string
+		ts, dur   int64 // microseconds
+	}{
+		{"successful", "futex", 2003, "(0x55d0c0a0, FUTEX_WAKE_PRIVATE, 1)", 1651010490000300, 10},
+		{"detached", "futex", 2000, "(0x55d0c0a0, FUTEX_WAIT_PRIVATE, 0, NULL ", 1651010490000000, 400},
+		{"detached", "epoll_wait", 2001, "(5,  ", 1651010490000100, 500},
+		{"detached", "futex", 2002, "(0x55d0c0c0, FUTEX_WAIT_PRIVATE, 0, NULL ", 1651010490000500, 200},
+		{"detached", "futex", 2002, "(0x55d0c0b0, FUTEX_WAIT_PRIVATE, 0, NULL ", 1651010490000200, 700},
+		{"unfinished", "epoll_wait", 2000, "(5,  ", 1651010490000800, 1202},
+		{"unfinished", "futex", 2001, "(0x55d0c0d0, FUTEX_WAIT_PRIVATE, 0, NULL ", 1651010490001000, 1002},
+		{"unfinished", "epoll_wait", 2003, "(6,  ", 1651010490001000, 1002},
+		{"successful", "getpid", 2002, "()", 1651010490002000, 2},
+	}
+	var syscalls []*Event
+	for _, e := range events {
+		if e.Cat != "lifetime" {
+			syscalls = append(syscalls, e)
+		}
+	}
+	if len(syscalls) != len(want) {
+		t.Fatalf("Parse returned %d syscalls, want %d", len(syscalls), len(want))
+	}
+	for i, w := range want {
+		e := syscalls[i]
+		if e.Cat != w.cat || e.Name != w.name || e.Tid != w.tid || e.Args.First != w.first || e.Ts != w.ts || e.Dur != w.dur {
+			t.Errorf("syscall %d = %s %s tid %d %q at %d for %dus, want %s %s tid %d %q at %d for %dus", i,
+				e.Cat, e.Name, e.Tid, e.Args.First, e.Ts, e.Dur,
+				w.cat, w.name, w.tid, w.first, w.ts, w.dur)
+		}
+	}
+	if p.Stats.Unresumed != 3 {
+		t.Errorf("Unresumed = %d, want 3", p.Stats.Unresumed)
+	}
+}
@@ -0,0 +1,165 @@
+package traceconv
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+var (
+	rePersonality = `^(\d+) +(\d+\.\d+) +\[ Process PID=(\d+) runs in (.+) mode\. \]` // pid,ts,pid,personality
+
+	regexpPersonality = regexp.MustCompile(rePersonality)
+
+	// compatSyscalls maps the syscalls that only exist for 32-bit tracees to
+	// their 64-bit equivalents, so that 32-bit helpers (still spawned by some
+	// build toolchains) are categorized and filtered like the rest.
+	compatSyscalls = map[string]string{
+		"mmap2":        "mmap",
+		"_llseek":      "lseek",
+		"_newselect":   "select",
+		"stat64":       "stat",
+		"lstat64":      "lstat",
+		"fstat64":      "fstat",
+		"fstatat64":    "newfstatat",
+		"statfs64":     "statfs",
+		"fstatfs64":    "fstatfs",
+		"fcntl64":      "fcntl",
+		"truncate64":   "truncate",
+		"ftruncate64":  "ftruncate",
+		"sendfile64":   "sendfile",
+		"ugetrlimit":   "getrlimit",
+		"fadvise64_64": "fadvise64",
+		"chown32":      "chown",
+		"lchown32":     "lchown",
+		"fchown32":     "fchown",
+		"getuid32":     "getuid",
+		"getgid32":     "getgid",
+		"geteuid32":    "geteuid",
+		"getegid32":    "getegid",
+		"setuid32":     "setuid",
+		"setgid32":     "setgid",
+		"setreuid32":   "setreuid",
+		"setregid32":   "setregid",
+		"setresuid32":  "setresuid",
+		"setresgid32":  "setresgid",
+		"getresuid32":  "getresuid",
+		"getresgid32":  "getresgid",
+		"getgroups32":  "getgroups",
+		"setgroups32":  "setgroups",
+		"setfsuid32":   "setfsuid",
+		"setfsgid32":   "setfsgid",
+
+		// The 64-bit time variants 32-bit glibc makes by default.
+		"clock_gettime64":              "clock_gettime",
+		"clock_settime64":              "clock_settime",
+		"clock_adjtime64":              "clock_adjtime",
+		"clock_getres_time64":          "clock_getres",
+		"clock_nanosleep_time64":       "clock_nanosleep",
+		"timer_gettime64":              "timer_gettime",
+		"timer_settime64":              "timer_settime",
+		"timerfd_gettime64":            "timerfd_gettime",
+		"timerfd_settime64":            "timerfd_settime",
+		"utimensat_time64":             "utimensat",
+		"pselect6_time64":              "pselect6",
+		"ppoll_time64":                 "ppoll",
+		"io_pgetevents_time64":         "io_pgetevents",
+		"recvmmsg_time64":              "recvmmsg",
+		"mq_timedsend_time64":          "mq_timedsend",
+		"mq_timedreceive_time64":       "mq_timedreceive",
+		"semtimedop_time64":            "semtimedop",
+		"rt_sigtimedwait_time64":       "rt_sigtimedwait",
+		"futex_time64":                 "futex",
+		"sched_rr_get_interval_time64": "sched_rr_get_interval",
+	}
+)
+
+// personalities tracks the personality (64 bit, 32 bit, x32) each thread
+// runs in. strace prints a notice when a tracee changes personality, unless
+// it runs with -q as it does by default; without the notices, 32-bit tracees
+// are recognized by the syscalls only they make, such as mmap2 and
+// futex_time64 which 32-bit glibc makes from the start. The threads and
+// processes a thread creates run in its personality, until they execute a
+// program.
+type personalities map[int]string // [tid]
+
+// notice records a personality change notice, and reports whether the line
+// was one.
+func (p personalities) notice(line string) bool {
+	m := regexpPersonality.FindStringSubmatch(line)
+	if len(m) != 5 {
+		return false
+	}
+	tid, err := convertID(m[3])
+	if err != nil {
+		return false
+	}
+	p[tid] = m[4]
+	return true
+}
+
+// normalize renames the 32-bit syscalls to their 64-bit equivalents, keeping
+// the original name in the args, and labels the syscalls of threads not
+// running in the native personality with it.
+func (p personalities) normalize(e *Event) {
+	if name, ok := compatSyscalls[e.Name]; ok {
+		if p[e.Tid] == "" {
+			p[e.Tid] = "32 bit"
+		}
+		if e.Args.Data == nil {
+			e.Args.Data = make(map[string]any)
+		}
+		e.Args.Data["syscall"] = e.Name
+		e.Name = name
+	}
+	personality := p[e.Tid]
+	if personality != "" && personality != "64 bit" && e.Cat != "lifetime" {
+		if e.Args.Data == nil {
+			e.Args.Data = make(map[string]any)
+		}
+		e.Args.Data["personality"] = personality
+	}
+	if e.Cat != "successful" {
+		return
+	}
+	switch {
+	case e.Name == "execve" || e.Name == "execveat":
+		// The program executed sets the personality, which a notice or
+		// its syscalls tell again.
+		delete(p, e.Tid)
+	case isClone(e) && personality != "":
+		if child, err := strconv.Atoi(e.Args.ReturnValue); err == nil && p[child] == "" {
+			p[child] = personality
+		}
+	}
+}
+
+// PersonalityLabels labels the processes that made syscalls in a non-native
+// personality with it.
+func PersonalityLabels(syscallEvents []*Event) []*Event {
+	labels := make(map[int]string) // [pid]
+	for _, e := range syscallEvents {
+		if personality, ok := e.Args.Data["personality"].(string); ok {
+			labels[e.Pid] = personality
+		}
+	}
+	pids := make([]int, 0, len(labels))
+	for pid := range labels {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	var events []*Event
+	for _, pid := range pids {
+		events = append(events, &Event{
+			Name: "process_labels",
+			Ph:   "M",
+			Cat:  "__metadata",
+			Pid:  pid,
+			Tid:  pid,
+			Args: Args{
+				Labels: labels[pid],
+			},
+		})
+	}
+	return events
+}
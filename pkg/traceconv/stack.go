@@ -0,0 +1,75 @@
+package traceconv
+
+import (
+	"path"
+	"strconv"
+	"strings"
+)
+
+// stackFramePrefix starts the backtrace lines strace -k prints after a
+// syscall, innermost frame first:
+//
+//	> /usr/lib/libc.so.6(read+0x12) [0x10f1e2]
+const stackFramePrefix = " > "
+
+// StackFrame is an entry of the "stackFrames" dictionary of a JSON trace,
+// which events refer to by id in "sf".
+type StackFrame struct {
+	Name     string `json:"name"`
+	Category string `json:"category"`
+	Parent   string `json:"parent,omitempty"`
+}
+
+// ParseStackFrame returns the function and the file name of the binary of a
+// frame printed by strace -k, without the " > " prefix. Frames without symbols
+// are named after their address.
+func ParseStackFrame(frame string) (name, category string) {
+	binary, rest, ok := strings.Cut(frame, "(")
+	if !ok {
+		// e.g. unexpected_backtracing_error
+		return frame, ""
+	}
+	symbol, rest, _ := strings.Cut(rest, ")")
+	symbol, _, _ = strings.Cut(symbol, "+")
+	if symbol == "" {
+		symbol = strings.Trim(strings.TrimSpace(rest), "[]")
+	}
+	return symbol, path.Base(binary)
+}
+
+// stackFrames interns the stacks of the events written to a trace into a
+// stackFrames dictionary, sharing the frames of common callers.
+type stackFrames struct {
+	ids    map[stackFrameKey]string
+	frames map[string]StackFrame
+}
+
+type stackFrameKey struct {
+	parent string
+	frame  string
+}
+
+func newStackFrames() *stackFrames {
+	return &stackFrames{
+		ids:    make(map[stackFrameKey]string),
+		frames: make(map[string]StackFrame),
+	}
+}
+
+// intern returns the id of the innermost frame of a stack, innermost frame
+// first, adding the frames not seen yet.
+func (s *stackFrames) intern(stack []string) string {
+	parent := ""
+	for i := len(stack) - 1; i >= 0; i-- {
+		k := stackFrameKey{parent: parent, frame: stack[i]}
+		id, ok := s.ids[k]
+		if !ok {
+			id = strconv.Itoa(len(s.ids) + 1)
+			s.ids[k] = id
+			name, category := ParseStackFrame(stack[i])
+			s.frames[id] = StackFrame{Name: name, Category: category, Parent: parent}
+		}
+		parent = id
+	}
+	return parent
+}
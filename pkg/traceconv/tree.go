@@ -0,0 +1,395 @@
+package traceconv
+
+import (
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ProcTree describes processes that were already running when strace
+// attached to them, which strace's output says nothing about: which threads
+// belong to the same process, and what they are called.
+//
+// Names may also name threads not in Threads, as read from /proc while
+// tracing, for the threads that strace's output leaves unnamed.
+type ProcTree struct {
+	Threads map[int]int    // [tid]pid
+	Names   map[int]string // [tid]name
+}
+
+// nameChange is a process taking a name, from the parent it was forked from
+// or from the program it executed.
+type nameChange struct {
+	ts   int64
+	name string
+}
+
+// BuildProcessTree reconstructs the process tree from the syscall events,
+// fixing up their pids, and returns the process/thread names, their sort
+// order and the flows between parents and children as metadata events. tree
+// describes the processes strace attached to, if any.
+//
+// The processes are named after the last program they executed. The ones
+// that went by several names, such as the children of a shell that run
+// under the name of the shell until they execute a command, also get a
+// timeline of their names.
+func BuildProcessTree(syscallEvents []*Event, tree ProcTree) []*Event {
+	processNames := make(map[int]string)
+	threadNames := make(map[int]string)
+	processThreads := make(map[int]int)
+	nameChanges := make(map[int][]nameChange) // [pid]
+	processEnd := make(map[int]int64)         // [pid]
+	var firstSeen []*Event                    // first syscall of each thread
+	seenTids := make(map[int]bool)
+	if len(syscallEvents) == 0 {
+		return nil
+	}
+	// Processes that were attached to are known from /proc, the others are
+	// found through the clones that create them.
+	for tid, pid := range tree.Threads {
+		processThreads[tid] = pid
+		threadNames[tid] = tree.Names[tid]
+		if tid == pid {
+			processNames[pid] = tree.Names[tid]
+			nameChanges[pid] = []nameChange{{ts: syscallEvents[0].Ts, name: tree.Names[tid]}}
+		}
+	}
+	if _, ok := processThreads[syscallEvents[0].Tid]; !ok {
+		processThreads[syscallEvents[0].Tid] = syscallEvents[0].Pid
+	}
+	// First construct the process tree. This is needed because sometimes the
+	// fork/clone syscall returns after the thread has started executing and
+	// some syscalls have been called.
+	for _, e := range syscallEvents {
+		pid, ok := processThreads[e.Tid]
+		if ok {
+			e.Pid = pid
+		}
+		if isClone(e) {
+			childTid, err := strconv.Atoi(e.Args.ReturnValue)
+			if err == nil {
+				if isThreadClone(e) {
+					processThreads[childTid] = e.Pid
+				} else {
+					processThreads[childTid] = childTid
+				}
+			}
+		}
+	}
+	for _, e := range syscallEvents {
+		pid, ok := processThreads[e.Tid]
+		if ok {
+			e.Pid = pid
+		}
+		if isClone(e) {
+			childTid, err := strconv.Atoi(e.Args.ReturnValue)
+			if err == nil {
+				if isThreadClone(e) {
+					processThreads[childTid] = e.Pid
+				} else {
+					processThreads[childTid] = childTid
+				}
+			}
+		}
+	}
+	// Now we can get the process names and flows between parent/children.
+	var metadataEvents []*Event
+	var nextFlowId uint64
+	for _, e := range syscallEvents {
+		pid, ok := processThreads[e.Tid]
+		if ok {
+			e.Pid = pid
+		}
+		processEnd[e.Pid] = max(processEnd[e.Pid], e.Ts+e.Dur)
+		if !seenTids[e.Tid] {
+			seenTids[e.Tid] = true
+			firstSeen = append(firstSeen, e)
+		}
+		if e.Cat == "library" {
+			// The syscalls the library calls make name the
+			// processes and threads.
+			continue
+		}
+		if e.Name == "prctl" && strings.Contains(e.Args.First, "PR_SET_NAME") {
+			threadName := e.Args.First
+			m := regexpPrctl.FindStringSubmatch(threadName)
+			if len(m) == 2 {
+				threadName = m[1]
+			}
+			threadNames[e.Tid] = threadName
+		}
+		if e.Name == "execve" {
+			processName := e.Args.First
+			m := regexpExecve.FindStringSubmatch(processName)
+			if len(m) == 4 {
+				processName = m[2]
+				if m[3] == "..." {
+					processName = path.Base(m[1])
+				}
+			}
+			processNames[e.Pid] = processName
+			threadNames[e.Tid] = processName
+			nameChanges[e.Pid] = append(nameChanges[e.Pid], nameChange{ts: e.Ts, name: processName})
+		}
+		if e.Name == "write" {
+			m := regexpGlobalEvent.FindStringSubmatch(e.Args.First)
+			if len(m) == 2 && strings.HasPrefix(m[1], markerPrefix) {
+				metadataEvents = append(metadataEvents, MarkerEvents(m[1], e.Pid, e.Tid, e.TsNanos(), e.EndNanos())...)
+			} else if len(m) == 2 {
+				metadataEvents = append(
+					metadataEvents,
+					&Event{
+						Name:  strings.TrimSpace(m[1]),
+						Cat:   "event",
+						Ph:    "i",
+						Pid:   e.Pid,
+						Tid:   e.Tid,
+						Scope: "g",
+						Ts:    e.Ts,
+						TsNs:  e.TsNs,
+					},
+				)
+			}
+		}
+		if isClone(e) {
+			childTid, err := strconv.Atoi(e.Args.ReturnValue)
+			if err == nil {
+				metadataEvents = append(
+					metadataEvents,
+					&Event{
+						Name: e.Name,
+						Cat:  "clone",
+						Ph:   "s",
+						Pid:  e.Pid,
+						Tid:  e.Tid,
+						Ts:   e.Ts + 1,
+						Id:   nextFlowId,
+					},
+				)
+				// A clone that returns after the child started
+				// comes after the child's execve, which names it.
+				if _, ok := threadNames[childTid]; !ok {
+					threadNames[childTid] = threadNames[e.Tid]
+				}
+				if isThreadClone(e) {
+					metadataEvents = append(
+						metadataEvents,
+						&Event{
+							Name: e.Name,
+							Cat:  "clone",
+							Ph:   "f",
+							Pid:  e.Pid,
+							Tid:  childTid,
+							Ts:   e.Ts + 1,
+							Id:   nextFlowId,
+						},
+					)
+				} else {
+					metadataEvents = append(
+						metadataEvents,
+						&Event{
+							Name: e.Name,
+							Cat:  "clone",
+							Ph:   "f",
+							Pid:  childTid,
+							Tid:  childTid,
+							Ts:   e.Ts + 1,
+							Id:   nextFlowId,
+						},
+					)
+					if _, ok := processNames[childTid]; !ok {
+						processNames[childTid] = processNames[e.Pid]
+					}
+					nameChanges[childTid] = append(nameChanges[childTid], nameChange{ts: e.Ts, name: processNames[e.Pid]})
+				}
+				nextFlowId++
+			}
+		}
+	}
+	// The threads that were named neither by strace's output nor by the
+	// process they are cloned from go by their name in /proc, if known.
+	for _, e := range syscallEvents {
+		if _, ok := threadNames[e.Tid]; !ok && tree.Names[e.Tid] != "" {
+			threadNames[e.Tid] = tree.Names[e.Tid]
+			processThreads[e.Tid] = e.Pid
+		}
+		if _, ok := processNames[e.Pid]; !ok && tree.Names[e.Pid] != "" {
+			processNames[e.Pid] = tree.Names[e.Pid]
+		}
+	}
+	metadataEvents = append(metadataEvents, nameTimelines(nameChanges, processEnd)...)
+	for pid, name := range processNames {
+		metadataEvents = append(
+			metadataEvents,
+			&Event{
+				Name: "process_name",
+				Ph:   "M",
+				Pid:  pid,
+				Tid:  pid,
+				Cat:  "__metadata",
+				Args: Args{
+					Name: name,
+				},
+			},
+		)
+	}
+	for tid, name := range threadNames {
+		metadataEvents = append(
+			metadataEvents,
+			&Event{
+				Name: "thread_name",
+				Ph:   "M",
+				Tid:  tid,
+				Pid:  processThreads[tid],
+				Cat:  "__metadata",
+				Args: Args{
+					Name: name,
+				},
+			},
+		)
+	}
+	metadataEvents = append(metadataEvents, sortIndexes(firstSeen)...)
+	return metadataEvents
+}
+
+// sortIndexes returns the process_sort_index and thread_sort_index metadata
+// events that order the processes and their threads by when they were
+// spawned, given the first syscall of each thread in the order they were
+// made: the root process first and its children below it, rather than by
+// pid, which wraps around and is shared by the processes of appended runs.
+// The main thread of a process comes first whenever its threads were seen.
+func sortIndexes(firstSeen []*Event) []*Event {
+	var events []*Event
+	processIndex := make(map[int]int)
+	threadIndex := make(map[int]int) // [pid]
+	for _, e := range firstSeen {
+		if _, ok := processIndex[e.Pid]; !ok {
+			processIndex[e.Pid] = len(processIndex) + 1
+			events = append(events, &Event{
+				Name: "process_sort_index",
+				Ph:   "M",
+				Pid:  e.Pid,
+				Tid:  e.Pid,
+				Cat:  "__metadata",
+				Args: Args{SortIndex: processIndex[e.Pid]},
+			})
+		}
+		index := 1
+		if e.Tid != e.Pid {
+			threadIndex[e.Pid]++
+			index = threadIndex[e.Pid] + 1
+		}
+		events = append(events, &Event{
+			Name: "thread_sort_index",
+			Ph:   "M",
+			Pid:  e.Pid,
+			Tid:  e.Tid,
+			Cat:  "__metadata",
+			Args: Args{SortIndex: index},
+		})
+	}
+	return events
+}
+
+// cloneThread is the CLONE_THREAD flag, for the clone flags printed as a
+// number, by ltrace -S or by strace -X raw.
+const cloneThread = 0x10000
+
+// isClone reports whether e is a syscall creating a thread or a process. The
+// fork of a library call traced with ltrace isn't, the clone syscall it
+// makes is.
+//
+// The parent of a vfork, or of a clone with CLONE_VFORK, is suspended until
+// its child executes a program or exits, which strace shows as the vfork
+// returning after the child's execve: the child is found in a first pass
+// over the syscalls, as for the clones that return late.
+func isClone(e *Event) bool {
+	if e.Cat == "library" {
+		return false
+	}
+	switch e.Name {
+	case "fork", "vfork", "clone", "clone3":
+		return true
+	}
+	return false
+}
+
+// isThreadClone reports whether a clone syscall created a thread rather than
+// a process, from its CLONE_THREAD flag. A clone3 whose struct clone_args
+// wasn't decoded, as ltrace -S prints it, is taken for a process.
+func isThreadClone(e *Event) bool {
+	flags := cloneFlags(e)
+	if strings.Contains(flags, "CLONE_THREAD") {
+		return true
+	}
+	n, err := strconv.ParseUint(flags, 0, 64)
+	return err == nil && n&cloneThread != 0
+}
+
+// cloneFlags returns the flags a clone or clone3 was made with, by name or as
+// a number, or "" if they aren't known. strace prints them as the flags arg
+// of clone, and as the flags field of the struct clone_args of clone3:
+//
+//	clone(child_stack=NULL, flags=CLONE_CHILD_CLEARTID|SIGCHLD, ...)
+//	clone3({flags=CLONE_VM|CLONE_THREAD|..., exit_signal=0, ...} => {parent_tid=[124]}, 88)
+//
+// ltrace -S prints the flags of clone as its first arg, a number.
+func cloneFlags(e *Event) string {
+	args := splitArgs(e.Args.First)
+	if len(args) == 0 {
+		return ""
+	}
+	if e.Name == "clone3" {
+		cloneArgs, _, _ := strings.Cut(args[0], " => ")
+		if !strings.HasPrefix(cloneArgs, "{") {
+			return ""
+		}
+		args = splitArgs(strings.TrimSuffix(strings.TrimPrefix(cloneArgs, "{"), "}"))
+	}
+	for _, arg := range args {
+		if flags, ok := strings.CutPrefix(arg, "flags="); ok {
+			return flags
+		}
+	}
+	if e.Name == "clone" {
+		return args[0]
+	}
+	return ""
+}
+
+// nameTimelines returns, for the processes that went by several names, a
+// track of async slices with the name of the process over time, each name
+// lasting until the next one or the end of the process.
+func nameTimelines(nameChanges map[int][]nameChange, processEnd map[int]int64) []*Event {
+	var events []*Event
+	for pid, changes := range nameChanges {
+		sort.SliceStable(changes, func(i, j int) bool {
+			return changes[i].ts < changes[j].ts
+		})
+		var names []nameChange
+		for _, c := range changes {
+			if c.name == "" || len(names) > 0 && names[len(names)-1].name == c.name {
+				continue
+			}
+			names = append(names, c)
+		}
+		if len(names) < 2 {
+			continue
+		}
+		for i, c := range names {
+			end := max(processEnd[pid], c.ts)
+			if i+1 < len(names) {
+				end = names[i+1].ts
+			}
+			events = append(events,
+				&Event{Name: c.name, Cat: "process name", Ph: "b", Pid: pid, Tid: pid, Ts: c.ts, Id: uint64(pid)},
+				&Event{Name: c.name, Cat: "process name", Ph: "e", Pid: pid, Tid: pid, Ts: end, Id: uint64(pid)},
+			)
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Ts < events[j].Ts
+	})
+	return events
+}
@@ -0,0 +1,107 @@
+package traceconv
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// Writer streams a JSON trace: the events are encoded and written as they
+// come, so that the encoded trace, which for tens of millions of syscalls
+// runs into gigabytes, is never held in memory. The events themselves still
+// are, by the caller: the process tree and most annotations need all of them
+// before anything can be written.
+type Writer struct {
+	w      io.Writer
+	events int
+	stacks *stackFrames
+	err    error
+}
+
+// NewWriter returns a writer of a JSON trace to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w, stacks: newStackFrames()}
+}
+
+func (tw *Writer) write(s string) {
+	if tw.err == nil {
+		_, tw.err = io.WriteString(tw.w, s)
+	}
+}
+
+// WriteEvent appends an event to the trace. The stack of the event, if any,
+// is added to the stackFrames of the trace.
+func (tw *Writer) WriteEvent(e *Event) error {
+	b, err := tw.Encode(e)
+	if err != nil {
+		return err
+	}
+	return tw.WriteEncoded(b)
+}
+
+// Encode encodes an event as WriteEvent writes it, for the callers that need
+// its size before writing it with WriteEncoded. The stack of the event, if
+// any, is added to the stackFrames of the trace.
+func (tw *Writer) Encode(e *Event) ([]byte, error) {
+	if len(e.Stack) > 0 {
+		e.Sf = tw.stacks.intern(e.Stack)
+	}
+	return json.MarshalIndent(e, "  ", " ")
+}
+
+// WriteEncoded appends an event encoded by Encode to the trace.
+func (tw *Writer) WriteEncoded(b []byte) error {
+	if tw.events == 0 {
+		tw.write("{\n \"traceEvents\": [\n  ")
+	} else {
+		tw.write(",\n  ")
+	}
+	if tw.err == nil {
+		_, tw.err = tw.w.Write(b)
+	}
+	tw.events++
+	return tw.err
+}
+
+// Close ends the list of events and writes the stack frames and the metadata.
+// It doesn't close the underlying writer.
+func (tw *Writer) Close(metadata map[string]any) error {
+	if tw.events == 0 {
+		tw.write("{\n \"traceEvents\": []")
+	} else {
+		tw.write("\n ]")
+	}
+	if len(tw.stacks.frames) > 0 {
+		b, err := json.MarshalIndent(tw.stacks.frames, " ", " ")
+		if err != nil {
+			return err
+		}
+		tw.write(",\n \"stackFrames\": ")
+		if tw.err == nil {
+			_, tw.err = tw.w.Write(b)
+		}
+	}
+	if len(metadata) > 0 {
+		b, err := json.MarshalIndent(metadata, " ", " ")
+		if err != nil {
+			return err
+		}
+		tw.write(",\n \"metadata\": ")
+		if tw.err == nil {
+			_, tw.err = tw.w.Write(b)
+		}
+	}
+	tw.write("\n}")
+	return tw.err
+}
+
+// Write writes a whole JSON trace, in the object format with the events in
+// "traceEvents" and the metadata, if any, in "metadata".
+func Write(w io.Writer, events []*Event, metadata map[string]any) error {
+	tw := NewWriter(w)
+	for _, e := range events {
+		if err := tw.WriteEvent(e); err != nil {
+			return err
+		}
+	}
+	return tw.Close(metadata)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/replit/strace-perfetto/pkg/traceconv"
+)
+
+// Field numbers of the pprof profile (github.com/google/pprof/proto/profile.proto).
+const (
+	pprofProfileSampleType        = 1
+	pprofProfileSample            = 2
+	pprofProfileLocation          = 4
+	pprofProfileFunction          = 5
+	pprofProfileStringTable       = 6
+	pprofProfileTimeNanos         = 9
+	pprofProfileDurationNanos     = 10
+	pprofProfilePeriodType        = 11
+	pprofProfilePeriod            = 12
+	pprofProfileDefaultSampleType = 14
+
+	pprofValueTypeType = 1
+	pprofValueTypeUnit = 2
+
+	pprofSampleLocationID = 1
+	pprofSampleValue      = 2
+
+	pprofLocationID   = 1
+	pprofLocationLine = 4
+	pprofLineFunction = 1
+
+	pprofFunctionID       = 1
+	pprofFunctionName     = 2
+	pprofFunctionFilename = 4
+)
+
+// pprofFrame is a function of a pprof profile: a syscall, a frame of the
+// stack it was made from, a thread or a process.
+type pprofFrame struct {
+	name, file string
+}
+
+// pprofProfile builds a pprof profile, interning its strings and functions.
+type pprofProfile struct {
+	strings   []string
+	stringIDs map[string]uint64
+	functions map[pprofFrame]uint64
+	b         []byte
+}
+
+func newPprofProfile() *pprofProfile {
+	p := &pprofProfile{
+		stringIDs: make(map[string]uint64),
+		functions: make(map[pprofFrame]uint64),
+	}
+	p.str("")
+	return p
+}
+
+func (p *pprofProfile) str(s string) uint64 {
+	id, ok := p.stringIDs[s]
+	if !ok {
+		id = uint64(len(p.strings))
+		p.stringIDs[s] = id
+		p.strings = append(p.strings, s)
+	}
+	return id
+}
+
+// location returns the id of the location of a frame, which is also the id of
+// its function, adding both the first time.
+func (p *pprofProfile) location(f pprofFrame) uint64 {
+	id, ok := p.functions[f]
+	if ok {
+		return id
+	}
+	id = uint64(len(p.functions) + 1)
+	p.functions[f] = id
+	var fn []byte
+	fn = appendProtoVarint(fn, pprofFunctionID, id)
+	fn = appendProtoVarint(fn, pprofFunctionName, p.str(f.name))
+	if f.file != "" {
+		fn = appendProtoVarint(fn, pprofFunctionFilename, p.str(f.file))
+	}
+	p.b = appendProtoBytes(p.b, pprofProfileFunction, fn)
+	var line, loc []byte
+	line = appendProtoVarint(line, pprofLineFunction, id)
+	loc = appendProtoVarint(loc, pprofLocationID, id)
+	loc = appendProtoBytes(loc, pprofLocationLine, line)
+	p.b = appendProtoBytes(p.b, pprofProfileLocation, loc)
+	return id
+}
+
+// pprofFrameName names the frame of a thread or a process. pprof goes by
+// function names, so the main thread and its process must not share one.
+func pprofFrameName(name, kind string, id int) string {
+	if name == "" {
+		return fmt.Sprintf("%s %d", kind, id)
+	}
+	return fmt.Sprintf("%s (%s %d)", name, kind, id)
+}
+
+func (p *pprofProfile) valueType(field int, typ, unit string) {
+	var vt []byte
+	vt = appendProtoVarint(vt, pprofValueTypeType, p.str(typ))
+	vt = appendProtoVarint(vt, pprofValueTypeUnit, p.str(unit))
+	p.b = appendProtoBytes(p.b, field, vt)
+}
+
+// SavePprof writes the time spent in syscalls as a gzipped pprof profile, for
+// go tool pprof: each sample is the calls of a syscall by a thread, with the
+// thread and its process as the callers of the syscall. With -stacks, the
+// user stack the syscall was made from goes in between.
+func (te TraceEvents) SavePprof(output string) {
+	processNames := make(map[int]string)
+	threadNames := make(map[int]string)
+	for _, e := range te.Event {
+		switch {
+		case e.Ph == "M" && e.Name == "process_name":
+			processNames[e.Pid] = e.Args.Name
+		case e.Ph == "M" && e.Name == "thread_name":
+			threadNames[e.Tid] = e.Args.Name
+		}
+	}
+
+	type sample struct {
+		frames []pprofFrame // innermost first
+		calls  int64
+		dur    int64
+	}
+	var samples []*sample
+	byStack := make(map[string]*sample)
+	start, end := int64(-1), int64(0)
+	for _, e := range te.Event {
+		if !isSyscall(e) {
+			continue
+		}
+		if start < 0 {
+			start = e.TsNanos()
+		}
+		end = max(end, e.EndNanos())
+		frames := []pprofFrame{{name: e.Name}}
+		for _, frame := range e.Stack {
+			name, binary := traceconv.ParseStackFrame(frame)
+			frames = append(frames, pprofFrame{name: name, file: binary})
+		}
+		frames = append(frames,
+			pprofFrame{name: pprofFrameName(threadNames[e.Tid], "tid", e.Tid)},
+			pprofFrame{name: pprofFrameName(processNames[e.Pid], "pid", e.Pid)},
+		)
+		var key strings.Builder
+		for _, f := range frames {
+			key.WriteString(f.name + "\x00" + f.file + "\x00")
+		}
+		s := byStack[key.String()]
+		if s == nil {
+			s = &sample{frames: frames}
+			byStack[key.String()] = s
+			samples = append(samples, s)
+		}
+		s.calls++
+		s.dur += e.EndNanos() - e.TsNanos()
+	}
+
+	p := newPprofProfile()
+	p.valueType(pprofProfileSampleType, "calls", "count")
+	p.valueType(pprofProfileSampleType, "wall", "nanoseconds")
+	for _, s := range samples {
+		var locations, values, sb []byte
+		for _, f := range s.frames {
+			locations = appendVarint(locations, p.location(f))
+		}
+		values = appendVarint(values, uint64(s.calls))
+		values = appendVarint(values, uint64(s.dur))
+		sb = appendProtoBytes(sb, pprofSampleLocationID, locations)
+		sb = appendProtoBytes(sb, pprofSampleValue, values)
+		p.b = appendProtoBytes(p.b, pprofProfileSample, sb)
+	}
+	if start >= 0 {
+		p.b = appendProtoVarint(p.b, pprofProfileTimeNanos, uint64(start))
+		p.b = appendProtoVarint(p.b, pprofProfileDurationNanos, uint64(end-start))
+	}
+	p.valueType(pprofProfilePeriodType, "wall", "nanoseconds")
+	p.b = appendProtoVarint(p.b, pprofProfilePeriod, 1)
+	p.b = appendProtoVarint(p.b, pprofProfileDefaultSampleType, p.str("wall"))
+	for _, s := range p.strings {
+		p.b = appendProtoString(p.b, pprofProfileStringTable, s)
+	}
+
+	f, err := os.Create(output)
+	if err != nil {
+		log.Fatalf("[!] Error creating pprof file: %s\n", err)
+	}
+	w := gzip.NewWriter(f)
+	if _, err := w.Write(p.b); err != nil {
+		log.Fatalf("[!] Error creating pprof file: %s\n", err)
+	}
+	if err := w.Close(); err != nil {
+		log.Fatalf("[!] Error creating pprof file: %s\n", err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatalf("[!] Error creating pprof file: %s\n", err)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/replit/strace-perfetto/pkg/traceconv"
+)
+
+// procDescendants returns the pids of all the descendants of a process, found
+// by walking /proc/<pid>/task/<tid>/children. Processes that exit while
+// walking the tree are silently skipped.
+func procDescendants(pid int) []int {
+	var descendants []int
+	queue := []int{pid}
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		tasks, _ := filepath.Glob(fmt.Sprintf("/proc/%d/task/*/children", p))
+		for _, task := range tasks {
+			contents, err := os.ReadFile(task)
+			if err != nil {
+				continue
+			}
+			for _, field := range strings.Fields(string(contents)) {
+				child, err := strconv.Atoi(field)
+				if err != nil {
+					continue
+				}
+				descendants = append(descendants, child)
+				queue = append(queue, child)
+			}
+		}
+	}
+	return descendants
+}
+
+// readProcTree reads the threads and names of a process and its descendants
+// from /proc.
+func readProcTree(pid int) traceconv.ProcTree {
+	tree := traceconv.ProcTree{
+		Threads: make(map[int]int),
+		Names:   make(map[int]string),
+	}
+	for _, p := range append([]int{pid}, procDescendants(pid)...) {
+		tasks, _ := filepath.Glob(fmt.Sprintf("/proc/%d/task/*", p))
+		for _, task := range tasks {
+			tid, err := strconv.Atoi(filepath.Base(task))
+			if err != nil {
+				continue
+			}
+			comm, err := os.ReadFile(filepath.Join(task, "comm"))
+			if err != nil {
+				continue
+			}
+			tree.Threads[tid] = p
+			tree.Names[tid] = strings.TrimSpace(string(comm))
+		}
+	}
+	return tree
+}
+
+// threadNameInterval is how often the names of the traced threads are read
+// from /proc.
+const threadNameInterval = 100 * time.Millisecond
+
+// ThreadNameMonitor reads the names of the traced threads from
+// /proc/<pid>/task/<tid>/comm while tracing, for the threads strace's output
+// doesn't name: the ones that never call prctl(PR_SET_NAME) or execve and
+// weren't seen being cloned, such as the threads of an attached process.
+type ThreadNameMonitor struct {
+	mu    sync.Mutex
+	names map[int]string
+}
+
+// NewThreadNameMonitor returns a new thread name monitor.
+func NewThreadNameMonitor() *ThreadNameMonitor {
+	return &ThreadNameMonitor{names: make(map[int]string)}
+}
+
+// Run reads the names of the threads of the traced processes, as listed by
+// tracees, right away and then periodically until ctx is done.
+func (m *ThreadNameMonitor) Run(ctx context.Context, tracees func() []int) {
+	timer := time.NewTicker(threadNameInterval)
+	defer timer.Stop()
+	for {
+		m.read(tracees())
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+func (m *ThreadNameMonitor) read(pids []int) {
+	for _, pid := range pids {
+		comms, _ := filepath.Glob(fmt.Sprintf("/proc/%d/task/*/comm", pid))
+		for _, comm := range comms {
+			tid, err := strconv.Atoi(filepath.Base(filepath.Dir(comm)))
+			if err != nil {
+				continue
+			}
+			name, err := os.ReadFile(comm)
+			if err != nil {
+				continue
+			}
+			m.mu.Lock()
+			m.names[tid] = strings.TrimSpace(string(name))
+			m.mu.Unlock()
+		}
+	}
+}
+
+// AddTo adds the names read to the names of tree, leaving the threads it
+// names already alone.
+func (m *ThreadNameMonitor) AddTo(tree *traceconv.ProcTree) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if tree.Names == nil {
+		tree.Names = make(map[int]string)
+	}
+	for tid, name := range m.names {
+		if _, ok := tree.Names[tid]; !ok {
+			tree.Names[tid] = name
+		}
+	}
+}
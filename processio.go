@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// processIOInterval is how often /proc/<pid>/io is read. The counters are
+// cumulative, so the only loss from a coarse interval is the I/O done between
+// the last reading and the exit of a process, which Totals adds back from
+// the syscalls.
+const processIOInterval = 50 * time.Millisecond
+
+// ProcessIO is the content of /proc/<pid>/io.
+type ProcessIO struct {
+	Rchar               uint64 `json:"rchar"`
+	Wchar               uint64 `json:"wchar"`
+	Syscr               uint64 `json:"syscr"`
+	Syscw               uint64 `json:"syscw"`
+	ReadBytes           uint64 `json:"read_bytes"`
+	WriteBytes          uint64 `json:"write_bytes"`
+	CancelledWriteBytes uint64 `json:"cancelled_write_bytes"`
+}
+
+// ProcessIOMonitor keeps the latest /proc/<pid>/io reading of every traced
+// process, so that their I/O totals at exit can be recorded in the trace
+// metadata as ground truth for the syscall-derived numbers.
+type ProcessIOMonitor struct {
+	mu     sync.Mutex
+	totals map[int]ProcessIO
+	readAt map[int]int64 // [pid], microseconds
+}
+
+// NewProcessIOMonitor returns a new process I/O monitor.
+func NewProcessIOMonitor() *ProcessIOMonitor {
+	return &ProcessIOMonitor{
+		totals: make(map[int]ProcessIO),
+		readAt: make(map[int]int64),
+	}
+}
+
+// Run polls the I/O counters of the traced processes, as listed by tracees,
+// until ctx is done.
+func (m *ProcessIOMonitor) Run(ctx context.Context, tracees func() []int) {
+	timer := time.NewTicker(processIOInterval)
+	defer timer.Stop()
+	for {
+		for _, pid := range tracees() {
+			now := time.Now().UnixMicro()
+			var io ProcessIO
+			err := readFlatKeyedColon(fmt.Sprintf("/proc/%d/io", pid), map[string]*uint64{
+				"rchar":                 &io.Rchar,
+				"wchar":                 &io.Wchar,
+				"syscr":                 &io.Syscr,
+				"syscw":                 &io.Syscw,
+				"read_bytes":            &io.ReadBytes,
+				"write_bytes":           &io.WriteBytes,
+				"cancelled_write_bytes": &io.CancelledWriteBytes,
+			})
+			if err != nil {
+				// The process exited, its last reading is kept.
+				continue
+			}
+			m.mu.Lock()
+			m.totals[pid] = io
+			m.readAt[pid] = now
+			m.mu.Unlock()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// Totals returns the I/O totals of every traced process at its exit, keyed by
+// pid: its last reading, plus the bytes of the read and write syscalls it
+// made that returned after the reading. The storage counters (read_bytes,
+// write_bytes) are the ones of the last reading.
+func (m *ProcessIOMonitor) Totals(syscallEvents []*Event) map[int]ProcessIO {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	totals := make(map[int]ProcessIO, len(m.totals))
+	for pid, io := range m.totals {
+		totals[pid] = io
+	}
+	for _, e := range syscallEvents {
+		io, ok := totals[e.Pid]
+		if !ok || !isSyscall(e) || e.Ts+e.Dur < m.readAt[e.Pid] || e.Cat == "failed" {
+			continue
+		}
+		write := throughputWriteSyscalls[e.Name]
+		if !write && !throughputReadSyscalls[e.Name] {
+			continue
+		}
+		n, err := strconv.ParseUint(strings.Fields(e.Args.ReturnValue + " ")[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		if write {
+			io.Wchar += n
+			io.Syscw++
+		} else {
+			io.Rchar += n
+			io.Syscr++
+		}
+		totals[e.Pid] = io
+	}
+	return totals
+}
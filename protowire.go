@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Protocol buffer wire types.
+const (
+	protoVarint = 0
+	protoI64    = 1
+	protoBytes  = 2
+	protoI32    = 5
+)
+
+// The append* functions below encode protocol buffer fields. They cover just
+// enough of the wire format for the messages this tool exchanges, without
+// pulling in the protobuf runtime.
+
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func appendProtoTag(b []byte, field int, wireType int) []byte {
+	return appendVarint(b, uint64(field)<<3|uint64(wireType))
+}
+
+func appendProtoVarint(b []byte, field int, v uint64) []byte {
+	b = appendProtoTag(b, field, protoVarint)
+	return appendVarint(b, v)
+}
+
+func appendProtoFixed64(b []byte, field int, v uint64) []byte {
+	b = appendProtoTag(b, field, protoI64)
+	return binary.LittleEndian.AppendUint64(b, v)
+}
+
+func appendProtoDouble(b []byte, field int, v float64) []byte {
+	return appendProtoFixed64(b, field, math.Float64bits(v))
+}
+
+func appendProtoBytes(b []byte, field int, v []byte) []byte {
+	b = appendProtoTag(b, field, protoBytes)
+	b = appendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendProtoString(b []byte, field int, v string) []byte {
+	b = appendProtoTag(b, field, protoBytes)
+	b = appendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// parseProto calls fn with every field of an encoded message. For varint and
+// fixed-size fields the value is passed in v, for length-delimited fields the
+// contents are passed in data.
+func parseProto(b []byte, fn func(field int, wireType int, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errors.New("invalid field tag")
+		}
+		b = b[n:]
+		field, wireType := int(tag>>3), int(tag&7)
+		var v uint64
+		var data []byte
+		switch wireType {
+		case protoVarint:
+			v, n = binary.Uvarint(b)
+			if n <= 0 {
+				return fmt.Errorf("invalid varint in field %d", field)
+			}
+			b = b[n:]
+		case protoI64:
+			if len(b) < 8 {
+				return fmt.Errorf("truncated field %d", field)
+			}
+			v, b = binary.LittleEndian.Uint64(b), b[8:]
+		case protoBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return fmt.Errorf("truncated field %d", field)
+			}
+			data, b = b[n:n+int(l)], b[n+int(l):]
+		case protoI32:
+			if len(b) < 4 {
+				return fmt.Errorf("truncated field %d", field)
+			}
+			v, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		default:
+			return fmt.Errorf("unsupported wire type %d in field %d", wireType, field)
+		}
+		if err := fn(field, wireType, v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,989 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/replit/strace-perfetto/pkg/traceconv"
+)
+
+const (
+	ptraceGetSyscallInfo = 0x420e
+	ptraceOExitKill      = 0x100000
+	ptraceWNoThread      = 0x20000000 // __WNOTHREAD
+
+	ptraceSyscallInfoEntry = 1
+	ptraceSyscallInfoExit  = 2
+
+	// ptraceSyscallStop is the stop signal of the syscall stops, with
+	// PTRACE_O_TRACESYSGOOD.
+	ptraceSyscallStop = syscall.SIGTRAP | 0x80
+
+	// ptracePathMax is the size of the longest path, which strace prints in
+	// full whatever -s is.
+	ptracePathMax = 4096
+
+	// ptraceMaxArrayLen is how many elements of the arrays of strings,
+	// such as the argv of execve, are printed, as strace does.
+	ptraceMaxArrayLen = 32
+)
+
+// ptraceSyscallInfo is the struct ptrace_syscall_info PTRACE_GET_SYSCALL_INFO
+// fills in. At a syscall exit, Nr is the return value and the low byte of
+// Args[0] whether it is an error.
+type ptraceSyscallInfo struct {
+	Op   uint8
+	_    [3]uint8
+	Arch uint32
+	IP   uint64
+	SP   uint64
+	Nr   uint64
+	Args [6]uint64
+	_    uint64
+}
+
+// ptraceArgCounts are the numbers of arguments of the syscalls that
+// traceconv.ArgNames doesn't know the names of. The other syscalls get their
+// six argument registers.
+var ptraceArgCounts = map[string]int{
+	"brk": 1, "arch_prctl": 2, "rt_sigaction": 4, "rt_sigprocmask": 4, "rt_sigreturn": 0,
+	"sigaltstack": 2, "getpid": 0, "gettid": 0, "getppid": 0, "getuid": 0, "geteuid": 0,
+	"getgid": 0, "getegid": 0, "setuid": 1, "setgid": 1, "setsid": 0, "setpgid": 2,
+	"getpgid": 1, "getpgrp": 0, "set_tid_address": 1, "set_robust_list": 2, "rseq": 4,
+	"prlimit64": 4, "getrlimit": 2, "setrlimit": 2, "getrandom": 3, "mprotect": 3,
+	"madvise": 3, "mremap": 5, "msync": 3, "mlock": 2, "munlock": 2, "mincore": 3,
+	"clock_gettime": 2, "clock_getres": 2, "clock_nanosleep": 4, "nanosleep": 2,
+	"gettimeofday": 2, "time": 1, "times": 1, "alarm": 1, "setitimer": 3, "getitimer": 2,
+	"pause": 0, "poll": 3, "ppoll": 5, "select": 5, "pselect6": 6, "epoll_create": 1,
+	"epoll_create1": 1, "epoll_ctl": 4, "epoll_pwait": 6, "pipe": 1, "pipe2": 2,
+	"eventfd2": 2, "timerfd_create": 2, "timerfd_settime": 4, "signalfd4": 4,
+	"inotify_init1": 1, "inotify_add_watch": 3, "memfd_create": 2, "uname": 1,
+	"sysinfo": 1, "getcwd": 2, "fchdir": 1, "umask": 1, "exit": 1, "exit_group": 1,
+	"sched_yield": 0, "sched_getaffinity": 3, "sched_setaffinity": 3, "getrusage": 2,
+	"rename": 2, "renameat": 4, "renameat2": 5, "rmdir": 1, "symlink": 2, "symlinkat": 3,
+	"link": 2, "linkat": 5, "chmod": 2, "fchmod": 2, "fchmodat": 3, "chown": 3,
+	"fchown": 3, "lchown": 3, "fchownat": 5, "truncate": 2, "ftruncate": 2,
+	"fallocate": 4, "fadvise64": 4, "sendfile": 4, "splice": 6, "tee": 4,
+	"copy_file_range": 6, "shutdown": 2, "getsockname": 3, "getpeername": 3,
+	"setsockopt": 5, "getsockopt": 5, "socketpair": 4, "statfs": 2, "fstatfs": 2,
+	"getdents": 3, "sync": 0, "syncfs": 1, "flock": 2, "utimensat": 4, "close_range": 3,
+	"fork": 0, "vfork": 0, "clone": 5, "clone3": 2, "waitid": 5, "pidfd_open": 2,
+	"pidfd_send_signal": 4, "tkill": 2, "personality": 1, "prctl": 5, "unshare": 1,
+	"setns": 2, "mount": 5, "umount2": 2, "chroot": 1, "capget": 2, "capset": 2,
+	"membarrier": 3, "io_uring_setup": 2, "io_uring_enter": 6, "shmget": 3,
+	"shmat": 3, "shmdt": 1, "shmctl": 3, "getxattr": 4, "lgetxattr": 4,
+	"fgetxattr": 4, "setxattr": 5, "listxattr": 3, "getpriority": 2, "setpriority": 3,
+	"seccomp": 3, "bpf": 3, "perf_event_open": 5, "userfaultfd": 1, "futex_waitv": 5,
+}
+
+// ptraceFdSyscalls are the syscalls that return a new fd, whose path is read
+// once they return. The path of the fd passed as the first argument of the
+// others is read when they start.
+var ptraceFdSyscalls = map[string]bool{
+	"open": true, "openat": true, "openat2": true, "creat": true, "socket": true,
+	"accept": true, "accept4": true, "dup": true, "dup2": true, "dup3": true,
+	"epoll_create": true, "epoll_create1": true, "eventfd2": true, "memfd_create": true,
+	"timerfd_create": true, "signalfd4": true, "inotify_init1": true, "pidfd_open": true,
+}
+
+// ptraceIntArgs are the named arguments that are C ints, whose upper 32 bits
+// in the registers are left out.
+var ptraceIntArgs = map[string]bool{
+	"fd": true, "dirfd": true, "newfd": true, "epfd": true, "pid": true, "tid": true,
+	"tgid": true, "sig": true, "timeout": true, "maxevents": true,
+}
+
+// ptraceHexResults are the syscalls that return addresses, which are printed
+// in hex.
+var ptraceHexResults = map[string]bool{
+	"brk": true, "mmap": true, "mremap": true, "shmat": true,
+}
+
+var ptraceSignalNames = [...]string{
+	1: "SIGHUP", 2: "SIGINT", 3: "SIGQUIT", 4: "SIGILL", 5: "SIGTRAP", 6: "SIGABRT",
+	7: "SIGBUS", 8: "SIGFPE", 9: "SIGKILL", 10: "SIGUSR1", 11: "SIGSEGV", 12: "SIGUSR2",
+	13: "SIGPIPE", 14: "SIGALRM", 15: "SIGTERM", 16: "SIGSTKFLT", 17: "SIGCHLD",
+	18: "SIGCONT", 19: "SIGSTOP", 20: "SIGTSTP", 21: "SIGTTIN", 22: "SIGTTOU",
+	23: "SIGURG", 24: "SIGXCPU", 25: "SIGXFSZ", 26: "SIGVTALRM", 27: "SIGPROF",
+	28: "SIGWINCH", 29: "SIGIO", 30: "SIGPWR", 31: "SIGSYS",
+}
+
+var ptraceCloneFlags = []struct {
+	flag uint64
+	name string
+}{
+	{syscall.CLONE_VM, "CLONE_VM"},
+	{syscall.CLONE_FS, "CLONE_FS"},
+	{syscall.CLONE_FILES, "CLONE_FILES"},
+	{syscall.CLONE_SIGHAND, "CLONE_SIGHAND"},
+	{0x1000, "CLONE_PIDFD"},
+	{syscall.CLONE_PTRACE, "CLONE_PTRACE"},
+	{syscall.CLONE_VFORK, "CLONE_VFORK"},
+	{syscall.CLONE_PARENT, "CLONE_PARENT"},
+	{syscall.CLONE_THREAD, "CLONE_THREAD"},
+	{syscall.CLONE_NEWNS, "CLONE_NEWNS"},
+	{syscall.CLONE_SYSVSEM, "CLONE_SYSVSEM"},
+	{syscall.CLONE_SETTLS, "CLONE_SETTLS"},
+	{syscall.CLONE_PARENT_SETTID, "CLONE_PARENT_SETTID"},
+	{syscall.CLONE_CHILD_CLEARTID, "CLONE_CHILD_CLEARTID"},
+	{syscall.CLONE_DETACHED, "CLONE_DETACHED"},
+	{syscall.CLONE_UNTRACED, "CLONE_UNTRACED"},
+	{syscall.CLONE_CHILD_SETTID, "CLONE_CHILD_SETTID"},
+	{0x2000000, "CLONE_NEWCGROUP"},
+	{syscall.CLONE_NEWUTS, "CLONE_NEWUTS"},
+	{syscall.CLONE_NEWIPC, "CLONE_NEWIPC"},
+	{syscall.CLONE_NEWUSER, "CLONE_NEWUSER"},
+	{syscall.CLONE_NEWPID, "CLONE_NEWPID"},
+	{syscall.CLONE_NEWNET, "CLONE_NEWNET"},
+	{syscall.CLONE_IO, "CLONE_IO"},
+}
+
+var ptraceFutexOps = [...]string{
+	"FUTEX_WAIT", "FUTEX_WAKE", "FUTEX_FD", "FUTEX_REQUEUE", "FUTEX_CMP_REQUEUE",
+	"FUTEX_WAKE_OP", "FUTEX_LOCK_PI", "FUTEX_UNLOCK_PI", "FUTEX_TRYLOCK_PI",
+	"FUTEX_WAIT_BITSET", "FUTEX_WAKE_BITSET", "FUTEX_WAIT_REQUEUE_PI",
+	"FUTEX_CMP_REQUEUE_PI", "FUTEX_LOCK_PI2",
+}
+
+// PtraceTracer traces a command, or attaches to a process, with the ptrace
+// syscall itself rather than by running strace: no strace binary is needed,
+// and the syscalls are read as numbers (PTRACE_GET_SYSCALL_INFO) rather than
+// parsed from text. The events it records are the ones traceconv.Parse
+// returns for the same syscalls, with their arguments formatted as strace
+// prints them, minus the structures strace decodes.
+type PtraceTracer struct {
+	// Command is the command to run, unless Pid is set, in which case the
+	// process and its threads and children are attached to.
+	Command []string
+	Pid     int
+	Timeout time.Duration
+	// StrSize is how many bytes of the strings and buffers are printed,
+	// 32 if 0, as strace -s.
+	StrSize int
+	// Nanoseconds records the timestamps and durations with nanosecond
+	// precision.
+	Nanoseconds bool
+	// Stdin is the input of the command, none if nil, as with Strace.
+	// Stdout and Stderr receive the output of the command, and default to
+	// the ones of this process.
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	// OnStart, if set, is called with the pid of this process once the
+	// tracing has started, the traced processes being its descendants.
+	OnStart    func(pid int)
+	ExtraFiles []*os.File
+	Env        []string
+	// Cgroup, if set, is the cgroup the command is started in.
+	Cgroup *CommandCgroup
+
+	events []*Event
+}
+
+// ptraceThread is a traced thread, and the syscall it is in.
+type ptraceThread struct {
+	lifetime *Event
+	syscall  *ptraceSyscall
+}
+
+// ptraceSyscall is a syscall being traced, from its entry to its exit.
+type ptraceSyscall struct {
+	name   string
+	nr     uint64
+	raw    [6]uint64
+	args   []string
+	paths  map[int]string // [arg] the paths, as read
+	fdPath string
+	// fdPathLate is set when fdPath was read once the syscall returned,
+	// when the fd may have been closed, or reused for another file.
+	fdPathLate bool
+	// personality is set for the syscalls not made in the native
+	// personality, as traceconv labels them.
+	personality string
+	start       time.Time
+}
+
+// Events returns the events recorded by RunContext.
+func (t *PtraceTracer) Events() []*Event {
+	return t.events
+}
+
+// RunContext traces until the traced processes exit, the timeout is reached
+// or ctx is done. In the latter two cases, a command is passed the signal
+// the tool received (SIGINT for the timeout), and killed if it hasn't exited
+// straceWaitDelay later, and attached processes are detached from. The error
+// is the cause of ctx being done, as with Strace.RunContext.
+func (t *PtraceTracer) RunContext(ctx context.Context) error {
+	if t.Timeout != time.Duration(0) {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, t.Timeout)
+		defer cancel()
+	}
+	if t.Stdout == nil {
+		t.Stdout = os.Stdout
+	}
+	if t.Stderr == nil {
+		t.Stderr = os.Stderr
+	}
+	if t.StrSize <= 0 {
+		t.StrSize = 32
+	}
+	// All the ptrace requests have to come from the thread that attached.
+	errs := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		errs <- t.trace(ctx)
+	}()
+	err := <-errs
+	if err != nil {
+		fmt.Fprintf(t.Stdout, "[!] Error tracing: %s\n", err)
+		return err
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		fmt.Fprintf(t.Stdout, "[!] Tracing timeout reached: %s\n", ctx.Err())
+	}
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	return nil
+}
+
+func (t *PtraceTracer) trace(ctx context.Context) error {
+	threads := make(map[int]*ptraceThread)
+	options := syscall.PTRACE_O_TRACESYSGOOD | syscall.PTRACE_O_TRACECLONE | syscall.PTRACE_O_TRACEFORK | syscall.PTRACE_O_TRACEVFORK | syscall.PTRACE_O_TRACEEXEC
+
+	var cmd *exec.Cmd
+	var stopTracees func()
+	if t.Pid != 0 {
+		for tid := range readProcTree(t.Pid).Threads {
+			if err := syscall.PtraceAttach(tid); err != nil {
+				continue
+			}
+			// Its first stop is the SIGSTOP of the attach.
+			threads[tid] = nil
+		}
+		if len(threads) == 0 {
+			return fmt.Errorf("attach to pid %d: no thread could be attached to", t.Pid)
+		}
+		// The tracees are stopped to be detached from, and continued
+		// once they are.
+		stopTracees = func() {
+			for tid, pid := range readProcTree(t.Pid).Threads {
+				syscall.Tgkill(pid, tid, syscall.SIGSTOP)
+			}
+		}
+	} else {
+		start := time.Now()
+		cmd = exec.Command(t.Command[0], t.Command[1:]...)
+		cmd.Stdin = t.Stdin
+		cmd.Stdout = t.Stdout
+		cmd.Stderr = t.Stderr
+		cmd.ExtraFiles = t.ExtraFiles
+		if len(t.Env) > 0 {
+			cmd.Env = append(os.Environ(), t.Env...)
+		}
+		cmd.SysProcAttr = &syscall.SysProcAttr{Ptrace: true}
+		if t.Cgroup != nil {
+			t.Cgroup.startIn(cmd)
+		}
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+		pid := cmd.Process.Pid
+		// The command stops once it executed, with a SIGTRAP.
+		var ws syscall.WaitStatus
+		if _, err := syscall.Wait4(pid, &ws, syscall.WALL, nil); err != nil {
+			return err
+		}
+		if !ws.Stopped() {
+			return fmt.Errorf("run %s: %s", t.Command[0], ptraceExit(ws))
+		}
+		if err := syscall.PtraceSetOptions(pid, options|ptraceOExitKill); err != nil {
+			return err
+		}
+		th := &ptraceThread{lifetime: t.lifetime(pid, start)}
+		threads[pid] = th
+		t.events = append(t.events, t.execve(pid, start, time.Now()))
+		if err := syscall.PtraceSyscall(pid, 0); err != nil {
+			return err
+		}
+		stopTracees = func() {
+			signal := os.Signal(os.Interrupt)
+			var interrupted Interrupted
+			if errors.As(context.Cause(ctx), &interrupted) {
+				signal = interrupted.Signal
+			}
+			cmd.Process.Signal(signal)
+			time.AfterFunc(straceWaitDelay, func() {
+				cmd.Process.Kill()
+			})
+		}
+	}
+	if t.OnStart != nil {
+		t.OnStart(os.Getpid())
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			stopTracees()
+		case <-done:
+		}
+	}()
+
+	var detached []int
+	for len(threads) > 0 {
+		var ws syscall.WaitStatus
+		// The tracees are the children of this thread, as far as
+		// waiting goes, unlike the processes the other goroutines
+		// run: they are left for them to wait for.
+		tid, err := syscall.Wait4(-1, &ws, syscall.WALL|ptraceWNoThread, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		th := threads[tid]
+		if ws.Exited() || ws.Signaled() {
+			if th != nil {
+				t.exited(tid, th, ws, now)
+			}
+			delete(threads, tid)
+			continue
+		}
+		if !ws.Stopped() {
+			continue
+		}
+		if th == nil {
+			// A thread attached to, or a child that stopped before its
+			// parent's clone returned: its first stop is a SIGSTOP.
+			th = &ptraceThread{lifetime: t.lifetime(tid, now)}
+			threads[tid] = th
+			syscall.PtraceSetOptions(tid, options)
+			if ws.StopSignal() == syscall.SIGSTOP {
+				syscall.PtraceSyscall(tid, 0)
+				continue
+			}
+		}
+		if t.Pid != 0 && ctx.Err() != nil {
+			syscall.PtraceDetach(tid)
+			detached = append(detached, tid)
+			t.unfinished(tid, th, now)
+			delete(threads, tid)
+			continue
+		}
+		signal := 0
+		switch stop := ws.StopSignal(); {
+		case stop == ptraceSyscallStop:
+			t.syscallStop(tid, th, now)
+		case stop == syscall.SIGTRAP && ws.TrapCause() > 0:
+			// Clone, fork, vfork and exec events: the children
+			// are traced, and the execve returns next.
+		default:
+			// A signal is delivered, unless PTRACE_GETSIGINFO fails,
+			// for the stop of the thread's group by a SIGSTOP that
+			// was already delivered.
+			var info [128]byte
+			if ptrace(syscall.PTRACE_GETSIGINFO, tid, 0, uintptr(unsafe.Pointer(&info[0]))) != nil {
+				break
+			}
+			signal = int(stop)
+			t.events = append(t.events, t.signal(tid, stop, info, now))
+		}
+		if err := syscall.PtraceSyscall(tid, signal); err == syscall.ESRCH {
+			// Killed while stopped, its exit follows.
+			continue
+		}
+	}
+	// The tracees stopped to be detached from are left with a pending
+	// SIGSTOP.
+	for _, tid := range detached {
+		syscall.Kill(tid, syscall.SIGCONT)
+	}
+	if cmd != nil {
+		// The command was reaped already, this waits for its output
+		// to be copied.
+		cmd.Wait()
+	}
+	return nil
+}
+
+// ptrace makes a ptrace request the syscall package doesn't have a function
+// for.
+func ptrace(request int, pid int, addr, data uintptr) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_PTRACE, uintptr(request), uintptr(pid), addr, data, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// lifetime returns the beginning of the lifetime of a thread, first seen at
+// start, and adds it to the events.
+func (t *PtraceTracer) lifetime(tid int, start time.Time) *Event {
+	e := &Event{
+		Name: "lifetime",
+		Cat:  "lifetime",
+		Ph:   "B",
+		Pid:  tid,
+		Tid:  tid,
+	}
+	e.Ts, e.TsNs = t.micros(start.UnixNano())
+	t.events = append(t.events, e)
+	return e
+}
+
+// micros splits nanoseconds into microseconds and the nanoseconds past them,
+// which are dropped without Nanoseconds.
+func (t *PtraceTracer) micros(ns int64) (int64, int) {
+	if !t.Nanoseconds {
+		return ns / 1000, 0
+	}
+	return ns / 1000, int(ns % 1000)
+}
+
+// execve returns the execve of the command, which ran before it was traced.
+func (t *PtraceTracer) execve(pid int, start, end time.Time) *Event {
+	argv := make([]string, 0, len(t.Command))
+	for _, arg := range t.Command {
+		argv = append(argv, ptraceQuote([]byte(arg), len(arg) > t.StrSize, t.StrSize))
+	}
+	path, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		path = t.Command[0]
+	}
+	e := &Event{
+		Name: "execve",
+		Cat:  "successful",
+		Ph:   "X",
+		Pid:  pid,
+		Tid:  pid,
+		Args: Args{
+			First:       fmt.Sprintf("(%s, [%s], 0x0 /* %d vars */)", ptraceQuote([]byte(path), false, len(path)), strings.Join(argv, ", "), len(os.Environ())+len(t.Env)),
+			ReturnValue: "0",
+		},
+	}
+	e.Ts, e.TsNs = t.micros(start.UnixNano())
+	e.Dur, e.DurNs = t.micros(end.Sub(start).Nanoseconds())
+	e.ParseArgs()
+	return e
+}
+
+// syscallStop records the entry to a syscall, or turns it into an event on
+// its exit.
+func (t *PtraceTracer) syscallStop(tid int, th *ptraceThread, now time.Time) {
+	var info ptraceSyscallInfo
+	if ptrace(ptraceGetSyscallInfo, tid, unsafe.Sizeof(info), uintptr(unsafe.Pointer(&info))) != nil {
+		return
+	}
+	switch info.Op {
+	case ptraceSyscallInfoEntry:
+		s := &ptraceSyscall{name: ptraceSyscallName(info.Nr), nr: info.Nr, raw: info.Args, paths: make(map[int]string), start: now}
+		if info.Arch != ptraceAuditArch {
+			// The numbers of the other personalities aren't those of
+			// ptraceSyscallNames: their syscalls are left unnamed, with
+			// their six argument registers.
+			s.name = "syscall_" + strconv.FormatUint(info.Nr, 10)
+			s.personality = ptracePersonality(info.Arch)
+		}
+		s.args = t.formatArgs(tid, s)
+		if names := traceconv.ArgNames(s.name); len(names) > 0 && names[0] == "fd" {
+			s.fdPath = fdPath(tid, int(int32(s.raw[0])))
+		}
+		th.syscall = s
+	case ptraceSyscallInfoExit:
+		s := th.syscall
+		if s == nil {
+			// Attached to during the syscall.
+			return
+		}
+		th.syscall = nil
+		ret := int64(info.Nr)
+		isError := info.Args[0]&0xff != 0
+		if !isError && ret > 0 && (s.name == "read" || s.name == "pread64" || s.name == "recvfrom") {
+			// The buffer is only filled in once the syscall returns.
+			s.args[1] = t.formatBuffer(tid, s.raw[1], int(ret))
+		}
+		if !isError && ptraceFdSyscalls[s.name] {
+			s.fdPath = fdPath(tid, int(ret))
+		}
+		t.events = append(t.events, t.ended(tid, s, ret, isError, now))
+	}
+}
+
+// ended returns the event of a syscall that returned ret at end, or the
+// errno -ret if isError.
+func (t *PtraceTracer) ended(tid int, s *ptraceSyscall, ret int64, isError bool, end time.Time) *Event {
+	e := t.syscallEvent(tid, s)
+	e.Dur, e.DurNs = t.micros(end.Sub(s.start).Nanoseconds())
+	switch {
+	case isError:
+		e.Cat = "failed"
+		errno := uint64(-ret)
+		name, ok := ptraceErrnoNames[errno]
+		if !ok {
+			name = "E" + strconv.FormatUint(errno, 10)
+		}
+		e.Args.ReturnValue = fmt.Sprintf("-1 %s (%s)", name, ptraceErrnoText(errno))
+	case ptraceHexResults[s.name]:
+		e.Args.ReturnValue = "0x" + strconv.FormatUint(uint64(ret), 16)
+	default:
+		e.Args.ReturnValue = strconv.FormatInt(ret, 10)
+	}
+	if s.fdPath != "" {
+		if e.Args.Data == nil {
+			e.Args.Data = make(map[string]any)
+		}
+		e.Args.Data["fd_path"] = s.fdPath
+		if s.fdPathLate {
+			e.Args.Data["fd_path_late"] = true
+		}
+	}
+	e.SetArgs(argsData(s))
+	return e
+}
+
+// syscallEvent returns the event of a syscall, without its end.
+func (t *PtraceTracer) syscallEvent(tid int, s *ptraceSyscall) *Event {
+	e := &Event{
+		Name: s.name,
+		Cat:  "successful",
+		Ph:   "X",
+		Pid:  tid,
+		Tid:  tid,
+		Args: Args{
+			First: "(" + strings.Join(s.args, ", ") + ")",
+		},
+	}
+	if s.personality != "" {
+		e.Args.Data = map[string]any{"personality": s.personality}
+	}
+	e.Ts, e.TsNs = t.micros(s.start.UnixNano())
+	return e
+}
+
+// unfinished records the syscall a thread is in when it stops being traced,
+// at end: an exit, which never returns, as strace prints it, and any other as
+// a slice until end that did not complete.
+func (t *PtraceTracer) unfinished(tid int, th *ptraceThread, end time.Time) {
+	s := th.syscall
+	if s == nil {
+		return
+	}
+	e := t.syscallEvent(tid, s)
+	if s.name == "exit" || s.name == "exit_group" {
+		e.Args.ReturnValue = "?"
+	} else {
+		ts, ns := t.micros(end.UnixNano())
+		e.EndUnfinished(ts*1000 + int64(ns))
+	}
+	e.SetArgs(argsData(s))
+	t.events = append(t.events, e)
+}
+
+// exited records the exit of a thread, ending its lifetime as a lifetime line
+// of strace does.
+func (t *PtraceTracer) exited(tid int, th *ptraceThread, ws syscall.WaitStatus, now time.Time) {
+	t.unfinished(tid, th, now)
+	e := &Event{
+		Name: "lifetime",
+		Cat:  "lifetime",
+		Ph:   "E",
+		Pid:  tid,
+		Tid:  tid,
+		Args: Args{
+			First: ptraceExit(ws),
+		},
+	}
+	e.Ts, e.TsNs = t.micros(now.UnixNano())
+	exit := ""
+	switch {
+	case ws.Signaled():
+		e.Args.Data = map[string]any{"signal": ptraceSignalName(ws.Signal())}
+		exit = "killed by " + ptraceSignalName(ws.Signal())
+		if ws.CoreDump() {
+			e.Args.Data["core_dumped"] = true
+		}
+	case ws.ExitStatus() != 0:
+		e.Args.Data = map[string]any{"exit_code": ws.ExitStatus()}
+		exit = fmt.Sprintf("exit %d", ws.ExitStatus())
+	default:
+		e.Args.Data = map[string]any{"exit_code": 0}
+	}
+	if exit != "" {
+		th.lifetime.Name = "lifetime (" + exit + ")"
+		th.lifetime.Cname = "terrible"
+		e.Cname = "terrible"
+	}
+	t.events = append(t.events, e)
+}
+
+// signal returns the instant of a signal delivered to a thread, with the
+// fields of its siginfo strace prints.
+func (t *PtraceTracer) signal(tid int, sig syscall.Signal, info [128]byte, now time.Time) *Event {
+	code := *(*int32)(unsafe.Pointer(&info[8]))
+	e := &Event{
+		Name:  ptraceSignalName(sig),
+		Cat:   "signal",
+		Ph:    "i",
+		Scope: "t",
+		Pid:   tid,
+		Tid:   tid,
+		Args: Args{
+			Data: map[string]any{
+				"si_signo": ptraceSignalName(sig),
+				"si_code":  strconv.Itoa(int(code)),
+				"si_pid":   strconv.Itoa(int(*(*int32)(unsafe.Pointer(&info[16])))),
+				"si_uid":   strconv.Itoa(int(*(*uint32)(unsafe.Pointer(&info[20])))),
+			},
+		},
+	}
+	e.Ts, e.TsNs = t.micros(now.UnixNano())
+	return e
+}
+
+// ptraceExit describes the exit of a thread as a lifetime line of strace.
+func ptraceExit(ws syscall.WaitStatus) string {
+	if ws.Signaled() {
+		status := "killed by " + ptraceSignalName(ws.Signal())
+		if ws.CoreDump() {
+			status += " (core dumped)"
+		}
+		return status
+	}
+	return "exited with " + strconv.Itoa(ws.ExitStatus())
+}
+
+// ptraceSyscallName returns the name of the syscall numbered nr.
+func ptraceSyscallName(nr uint64) string {
+	if nr < uint64(len(ptraceSyscallNames)) && ptraceSyscallNames[nr] != "" {
+		return ptraceSyscallNames[nr]
+	}
+	return "syscall_" + strconv.FormatUint(nr, 10)
+}
+
+// ptracePersonality returns the personality, as strace names it, of the
+// syscalls PTRACE_GET_SYSCALL_INFO reports with arch.
+func ptracePersonality(arch uint32) string {
+	switch arch {
+	case 0x40000003, 0x40000028: // AUDIT_ARCH_I386, AUDIT_ARCH_ARM
+		return "32 bit"
+	}
+	return "arch 0x" + strconv.FormatUint(uint64(arch), 16)
+}
+
+func ptraceSignalName(sig syscall.Signal) string {
+	if int(sig) < len(ptraceSignalNames) && ptraceSignalNames[sig] != "" {
+		return ptraceSignalNames[sig]
+	}
+	if sig >= 32 {
+		return "SIGRT_" + strconv.Itoa(int(sig)-32)
+	}
+	return "SIG" + strconv.Itoa(int(sig))
+}
+
+// ptraceErrnoText returns the description strace prints after an errno.
+func ptraceErrnoText(errno uint64) string {
+	switch ptraceErrnoNames[errno] {
+	case "ERESTARTSYS":
+		return "To be restarted if SA_RESTART is set"
+	case "ERESTARTNOINTR":
+		return "To be restarted"
+	case "ERESTARTNOHAND":
+		return "To be restarted if no handler"
+	case "ERESTART_RESTARTBLOCK":
+		return "Interrupted by signal"
+	}
+	text := syscall.Errno(errno).Error()
+	if text == "" {
+		return "errno " + strconv.FormatUint(errno, 10)
+	}
+	return strings.ToUpper(text[:1]) + text[1:]
+}
+
+// fdPath returns the path of an fd of a thread, as strace -y prints it, or ""
+// if it's not open.
+func fdPath(tid, fd int) string {
+	if fd < 0 {
+		return ""
+	}
+	path, err := os.Readlink(fmt.Sprintf("/proc/%d/fd/%d", tid, fd))
+	if err != nil {
+		return ""
+	}
+	return path
+}
+
+// formatArgs formats the arguments of a syscall at its entry, as strace
+// prints them: numbers, except for the paths, the buffers written, the argv
+// of execve and the flags of clone, futex and prctl that the analyses look
+// at.
+func (t *PtraceTracer) formatArgs(tid int, s *ptraceSyscall) []string {
+	args := ptraceNumbers(s.name, s.raw)
+	for i, name := range traceconv.ArgNames(s.name) {
+		switch name {
+		case "path":
+			if path, truncated, ok := t.readString(tid, s.raw[i], ptracePathMax); ok {
+				s.paths[i] = string(path)
+				args[i] = ptraceQuote(path, truncated, ptracePathMax)
+			} else {
+				args[i] = ptraceAddress(s.raw[i])
+			}
+		case "buf":
+			if s.name == "write" || s.name == "pwrite64" || s.name == "sendto" {
+				args[i] = t.formatBuffer(tid, s.raw[i], int(s.raw[i+1]))
+			}
+		case "argv":
+			args[i] = t.formatArgv(tid, s.raw[i])
+		}
+	}
+	switch s.name {
+	case "clone":
+		args = []string{"flags=" + ptraceCloneFlagNames(s.raw[0]), "child_stack=0x" + strconv.FormatUint(s.raw[1], 16)}
+	case "clone3":
+		flags := make([]byte, 8)
+		if n, _ := syscall.PtracePeekData(tid, uintptr(s.raw[0]), flags); n == 8 {
+			args[0] = "{flags=" + ptraceCloneFlagNames(*(*uint64)(unsafe.Pointer(&flags[0]))) + "}"
+		}
+		args[1] = strconv.FormatUint(s.raw[1], 10)
+	case "prctl":
+		if s.raw[0] == syscall.PR_SET_NAME {
+			args = []string{"PR_SET_NAME", t.formatString(tid, s.raw[1], t.StrSize)}
+		}
+	}
+	return args
+}
+
+// argsData returns the arguments of a syscall by name, as ParseArgs splits
+// the args strace prints, but from their raw values rather than from their
+// text: the paths as read, and the fds, counts and sizes as numbers.
+func argsData(s *ptraceSyscall) map[string]any {
+	data := make(map[string]any, len(s.args))
+	names := traceconv.ArgNames(s.name)
+	for i, arg := range s.args {
+		if i >= len(names) {
+			// The args of clone are named, as strace prints them.
+			if name, value, ok := strings.Cut(arg, "="); ok && s.name == "clone" {
+				data[name] = value
+			} else {
+				data["arg"+strconv.Itoa(i)] = arg
+			}
+			continue
+		}
+		name := names[i]
+		path, isPath := s.paths[i]
+		switch {
+		case isPath:
+			data[name] = path
+		case name == "dirfd" && int32(s.raw[i]) == -100:
+			data[name] = "AT_FDCWD"
+		case ptraceIntArgs[name]:
+			data[name] = int(int32(s.raw[i]))
+		case traceconv.NumericArg(name):
+			data[name] = int(s.raw[i])
+		default:
+			data[name] = arg
+		}
+	}
+	return data
+}
+
+// ptraceNumbers formats the arguments of a syscall as numbers, but for the
+// dirfds and futex operations, which are named.
+func ptraceNumbers(syscallName string, raw [6]uint64) []string {
+	names := traceconv.ArgNames(syscallName)
+	n, ok := ptraceArgCounts[syscallName]
+	if len(names) > 0 {
+		n, ok = len(names), true
+	}
+	if !ok {
+		n = len(raw)
+	}
+	args := make([]string, n)
+	for i := range args {
+		args[i] = ptraceNumber(raw[i])
+	}
+	for i, name := range names {
+		switch {
+		case ptraceIntArgs[name]:
+			args[i] = strconv.Itoa(int(int32(raw[i])))
+		}
+		switch name {
+		case "dirfd":
+			if int32(raw[i]) == -100 {
+				args[i] = "AT_FDCWD"
+			}
+		case "futex_op":
+			args[i] = ptraceFutexOp(raw[i])
+		}
+	}
+	return args
+}
+
+// ptraceNumber formats an argument in decimal if it looks like a number, such
+// as an fd, a size or an error, and in hex if it looks like an address.
+func ptraceNumber(v uint64) string {
+	if n := int64(v); n > -4096 && n < 1<<32 {
+		return strconv.FormatInt(n, 10)
+	}
+	return "0x" + strconv.FormatUint(v, 16)
+}
+
+// formatString reads the NUL-terminated string at addr, up to size bytes,
+// and quotes it.
+func (t *PtraceTracer) formatString(tid int, addr uint64, size int) string {
+	s, truncated, ok := t.readString(tid, addr, size)
+	if !ok {
+		return ptraceAddress(addr)
+	}
+	return ptraceQuote(s, truncated, size)
+}
+
+// readString reads the NUL-terminated string at addr, up to size bytes, and
+// reports whether it was longer, and whether it could be read at all.
+func (t *PtraceTracer) readString(tid int, addr uint64, size int) (s []byte, truncated, ok bool) {
+	if addr == 0 {
+		return nil, false, false
+	}
+	chunk := make([]byte, 64)
+	for len(s) <= size {
+		n, _ := syscall.PtracePeekData(tid, uintptr(addr)+uintptr(len(s)), chunk)
+		if n == 0 {
+			break
+		}
+		if i := bytes.IndexByte(chunk[:n], 0); i >= 0 {
+			s = append(s, chunk[:i]...)
+			return s[:min(len(s), size)], len(s) > size, true
+		}
+		s = append(s, chunk[:n]...)
+	}
+	if len(s) == 0 {
+		return nil, false, false
+	}
+	return s[:min(len(s), size)], len(s) > size, true
+}
+
+// ptraceAddress formats a pointer that couldn't be read from, as strace does.
+func ptraceAddress(addr uint64) string {
+	if addr == 0 {
+		return "NULL"
+	}
+	return "0x" + strconv.FormatUint(addr, 16)
+}
+
+// formatBuffer reads the first bytes of the buffer of size bytes at addr,
+// and quotes them.
+func (t *PtraceTracer) formatBuffer(tid int, addr uint64, size int) string {
+	buf := make([]byte, max(min(size, t.StrSize), 0))
+	n, _ := syscall.PtracePeekData(tid, uintptr(addr), buf)
+	if n == 0 && len(buf) > 0 {
+		return "0x" + strconv.FormatUint(addr, 16)
+	}
+	return ptraceQuote(buf[:n], size > n, t.StrSize)
+}
+
+// formatArgv reads the array of strings at addr, such as the argv of execve.
+func (t *PtraceTracer) formatArgv(tid int, addr uint64) string {
+	var args []string
+	pointer := make([]byte, 8)
+	for i := 0; ; i++ {
+		if n, _ := syscall.PtracePeekData(tid, uintptr(addr)+uintptr(i*8), pointer); n != 8 {
+			return "0x" + strconv.FormatUint(addr, 16)
+		}
+		arg := *(*uint64)(unsafe.Pointer(&pointer[0]))
+		if arg == 0 {
+			break
+		}
+		if i == ptraceMaxArrayLen {
+			args = append(args, "...")
+			break
+		}
+		args = append(args, t.formatString(tid, arg, t.StrSize))
+	}
+	return "[" + strings.Join(args, ", ") + "]"
+}
+
+// ptraceQuote quotes a string with the escapes of strace, followed by ... if
+// it was truncated.
+func ptraceQuote(s []byte, truncated bool, size int) string {
+	if len(s) > size {
+		s, truncated = s[:size], true
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, c := range s {
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == '\n':
+			b.WriteString(`\n`)
+		case c == '\t':
+			b.WriteString(`\t`)
+		case c == '\r':
+			b.WriteString(`\r`)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&b, `\%03o`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	if truncated {
+		b.WriteString("...")
+	}
+	return b.String()
+}
+
+// ptraceCloneFlagNames returns the names of clone flags, followed by the
+// signal sent to the parent on exit.
+func ptraceCloneFlagNames(flags uint64) string {
+	var names []string
+	for _, f := range ptraceCloneFlags {
+		if flags&f.flag != 0 {
+			names = append(names, f.name)
+			flags &^= f.flag
+		}
+	}
+	if exitSignal := syscall.Signal(flags & 0xff); exitSignal != 0 {
+		names = append(names, ptraceSignalName(exitSignal))
+		flags &^= 0xff
+	}
+	if flags != 0 || len(names) == 0 {
+		names = append(names, "0x"+strconv.FormatUint(flags, 16))
+	}
+	return strings.Join(names, "|")
+}
+
+// ptraceFutexOp returns the name of a futex operation, as strace prints it.
+func ptraceFutexOp(op uint64) string {
+	cmd := op & 0x7f
+	if cmd >= uint64(len(ptraceFutexOps)) {
+		return strconv.FormatUint(op, 10)
+	}
+	name := ptraceFutexOps[cmd]
+	if op&0x80 != 0 {
+		name += "_PRIVATE"
+	}
+	if op&0x100 != 0 {
+		name += "|FUTEX_CLOCK_REALTIME"
+	}
+	return name
+}
@@ -0,0 +1,35 @@
+//go:build !linux || !(amd64 || arm64)
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// PtraceTracer stands in for the ptrace tracer where it isn't supported.
+type PtraceTracer struct {
+	Command     []string
+	Pid         int
+	Timeout     time.Duration
+	StrSize     int
+	Nanoseconds bool
+	Stdin       io.Reader
+	Stdout      io.Writer
+	Stderr      io.Writer
+	OnStart     func(pid int)
+	ExtraFiles  []*os.File
+	Env         []string
+	Cgroup      *CommandCgroup
+}
+
+func (t *PtraceTracer) Events() []*Event {
+	return nil
+}
+
+func (t *PtraceTracer) RunContext(ctx context.Context) error {
+	return errors.New("the ptrace backend needs Linux on amd64 or arm64")
+}
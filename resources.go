@@ -2,40 +2,139 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"math"
 	"os"
 	"path"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/replit/strace-perfetto/pkg/traceconv"
 )
 
+// resourcesPid is the pid of the "System resources" process, which holds the
+// cgroup-wide (or system-wide) counter tracks.
+const resourcesPid = pidMaxLimit + 5
+
+// rssInterval is how often the RSS of the traced processes is read. Every
+// process has its own status file, so it is polled less often than the
+// cgroup-wide counters.
+const rssInterval = 10 * time.Millisecond
+
 type sample struct {
-	ts     time.Time
-	cpu    float64
-	memory uint64
+	ts       time.Time
+	cpu      float64
+	memory   uint64
+	io       ioStat
+	pids     uint64
+	pressure [len(pressureResources)]psiTotals
+	throttle cpuThrottle
+	oom      memoryEvents
+	swap     uint64
+	swapIO   swapIO
+}
+
+// pressureResources are the resources with pressure stall information.
+var pressureResources = [...]string{"cpu", "memory", "io"}
+
+// psiTotals are the total stall times, in microseconds, of a pressure file.
+type psiTotals struct {
+	some, full uint64
+}
+
+// ioStat is the content of a cgroup's io.stat, summed over all devices.
+type ioStat struct {
+	rbytes, wbytes uint64
+	rios, wios     uint64
+}
+
+type rssSample struct {
+	ts  time.Time
+	rss uint64
 }
 
 // ResourceMonitor polls the state of system resources (RAM, CPU) and can save that
 // to a timeseries list that can be visualized in Perfetto.
 type ResourceMonitor struct {
-	cgroupPath       string
+	// Interval is the time between two samples.
+	Interval time.Duration
+	// Adaptive doubles the interval, up to adaptiveMaxFactor times
+	// Interval, as long as the samples don't change, and goes back to
+	// Interval as soon as they do.
+	Adaptive bool
+
+	// cgroupPath is empty when the counters are system-wide.
+	cgroupPath string
+	// hasIO and hasPids are set when the cgroup has the io and pids
+	// controllers enabled.
+	hasIO   bool
+	hasPids bool
+	// hasSwap is set when the machine has swap.
+	hasSwap bool
+	// pressureFiles are the pressure files of pressureResources, or empty
+	// where there is no pressure stall information.
+	pressureFiles [len(pressureResources)]string
+	// cpuWindow is the minimum interval the CPU usage is averaged over, for
+	// counters too coarse to be differentiated at every sample.
+	cpuWindow        time.Duration
 	vCPUs            float64
+	memoryMax        uint64
 	timestamp        time.Time
+	clock            ClockSnapshot
 	lastTimestamp    time.Time
 	lastCPUUsageUsec uint64
 	samples          []sample
+	// loggedErrors are the errors of the counters already logged with
+	// -verbose.
+	loggedErrors map[string]bool
+
+	mu  sync.Mutex
+	rss map[int][]rssSample
+	// threadCPU are the CPU times of the threads of the traced processes,
+	// and threadPids the processes they belong to.
+	threadCPU  map[int][]threadCPUSample
+	threadPids map[int]int
+	faults     map[int][]faultSample
 }
 
-// NewResourceMonitor returns a new resource monitor.
-func NewResourceMonitor() (*ResourceMonitor, error) {
-	cgroupBytes, err := os.ReadFile("/proc/self/cgroup")
+// NewResourceMonitor returns a new resource monitor for the cgroup of the
+// given process, or of this process if pid is 0. Without a cgroup v2 to read
+// the counters from, the monitor falls back to system-wide CPU and memory
+// usage.
+func NewResourceMonitor(pid int) (*ResourceMonitor, error) {
+	cgroupPath, err := cgroupOf(pid)
+	if err == nil {
+		var r *ResourceMonitor
+		r, err = NewCgroupResourceMonitor(cgroupPath)
+		if err == nil {
+			return r, nil
+		}
+	}
+	r, systemErr := newSystemResourceMonitor()
+	if systemErr != nil {
+		return nil, errors.Join(err, systemErr)
+	}
+	log.Printf("cgroup counters are not available, using system-wide cpu / memory: %v", err)
+	return r, nil
+}
+
+// cgroupOf returns the directory of the cgroup v2 of the given process, or of
+// this process if pid is 0.
+func cgroupOf(pid int) (string, error) {
+	cgroupFile := "/proc/self/cgroup"
+	if pid != 0 {
+		cgroupFile = fmt.Sprintf("/proc/%d/cgroup", pid)
+	}
+	cgroupBytes, err := os.ReadFile(cgroupFile)
 	if err != nil {
-		return nil, fmt.Errorf("error reading /proc/self/cgroup: %w", err)
+		return "", fmt.Errorf("error reading %s: %w", cgroupFile, err)
 	}
-	var cgroupPath string
 	for _, line := range strings.Split(strings.TrimSpace(string(cgroupBytes)), "\n") {
 		fields := strings.Split(line, ":")
 		if len(fields) != 3 {
@@ -45,97 +144,535 @@ func NewResourceMonitor() (*ResourceMonitor, error) {
 			// We don't support cgroupv1.
 			continue
 		}
-		cgroupPath = "/sys/fs/cgroup" + fields[2]
-		break
+		return cgroupRoot + fields[2], nil
 	}
-	if cgroupPath == "" {
-		return nil, fmt.Errorf("could not find cgroup path from /proc/self/cgroup: %q", string(cgroupBytes))
+	return "", fmt.Errorf("could not find cgroup path from %s: %q", cgroupFile, string(cgroupBytes))
+}
+
+// NewCgroupResourceMonitor returns a new resource monitor for the cgroup v2
+// in the given directory.
+func NewCgroupResourceMonitor(cgroupPath string) (*ResourceMonitor, error) {
+	// cpu.max is only there with the cpu controller, which the
+	// throttling counters of cpu.stat need too.
+	if _, _, err := readCPUMax(cgroupPath); err != nil {
+		return nil, err
 	}
-	cpuMaxBytes, err := os.ReadFile(path.Join(cgroupPath, "cpu.max"))
+	vCPUs := effectiveVCPUs(cgroupPath)
+
+	var cpuUsageUsec uint64
+	err := readFlatKeyed(path.Join(cgroupPath, "cpu.stat"), map[string]*uint64{
+		"usage_usec": &cpuUsageUsec,
+	})
 	if err != nil {
-		return nil, fmt.Errorf("error reading %s: %w", path.Join(cgroupPath, "cpu.max"), err)
+		return nil, fmt.Errorf("error reading %s: %w", path.Join(cgroupPath, "cpu.stat"), err)
 	}
-	quotaMsBytes, timesliceMsBytes, ok := strings.Cut(strings.TrimSpace(string(cpuMaxBytes)), " ")
+
+	// The memory limit is only used for annotations, the monitor works
+	// without it.
+	memoryMax := effectiveMemoryMax(cgroupPath)
+	_, err = readIOStat(path.Join(cgroupPath, "io.stat"))
+	hasIO := err == nil
+	_, err = readUint64(path.Join(cgroupPath, "pids.current"))
+	hasPids := err == nil
+	var pressureFiles [len(pressureResources)]string
+	for i, resource := range pressureResources {
+		pressureFiles[i] = availablePSI(path.Join(cgroupPath, resource+".pressure"))
+	}
+
+	return &ResourceMonitor{
+		Interval:         time.Millisecond,
+		cgroupPath:       cgroupPath,
+		hasIO:            hasIO,
+		hasPids:          hasPids,
+		hasSwap:          hasSwap(),
+		pressureFiles:    pressureFiles,
+		memoryMax:        memoryMax,
+		timestamp:        time.Now(),
+		clock:            TakeClockSnapshot(),
+		lastTimestamp:    time.Now(),
+		lastCPUUsageUsec: cpuUsageUsec,
+		vCPUs:            vCPUs,
+		rss:              make(map[int][]rssSample),
+		threadCPU:        make(map[int][]threadCPUSample),
+		threadPids:       make(map[int]int),
+		faults:           make(map[int][]faultSample),
+	}, nil
+}
+
+// readCPUMax returns the quota and the period of a cgroup's cpu.max, in
+// microseconds. The quota is math.MaxUint64 when there is none.
+func readCPUMax(cgroupPath string) (uint64, uint64, error) {
+	p := path.Join(cgroupPath, "cpu.max")
+	cpuMaxBytes, err := os.ReadFile(p)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error reading %s: %w", p, err)
+	}
+	quotaBytes, periodBytes, ok := strings.Cut(strings.TrimSpace(string(cpuMaxBytes)), " ")
 	if !ok {
-		return nil, fmt.Errorf("invalid format for %s: %q", path.Join(cgroupPath, "cpu.max"), string(cpuMaxBytes))
+		return 0, 0, fmt.Errorf("invalid format for %s: %q", p, string(cpuMaxBytes))
 	}
-	quotaMs, err := parseUint64(string(quotaMsBytes))
+	quota, err := parseUint64(quotaBytes)
 	if err != nil {
-		return nil, fmt.Errorf("error parsing %s: %w", path.Join(cgroupPath, "cpu.max"), err)
+		return 0, 0, fmt.Errorf("error parsing %s: %w", p, err)
 	}
-	timesliceMs, err := parseUint64(string(timesliceMsBytes))
+	period, err := parseUint64(periodBytes)
 	if err != nil {
-		return nil, fmt.Errorf("error parsing %s: %w", path.Join(cgroupPath, "cpu.max"), err)
+		return 0, 0, fmt.Errorf("error parsing %s: %w", p, err)
 	}
-	vCPUs := float64(quotaMs) / float64(timesliceMs)
+	return quota, period, nil
+}
 
-	var cpuUsageUsec uint64
-	err = readFlatKeyed(path.Join(cgroupPath, "cpu.stat"), map[string]*uint64{
-		"usage_usec": &cpuUsageUsec,
+// effectiveVCPUs returns the number of CPUs a cgroup can use: the lowest
+// cpu.max quota of the cgroup and its ancestors, in CPUs, or the CPUs of the
+// machine without any.
+func effectiveVCPUs(cgroupPath string) float64 {
+	vCPUs := float64(runtime.NumCPU())
+	for p := cgroupPath; strings.HasPrefix(p, cgroupRoot+"/"); p = path.Dir(p) {
+		quota, period, err := readCPUMax(p)
+		if err == nil && quota != math.MaxUint64 && period > 0 {
+			vCPUs = min(vCPUs, float64(quota)/float64(period))
+		}
+	}
+	return vCPUs
+}
+
+// effectiveMemoryMax returns the memory limit of a cgroup, the lowest
+// memory.max of the cgroup and its ancestors, as the cgroup of the command
+// has no limit of its own.
+func effectiveMemoryMax(cgroupPath string) uint64 {
+	var memoryMax uint64
+	for p := cgroupPath; strings.HasPrefix(p, cgroupRoot+"/"); p = path.Dir(p) {
+		if v, err := readUint64(path.Join(p, "memory.max")); err == nil && (memoryMax == 0 || v < memoryMax) {
+			memoryMax = v
+		}
+	}
+	return memoryMax
+}
+
+// systemCPUWindow is the interval the system-wide CPU usage is averaged over:
+// /proc/stat counts in jiffies of 10ms.
+const systemCPUWindow = 100 * time.Millisecond
+
+func newSystemResourceMonitor() (*ResourceMonitor, error) {
+	cpuUsageUsec, cpus, err := readProcStat()
+	if err != nil {
+		return nil, err
+	}
+	var memTotalKB uint64
+	err = readFlatKeyedColon("/proc/meminfo", map[string]*uint64{
+		"MemTotal": &memTotalKB,
 	})
 	if err != nil {
-		return nil, fmt.Errorf("error reading %s: %w", path.Join(cgroupPath, "cpu.stat"), err)
+		return nil, fmt.Errorf("error reading /proc/meminfo: %w", err)
+	}
+	var pressureFiles [len(pressureResources)]string
+	for i, resource := range pressureResources {
+		pressureFiles[i] = availablePSI(path.Join("/proc/pressure", resource))
 	}
 
 	return &ResourceMonitor{
-		cgroupPath:       cgroupPath,
+		Interval:         time.Millisecond,
+		cpuWindow:        systemCPUWindow,
+		memoryMax:        memTotalKB * 1024,
 		timestamp:        time.Now(),
+		clock:            TakeClockSnapshot(),
 		lastTimestamp:    time.Now(),
 		lastCPUUsageUsec: cpuUsageUsec,
-		vCPUs:            vCPUs,
+		vCPUs:            float64(cpus),
+		pressureFiles:    pressureFiles,
+		hasSwap:          hasSwap(),
+		rss:              make(map[int][]rssSample),
+		threadCPU:        make(map[int][]threadCPUSample),
+		threadPids:       make(map[int]int),
+		faults:           make(map[int][]faultSample),
 	}, nil
 }
 
+// adaptiveMaxFactor bounds how far adaptive sampling backs off, so that a
+// change after a long stable period still shows up quickly.
+const adaptiveMaxFactor = 64
+
+// Samples that differ by less than this are considered unchanged by adaptive
+// sampling.
+const (
+	adaptiveCPUThreshold    = 1       // percentage points
+	adaptiveMemoryThreshold = 1 << 20 // bytes
+)
+
 func (r *ResourceMonitor) Run(ctx context.Context) {
-	timer := time.NewTicker(1 * time.Millisecond)
+	interval := r.Interval
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
 	for {
 		select {
 		case <-ctx.Done():
+			// A last sample, for what happened since the previous
+			// one, such as the OOM kill that ended the command, to
+			// be in the trace.
+			r.sample()
 			return
 		case <-timer.C:
 		}
+		if r.Adaptive && len(r.samples) >= 2 && r.stable(r.samples[len(r.samples)-2], r.samples[len(r.samples)-1]) {
+			interval = min(2*interval, adaptiveMaxFactor*r.Interval)
+		} else {
+			interval = r.Interval
+		}
+		timer.Reset(interval)
+		if !r.sample() {
+			return
+		}
+	}
+}
+
+// sample reads the counters, and returns false if they can't be read.
+func (r *ResourceMonitor) sample() bool {
+	timestamp := time.Now()
+	cpuUsageUsec, memory, err := r.read()
+	if err != nil {
+		log.Print(err)
+		return false
+	}
+
+	s := sample{
+		ts:     timestamp,
+		memory: memory,
+	}
+	r.readCounters(&s)
+
+	timeDelta := timestamp.Sub(r.lastTimestamp)
+	if timeDelta < r.cpuWindow && len(r.samples) > 0 {
+		// Too early for the CPU counter to have moved, keep the last
+		// usage.
+		s.cpu = r.samples[len(r.samples)-1].cpu
+		r.samples = append(r.samples, s)
+		return true
+	}
+	s.cpu = 100 * float64(cpuUsageUsec-r.lastCPUUsageUsec) /
+		r.vCPUs /
+		float64(timeDelta.Microseconds())
 
-		timestamp := time.Now()
-		var cpuUsageUsec uint64
+	r.samples = append(r.samples, s)
+	r.lastCPUUsageUsec = cpuUsageUsec
+	r.lastTimestamp = timestamp
+	return true
+}
+
+// stable returns whether two consecutive samples are close enough for
+// adaptive sampling to back off.
+func (r *ResourceMonitor) stable(a, b sample) bool {
+	memoryDelta := int64(b.memory) - int64(a.memory)
+	return math.Abs(b.cpu-a.cpu) < adaptiveCPUThreshold &&
+		memoryDelta > -adaptiveMemoryThreshold && memoryDelta < adaptiveMemoryThreshold
+}
+
+// read returns the CPU time used so far, in microseconds, and the memory
+// currently in use, in bytes.
+func (r *ResourceMonitor) read() (uint64, uint64, error) {
+	if r.cgroupPath == "" {
+		return readSystemUsage()
+	}
+	var cpuUsageUsec uint64
+	err := readFlatKeyed(path.Join(r.cgroupPath, "cpu.stat"), map[string]*uint64{
+		"usage_usec": &cpuUsageUsec,
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("error reading %s: %w", path.Join(r.cgroupPath, "cpu.stat"), err)
+	}
+	var memoryAnon uint64
+	err = readFlatKeyed(path.Join(r.cgroupPath, "memory.stat"), map[string]*uint64{
+		"anon": &memoryAnon,
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("error reading %s: %w", path.Join(r.cgroupPath, "memory.stat"), err)
+	}
+	return cpuUsageUsec, memoryAnon, nil
+}
+
+// readCounters adds the I/O, pids and pressure counters to s, when they are
+// available. A failed read keeps the previous values, so that the rates
+// derived from them don't go negative.
+func (r *ResourceMonitor) readCounters(s *sample) {
+	if len(r.samples) > 0 {
+		last := r.samples[len(r.samples)-1]
+		s.io, s.pids, s.pressure, s.throttle, s.oom = last.io, last.pids, last.pressure, last.throttle, last.oom
+		s.swap, s.swapIO = last.swap, last.swapIO
+	}
+	for i, p := range r.pressureFiles {
+		if p == "" {
+			continue
+		}
+		if totals, err := readPSI(p); err == nil {
+			s.pressure[i] = totals
+		} else {
+			r.logError(err)
+		}
+	}
+	if r.hasIO {
+		if io, err := readIOStat(path.Join(r.cgroupPath, "io.stat")); err == nil {
+			s.io = io
+		} else {
+			r.logError(err)
+		}
+	}
+	if r.cgroupPath != "" {
+		// The cpu controller the monitor needs for cpu.max adds these.
 		err := readFlatKeyed(path.Join(r.cgroupPath, "cpu.stat"), map[string]*uint64{
-			"usage_usec": &cpuUsageUsec,
+			"nr_throttled":   &s.throttle.periods,
+			"throttled_usec": &s.throttle.usec,
 		})
 		if err != nil {
-			log.Printf("error reading %s: %v", path.Join(r.cgroupPath, "cpu.stat"), err)
-			return
+			r.logError(err)
 		}
-		var memoryAnon uint64
-		err = readFlatKeyed(path.Join(r.cgroupPath, "memory.stat"), map[string]*uint64{
-			"anon": &memoryAnon,
-		})
-		if err != nil {
-			log.Printf("error reading %s: %v", path.Join(r.cgroupPath, "memory.stat"), err)
-			return
+		// memory.events comes with the memory controller, which
+		// memory.stat needs too.
+		if oom, err := readMemoryEvents(r.cgroupPath); err == nil {
+			s.oom = oom
+		} else {
+			r.logError(err)
+		}
+	}
+	if r.hasSwap {
+		if swap, err := r.readSwap(); err == nil {
+			s.swap = swap
+		} else {
+			r.logError(err)
 		}
+		if swapIO, err := readSwapIO(); err == nil {
+			s.swapIO = swapIO
+		} else {
+			r.logError(err)
+		}
+	}
+	if r.hasPids {
+		if pids, err := readUint64(path.Join(r.cgroupPath, "pids.current")); err == nil {
+			s.pids = pids
+		} else {
+			r.logError(err)
+		}
+	}
+}
+
+// logError logs an error reading a counter with -verbose, once, since a
+// counter that can't be read fails at every sample.
+func (r *ResourceMonitor) logError(err error) {
+	if !*flagVerbose || r.loggedErrors[err.Error()] {
+		return
+	}
+	if r.loggedErrors == nil {
+		r.loggedErrors = make(map[string]bool)
+	}
+	r.loggedErrors[err.Error()] = true
+	verbosef("[!] Error reading the cpu / memory counters: %v", err)
+}
 
-		timeDelta := timestamp.Sub(r.lastTimestamp).Microseconds()
-		cpuUsage := 100 * float64(cpuUsageUsec-r.lastCPUUsageUsec) /
-			r.vCPUs /
-			float64(timeDelta)
+// counterRate returns the rate of change of a cumulative counter over an
+// elapsed time, or 0 if the counter went backwards, as when a device
+// disappears from io.stat.
+func counterRate(prev, cur uint64, elapsed float64) float64 {
+	if cur < prev {
+		return 0
+	}
+	return float64(cur-prev) / elapsed
+}
 
-		r.samples = append(r.samples, sample{
-			ts:     timestamp,
-			cpu:    cpuUsage,
-			memory: uint64(memoryAnon),
-		})
-		r.lastCPUUsageUsec = cpuUsageUsec
-		r.lastTimestamp = timestamp
+// availablePSI returns p if it is a readable pressure file, and "" otherwise:
+// PSI can be disabled in the kernel, and its files then fail to read.
+func availablePSI(p string) string {
+	if _, err := readPSI(p); err != nil {
+		return ""
+	}
+	return p
+}
+
+// readPSI reads the total stall times of a pressure file, whose lines are
+// "some" or "full" followed by key=value averages and total.
+func readPSI(p string) (psiTotals, error) {
+	var totals psiTotals
+	contents, err := os.ReadFile(p)
+	if err != nil {
+		return totals, err
 	}
+	for _, line := range strings.Split(strings.TrimSpace(string(contents)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		var total *uint64
+		switch fields[0] {
+		case "some":
+			total = &totals.some
+		case "full":
+			total = &totals.full
+		default:
+			continue
+		}
+		for _, field := range fields[1:] {
+			value, ok := strings.CutPrefix(field, "total=")
+			if !ok {
+				continue
+			}
+			*total, err = parseUint64(value)
+			if err != nil {
+				return totals, fmt.Errorf("parse %s: %w", p, err)
+			}
+		}
+	}
+	return totals, nil
 }
 
+// readIOStat reads a cgroup's io.stat, whose lines are a device followed by
+// its key=value counters.
+func readIOStat(p string) (ioStat, error) {
+	var io ioStat
+	contents, err := os.ReadFile(p)
+	if err != nil {
+		return io, err
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(contents)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		for _, field := range fields[1:] {
+			name, value, ok := strings.Cut(field, "=")
+			if !ok {
+				continue
+			}
+			var counter *uint64
+			switch name {
+			case "rbytes":
+				counter = &io.rbytes
+			case "wbytes":
+				counter = &io.wbytes
+			case "rios":
+				counter = &io.rios
+			case "wios":
+				counter = &io.wios
+			default:
+				continue
+			}
+			v, err := parseUint64(value)
+			if err != nil {
+				return io, fmt.Errorf("parse %s: %q: %w", p, name, err)
+			}
+			*counter += v
+		}
+	}
+	return io, nil
+}
+
+// readSystemUsage is like read, for the whole system: the busy time of all
+// CPUs and the memory that is not available to new allocations.
+func readSystemUsage() (uint64, uint64, error) {
+	cpuUsageUsec, _, err := readProcStat()
+	if err != nil {
+		return 0, 0, err
+	}
+	var memTotalKB, memAvailableKB uint64
+	err = readFlatKeyedColon("/proc/meminfo", map[string]*uint64{
+		"MemTotal":     &memTotalKB,
+		"MemAvailable": &memAvailableKB,
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("error reading /proc/meminfo: %w", err)
+	}
+	return cpuUsageUsec, (memTotalKB - memAvailableKB) * 1024, nil
+}
+
+// userHZ is the unit of the times in /proc/stat, which is fixed by the kernel
+// ABI regardless of the tick rate.
+const userHZ = 100
+
+// readProcStat returns the busy time of all CPUs in microseconds, and the
+// number of CPUs, from /proc/stat.
+func readProcStat() (uint64, int, error) {
+	contents, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return 0, 0, fmt.Errorf("error reading /proc/stat: %w", err)
+	}
+	var busy uint64
+	var cpus int
+	for _, line := range strings.Split(string(contents), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || !strings.HasPrefix(fields[0], "cpu") {
+			continue
+		}
+		if fields[0] != "cpu" {
+			cpus++
+			continue
+		}
+		// user nice system idle iowait irq softirq steal ...; guest time
+		// is already included in user.
+		if len(fields) < 9 {
+			return 0, 0, fmt.Errorf("invalid format for /proc/stat: %q", line)
+		}
+		for i, field := range fields[1:9] {
+			if i == 3 || i == 4 {
+				// idle, iowait
+				continue
+			}
+			v, err := parseUint64(field)
+			if err != nil {
+				return 0, 0, fmt.Errorf("error parsing /proc/stat: %w", err)
+			}
+			busy += v
+		}
+	}
+	if cpus == 0 {
+		return 0, 0, fmt.Errorf("no cpus in /proc/stat")
+	}
+	return busy * 1e6 / userHZ, cpus, nil
+}
+
+// RunProcesses polls the resident memory of the traced processes, as listed
+// by tracees, their page faults and the CPU time of their threads until ctx
+// is done.
+func (r *ResourceMonitor) RunProcesses(ctx context.Context, tracees func() []int) {
+	timer := time.NewTicker(rssInterval)
+	defer timer.Stop()
+	for {
+		for _, pid := range tracees() {
+			var rssKB uint64
+			err := readFlatKeyedColon(fmt.Sprintf("/proc/%d/status", pid), map[string]*uint64{
+				"VmRSS": &rssKB,
+			})
+			if err != nil {
+				// The process exited.
+				continue
+			}
+			r.mu.Lock()
+			r.rss[pid] = append(r.rss[pid], rssSample{ts: time.Now(), rss: rssKB * 1024})
+			r.mu.Unlock()
+			r.sampleFaults(pid)
+			r.sampleThreadCPU(pid)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// Clock returns the clock domain the resource samples are taken in.
+func (r *ResourceMonitor) Clock() ClockDomain {
+	return ClockMonotonic
+}
+
+// Events returns the samples as the counter tracks of a "System resources"
+// process, along with the RSS tracks of the traced processes.
 func (r *ResourceMonitor) Events() []*Event {
-	events := make([]*Event, 0, len(r.samples)+1)
+	events := make([]*Event, 0, 2*len(r.samples)+2)
 	events = append(
 		events,
 		&Event{
 			Name: "process_name",
 			Ph:   "M",
 			Cat:  "__metadata",
+			Pid:  resourcesPid,
+			Tid:  resourcesPid,
 			Args: Args{
 				Name: "System resources",
 			},
@@ -144,27 +681,242 @@ func (r *ResourceMonitor) Events() []*Event {
 			Name: "thread_name",
 			Ph:   "M",
 			Cat:  "__metadata",
+			Pid:  resourcesPid,
+			Tid:  resourcesPid,
 			Args: Args{
 				Name: "System resources",
 			},
 		},
 	)
-	for _, sample := range r.samples {
+	// Each counter is its own track, named after the counter and its unit
+	// ("CPU usage %", "Memory anon bytes", ...).
+	memoryKey := "anon bytes"
+	if r.cgroupPath == "" {
+		memoryKey = "used bytes"
+	}
+	for i, sample := range r.samples {
 		events = append(
 			events,
 			&Event{
-				Ph: "C",
-				Ts: int(sample.ts.UnixNano() / 1000),
+				Name: "CPU",
+				Ph:   "C",
+				Pid:  resourcesPid,
+				Ts:   r.sampleTs(sample),
+				Args: Args{
+					Counters: map[string]float64{"usage %": sample.cpu},
+				},
+			},
+			&Event{
+				Name: "Memory",
+				Ph:   "C",
+				Pid:  resourcesPid,
+				Ts:   r.sampleTs(sample),
 				Args: Args{
-					CPU:    sample.cpu,
-					Memory: sample.memory,
+					Counters: map[string]float64{memoryKey: float64(sample.memory)},
 				},
 			},
 		)
+		if r.hasIO && i > 0 {
+			// io.stat is cumulative, the tracks show the throughput
+			// since the previous sample.
+			prev := r.samples[i-1]
+			seconds := sample.ts.Sub(prev.ts).Seconds()
+			events = append(events, &Event{
+				Name: "io",
+				Ph:   "C",
+				Pid:  resourcesPid,
+				Ts:   r.sampleTs(sample),
+				Args: Args{
+					Counters: map[string]float64{
+						"rbytes/s": counterRate(prev.io.rbytes, sample.io.rbytes, seconds),
+						"wbytes/s": counterRate(prev.io.wbytes, sample.io.wbytes, seconds),
+						"rios/s":   counterRate(prev.io.rios, sample.io.rios, seconds),
+						"wios/s":   counterRate(prev.io.wios, sample.io.wios, seconds),
+					},
+				},
+			})
+		}
+		for j, p := range r.pressureFiles {
+			if p == "" || i == 0 {
+				continue
+			}
+			// Like the avg10/60/300 averages, the tracks are the
+			// share of time in which some or all tasks were stalled
+			// on the resource, but since the previous sample.
+			prev := r.samples[i-1]
+			usec := float64(sample.ts.Sub(prev.ts).Microseconds())
+			events = append(events, &Event{
+				Name: pressureResources[j] + " pressure",
+				Ph:   "C",
+				Pid:  resourcesPid,
+				Ts:   r.sampleTs(sample),
+				Args: Args{
+					Counters: map[string]float64{
+						"some %": 100 * counterRate(prev.pressure[j].some, sample.pressure[j].some, usec),
+						"full %": 100 * counterRate(prev.pressure[j].full, sample.pressure[j].full, usec),
+					},
+				},
+			})
+		}
+		if r.hasPids {
+			events = append(events, &Event{
+				Name: "pids",
+				Ph:   "C",
+				Pid:  resourcesPid,
+				Ts:   r.sampleTs(sample),
+				Args: Args{
+					Counters: map[string]float64{"current": float64(sample.pids)},
+				},
+			})
+		}
+	}
+	return traceconv.Merge(events, r.limitEvents(), r.swapEvents(), r.processEvents(), r.faultEvents(), r.threadCPUEvents())
+}
+
+// limitEvents returns the "CPU limit vCPUs" and "Memory limit bytes" counter
+// tracks, constant lines with the CPUs and memory the cgroup can use (or the
+// machine has), to see the headroom left next to the usage tracks.
+func (r *ResourceMonitor) limitEvents() []*Event {
+	if len(r.samples) == 0 {
+		return nil
+	}
+	var events []*Event
+	for _, ts := range []int64{r.sampleTs(r.samples[0]), r.sampleTs(r.samples[len(r.samples)-1])} {
+		events = append(events, &Event{
+			Name: "CPU",
+			Ph:   "C",
+			Pid:  resourcesPid,
+			Ts:   ts,
+			Args: Args{
+				Counters: map[string]float64{"limit vCPUs": r.vCPUs},
+			},
+		})
+		if r.memoryMax != 0 && r.memoryMax != math.MaxUint64 {
+			events = append(events, &Event{
+				Name: "Memory",
+				Ph:   "C",
+				Pid:  resourcesPid,
+				Ts:   ts,
+				Args: Args{
+					Counters: map[string]float64{"limit bytes": float64(r.memoryMax)},
+				},
+			})
+		}
 	}
 	return events
 }
 
+// processEvents returns a "Memory" counter track with the RSS of each traced
+// process.
+func (r *ResourceMonitor) processEvents() []*Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var tracks [][]*Event
+	for _, pid := range r.pids() {
+		track := make([]*Event, 0, len(r.rss[pid]))
+		for _, s := range r.rss[pid] {
+			track = append(track, &Event{
+				Name: "Memory",
+				Ph:   "C",
+				Pid:  pid,
+				Ts:   r.ts(s.ts),
+				Args: Args{
+					Counters: map[string]float64{"rss": float64(s.rss)},
+				},
+			})
+		}
+		tracks = append(tracks, track)
+	}
+	return traceconv.Merge(tracks...)
+}
+
+// pids returns the sorted pids of the processes with RSS samples. r.mu must
+// be held.
+func (r *ResourceMonitor) pids() []int {
+	pids := make([]int, 0, len(r.rss))
+	for pid := range r.rss {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	return pids
+}
+
+// MemoryGrowth looks for sustained growth of the anonymous memory of the
+// cgroup, and returns an annotation slice and a warning if there is any.
+func (r *ResourceMonitor) MemoryGrowth() ([]*Event, []string) {
+	points := make([]memoryPoint, 0, len(r.samples))
+	for _, sample := range r.samples {
+		points = append(points, memoryPoint{ts: r.sampleTs(sample), bytes: sample.memory})
+	}
+	var events []*Event
+	var warnings []string
+	if g, ok := detectMemoryGrowth(points); ok {
+		e, warning := memoryGrowthAnnotation(g, "Memory usage", resourcesPid, resourcesPid)
+		events = append(events, e)
+		warnings = append(warnings, warning)
+	}
+
+	// A leak in one of the processes can be hidden in the cgroup-wide
+	// number by others freeing memory.
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, pid := range r.pids() {
+		points := make([]memoryPoint, 0, len(r.rss[pid]))
+		for _, s := range r.rss[pid] {
+			points = append(points, memoryPoint{ts: r.ts(s.ts), bytes: s.rss})
+		}
+		if g, ok := detectMemoryGrowth(points); ok {
+			e, warning := memoryGrowthAnnotation(g, fmt.Sprintf("RSS of process %d", pid), pid, pid)
+			events = append(events, e)
+			warnings = append(warnings, warning)
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Ts < events[j].Ts
+	})
+	return events, warnings
+}
+
+// AverageCPU returns the average CPU usage (in percent of the cgroup's vCPUs)
+// sampled between start and end (in microseconds), if there are any samples
+// in that interval.
+func (r *ResourceMonitor) AverageCPU(start, end int64) (float64, bool) {
+	var sum float64
+	var n int
+	for _, sample := range r.samples {
+		ts := r.sampleTs(sample)
+		if ts < start || ts > end {
+			continue
+		}
+		sum += sample.cpu
+		n++
+	}
+	if n == 0 {
+		return 0, false
+	}
+	return sum / float64(n), true
+}
+
+// CoreShare returns the CPU usage (in percent) that corresponds to a single
+// core being busy.
+func (r *ResourceMonitor) CoreShare() float64 {
+	return 100 / r.vCPUs
+}
+
+// sampleTs returns the timestamp of a sample in microseconds. Samples are
+// timed with the monotonic clock so that wall clock adjustments during the
+// capture don't skew them, and then converted to realtime to line up with
+// strace's timestamps.
+func (r *ResourceMonitor) sampleTs(s sample) int64 {
+	return r.ts(s.ts)
+}
+
+// ts converts a sampling time to a timestamp in microseconds, as sampleTs.
+func (r *ResourceMonitor) ts(t time.Time) int64 {
+	monotonic := r.clock.Monotonic + uint64(t.Sub(r.timestamp))
+	return int64(r.clock.ToRealtime(ClockMonotonic, monotonic) / 1000)
+}
+
 func readUint64(p string) (uint64, error) {
 	contents, err := os.ReadFile(p)
 	if err != nil {
@@ -189,12 +941,23 @@ func parseUint64(s string) (uint64, error) {
 }
 
 func readFlatKeyed(p string, kv map[string]*uint64) error {
+	return readKeyed(p, " ", kv)
+}
+
+// readFlatKeyedColon is like readFlatKeyed, for the "key: value" files in
+// /proc. Values in kB, like in /proc/<pid>/status, are returned as is.
+func readFlatKeyedColon(p string, kv map[string]*uint64) error {
+	return readKeyed(p, ":", kv)
+}
+
+func readKeyed(p string, sep string, kv map[string]*uint64) error {
 	contents, err := os.ReadFile(p)
 	if err != nil {
 		return err
 	}
 	for _, line := range strings.Split(strings.TrimSpace(string(contents)), "\n") {
-		name, value, ok := strings.Cut(line, " ")
+		name, value, ok := strings.Cut(line, sep)
+		value = strings.TrimSuffix(strings.TrimSpace(value), " kB")
 		if !ok {
 			continue
 		}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// restartErrno returns the ERESTART* errno of a syscall interrupted by a
+// signal, which the kernel restarts once the signal is handled, or "" if it
+// wasn't interrupted: strace prints "? ERESTARTSYS (...)", the ptrace tracer
+// "-1 ERESTARTSYS (...)".
+func restartErrno(e *Event) string {
+	fields := strings.Fields(e.Args.ReturnValue)
+	if len(fields) < 2 || !strings.HasPrefix(fields[1], "ERESTART") || fields[1] == "ERESTART" {
+		return ""
+	}
+	return fields[1]
+}
+
+// stopSignals are the signals that interrupt a syscall without running a
+// handler: it is restarted right away once the thread is continued.
+var stopSignals = map[string]bool{
+	"SIGSTOP": true, "SIGTSTP": true, "SIGTTIN": true, "SIGTTOU": true, "SIGCONT": true,
+}
+
+// isRestart reports whether e restarts the interrupted syscall: it is made
+// again, or resumed by restart_syscall for the sleeps
+// (ERESTART_RESTARTBLOCK).
+func isRestart(interrupted, e *Event) bool {
+	return e.Name == interrupted.Name || e.Name == "restart_syscall"
+}
+
+// coalesceRestarts merges each syscall interrupted by a signal with its
+// restarts into one slice, from its start to the end of the last restart, so
+// that a blocking read interrupted by a timer signal every 10ms is one read
+// rather than dozens of short ones. The merged syscall has the result of its
+// last restart, and the number of interruptions, their last errno and the
+// time spent out of the syscall, handling the signals, in its args. The
+// signal handlers, and their syscalls, are nested in it.
+//
+// A syscall isn't restarted when the handler returns EINTR from it: its
+// rt_sigreturn then fails with EINTR, and it keeps its own slice. Once a
+// handler ran, only a syscall made after its rt_sigreturn is a restart, so
+// that the same syscall made by the handler isn't taken for one; without a
+// handler, for the stop signals or a ptrace stop, the restart is the next
+// syscall.
+func coalesceRestarts(syscallEvents []*Event) []*Event {
+	threads := make(map[int][]*Event) // [tid]
+	for _, e := range syscallEvents {
+		if isSyscall(e) || e.Cat == "unfinished" || e.Cat == "signal" {
+			threads[e.Tid] = append(threads[e.Tid], e)
+		}
+	}
+	merged := make(map[*Event]bool)
+	for _, events := range threads {
+		sort.SliceStable(events, func(i, j int) bool {
+			return events[i].TsNanos() < events[j].TsNanos()
+		})
+		var interrupted *Event
+		var interruptedNs int64
+		// handled is whether a handler ran since the interruption,
+		// and returned whether it returned.
+		handled, returned := false, false
+		for _, e := range events {
+			switch {
+			case e.Cat == "signal":
+				if interrupted != nil && !stopSignals[e.Name] {
+					handled = true
+				}
+				continue
+			case interrupted == nil:
+			case e.Name == "rt_sigreturn" && strings.Contains(e.Args.ReturnValue, "EINTR"):
+				interrupted = nil
+			case e.Name == "rt_sigreturn":
+				returned = true
+			case isRestart(interrupted, e) && (returned || !handled):
+				interruptedNs += e.TsNanos() - interrupted.EndNanos()
+				restartOf(interrupted, e, interruptedNs)
+				merged[e] = true
+				if restartErrno(e) == "" {
+					interrupted = nil
+				}
+				handled, returned = false, false
+				continue
+			case returned:
+				// The handler returned, and another syscall
+				// was made instead.
+				interrupted = nil
+			default:
+				// A syscall of the handler.
+				handled = true
+			}
+			if interrupted == nil && restartErrno(e) != "" {
+				interrupted, interruptedNs, handled, returned = e, 0, false, false
+			}
+		}
+	}
+	if len(merged) == 0 {
+		return syscallEvents
+	}
+	kept := syscallEvents[:0]
+	for _, e := range syscallEvents {
+		if !merged[e] {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+// restartOf extends the interrupted syscall to the end of its restart, taking
+// the result of the restart, interruptedNs being the time spent out of the
+// syscall so far.
+func restartOf(interrupted, restart *Event, interruptedNs int64) {
+	if interrupted.Args.Data == nil {
+		interrupted.Args.Data = make(map[string]any)
+	}
+	interruptions, _ := interrupted.Args.Data["interruptions"].(int)
+	errno := restartErrno(interrupted)
+	data := interrupted.Args.Data
+	if restart.Name == interrupted.Name {
+		// The restart has the args as they were when it returned,
+		// such as the buffer read.
+		interrupted.Args.First = restart.Args.First
+		data = restart.Args.Data
+		if data == nil {
+			data = make(map[string]any)
+		}
+	}
+	data["interruptions"] = interruptions + 1
+	data["interrupted_errno"] = errno
+	data["interrupted_us"] = float64(interruptedNs) / 1000
+	interrupted.Args.Data = data
+	interrupted.Args.ReturnValue = restart.Args.ReturnValue
+	interrupted.Cat = restart.Cat
+	dur := restart.EndNanos() - interrupted.TsNanos()
+	interrupted.Dur, interrupted.DurNs = dur/1000, int(dur%1000)
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/replit/strace-perfetto/pkg/traceconv"
+)
+
+// byteSize is a size in bytes, set from a number with an optional K, M or G
+// suffix (powers of 1024), e.g. 500M.
+type byteSize int64
+
+func (s *byteSize) String() string {
+	for _, u := range []struct {
+		suffix string
+		size   int64
+	}{{"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}} {
+		if *s != 0 && int64(*s)%u.size == 0 {
+			return strconv.FormatInt(int64(*s)/u.size, 10) + u.suffix
+		}
+	}
+	return strconv.FormatInt(int64(*s), 10)
+}
+
+func (s *byteSize) Set(v string) error {
+	units := map[string]int64{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30}
+	n, unit := v, int64(1)
+	if len(v) > 0 {
+		if u, ok := units[strings.ToUpper(v[len(v)-1:])]; ok {
+			n, unit = v[:len(v)-1], u
+		}
+	}
+	size, err := strconv.ParseInt(n, 10, 64)
+	if err != nil || size < 0 {
+		return fmt.Errorf("invalid size %q", v)
+	}
+	*s = byteSize(size * unit)
+	return nil
+}
+
+// segmentWriter writes a trace rotated into segments of at most maxSize bytes,
+// as far as the events allow: a segment has at least one event. Each segment
+// is a trace of its own, with the metadata events naming its processes and
+// threads. The slices still open when a segment is cut are ended there and
+// begun again in the next one, and the steps of a flow are held back until
+// its end, so that they all land in the same segment. Each event is encoded
+// once, its size known before it is written.
+type segmentWriter struct {
+	output  string
+	maxSize int64
+	// outputs are the segments written so far: the trace can be written in
+	// several calls, its segments numbered on.
+	outputs []string
+}
+
+// segment is the segment being written.
+type segment struct {
+	f      *os.File
+	w      *bufio.Writer
+	tw     *traceconv.Writer
+	size   int64
+	events int // not counting the metadata events
+}
+
+// openSlices are the B and b events not ended yet, innermost last, by
+// thread for B and by id for b.
+type openSlices map[string][]*Event
+
+func sliceKey(e *Event) string {
+	if e.Ph == "B" || e.Ph == "E" {
+		return fmt.Sprintf("%d/%d", e.Pid, e.Tid)
+	}
+	return fmt.Sprintf("%s/%d", e.Cat, e.Id)
+}
+
+func (o openSlices) observe(e *Event) {
+	switch e.Ph {
+	case "B", "b":
+		o[sliceKey(e)] = append(o[sliceKey(e)], e)
+	case "E", "e":
+		key := sliceKey(e)
+		if n := len(o[key]); n > 0 {
+			o[key] = o[key][:n-1]
+		}
+	}
+}
+
+// write writes the events, sorted by time, into the next segments, and the
+// events tail returns at the end of the last one.
+func (sw *segmentWriter) write(events []*Event, metadata map[string]any, tail func() []*Event) error {
+	var names []*Event
+	for _, e := range events {
+		if e.Ph == "M" {
+			names = append(names, e)
+		}
+	}
+	header, err := json.MarshalIndent(metadata, " ", " ")
+	if err != nil {
+		return err
+	}
+	open := make(openSlices)
+	var seg *segment
+	var last *Event
+
+	begin := func(first *Event) error {
+		output := segmentOutput(sw.output, len(sw.outputs))
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		sw.outputs = append(sw.outputs, output)
+		seg = &segment{f: f, w: bufio.NewWriter(f)}
+		seg.tw = traceconv.NewWriter(seg)
+		for _, e := range names {
+			if err := seg.tw.WriteEvent(e); err != nil {
+				return err
+			}
+		}
+		for _, key := range slices.Sorted(maps.Keys(open)) {
+			for _, e := range open[key] {
+				reopened := *e
+				reopened.Ts, reopened.TsNs = first.Ts, first.TsNs
+				if err := seg.tw.WriteEvent(&reopened); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	end := func() error {
+		for _, key := range slices.Sorted(maps.Keys(open)) {
+			opened := open[key]
+			for i := len(opened) - 1; i >= 0; i-- {
+				e := opened[i]
+				ended := &Event{Name: e.Name, Cat: e.Cat, Ph: "E", Pid: e.Pid, Tid: e.Tid, Id: e.Id, Ts: last.Ts, TsNs: last.TsNs}
+				if e.Ph == "b" {
+					ended.Ph = "e"
+				}
+				if err := seg.tw.WriteEvent(ended); err != nil {
+					return err
+				}
+			}
+		}
+		if err := seg.tw.Close(metadata); err != nil {
+			return err
+		}
+		if err := seg.w.Flush(); err != nil {
+			return err
+		}
+		if err := seg.f.Close(); err != nil {
+			return err
+		}
+		fmt.Printf("[+] Trace file saved to: %s\n", seg.f.Name())
+		return nil
+	}
+	// emit writes the events, the steps of a flow, into one segment.
+	emit := func(group ...*Event) error {
+		if seg == nil {
+			if err := begin(group[0]); err != nil {
+				return err
+			}
+		}
+		encoded := make([][]byte, len(group))
+		var size int64
+		for i, e := range group {
+			b, err := seg.tw.Encode(e)
+			if err != nil {
+				return err
+			}
+			encoded[i] = b
+			size += int64(len(b)) + 4
+		}
+		// The ends of the open slices, the metadata and the closing
+		// of the trace come last.
+		closing := int64(len(header)) + 64
+		for _, opened := range open {
+			closing += int64(len(opened)) * 160
+		}
+		if seg.events > 0 && seg.size+size+closing > sw.maxSize {
+			if err := end(); err != nil {
+				return err
+			}
+			if err := begin(group[0]); err != nil {
+				return err
+			}
+			// Encoded again, for the stack frames of the new
+			// segment.
+			for i, e := range group {
+				if encoded[i], err = seg.tw.Encode(e); err != nil {
+					return err
+				}
+			}
+		}
+		for i, e := range group {
+			if err := seg.tw.WriteEncoded(encoded[i]); err != nil {
+				return err
+			}
+			seg.events++
+			open.observe(e)
+			if last == nil || e.TsNanos() > last.TsNanos() {
+				last = e
+			}
+		}
+		return nil
+	}
+
+	flows := make(map[string][]*Event) // [cat/id] the steps before the end
+	var flowOrder []string
+	for _, e := range events {
+		var err error
+		switch e.Ph {
+		case "M":
+			continue
+		case "s", "t":
+			key := sliceKey(e)
+			if flows[key] == nil {
+				flowOrder = append(flowOrder, key)
+			}
+			flows[key] = append(flows[key], e)
+		case "f":
+			key := sliceKey(e)
+			err = emit(append(flows[key], e)...)
+			delete(flows, key)
+		default:
+			err = emit(e)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// The flows that never ended.
+	for _, key := range flowOrder {
+		if steps := flows[key]; steps != nil {
+			if err := emit(steps...); err != nil {
+				return err
+			}
+		}
+	}
+	if tail != nil {
+		for _, e := range tail() {
+			if err := emit(e); err != nil {
+				return err
+			}
+		}
+	}
+	if seg == nil {
+		// Only metadata events, or none: an empty trace.
+		if err := begin(&Event{}); err != nil {
+			return err
+		}
+	}
+	return end()
+}
+
+// Write counts the bytes of the segment as they are written.
+func (s *segment) Write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	s.size += int64(n)
+	return n, err
+}
+
+// straceRotator rotates the trace while strace is still writing its output,
+// so that neither the output file nor the events in memory grow with the
+// length of the capture: each time the output grows by maxSize, the lines so
+// far are converted and written as segments, and their space in the file is
+// given back. The syscalls still unfinished are carried over to the next
+// lines, with the process tree and the personalities of the processes.
+type straceRotator struct {
+	f            *os.File // the strace output
+	segments     *segmentWriter
+	metadata     map[string]any
+	tree         traceconv.ProcTree
+	pollInterval time.Duration
+
+	offset        int64    // the output rotated so far
+	carried       []string // the unfinished syscalls of the lines rotated
+	personalities []string
+}
+
+// Run rotates the output as it grows, until ctx is done.
+func (r *straceRotator) Run(ctx context.Context) {
+	f, err := os.Open(r.f.Name())
+	if err != nil {
+		log.Printf("[!] Error reading strace output to rotate it: %s", err)
+		return
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	var lines []string
+	var size int64
+	var partial string
+	for {
+		line, err := br.ReadString('\n')
+		if err == nil {
+			lines = append(lines, partial+line)
+			size += int64(len(partial) + len(line))
+			partial = ""
+			if size >= r.segments.maxSize {
+				if err := r.rotate(lines, size); err != nil {
+					log.Printf("[!] Error rotating the trace: %s", err)
+					return
+				}
+				lines, size = nil, 0
+			}
+			continue
+		}
+		if err != io.EOF {
+			log.Printf("[!] Error reading strace output to rotate it: %s", err)
+			return
+		}
+		partial += line
+		select {
+		case <-ctx.Done():
+			// The lines not rotated yet are left for Rest.
+			return
+		case <-time.After(r.pollInterval):
+		}
+	}
+}
+
+// rotate converts and writes the lines, size bytes of the output, but for the
+// syscalls still unfinished at their end, which are carried on to the next
+// rotation along with the ones carried so far, for as many rotations as they
+// block.
+func (r *straceRotator) rotate(lines []string, size int64) error {
+	lines = append(r.carried, lines...)
+	unfinished := unfinishedLines(lines)
+	var text strings.Builder
+	for _, line := range r.personalities {
+		text.WriteString(line)
+	}
+	var carried []string
+	for i, line := range lines {
+		if strings.HasPrefix(line, "[ Process PID=") {
+			r.personalities = append(r.personalities, line)
+		}
+		if unfinished[i] {
+			carried = append(carried, line)
+			continue
+		}
+		text.WriteString(line)
+	}
+	events := convertStrace(strings.NewReader(text.String()), r.tree)
+	if *flagMinDur > 0 {
+		events = dropShortSyscalls(events, flagMinDur.Microseconds(), *flagMinDurCount)
+	}
+	if err := r.segments.write(events, r.metadata, nil); err != nil {
+		return err
+	}
+	r.tree = treeOf(events, r.tree)
+	r.offset += size
+	r.carried = carried
+	if err := punchHole(r.f, r.offset); err != nil {
+		verbosef("the strace output keeps its size on disk: %v", err)
+	}
+	return nil
+}
+
+// Rest returns the output not rotated yet, once strace exited, and the
+// process tree to convert it with.
+func (r *straceRotator) Rest() (io.Reader, traceconv.ProcTree, error) {
+	if _, err := r.f.Seek(r.offset, io.SeekStart); err != nil {
+		return nil, r.tree, err
+	}
+	carried := strings.Join(r.personalities, "") + strings.Join(r.carried, "")
+	return io.MultiReader(strings.NewReader(carried), r.f), r.tree, nil
+}
+
+// unfinishedLines returns the lines of the syscalls unfinished and not
+// resumed in lines, which strace resumes further on, unless their thread
+// exits first.
+func unfinishedLines(lines []string) map[int]bool {
+	type call struct {
+		line int
+		name string
+	}
+	pending := make(map[int][]call) // [tid]
+	for i, line := range lines {
+		e := traceconv.NewEvent(strings.TrimSuffix(line, "\n"))
+		switch e.Cat {
+		case "unfinished":
+			pending[e.Tid] = append(pending[e.Tid], call{i, e.Name})
+		case "detached":
+			calls := pending[e.Tid]
+			for j := len(calls) - 1; j >= 0; j-- {
+				if calls[j].name == e.Name {
+					pending[e.Tid] = append(calls[:j], calls[j+1:]...)
+					break
+				}
+			}
+		case "lifetime":
+			delete(pending, e.Tid)
+		}
+	}
+	unfinished := make(map[int]bool)
+	for _, calls := range pending {
+		for _, c := range calls {
+			unfinished[c.line] = true
+		}
+	}
+	return unfinished
+}
+
+// treeOf adds the processes and threads named in the metadata events to the
+// tree, for the next lines to convert.
+func treeOf(events []*Event, tree traceconv.ProcTree) traceconv.ProcTree {
+	if tree.Threads == nil {
+		tree = traceconv.ProcTree{Threads: make(map[int]int), Names: make(map[int]string)}
+	}
+	for _, e := range events {
+		if e.Ph != "M" || e.Pid >= pidMaxLimit || e.Tid >= pidMaxLimit {
+			continue
+		}
+		switch e.Name {
+		case "thread_name":
+			tree.Threads[e.Tid] = e.Pid
+			tree.Names[e.Tid] = e.Args.Name
+		case "process_name":
+			tree.Threads[e.Pid] = e.Pid
+			tree.Names[e.Pid] = e.Args.Name
+		}
+	}
+	return tree
+}
+
+// segmentOutput returns the output file of the given segment, e.g.
+// stracefile-001.json.
+func segmentOutput(output string, i int) string {
+	ext := path.Ext(output)
+	return fmt.Sprintf("%s-%03d%s", strings.TrimSuffix(output, ext), i+1, ext)
+}
+
+// segmentWriters are the segment writers of the outputs, the segments of a
+// trace rotated during the capture numbered on by the ones written after it.
+var segmentWriters = make(map[string]*segmentWriter)
+
+// segmentsOf returns the segment writer of output.
+func segmentsOf(output string) *segmentWriter {
+	sw := segmentWriters[output]
+	if sw == nil {
+		sw = &segmentWriter{output: output, maxSize: int64(flagMaxOutput)}
+		segmentWriters[output] = sw
+	}
+	return sw
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestRotateCarriesUnfinished checks that a syscall blocked across two
+// rotations, the parent's wait4, is carried on until it is resumed, rather
+// than written as never resumed into the second segment.
+func TestRotateCarriesUnfinished(t *testing.T) {
+	chunks := [][]string{{
+		"1000 1651010489.100000 execve(\"/bin/sh\", [\"sh\"], 0x7ffd /* 20 vars */) = 0 <0.000100>\n",
+		"1000 1651010489.100200 wait4(-1,  <unfinished ...>\n",
+		"1001 1651010489.100300 getpid() = 1001 <0.000001>\n",
+	}, {
+		"1001 1651010489.100400 nanosleep({tv_sec=0, tv_nsec=1000}, NULL) = 0 <0.000100>\n",
+		"1001 1651010489.100600 getppid() = 1000 <0.000001>\n",
+	}}
+	rest := []string{
+		"1001 1651010489.100700 exit_group(0) = ?\n",
+		"1001 1651010489.100800 +++ exited with 0 +++\n",
+		"1000 1651010489.100900 <... wait4 resumed>[{WIFEXITED(s) && WEXITSTATUS(s) == 0}], 0, NULL) = 1001 <0.000700>\n",
+	}
+	dir := t.TempDir()
+	f, err := os.Create(filepath.Join(dir, "strace.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, lines := range append(chunks, rest) {
+		f.WriteString(strings.Join(lines, ""))
+	}
+	r := &straceRotator{
+		f:        f,
+		segments: &segmentWriter{output: filepath.Join(dir, "trace.json"), maxSize: 1 << 20},
+		metadata: map[string]any{},
+	}
+	for _, lines := range chunks {
+		if err := r.rotate(lines, int64(len(strings.Join(lines, "")))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, output := range r.segments.outputs {
+		te, err := LoadTraceEvents(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range te.Event {
+			if e.Name == "wait4" {
+				t.Errorf("%s has wait4 (%s), want it carried on", output, e.Cat)
+			}
+		}
+	}
+	if len(r.carried) != 1 {
+		t.Fatalf("%d lines carried, want the wait4 one: %q", len(r.carried), r.carried)
+	}
+	restReader, tree, err := r.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(restReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wait4 *Event
+	for _, e := range convertStrace(strings.NewReader(string(b)), tree) {
+		if e.Name == "wait4" {
+			wait4 = e
+		}
+	}
+	if wait4 == nil || wait4.Cat != "detached" || wait4.Ts != 1651010489100200 || wait4.Dur != 700 {
+		t.Errorf("wait4 = %+v, want it resumed, from 1651010489100200 for 700us", wait4)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// runsScript runs the command given as its arguments the number of times
+// given as $0, one after the other, each in a process of its own.
+const runsScript = `i=0; while [ "$i" -lt "$0" ]; do "$@"; i=$((i+1)); done`
+
+// runsArgs returns the command wrapped in a shell that runs it n times.
+func runsArgs(n int, command []string) []string {
+	return append([]string{"sh", "-c", runsScript, strconv.Itoa(n)}, command...)
+}
+
+// run is one of the runs of -runs: the process the shell forked for it and
+// its descendants, from the fork to the last of their events.
+type run struct {
+	pid        int
+	start, end int64
+	pids       map[int]bool
+	syscalls   int
+	syscallDur int64
+}
+
+// findRuns finds the runs of the command in the trace of the -runs shell, the
+// processes forked by the process the trace starts with, in order.
+func findRuns(events []*Event) []*run {
+	shell := -1
+	var runs []*run
+	byPid := make(map[int]*run)
+	forks := make(map[uint64]*Event) // [flow id]clone
+	for _, e := range events {
+		if e.Ph == "M" {
+			continue
+		}
+		if shell < 0 {
+			shell = e.Pid
+		}
+		if e.Cat == "clone" {
+			switch e.Ph {
+			case "s":
+				forks[e.Id] = e
+			case "f":
+				fork := forks[e.Id]
+				if fork == nil || fork.Pid == e.Pid {
+					continue
+				}
+				if fork.Pid == shell {
+					r := &run{pid: e.Pid, start: fork.Ts, end: fork.Ts, pids: map[int]bool{e.Pid: true}}
+					runs = append(runs, r)
+					byPid[e.Pid] = r
+				} else if r := byPid[fork.Pid]; r != nil {
+					// Descendants belong to the same run as
+					// their parent.
+					r.pids[e.Pid] = true
+					byPid[e.Pid] = r
+				}
+			}
+			continue
+		}
+		r := byPid[e.Pid]
+		if r == nil {
+			continue
+		}
+		r.end = max(r.end, e.Ts+e.Dur)
+		if isSyscall(e) {
+			r.syscalls++
+			r.syscallDur += e.Dur
+		}
+	}
+	return runs
+}
+
+// labelRuns prefixes the name of the processes of each run with the run
+// number, so that each run is a process group of its own.
+func labelRuns(events []*Event, runs []*run) {
+	owner := make(map[int]int)
+	for i, r := range runs {
+		for pid := range r.pids {
+			owner[pid] = i
+		}
+	}
+	for _, e := range events {
+		if e.Name != "process_name" {
+			continue
+		}
+		if i, ok := owner[e.Pid]; ok {
+			e.Args.Name = fmt.Sprintf("run %d: %s", i+1, e.Args.Name)
+		}
+	}
+}
+
+// runEvents returns the events of the runs, leaving out the shell running
+// them.
+func runEvents(events []*Event, runs []*run) []*Event {
+	pids := make(map[int]bool)
+	for _, r := range runs {
+		for pid := range r.pids {
+			pids[pid] = true
+		}
+	}
+	var kept []*Event
+	for _, e := range events {
+		if pids[e.Pid] {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+// printRuns writes the wall time and the syscalls of each run, and the
+// summary of the syscalls of all of them.
+func printRuns(w io.Writer, events []*Event, runs []*run) {
+	const format = "%5s %12s %9s %14s\n"
+	fmt.Fprintf(w, format, "run", "wall time", "syscalls", "syscall time")
+	var total, fastest, slowest time.Duration
+	for i, r := range runs {
+		wall := time.Duration(r.end-r.start) * time.Microsecond
+		syscallTime := time.Duration(r.syscallDur) * time.Microsecond
+		fmt.Fprintf(w, format, strconv.Itoa(i+1), wall, strconv.Itoa(r.syscalls), syscallTime)
+		total += wall
+		if i == 0 || wall < fastest {
+			fastest = wall
+		}
+		slowest = max(slowest, wall)
+	}
+	if len(runs) > 0 {
+		fmt.Fprintf(w, "wall time: mean %s, min %s, max %s\n\n", total/time.Duration(len(runs)), fastest, slowest)
+	}
+	NewSummary(runEvents(events, runs)).Print(w)
+}
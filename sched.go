@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	schedPid = pidMaxLimit + 8
+
+	// schedPollInterval is how often trace_pipe is read once it is
+	// drained.
+	schedPollInterval = 10 * time.Millisecond
+)
+
+// tracefsMounts are the places tracefs is found, on its own or under debugfs.
+var tracefsMounts = []string{"/sys/kernel/tracing", "/sys/kernel/debug/tracing"}
+
+// schedEvents are the ftrace events the scheduler monitor enables.
+var schedEvents = []string{"sched_switch", "sched_wakeup", "sched_wakeup_new"}
+
+// regexpFtraceLine matches a line of trace_pipe, such as
+//
+//	bash-1234    [002] d..2. 5372.123456: sched_switch: prev_comm=bash ...
+//
+// capturing the CPU, the timestamp and the event with its fields. The flags
+// before the timestamp are only there with the irq-info option.
+var regexpFtraceLine = regexp.MustCompile(`\[(\d+)\](?:\s+\S+)?\s+(\d+)\.(\d+): (\w+): (.*)$`)
+
+// schedRecord is a sched_switch from prev to next on a CPU, or a sched_wakeup
+// of next.
+type schedRecord struct {
+	ts        int64 // CLOCK_REALTIME ns
+	cpu       int
+	wakeup    bool
+	prev      int
+	prevState string
+	next      int
+}
+
+// SchedMonitor records the scheduling of the threads with ftrace: when they
+// are woken up, and when and on which CPU they run. It tells a slow syscall
+// from a thread that was waiting for a CPU, which neither strace nor /proc
+// can. The events are recorded in a tracefs instance of its own, for the
+// threads it is given and the ones they create, and the ones of the traced
+// threads are picked among them once they are known. It needs root.
+type SchedMonitor struct {
+	instance string
+	clock    ClockSnapshot
+
+	mu      sync.Mutex
+	records []schedRecord
+	comms   map[int]string // [tid]
+	lost    bool
+}
+
+// NewSchedMonitor creates a tracefs instance recording the scheduler events
+// of the threads tids and of the threads and processes they create, or of the
+// whole system on kernels without set_event_pid (before 4.4).
+func NewSchedMonitor(tids []int) (*SchedMonitor, error) {
+	var tracefs string
+	for _, dir := range tracefsMounts {
+		if _, err := os.Stat(filepath.Join(dir, "instances")); err == nil {
+			tracefs = dir
+			break
+		}
+	}
+	if tracefs == "" {
+		return nil, errors.New("tracefs is not mounted")
+	}
+	m := &SchedMonitor{
+		instance: filepath.Join(tracefs, "instances", fmt.Sprintf("strace-perfetto-%d", os.Getpid())),
+		comms:    make(map[int]string),
+	}
+	if err := os.Mkdir(m.instance, 0o755); err != nil {
+		return nil, err
+	}
+	pids := make([]string, len(tids))
+	for i, tid := range tids {
+		pids[i] = strconv.Itoa(tid)
+	}
+	if err := os.WriteFile(filepath.Join(m.instance, "set_event_pid"), []byte(strings.Join(pids, " ")), 0); err != nil {
+		verbosef("the scheduler events are the ones of the whole system: %v", err)
+	} else if err := os.WriteFile(filepath.Join(m.instance, "options", "event-fork"), []byte("1"), 0); err != nil {
+		m.Close()
+		return nil, err
+	}
+	// The boot clock is the one that can be converted to the realtime
+	// one of strace.
+	settings := [][2]string{{"trace_clock", "boot"}, {"buffer_size_kb", "8192"}}
+	for _, event := range schedEvents {
+		settings = append(settings, [2]string{filepath.Join("events", "sched", event, "enable"), "1"})
+	}
+	for _, s := range settings {
+		if err := os.WriteFile(filepath.Join(m.instance, s[0]), []byte(s[1]), 0); err != nil {
+			m.Close()
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Close removes the tracefs instance.
+func (m *SchedMonitor) Close() {
+	os.WriteFile(filepath.Join(m.instance, "tracing_on"), []byte("0"), 0)
+	if err := syscall.Rmdir(m.instance); err != nil {
+		fmt.Printf("[!] Error removing the tracefs instance %s: %s\n", m.instance, err)
+	}
+}
+
+// Run records the scheduler events until ctx is done.
+func (m *SchedMonitor) Run(ctx context.Context) {
+	m.clock = TakeClockSnapshot()
+	fd, err := syscall.Open(filepath.Join(m.instance, "trace_pipe"), syscall.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		fmt.Printf("[!] Error reading the scheduler events: %s\n", err)
+		return
+	}
+	defer syscall.Close(fd)
+
+	buf := make([]byte, 1<<20)
+	var partial []byte
+	stopping := false
+	for {
+		n, err := syscall.Read(fd, buf)
+		if n > 0 {
+			data := append(partial, buf[:n]...)
+			end := strings.LastIndexByte(string(data), '\n') + 1
+			m.parse(string(data[:end]))
+			partial = append([]byte(nil), data[end:]...)
+			continue
+		}
+		if err != nil && err != syscall.EAGAIN && err != syscall.EINTR {
+			fmt.Printf("[!] Error reading the scheduler events: %s\n", err)
+			return
+		}
+		if stopping {
+			// Drained the events recorded before the end.
+			return
+		}
+		select {
+		case <-ctx.Done():
+			os.WriteFile(filepath.Join(m.instance, "tracing_on"), []byte("0"), 0)
+			stopping = true
+		case <-time.After(schedPollInterval):
+		}
+	}
+}
+
+// parse records the scheduler events in lines of trace_pipe.
+func (m *SchedMonitor) parse(lines string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, line := range strings.Split(lines, "\n") {
+		if strings.Contains(line, "LOST") && strings.Contains(line, "EVENTS") {
+			// "CPU:2 [LOST 123 EVENTS]"
+			m.lost = true
+			continue
+		}
+		match := regexpFtraceLine.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		cpu, _ := strconv.Atoi(match[1])
+		secs, _ := strconv.ParseInt(match[2], 10, 64)
+		frac := (match[3] + "000000000")[:9]
+		ns, _ := strconv.ParseInt(frac, 10, 64)
+		r := schedRecord{
+			ts:  int64(m.clock.ToRealtime(ClockBoottime, uint64(secs*1e9+ns))),
+			cpu: cpu,
+		}
+		fields := match[5]
+		switch match[4] {
+		case "sched_switch":
+			prevComm, ok1 := ftraceField(fields, "prev_comm", " prev_pid=")
+			prev, ok2 := ftraceField(fields, "prev_pid", " ")
+			r.prevState, _ = ftraceField(fields, "prev_state", " ")
+			nextComm, ok3 := ftraceField(fields, "next_comm", " next_pid=")
+			next, ok4 := ftraceField(fields, "next_pid", " ")
+			if !ok1 || !ok2 || !ok3 || !ok4 {
+				continue
+			}
+			r.prev, _ = strconv.Atoi(prev)
+			r.next, _ = strconv.Atoi(next)
+			m.comms[r.prev] = prevComm
+			m.comms[r.next] = nextComm
+		case "sched_wakeup", "sched_wakeup_new":
+			comm, ok1 := ftraceField(fields, "comm", " pid=")
+			pid, ok2 := ftraceField(fields, "pid", " ")
+			if !ok1 || !ok2 {
+				continue
+			}
+			r.wakeup = true
+			r.next, _ = strconv.Atoi(pid)
+			if cpu, ok := ftraceField(fields, "target_cpu", " "); ok {
+				r.cpu, _ = strconv.Atoi(cpu)
+			}
+			m.comms[r.next] = comm
+		default:
+			continue
+		}
+		m.records = append(m.records, r)
+	}
+}
+
+// ftraceField returns the value of key=value in the fields of an ftrace
+// event, up to end: the comms, which can contain spaces, end at the key that
+// follows them.
+func ftraceField(fields, key, end string) (string, bool) {
+	i := strings.Index(" "+fields, " "+key+"=")
+	if i < 0 {
+		return "", false
+	}
+	value := fields[i+len(key)+1:]
+	if j := strings.Index(value, end); j >= 0 {
+		value = value[:j]
+	} else if end != " " {
+		return "", false
+	}
+	return value, true
+}
+
+// Lost returns whether ftrace dropped events, its buffer filling up faster
+// than it was read.
+func (m *SchedMonitor) Lost() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lost
+}
+
+// schedSlice is a slice of the scheduling tracks being recorded.
+type schedSlice struct {
+	name  string
+	start int64
+	cpu   int
+}
+
+// Events returns the scheduling of the given threads, as the tracks of a "CPU
+// scheduling" process: a track per CPU with the threads it ran, and a track
+// per thread with when it ran and when it was runnable, woken up or
+// preempted, but waiting for a CPU.
+func (m *SchedMonitor) Events(tids map[int]bool) []*Event {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var events []*Event
+	cpus := make(map[int]*schedSlice)    // [cpu]
+	threads := make(map[int]*schedSlice) // [tid]
+	seenCPUs := make(map[int]bool)
+	seenThreads := make(map[int]bool)
+	slice := func(tid int, s *schedSlice, end int64) *Event {
+		e := &Event{
+			Name: s.name,
+			Cat:  "sched",
+			Ph:   "X",
+			Pid:  schedPid,
+			Tid:  tid,
+			Ts:   s.start / 1000,
+			Dur:  (end - s.start) / 1000,
+		}
+		if s.name == "Running" {
+			e.Args.Data = map[string]any{"cpu": s.cpu}
+		}
+		return e
+	}
+	endThread := func(tid int, end int64) {
+		if s := threads[tid]; s != nil {
+			events = append(events, slice(tid, s, end))
+			delete(threads, tid)
+		}
+	}
+	var last int64
+	for _, r := range m.records {
+		last = r.ts
+		if r.wakeup {
+			if tids[r.next] && threads[r.next] == nil {
+				threads[r.next] = &schedSlice{name: "Runnable", start: r.ts}
+				seenThreads[r.next] = true
+			}
+			continue
+		}
+		cpuTid := schedPid + 1 + r.cpu
+		if tids[r.prev] {
+			if s := cpus[r.cpu]; s != nil {
+				events = append(events, slice(cpuTid, s, r.ts))
+				delete(cpus, r.cpu)
+			}
+			endThread(r.prev, r.ts)
+			if strings.HasPrefix(r.prevState, "R") {
+				threads[r.prev] = &schedSlice{name: "Runnable (preempted)", start: r.ts}
+			}
+		}
+		if tids[r.next] {
+			cpus[r.cpu] = &schedSlice{name: fmt.Sprintf("%s %d", m.comms[r.next], r.next), start: r.ts}
+			seenCPUs[r.cpu] = true
+			endThread(r.next, r.ts)
+			threads[r.next] = &schedSlice{name: "Running", start: r.ts, cpu: r.cpu}
+			seenThreads[r.next] = true
+		}
+	}
+	for cpu, s := range cpus {
+		events = append(events, slice(schedPid+1+cpu, s, last))
+	}
+	for tid := range threads {
+		endThread(tid, last)
+	}
+	if len(events) == 0 {
+		return nil
+	}
+
+	metadata := []*Event{
+		{
+			Name: "process_name",
+			Ph:   "M",
+			Cat:  "__metadata",
+			Pid:  schedPid,
+			Tid:  schedPid,
+			Args: Args{
+				Name: "CPU scheduling",
+			},
+		},
+	}
+	for cpu := range seenCPUs {
+		metadata = append(metadata, &Event{
+			Name: "thread_name",
+			Ph:   "M",
+			Cat:  "__metadata",
+			Pid:  schedPid,
+			Tid:  schedPid + 1 + cpu,
+			Args: Args{
+				Name: fmt.Sprintf("CPU %d", cpu),
+			},
+		})
+	}
+	for tid := range seenThreads {
+		metadata = append(metadata, &Event{
+			Name: "thread_name",
+			Ph:   "M",
+			Cat:  "__metadata",
+			Pid:  schedPid,
+			Tid:  tid,
+			Args: Args{
+				Name: fmt.Sprintf("%s %d", m.comms[tid], tid),
+			},
+		})
+	}
+	// Slices are recorded when they end, not in the order they start.
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Ts < events[j].Ts
+	})
+	return append(metadata, events...)
+}
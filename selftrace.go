@@ -0,0 +1,110 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const selfTracePid = pidMaxLimit + 3
+
+// selfTrace records the tool's own phases when -self-trace is given, nil
+// otherwise.
+var selfTrace *SelfTrace
+
+// SelfTrace records the phases of strace-perfetto itself (running strace,
+// parsing, building the process tree, enriching, exporting) as slices in a
+// "strace-perfetto" process, along with how many events per second each
+// phase got through, to show where the conversion time goes on big captures.
+type SelfTrace struct {
+	mu     sync.Mutex
+	events []*Event
+	open   map[*Event]bool
+}
+
+// NewSelfTrace returns a new self trace.
+func NewSelfTrace() *SelfTrace {
+	return &SelfTrace{
+		open: make(map[*Event]bool),
+	}
+}
+
+// Begin starts a phase. The returned function ends it, given the number of
+// events the phase processed (0 if it doesn't process events). Both are no-ops
+// on a nil SelfTrace.
+func (s *SelfTrace) Begin(name string) func(events int) {
+	if s == nil {
+		return func(int) {}
+	}
+	start := time.Now()
+	e := &Event{
+		Name: name,
+		Cat:  "self",
+		Ph:   "X",
+		Pid:  selfTracePid,
+		Tid:  selfTracePid,
+		Ts:   start.UnixMicro(),
+	}
+	s.mu.Lock()
+	s.events = append(s.events, e)
+	s.open[e] = true
+	s.mu.Unlock()
+	return func(events int) {
+		end := time.Now()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if !s.open[e] {
+			return
+		}
+		delete(s.open, e)
+		e.Dur = end.Sub(start).Microseconds()
+		if events == 0 {
+			return
+		}
+		e.Args.Data = map[string]any{"events": events}
+		rate := float64(events) / end.Sub(start).Seconds()
+		s.events = append(s.events, &Event{
+			Name: "events/s",
+			Ph:   "C",
+			Pid:  selfTracePid,
+			Ts:   e.Ts,
+			Args: Args{Counters: map[string]float64{"events/s": rate}},
+		}, &Event{
+			Name: "events/s",
+			Ph:   "C",
+			Pid:  selfTracePid,
+			Ts:   e.Ts + e.Dur,
+			Args: Args{Counters: map[string]float64{"events/s": 0}},
+		})
+	}
+}
+
+// Events returns the phases recorded since the last call, so that a tool
+// writing several traces (segments, incarnations) writes each phase once.
+// Phases still running end now.
+func (s *SelfTrace) Events() []*Event {
+	if s == nil {
+		return nil
+	}
+	now := time.Now().UnixMicro()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for e := range s.open {
+		e.Dur = now - e.Ts
+		delete(s.open, e)
+	}
+	events := []*Event{
+		{
+			Name: "process_name",
+			Ph:   "M",
+			Cat:  "__metadata",
+			Pid:  selfTracePid,
+			Tid:  selfTracePid,
+			Args: Args{
+				Name: "strace-perfetto",
+			},
+		},
+	}
+	events = append(events, s.events...)
+	s.events = nil
+	return events
+}
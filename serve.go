@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// serve runs the long-lived capture service, which lets other systems trigger
+// traces programmatically, until the tool is interrupted.
+func serve(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s serve [OPTIONS]\n", path.Base(os.Args[0]))
+		flags.PrintDefaults()
+	}
+	grpcAddr := flags.String("grpc", "", "address to serve the gRPC API on (e.g. :50051, on localhost unless a host is given)")
+	httpAddr := flags.String("http", "", "address to serve the REST API on (e.g. :8080, on localhost unless a host is given)")
+	maxCaptures := flags.Int("max-captures", 16, "number of captures kept, running or finished; the oldest finished one is dropped to start another")
+	keep := flags.Duration("keep", time.Hour, "how long the trace of a finished capture is kept for")
+	flags.Parse(args)
+
+	if *grpcAddr == "" && *httpAddr == "" {
+		flags.Usage()
+		os.Exit(1)
+	}
+	if *maxCaptures < 1 || *keep <= 0 {
+		fmt.Fprintf(os.Stderr, "-max-captures and -keep must be positive\n")
+		os.Exit(1)
+	}
+	// The service runs commands on behalf of its callers, which must have
+	// its token.
+	token := os.Getenv("STRACE_PERFETTO_TOKEN")
+	if token == "" {
+		b := make([]byte, 16)
+		rand.Read(b)
+		token = hex.EncodeToString(b)
+		fmt.Printf("[+] Token: %s (set $STRACE_PERFETTO_TOKEN to choose it)\n", token)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	service := NewCaptureService(*maxCaptures, *keep)
+	var servers []*http.Server
+	if *grpcAddr != "" {
+		var protocols http.Protocols
+		// gRPC runs over HTTP/2, and clients expect to be able to talk to it
+		// in cleartext.
+		protocols.SetUnencryptedHTTP2(true)
+		servers = append(servers, &http.Server{
+			Addr:      localAddr(*grpcAddr),
+			Handler:   grpcHandler{service, token},
+			Protocols: &protocols,
+		})
+		fmt.Printf("[+] Serving gRPC API on %s\n", localAddr(*grpcAddr))
+	}
+	if *httpAddr != "" {
+		servers = append(servers, &http.Server{
+			Addr:    localAddr(*httpAddr),
+			Handler: newHTTPHandler(service, token),
+		})
+		fmt.Printf("[+] Serving REST API on %s\n", localAddr(*httpAddr))
+	}
+
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalf("[!] Error serving on %s: %s\n", server.Addr, err)
+			}
+		}()
+	}
+	<-ctx.Done()
+	for _, server := range servers {
+		server.Shutdown(context.Background())
+	}
+	wg.Wait()
+}
+
+// localAddr returns the address to listen on for addr, localhost when it
+// has no host (":8080"), so that the service isn't reachable from other
+// machines unless asked for, e.g. with "0.0.0.0:8080".
+func localAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host != "" {
+		return addr
+	}
+	return net.JoinHostPort("127.0.0.1", port)
+}
+
+// defaultServeAddr is the address -serve listens on. It is the one
+// address the Perfetto UI's content security policy lets it fetch traces
+// from over plain HTTP.
+const defaultServeAddr = "127.0.0.1:9001"
+
+// serveTraces serves the saved output files over HTTP, with the CORS headers
+// the Perfetto UI (or speedscope) needs to fetch them, and prints the links
+// that open them there, until the tool is interrupted. The traces hold argv,
+// environments, paths and buffers: the other web pages open in the browser
+// aren't let read them.
+func serveTraces(addr string, outputs []string) {
+	files := make(map[string]string, len(outputs))
+	viewerOrigin, viewer := "https://ui.perfetto.dev", "https://ui.perfetto.dev/#!/?url="
+	if *flagFormat == "speedscope" || *flagFormat == "folded" {
+		viewerOrigin, viewer = "https://www.speedscope.app", "https://www.speedscope.app/#profileURL="
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Vary", "Origin")
+		if r.Header.Get("Origin") == viewerOrigin {
+			w.Header().Set("Access-Control-Allow-Origin", viewerOrigin)
+		}
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Access-Control-Allow-Methods", "GET")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		file, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-cache")
+		http.ServeFile(w, r, file)
+	})
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	server := &http.Server{Addr: addr, Handler: mux}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("[!] Error serving on %s: %s\n", addr, err)
+	}
+	fmt.Printf("[+] Serving on http://%s/, press Ctrl-C to stop\n", listener.Addr())
+	for _, output := range outputs {
+		name := path.Base(output)
+		files["/"+name] = output
+		fmt.Printf("[+] Open %s: %shttp://%s/%s\n", output, viewer, listener.Addr(), url.PathEscape(name))
+	}
+
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+	if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalf("[!] Error serving on %s: %s\n", addr, err)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	reSocketPort = `sin6?_port=htons\((\d+)\)` // port
+	reSocketPath = `sun_path=@?"([^"]+)"`      // unix socket path
+	reFdArg      = `^\((\d+)[,)]`              // fd
+
+	regexpSocketPort = regexp.MustCompile(reSocketPort)
+	regexpSocketPath = regexp.MustCompile(reSocketPath)
+	regexpFdArg      = regexp.MustCompile(reFdArg)
+
+	// wellKnownPorts maps the ports of common services to their names.
+	wellKnownPorts = map[int]string{
+		22:    "ssh",
+		25:    "smtp",
+		53:    "dns",
+		80:    "http",
+		443:   "https",
+		2379:  "etcd",
+		3306:  "mysql",
+		4317:  "otlp",
+		5432:  "postgres",
+		5672:  "rabbitmq",
+		6379:  "redis",
+		8080:  "http",
+		9090:  "prometheus",
+		9092:  "kafka",
+		9200:  "elasticsearch",
+		11211: "memcached",
+		27017: "mongodb",
+	}
+
+	// wellKnownSockets maps substrings of the paths of common unix sockets to
+	// the name of the service listening on them.
+	wellKnownSockets = []struct {
+		path    string
+		service string
+	}{
+		{"docker.sock", "docker"},
+		{"containerd.sock", "containerd"},
+		{"/systemd/journal/", "journald"},
+		{"/systemd/private", "systemd"},
+		{"/systemd/notify", "systemd"},
+		{"dbus", "dbus"},
+		{"nscd/socket", "nscd"},
+		{".s.PGSQL.", "postgres"},
+		{"mysqld.sock", "mysql"},
+		{"redis", "redis"},
+		{"/dev/log", "syslog"},
+	}
+
+	// fdSyscalls are the syscalls taking a socket fd as first argument whose
+	// events get labeled with the service on the other end.
+	fdSyscalls = map[string]bool{
+		"read": true, "readv": true, "recv": true, "recvfrom": true, "recvmsg": true, "recvmmsg": true,
+		"write": true, "writev": true, "send": true, "sendto": true, "sendmsg": true, "sendmmsg": true,
+		"shutdown": true, "close": true,
+	}
+)
+
+// socketService returns the friendly name of the service at the address in
+// the args of a socket syscall, if it can be recognized.
+func socketService(args string) string {
+	if m := regexpSocketPath.FindStringSubmatch(args); len(m) == 2 {
+		for _, s := range wellKnownSockets {
+			if strings.Contains(m[1], s.path) {
+				return s.service
+			}
+		}
+		return path.Base(m[1])
+	}
+	if m := regexpSocketPort.FindStringSubmatch(args); len(m) == 2 {
+		port, _ := strconv.Atoi(m[1])
+		return wellKnownPorts[port]
+	}
+	return ""
+}
+
+// annotateServices labels socket events with the service on the other end of
+// the socket, e.g. "postgres" for a connection to port 5432 or "docker" for
+// /var/run/docker.sock. The label is carried over from connect()/bind() to the
+// later syscalls on the same fd, until it's closed.
+func annotateServices(syscallEvents []*Event) {
+	services := make(map[string]string) // [pid:fd]service
+	for _, e := range syscallEvents {
+		if !isSyscall(e) {
+			continue
+		}
+		m := regexpFdArg.FindStringSubmatch(e.Args.First)
+		if len(m) != 2 {
+			continue
+		}
+		k := strconv.Itoa(e.Pid) + ":" + m[1]
+		var service string
+		switch {
+		case e.Name == "connect" || e.Name == "bind" || e.Name == "sendto" || e.Name == "sendmsg":
+			service = socketService(e.Args.First)
+			if service == "" {
+				service = services[k]
+			} else if e.Name == "connect" || e.Name == "bind" {
+				services[k] = service
+			}
+		case fdSyscalls[e.Name]:
+			service = services[k]
+			if e.Name == "close" {
+				delete(services, k)
+			}
+		}
+		if service == "" {
+			continue
+		}
+		if e.Args.Data == nil {
+			e.Args.Data = make(map[string]any)
+		}
+		e.Args.Data["service"] = service
+	}
+}
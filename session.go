@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/replit/strace-perfetto/pkg/traceconv"
+)
+
+// LoadTraceEvents reads a trace file previously written by Save. Files in the
+// older JSON array format are accepted too.
+func LoadTraceEvents(input string) (TraceEvents, error) {
+	b, err := os.ReadFile(input)
+	if err != nil {
+		return TraceEvents{}, err
+	}
+	var te TraceEvents
+	if err := json.Unmarshal(b, &te); err != nil {
+		if err := json.Unmarshal(b, &te.Event); err != nil {
+			return TraceEvents{}, fmt.Errorf("parse %s: %w", input, err)
+		}
+	}
+	return te, nil
+}
+
+// AppendSession merges the events of a new capture into te as an additional
+// session. The processes of the new capture are labeled with the session name
+// and, if their ids clash with the ones already in the trace, renumbered so
+// they show up as their own process group. The flow and async ids are offset
+// past the ones already in the trace, so that the flows of different sessions
+// don't join each other. A session name already in the trace is suffixed with
+// a number, it returns the name the session was added as.
+func (te *TraceEvents) AppendSession(session string, events []*Event, metadata map[string]any) string {
+	sessions, _ := te.Metadata["sessions"].(map[string]any)
+	if sessions == nil {
+		sessions = make(map[string]any)
+		if len(te.Event) > 0 {
+			// The trace holds a single capture so far, which becomes the first
+			// session.
+			first := "session 1"
+			labelProcesses(first, te.Event)
+			sessions[first] = te.Metadata
+		}
+		te.Metadata = map[string]any{"sessions": sessions}
+	}
+	taken := func(name string) bool {
+		_, ok := sessions[name]
+		return ok
+	}
+	if session == "" {
+		for n := len(sessions) + 1; session == "" || taken(session); n++ {
+			session = fmt.Sprintf("session %d", n)
+		}
+	}
+	for base, n := session, 2; taken(session); n++ {
+		session = fmt.Sprintf("%s (%d)", base, n)
+	}
+	sessions[session] = metadata
+
+	usedIDs := make(map[int]bool)
+	nextID := 0
+	var maxFlowID uint64
+	for _, e := range te.Event {
+		maxFlowID = max(maxFlowID, e.Id)
+		for _, id := range []int{e.Pid, e.Tid} {
+			usedIDs[id] = true
+			nextID = max(nextID, id+1)
+		}
+	}
+	// The renumbered ids are past the ones of the new capture too, which
+	// keep theirs when they don't clash.
+	for _, e := range events {
+		nextID = max(nextID, e.Pid+1, e.Tid+1)
+	}
+	// The system resources process (pid 0) is shared by all sessions, since
+	// their samples never overlap in time.
+	renumbered := map[int]int{0: 0}
+	renumber := func(id int) int {
+		if newID, ok := renumbered[id]; ok {
+			return newID
+		}
+		newID := id
+		if usedIDs[id] {
+			newID = nextID
+			nextID++
+		}
+		renumbered[id] = newID
+		return newID
+	}
+	for _, e := range events {
+		e.Pid = renumber(e.Pid)
+		e.Tid = renumber(e.Tid)
+		if e.Id != 0 {
+			e.Id += maxFlowID
+		}
+	}
+	labelProcesses(session, events)
+
+	te.Event = traceconv.Merge(te.Event, events)
+	return session
+}
+
+// HasSession reports whether the trace holds a session of that name.
+func (te *TraceEvents) HasSession(session string) bool {
+	sessions, _ := te.Metadata["sessions"].(map[string]any)
+	_, ok := sessions[session]
+	return ok
+}
+
+func labelProcesses(session string, events []*Event) {
+	for _, e := range events {
+		if e.Name == "process_name" && e.Pid != 0 {
+			e.Args.Name = session + ": " + e.Args.Name
+		}
+	}
+}
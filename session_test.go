@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestAppendSessionRenumber(t *testing.T) {
+	te := TraceEvents{Event: []*Event{
+		{Name: "read", Ph: "X", Pid: 100, Tid: 100, Ts: 1},
+	}}
+	events := []*Event{
+		{Name: "read", Ph: "X", Pid: 100, Tid: 100, Ts: 2},
+		{Name: "write", Ph: "X", Pid: 101, Tid: 101, Ts: 3},
+	}
+	te.AppendSession("", events, nil)
+
+	// 100 clashes with the first session and is renumbered, past 101,
+	// which keeps its id: the two processes stay apart.
+	pids := make(map[int]string)
+	for _, e := range events {
+		if name, ok := pids[e.Pid]; ok {
+			t.Errorf("%s and %s share pid %d", name, e.Name, e.Pid)
+		}
+		pids[e.Pid] = e.Name
+	}
+	if events[0].Pid == 100 || events[0].Tid != events[0].Pid {
+		t.Errorf("clashing process renumbered to pid %d tid %d, want a new id for both", events[0].Pid, events[0].Tid)
+	}
+	if events[1].Pid != 101 {
+		t.Errorf("process 101 renumbered to %d, want it kept", events[1].Pid)
+	}
+}
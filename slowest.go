@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// slowestArgsMax is the length the arguments of a syscall are cut to in the
+// list of the slowest ones, so that each fits on a line.
+const slowestArgsMax = 80
+
+// printSlowest writes the n slowest syscalls of the trace, the slowest first,
+// with their process, arguments and start time since the first syscall: where
+// to look first, before opening the trace.
+func printSlowest(w io.Writer, events []*Event, n int) {
+	names := make(map[int]string)
+	var syscalls []*Event
+	var start int64
+	for _, e := range events {
+		switch {
+		case e.Ph == "M" && e.Name == "process_name":
+			names[e.Pid] = e.Args.Name
+		case isSyscall(e):
+			if len(syscalls) == 0 || e.Ts < start {
+				start = e.Ts
+			}
+			syscalls = append(syscalls, e)
+		}
+	}
+	if len(syscalls) == 0 {
+		return
+	}
+	sort.SliceStable(syscalls, func(i, j int) bool {
+		return syscalls[i].Dur > syscalls[j].Dur
+	})
+	if len(syscalls) > n {
+		syscalls = syscalls[:n]
+	}
+
+	fmt.Fprintf(w, "[+] The %d slowest syscalls:\n", len(syscalls))
+	const format = "%12s %12s %8s %-16s %s\n"
+	fmt.Fprintf(w, format, "duration us", "start s", "pid", "process", "syscall")
+	for _, e := range syscalls {
+		args := e.Args.First + e.Args.Second
+		if len(args) > slowestArgsMax {
+			args = args[:slowestArgsMax] + "..."
+		}
+		call := e.Name + args
+		if e.Args.ReturnValue != "" {
+			call += " = " + e.Args.ReturnValue
+		}
+		fmt.Fprintf(w, format, fmt.Sprint(e.Dur), fmt.Sprintf("%.6f", float64(e.Ts-start)/1e6), fmt.Sprint(e.Pid), names[e.Pid], call)
+	}
+}
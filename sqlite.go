@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// sqliteBinary is the sqlite3 command line shell, which -format sqlite feeds
+// the trace to as SQL statements.
+const sqliteBinary = "sqlite3"
+
+// sqliteSchema are the tables of -format sqlite. Timestamps and durations are
+// in nanoseconds.
+const sqliteSchema = `CREATE TABLE processes (pid INTEGER, name TEXT);
+CREATE TABLE threads (tid INTEGER, pid INTEGER, name TEXT);
+CREATE TABLE events (ts_ns INTEGER, dur_ns INTEGER, pid INTEGER, tid INTEGER, name TEXT, cat TEXT, ph TEXT, args TEXT, return_value TEXT, data TEXT);
+CREATE TABLE counters (ts_ns INTEGER, pid INTEGER, name TEXT, counter TEXT, value REAL);
+CREATE INDEX events_ts ON events (ts_ns);
+CREATE INDEX events_name ON events (name);
+`
+
+// SaveSQLite writes the trace as an SQLite database, to query with plain SQL:
+// a table of the processes, of the threads, of the events (syscalls, lifetimes,
+// signals, ...) and of the counter values.
+func (te TraceEvents) SaveSQLite(output string) {
+	binary, err := exec.LookPath(sqliteBinary)
+	if err != nil {
+		log.Fatalf("[!] Error creating SQLite database: %s not found in PATH: %s\n", sqliteBinary, err)
+	}
+	if err := os.Remove(output); err != nil && !os.IsNotExist(err) {
+		log.Fatalf("[!] Error creating SQLite database: %s\n", err)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command(binary, "-bail", output)
+	cmd.Stderr = &stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		log.Fatalf("[!] Error creating SQLite database: %s\n", err)
+	}
+	if err := cmd.Start(); err != nil {
+		log.Fatalf("[!] Error creating SQLite database: %s\n", err)
+	}
+	w := bufio.NewWriter(stdin)
+	err = te.writeSQL(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	stdin.Close()
+	if err := cmd.Wait(); err != nil {
+		log.Fatalf("[!] Error creating SQLite database: %s: %s\n", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	if err != nil {
+		log.Fatalf("[!] Error creating SQLite database: %s\n", err)
+	}
+}
+
+// writeSQL writes the statements creating the tables and inserting the
+// events, in a single transaction.
+func (te TraceEvents) writeSQL(w io.Writer) error {
+	events := te.Event
+	if te.tail != nil {
+		events = append(events[:len(events):len(events)], te.tail()...)
+	}
+	if _, err := io.WriteString(w, "BEGIN;\n"+sqliteSchema); err != nil {
+		return err
+	}
+	for _, e := range events {
+		var stmt string
+		switch {
+		case e.Ph == "M" && e.Name == "process_name":
+			stmt = fmt.Sprintf("INSERT INTO processes VALUES (%d, %s);\n", e.Pid, sqlString(e.Args.Name))
+		case e.Ph == "M" && e.Name == "thread_name":
+			stmt = fmt.Sprintf("INSERT INTO threads VALUES (%d, %d, %s);\n", e.Tid, e.Pid, sqlString(e.Args.Name))
+		case e.Ph == "M":
+			continue
+		case e.Ph == "C":
+			counters := make([]string, 0, len(e.Args.Counters))
+			for c := range e.Args.Counters {
+				counters = append(counters, c)
+			}
+			sort.Strings(counters)
+			var b strings.Builder
+			for _, c := range counters {
+				value := "NULL"
+				if v := e.Args.Counters[c]; !math.IsNaN(v) && !math.IsInf(v, 0) {
+					value = strconv.FormatFloat(v, 'g', -1, 64)
+				}
+				fmt.Fprintf(&b, "INSERT INTO counters VALUES (%d, %d, %s, %s, %s);\n",
+					e.TsNanos(), e.Pid, sqlString(e.Name), sqlString(c), value)
+			}
+			stmt = b.String()
+		default:
+			data := "NULL"
+			if len(e.Args.Data) > 0 {
+				b, err := json.Marshal(e.Args.Data)
+				if err != nil {
+					return err
+				}
+				data = sqlString(string(b))
+			}
+			stmt = fmt.Sprintf("INSERT INTO events VALUES (%d, %d, %d, %d, %s, %s, %s, %s, %s, %s);\n",
+				e.TsNanos(), e.EndNanos()-e.TsNanos(), e.Pid, e.Tid, sqlString(e.Name), sqlString(e.Cat), sqlString(e.Ph),
+				sqlString(e.Args.First+e.Args.Second), sqlString(e.Args.ReturnValue), data)
+		}
+		if _, err := io.WriteString(w, stmt); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "COMMIT;\n")
+	return err
+}
+
+// sqlString quotes a string as an SQL literal.
+func sqlString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
@@ -4,32 +4,256 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 )
 
+// straceWaitDelay is how long strace is given to detach and exit after being
+// interrupted before it is killed.
+const straceWaitDelay = 5 * time.Second
+
 type Strace struct {
+	// Tracer is the binary run with the args, "strace" if empty, or
+	// "ltrace" to trace library calls along with the syscalls.
+	Tracer      string
 	DefaultArgs []string
 	UserArgs    []string
 	Timeout     time.Duration
+	// Output is the local file strace writes its output to.
+	Output string
+	// Host, if set, is the ssh destination strace is run on. Its output is
+	// copied back to Output once it exits.
+	Host string
+	// Stdin is the input of the traced command, none (/dev/null) if nil:
+	// only the command run from the tool's own command line reads the
+	// terminal, for REPLs and prompts to work as they do without strace.
+	// Stdout and Stderr receive the output of strace and the traced command.
+	// They default to the ones of this process.
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	// OnStart, if set, is called with the pid of strace once it has started.
+	// The traced processes are its descendants.
+	OnStart func(pid int)
+	// ExtraFiles are passed on to strace, and so to the traced command, as
+	// fds 3 and up, and Env is added to their environment. Both only apply
+	// locally.
+	ExtraFiles []*os.File
+	Env        []string
+	// Cgroup, if set, is the cgroup strace is started in, with the traced
+	// command. It only applies locally.
+	Cgroup *CommandCgroup
+}
+
+// Interrupted is the cause of the cancellation of a context by a signal the
+// tool received. RunContext forwards the signal to strace.
+type Interrupted struct {
+	Signal os.Signal
+}
+
+func (i Interrupted) Error() string {
+	return "received " + i.Signal.String()
+}
+
+// NotifyInterrupt returns a copy of parent that is canceled with an
+// Interrupted cause on the first SIGINT or SIGTERM, so that the trace
+// captured so far can still be saved. Further signals are left to their
+// default behavior once stop is called.
+func NotifyInterrupt(parent context.Context) (ctx context.Context, stop func()) {
+	ctx, cancel := context.WithCancelCause(parent)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-signals:
+			fmt.Printf("[+] Received %s, stopping strace and saving the trace\n", sig)
+			cancel(Interrupted{Signal: sig})
+		case <-done:
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(signals)
+		close(done)
+		cancel(nil)
+	}
 }
 
 func (s Strace) Run() {
-	args := append(s.DefaultArgs, s.UserArgs...)
+	s.RunContext(context.Background())
+}
 
-	ctx := context.Background()
+// RunContext runs strace until it exits, the timeout is reached, or ctx is
+// done. In the latter two cases strace is interrupted so that it detaches
+// from the traced processes and flushes its output, with the signal the tool
+// received if ctx was canceled by NotifyInterrupt; strace passes it on to
+// the command it started. strace is killed if it hasn't exited
+// straceWaitDelay later.
+//
+// The error tells why strace stopped: the cause of ctx being done (an
+// Interrupted or context.DeadlineExceeded for the timeout) or else the error
+// strace exited with, which is that of the traced command when it fails.
+func (s Strace) RunContext(ctx context.Context) error {
 	if s.Timeout != time.Duration(0) {
 		var cancel func()
-		ctx, cancel = context.WithTimeout(context.Background(), s.Timeout)
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
 		defer cancel()
 	}
+	if s.Stdout == nil {
+		s.Stdout = os.Stdout
+	}
+	if s.Stderr == nil {
+		s.Stderr = os.Stderr
+	}
+
+	if s.Host != "" {
+		runErr, err := s.runRemote(ctx)
+		if err != nil {
+			fmt.Fprintf(s.Stdout, "[!] Remote strace failed: %s\n", err)
+			return err
+		}
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
+		return runErr
+	}
 
-	cmd := exec.CommandContext(ctx, "strace", args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	args := append(append(s.DefaultArgs, "-o", s.Output), s.UserArgs...)
+	tracer := s.Tracer
+	if tracer == "" {
+		tracer = "strace"
+	}
+	cmd := exec.CommandContext(ctx, tracer, args...)
+	cmd.Stdin = s.Stdin
+	cmd.Stdout = s.Stdout
+	cmd.Stderr = s.Stderr
+	cmd.ExtraFiles = s.ExtraFiles
+	if len(s.Env) > 0 {
+		cmd.Env = append(os.Environ(), s.Env...)
+	}
+	cmd.Cancel = func() error {
+		var interrupted Interrupted
+		if errors.As(context.Cause(ctx), &interrupted) {
+			return cmd.Process.Signal(interrupted.Signal)
+		}
+		return cmd.Process.Signal(os.Interrupt)
+	}
+	cmd.WaitDelay = straceWaitDelay
+	if s.Cgroup != nil {
+		s.Cgroup.startIn(cmd)
+	}
 
-	if err := cmd.Run(); errors.Is(err, context.Canceled) {
-		fmt.Printf("[!] Strace timeout reached: %s\n", err)
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(s.Stdout, "[!] Error starting %s: %s\n", tracer, err)
+		return err
+	}
+	if s.OnStart != nil {
+		s.OnStart(cmd.Process.Pid)
+	}
+	err := cmd.Wait()
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		fmt.Fprintf(s.Stdout, "[!] Strace timeout reached: %s\n", ctx.Err())
+	}
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
 	}
+	return err
+}
+
+// Supports reports whether strace (on Host, if set) accepts the given
+// options, by having it parse them before printing its version.
+func (s Strace) Supports(args ...string) bool {
+	args = append(args, "-V")
+	if s.Host == "" {
+		return exec.Command("strace", args...).Run() == nil
+	}
+	remoteCmd := "strace"
+	for _, arg := range args {
+		remoteCmd += " " + shellQuote(arg)
+	}
+	return exec.Command("ssh", s.Host, remoteCmd).Run() == nil
+}
+
+// runRemote runs strace on s.Host over ssh, writing its output to a
+// temporary file there, and then copies that file back to s.Output. runErr is
+// the error strace exited with, as RunContext returns it, and err the one of
+// the ssh connection or of the copy. When ctx is done, the remote strace is
+// interrupted over another connection, since killing ssh doesn't signal the
+// command it runs without a terminal.
+func (s Strace) runRemote(ctx context.Context) (runErr, err error) {
+	out, err := exec.Command("ssh", s.Host, "mktemp", "/tmp/stracefile.XXXXXX").Output()
+	if err != nil {
+		return nil, fmt.Errorf("create remote temporary file: %w", err)
+	}
+	remoteOutput := strings.TrimSpace(string(out))
+	pidFile := remoteOutput + ".pid"
+	defer exec.Command("ssh", s.Host, "rm", "-f", shellQuote(remoteOutput), shellQuote(pidFile)).Run()
+
+	args := append(append(s.DefaultArgs, "-o", remoteOutput), s.UserArgs...)
+	remoteCmd := "echo $$ > " + shellQuote(pidFile) + " && exec strace"
+	for _, arg := range args {
+		remoteCmd += " " + shellQuote(arg)
+	}
+	cmd := exec.CommandContext(ctx, "ssh", s.Host, remoteCmd)
+	cmd.Stdin = s.Stdin
+	cmd.Stdout = s.Stdout
+	cmd.Stderr = s.Stderr
+	cmd.Cancel = func() error {
+		return s.interruptRemote(ctx, pidFile)
+	}
+	cmd.WaitDelay = straceWaitDelay
+	runErr = cmd.Run()
+	var exitErr *exec.ExitError
+	switch {
+	case ctx.Err() != nil:
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			fmt.Fprintf(s.Stdout, "[!] Strace timeout reached: %s\n", ctx.Err())
+		}
+		// ssh may have been killed by the signal before it was
+		// canceled, leaving strace running.
+		s.interruptRemote(ctx, pidFile)
+	case errors.As(runErr, &exitErr) && exitErr.ExitCode() == 255:
+		return nil, fmt.Errorf("ssh %s: %w", s.Host, runErr)
+	case runErr != nil && exitErr == nil:
+		return nil, runErr
+	}
+
+	f, err := os.Create(s.Output)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cat := exec.Command("ssh", s.Host, "cat", shellQuote(remoteOutput))
+	cat.Stdout = f
+	cat.Stderr = s.Stderr
+	if err := cat.Run(); err != nil {
+		return nil, fmt.Errorf("copy %s:%s: %w", s.Host, remoteOutput, err)
+	}
+	return runErr, nil
+}
+
+// interruptRemote interrupts the remote strace whose pid is in pidFile, with
+// the signal the tool received (SIGINT for the timeout), and waits for it to
+// exit, killing it if it hasn't straceWaitDelay later.
+func (s Strace) interruptRemote(ctx context.Context, pidFile string) error {
+	sig := "INT"
+	var interrupted Interrupted
+	if errors.As(context.Cause(ctx), &interrupted) && interrupted.Signal == syscall.SIGTERM {
+		sig = "TERM"
+	}
+	script := fmt.Sprintf(`pid=$(cat %s) && kill -%s "$pid" || exit 0
+for i in $(seq %d); do kill -0 "$pid" 2>/dev/null || exit 0; sleep 0.1; done
+kill -KILL "$pid"`, shellQuote(pidFile), sig, straceWaitDelay/(100*time.Millisecond))
+	return exec.Command("ssh", s.Host, script).Run()
+}
+
+// shellQuote quotes s so that it is passed as a single word by the remote
+// shell ssh runs commands with.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
 }
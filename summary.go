@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// SyscallSummary sums up the calls of one syscall, durations in
+// microseconds.
+type SyscallSummary struct {
+	Syscall string `json:"syscall"`
+	Calls   int    `json:"calls"`
+	Errors  int    `json:"errors"`
+	TotalUs int64  `json:"total_us"`
+	P50     int64  `json:"p50_us"`
+	P95     int64  `json:"p95_us"`
+	P99     int64  `json:"p99_us"`
+}
+
+// Summary is an `strace -c`-style summary of the syscalls of a trace, the
+// syscalls that took the most time first.
+type Summary []SyscallSummary
+
+// NewSummary sums up the syscall events.
+func NewSummary(events []*Event) Summary {
+	durs := make(map[string][]int64)
+	errors := make(map[string]int)
+	for _, e := range events {
+		if !isSyscall(e) {
+			continue
+		}
+		durs[e.Name] = append(durs[e.Name], e.Dur)
+		if e.Cat == "failed" {
+			errors[e.Name]++
+		}
+	}
+
+	summary := make(Summary, 0, len(durs))
+	for name, d := range durs {
+		sortDurations(d)
+		s := SyscallSummary{
+			Syscall: name,
+			Calls:   len(d),
+			Errors:  errors[name],
+			P50:     percentile(d, 50),
+			P95:     percentile(d, 95),
+			P99:     percentile(d, 99),
+		}
+		for _, dur := range d {
+			s.TotalUs += dur
+		}
+		summary = append(summary, s)
+	}
+	sort.Slice(summary, func(i, j int) bool {
+		if summary[i].TotalUs != summary[j].TotalUs {
+			return summary[i].TotalUs > summary[j].TotalUs
+		}
+		return summary[i].Syscall < summary[j].Syscall
+	})
+	return summary
+}
+
+// Save writes the summary as JSON.
+func (s Summary) Save(output string) error {
+	b, err := json.MarshalIndent(s, "", " ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(output, b, 0644)
+}
+
+// Print writes the summary as a table like the one of `strace -c`, with the
+// latency percentiles added.
+func (s Summary) Print(w io.Writer) {
+	var total SyscallSummary
+	for _, row := range s {
+		total.Calls += row.Calls
+		total.Errors += row.Errors
+		total.TotalUs += row.TotalUs
+	}
+	const format = "%6s %11s %11s %9s %9s %9s %9s %9s %s\n"
+	fmt.Fprintf(w, format, "% time", "seconds", "usecs/call", "calls", "errors", "p50 us", "p95 us", "p99 us", "syscall")
+	fmt.Fprintf(w, format, "------", "-----------", "-----------", "---------", "---------", "---------", "---------", "---------", "----------------")
+	for _, row := range s {
+		share := 0.0
+		if total.TotalUs > 0 {
+			share = 100 * float64(row.TotalUs) / float64(total.TotalUs)
+		}
+		fmt.Fprintf(w, "%6.2f %11.6f %11d %9d %9s %9d %9d %9d %s\n",
+			share, float64(row.TotalUs)/1e6, row.TotalUs/int64(row.Calls), row.Calls, errorCount(row.Errors), row.P50, row.P95, row.P99, row.Syscall)
+	}
+	fmt.Fprintf(w, format, "------", "-----------", "-----------", "---------", "---------", "---------", "---------", "---------", "----------------")
+	fmt.Fprintf(w, "%6.2f %11.6f %11s %9d %9s %9s %9s %9s %s\n",
+		100.0, float64(total.TotalUs)/1e6, "", total.Calls, errorCount(total.Errors), "", "", "", "total")
+}
+
+// errorCount formats an error count the way strace -c does, blank for none.
+func errorCount(n int) string {
+	if n == 0 {
+		return ""
+	}
+	return fmt.Sprint(n)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"path"
+)
+
+// swapIO are the pages swapped in and out since boot, from /proc/vmstat.
+type swapIO struct {
+	in, out uint64
+}
+
+// hasSwap reports whether the machine has swap: without it, there is no swap
+// usage or swapping to show.
+func hasSwap() bool {
+	var swapTotalKB uint64
+	err := readFlatKeyedColon("/proc/meminfo", map[string]*uint64{
+		"SwapTotal": &swapTotalKB,
+	})
+	return err == nil && swapTotalKB > 0
+}
+
+// readSwap returns the swap used by the cgroup, from memory.swap.current, or
+// by the whole system without a cgroup, in bytes.
+func (r *ResourceMonitor) readSwap() (uint64, error) {
+	if r.cgroupPath != "" {
+		return readUint64(path.Join(r.cgroupPath, "memory.swap.current"))
+	}
+	var swapTotalKB, swapFreeKB uint64
+	err := readFlatKeyedColon("/proc/meminfo", map[string]*uint64{
+		"SwapTotal": &swapTotalKB,
+		"SwapFree":  &swapFreeKB,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error reading /proc/meminfo: %w", err)
+	}
+	return (swapTotalKB - swapFreeKB) * 1024, nil
+}
+
+// readSwapIO reads the pages swapped in and out by the whole system: cgroup v2
+// doesn't count them.
+func readSwapIO() (swapIO, error) {
+	var io swapIO
+	err := readFlatKeyed("/proc/vmstat", map[string]*uint64{
+		"pswpin":  &io.in,
+		"pswpout": &io.out,
+	})
+	if err != nil {
+		return io, fmt.Errorf("error reading /proc/vmstat: %w", err)
+	}
+	return io, nil
+}
+
+// swapEvents returns a "Swap used bytes" counter track with the swap used by
+// the cgroup, and "Swap in pages/s" and "Swap out pages/s" tracks with the
+// swapping of the whole system since the previous sample: a process whose
+// memory is being swapped in stalls on page faults, where neither its
+// syscalls nor its CPU usage show why.
+func (r *ResourceMonitor) swapEvents() []*Event {
+	if !r.hasSwap {
+		return nil
+	}
+	var events []*Event
+	for i, sample := range r.samples {
+		events = append(events, &Event{
+			Name: "Swap",
+			Ph:   "C",
+			Pid:  resourcesPid,
+			Ts:   r.sampleTs(sample),
+			Args: Args{
+				Counters: map[string]float64{"used bytes": float64(sample.swap)},
+			},
+		})
+		if i == 0 {
+			continue
+		}
+		prev := r.samples[i-1]
+		seconds := sample.ts.Sub(prev.ts).Seconds()
+		events = append(events, &Event{
+			Name: "Swap",
+			Ph:   "C",
+			Pid:  resourcesPid,
+			Ts:   r.sampleTs(sample),
+			Args: Args{
+				Counters: map[string]float64{
+					"in pages/s":  counterRate(prev.swapIO.in, sample.swapIO.in, seconds),
+					"out pages/s": counterRate(prev.swapIO.out, sample.swapIO.out, seconds),
+				},
+			},
+		})
+	}
+	return events
+}
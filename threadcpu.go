@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/replit/strace-perfetto/pkg/traceconv"
+)
+
+// threadCPUSample is the CPU time, in nanoseconds, a thread had used at ts.
+type threadCPUSample struct {
+	ts time.Time
+	ns uint64
+}
+
+// sampleThreadCPU reads the CPU time of the threads of a traced process.
+func (r *ResourceMonitor) sampleThreadCPU(pid int) {
+	tasks, _ := filepath.Glob(fmt.Sprintf("/proc/%d/task/*", pid))
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(filepath.Base(task))
+		if err != nil {
+			continue
+		}
+		ns, ok := readThreadCPU(task)
+		if !ok {
+			// The thread exited.
+			continue
+		}
+		r.mu.Lock()
+		r.threadCPU[tid] = append(r.threadCPU[tid], threadCPUSample{ts: time.Now(), ns: ns})
+		r.threadPids[tid] = pid
+		r.mu.Unlock()
+	}
+}
+
+// readThreadCPU returns the CPU time a thread has used, from the /proc/<pid>/task/<tid>
+// directory given: the nanoseconds on CPU in its schedstat, or its user and
+// system time in clock ticks, where the kernel has no schedstat.
+func readThreadCPU(task string) (uint64, bool) {
+	if contents, err := os.ReadFile(filepath.Join(task, "schedstat")); err == nil {
+		fields := strings.Fields(string(contents))
+		if len(fields) > 0 {
+			ns, err := strconv.ParseUint(fields[0], 10, 64)
+			return ns, err == nil
+		}
+	}
+	contents, err := os.ReadFile(filepath.Join(task, "stat"))
+	if err != nil {
+		return 0, false
+	}
+	// The fields after the command name, which can contain spaces, start
+	// with the state; utime and stime are the 14th and 15th.
+	s := string(contents)
+	fields := strings.Fields(s[strings.LastIndexByte(s, ')')+1:])
+	if len(fields) < 13 {
+		return 0, false
+	}
+	utime, err1 := strconv.ParseUint(fields[11], 10, 64)
+	stime, err2 := strconv.ParseUint(fields[12], 10, 64)
+	if err1 != nil || err2 != nil {
+		return 0, false
+	}
+	return (utime + stime) * uint64(time.Second) / userHZ, true
+}
+
+// threadCPUEvents returns a "Thread <tid> CPU" counter track per thread of
+// the traced processes, in its process, with the share of a CPU it used since
+// the previous sample: a thread busy between two syscalls is at 100%. The
+// samples that don't change the value are left out, so that the idle
+// threads don't fill the trace.
+func (r *ResourceMonitor) threadCPUEvents() []*Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tids := make([]int, 0, len(r.threadCPU))
+	for tid := range r.threadCPU {
+		tids = append(tids, tid)
+	}
+	sort.Ints(tids)
+	var tracks [][]*Event
+	for _, tid := range tids {
+		samples := r.threadCPU[tid]
+		var track []*Event
+		last := -1.0
+		for i := 1; i < len(samples); i++ {
+			prev, cur := samples[i-1], samples[i]
+			if !cur.ts.After(prev.ts) {
+				continue
+			}
+			usage := 100 * counterRate(prev.ns, cur.ns, float64(cur.ts.Sub(prev.ts).Nanoseconds()))
+			if usage == last && i < len(samples)-1 {
+				continue
+			}
+			last = usage
+			track = append(track, &Event{
+				Name: fmt.Sprintf("Thread %d CPU", tid),
+				Ph:   "C",
+				Pid:  r.threadPids[tid],
+				Ts:   r.ts(prev.ts),
+				Args: Args{
+					Counters: map[string]float64{"usage %": usage},
+				},
+			})
+		}
+		tracks = append(tracks, track)
+	}
+	return traceconv.Merge(tracks...)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	threadStatesPid = pidMaxLimit + 2
+
+	// threadStateInterval is how often the state of the traced threads is
+	// sampled, the same cadence as the resource monitor. States that last
+	// less than that are mostly missed.
+	threadStateInterval = 1 * time.Millisecond
+)
+
+// threadStateNames are the names of the states in /proc/<pid>/task/<tid>/stat.
+var threadStateNames = map[string]string{
+	"R": "Running",
+	"S": "Sleeping",
+	"D": "Uninterruptible sleep",
+	"T": "Stopped",
+	"t": "Tracing stop",
+	"Z": "Zombie",
+	"X": "Dead",
+	"I": "Idle",
+	"P": "Parked",
+	"W": "Waking",
+}
+
+// threadState is the state a thread is in since start.
+type threadState struct {
+	state string
+	start time.Time
+	last  time.Time
+}
+
+// ThreadStateMonitor samples the scheduler state (running, sleeping, in
+// uninterruptible sleep, ...) of the traced threads from /proc, making for a
+// coarse thread-state track when the scheduler tracepoints in tracefs can't be
+// used (they need root).
+type ThreadStateMonitor struct {
+	mu      sync.Mutex
+	current map[int]*threadState
+	names   map[int]string
+	events  []*Event
+}
+
+// NewThreadStateMonitor returns a new thread state monitor.
+func NewThreadStateMonitor() *ThreadStateMonitor {
+	return &ThreadStateMonitor{
+		current: make(map[int]*threadState),
+		names:   make(map[int]string),
+	}
+}
+
+// Run samples the state of the threads of the traced processes, as listed by
+// tracees, until ctx is done.
+func (m *ThreadStateMonitor) Run(ctx context.Context, tracees func() []int) {
+	timer := time.NewTicker(threadStateInterval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		seen := make(map[int]bool)
+		for _, pid := range tracees() {
+			stats, _ := filepath.Glob(fmt.Sprintf("/proc/%d/task/*/stat", pid))
+			for _, stat := range stats {
+				tid, comm, state, ok := readThreadStat(stat)
+				if !ok {
+					continue
+				}
+				seen[tid] = true
+				m.sample(pid, tid, comm, state, time.Now())
+			}
+		}
+
+		// Threads that weren't seen exited since the previous sample.
+		m.mu.Lock()
+		for tid := range m.current {
+			if !seen[tid] {
+				m.end(tid)
+			}
+		}
+		m.mu.Unlock()
+	}
+}
+
+// sample records the state of a thread, ending its previous state slice if the
+// state changed.
+func (m *ThreadStateMonitor) sample(pid, tid int, comm, state string, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.names[tid]; !ok {
+		m.names[tid] = fmt.Sprintf("%s %d (pid %d)", comm, tid, pid)
+	}
+	if cur := m.current[tid]; cur != nil {
+		cur.last = now
+		if cur.state == state {
+			return
+		}
+		m.end(tid)
+	}
+	m.current[tid] = &threadState{state: state, start: now, last: now}
+}
+
+// end closes the current state slice of a thread at the time it was last
+// sampled. m.mu must be held.
+func (m *ThreadStateMonitor) end(tid int) {
+	cur := m.current[tid]
+	delete(m.current, tid)
+	name, ok := threadStateNames[cur.state]
+	if !ok {
+		name = cur.state
+	}
+	m.events = append(m.events, &Event{
+		Name: name,
+		Cat:  "thread_state",
+		Ph:   "X",
+		Pid:  threadStatesPid,
+		Tid:  tid,
+		Ts:   cur.start.UnixMicro(),
+		Dur:  cur.last.Sub(cur.start).Microseconds(),
+		Args: Args{
+			Data: map[string]any{
+				"state": cur.state,
+			},
+		},
+	})
+}
+
+// Events returns the thread state slices, on one track per thread in a
+// "Thread states" process.
+func (m *ThreadStateMonitor) Events() []*Event {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for tid := range m.current {
+		m.end(tid)
+	}
+	if len(m.events) == 0 {
+		return nil
+	}
+	events := []*Event{
+		{
+			Name: "process_name",
+			Ph:   "M",
+			Cat:  "__metadata",
+			Pid:  threadStatesPid,
+			Tid:  threadStatesPid,
+			Args: Args{
+				Name: "Thread states",
+			},
+		},
+	}
+	for tid, name := range m.names {
+		events = append(events, &Event{
+			Name: "thread_name",
+			Ph:   "M",
+			Cat:  "__metadata",
+			Pid:  threadStatesPid,
+			Tid:  tid,
+			Args: Args{
+				Name: name,
+			},
+		})
+	}
+	events = append(events, m.events...)
+	// Slices are recorded when they end, not in the order they start.
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Ts < events[j].Ts
+	})
+	return events
+}
+
+// readThreadStat reads the tid, command name and state of a thread from its
+// /proc/<pid>/task/<tid>/stat file.
+func readThreadStat(path string) (tid int, comm string, state string, ok bool) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return 0, "", "", false
+	}
+	// The command name is in parentheses and can itself contain spaces and
+	// parentheses, so the fields are split around the last ')'.
+	s := string(contents)
+	open := strings.IndexByte(s, '(')
+	end := strings.LastIndexByte(s, ')')
+	if open < 0 || end < open {
+		return 0, "", "", false
+	}
+	tid, err = strconv.Atoi(strings.TrimSpace(s[:open]))
+	if err != nil {
+		return 0, "", "", false
+	}
+	fields := strings.Fields(s[end+1:])
+	if len(fields) == 0 {
+		return 0, "", "", false
+	}
+	return tid, s[open+1 : end], fields[0], true
+}
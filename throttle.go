@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// cpuThrottle are the throttling counters of a cgroup's cpu.stat: the number
+// of periods in which it used up its cpu.max quota, and the time its tasks
+// then waited for the next period, in microseconds.
+type cpuThrottle struct {
+	periods, usec uint64
+}
+
+// Throttling returns the intervals during which the cgroup was throttled,
+// having used up its cpu.max quota, each as a warning instant at its start
+// and a slice shading it, a "CPU throttled us" counter track with the time
+// spent throttled since the start of the trace, and a summary warning. A
+// syscall that took a whole period of 100ms is often a thread waiting for the
+// next one. Nothing is returned if the cgroup was never throttled.
+func (r *ResourceMonitor) Throttling() ([]*Event, []string) {
+	if len(r.samples) < 2 {
+		return nil, nil
+	}
+	first, last := r.samples[0].throttle, r.samples[len(r.samples)-1].throttle
+	if last.periods <= first.periods {
+		return nil, nil
+	}
+
+	var events []*Event
+	var current *Event
+	intervals := 0
+	for i := 1; i < len(r.samples); i++ {
+		prev, sample := r.samples[i-1], r.samples[i]
+		ts := r.sampleTs(sample)
+		events = append(events, &Event{
+			Name: "CPU throttled",
+			Ph:   "C",
+			Pid:  resourcesPid,
+			Ts:   ts,
+			Args: Args{
+				Counters: map[string]float64{"us": float64(sample.throttle.usec - first.usec)},
+			},
+		})
+		if sample.throttle.periods <= prev.throttle.periods {
+			current = nil
+			continue
+		}
+		if current == nil {
+			intervals++
+			start := r.sampleTs(prev)
+			events = append(events, &Event{
+				Name:  "CPU throttled (cpu.max)",
+				Cat:   "warning",
+				Ph:    "i",
+				Scope: "g",
+				Ts:    start,
+			})
+			current = &Event{
+				Name: "CPU throttled",
+				Cat:  "warning",
+				Ph:   "X",
+				Ts:   start,
+				Args: Args{
+					Data: map[string]any{
+						"throttled_periods": uint64(0),
+						"throttled_us":      uint64(0),
+					},
+				},
+			}
+			events = append(events, current)
+		}
+		current.Dur = ts - current.Ts
+		current.Args.Data["throttled_periods"] = current.Args.Data["throttled_periods"].(uint64) + sample.throttle.periods - prev.throttle.periods
+		current.Args.Data["throttled_us"] = current.Args.Data["throttled_us"].(uint64) + sample.throttle.usec - prev.throttle.usec
+	}
+	// The intervals start at the sample before the one they show up in.
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Ts < events[j].Ts
+	})
+	warning := fmt.Sprintf("The cgroup was CPU throttled by its cpu.max quota of %.2f CPUs %d time(s), in %d periods and for %s in total",
+		r.vCPUs, intervals, last.periods-first.periods, time.Duration(last.usec-first.usec)*time.Microsecond)
+	return events, []string{warning}
+}
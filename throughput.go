@@ -0,0 +1,160 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	throughputPid = pidMaxLimit + 7
+
+	// throughputBucket is the interval the bytes read and written are
+	// summed over, in microseconds.
+	throughputBucket = 100000
+)
+
+var (
+	reSocketFdPath = `^[\w-]+:\[` // TCP:[...], UNIX-STREAM:[...], ...
+
+	regexpSocketFdPath = regexp.MustCompile(reSocketFdPath)
+
+	throughputReadSyscalls = map[string]bool{
+		"read": true, "readv": true, "pread64": true, "preadv": true, "preadv2": true,
+		"recv": true, "recvfrom": true, "recvmsg": true,
+	}
+	throughputWriteSyscalls = map[string]bool{
+		"write": true, "writev": true, "pwrite64": true, "pwritev": true, "pwritev2": true,
+		"send": true, "sendto": true, "sendmsg": true,
+	}
+
+	// fdClasses are the classes of fds the throughput is broken down by.
+	fdClasses = []string{"file", "socket", "pipe", "other"}
+)
+
+// fdClass returns the class of the fd a syscall reads or writes: the path
+// strace -y printed for it, or else the path the fd tracker knows it by.
+func fdClass(e *Event, f *openFd) string {
+	path, _ := e.Args.Data["fd_path"].(string)
+	if path == "" && f != nil {
+		path = f.Path
+	}
+	switch {
+	case strings.HasPrefix(path, "pipe"):
+		return "pipe"
+	case strings.HasPrefix(path, "socket") || regexpSocketFdPath.MatchString(path):
+		return "socket"
+	case strings.HasPrefix(path, "/"):
+		return "file"
+	}
+	return "other"
+}
+
+// syscallThroughput sums the bytes the read and write syscalls returned, per
+// 100ms of the trace, and returns them as read and write bytes/s counters in
+// a "Syscall I/O" process, overall and per class of fd (file, socket, pipe),
+// to be compared with the disk and network throughput.
+func syscallThroughput(syscallEvents []*Event) []*Event {
+	type bucket struct {
+		start int64
+		write bool
+	}
+	totals := make(map[bucket]map[string]int)
+	classes := make(map[string]bool)
+	fds := newFdTracker()
+	first, last := int64(-1), int64(0)
+	for _, e := range syscallEvents {
+		f := fds.observe(e)
+		if !isSyscall(e) {
+			continue
+		}
+		if first < 0 {
+			first = e.Ts
+		}
+		last = max(last, e.Ts+e.Dur)
+		write := throughputWriteSyscalls[e.Name]
+		if e.Cat == "failed" || !(write || throughputReadSyscalls[e.Name]) {
+			continue
+		}
+		n, err := strconv.Atoi(strings.Fields(e.Args.ReturnValue + " ")[0])
+		if err != nil || n <= 0 {
+			continue
+		}
+		// The bytes are counted when the syscall returns.
+		end := e.Ts + e.Dur
+		b := bucket{start: end - (end-first)%throughputBucket, write: write}
+		if totals[b] == nil {
+			totals[b] = make(map[string]int)
+		}
+		class := fdClass(e, f)
+		totals[b][class] += n
+		classes[class] = true
+	}
+	if len(totals) == 0 {
+		return nil
+	}
+
+	buckets := make([]bucket, 0, len(totals))
+	for b := range totals {
+		buckets = append(buckets, b)
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		if buckets[i].start != buckets[j].start {
+			return buckets[i].start < buckets[j].start
+		}
+		return !buckets[i].write && buckets[j].write
+	})
+	events := []*Event{
+		{
+			Name: "process_name",
+			Ph:   "M",
+			Cat:  "__metadata",
+			Pid:  throughputPid,
+			Tid:  throughputPid,
+			Args: Args{
+				Name: "Syscall I/O",
+			},
+		},
+	}
+	counter := func(b bucket, bytes map[string]int) *Event {
+		name := "read"
+		if b.write {
+			name = "write"
+		}
+		seconds := float64(throughputBucket) / 1e6
+		total := 0
+		counters := make(map[string]float64)
+		for _, class := range fdClasses {
+			if classes[class] {
+				counters[class+" bytes/s"] = float64(bytes[class]) / seconds
+				total += bytes[class]
+			}
+		}
+		counters["total bytes/s"] = float64(total) / seconds
+		return &Event{
+			Name: name,
+			Ph:   "C",
+			Pid:  throughputPid,
+			Tid:  throughputPid,
+			Ts:   b.start,
+			Args: Args{
+				Counters: counters,
+			},
+		}
+	}
+	var counterEvents []*Event
+	for _, b := range buckets {
+		counterEvents = append(counterEvents, counter(b, totals[b]))
+		// Back to zero after an interval without I/O.
+		next := bucket{start: b.start + throughputBucket, write: b.write}
+		if totals[next] == nil {
+			next.start = min(next.start, last)
+			counterEvents = append(counterEvents, counter(next, nil))
+		}
+	}
+	sort.SliceStable(counterEvents, func(i, j int) bool {
+		return counterEvents[i].Ts < counterEvents[j].Ts
+	})
+	return append(events, counterEvents...)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// unexitedThreads returns the number of traced threads whose exit strace
+// didn't record.
+func unexitedThreads(syscallEvents []*Event) int {
+	running := make(map[int]bool)
+	for _, e := range syscallEvents {
+		if e.Cat != "lifetime" {
+			continue
+		}
+		running[e.Tid] = e.Ph == "B"
+	}
+	n := 0
+	for _, r := range running {
+		if r {
+			n++
+		}
+	}
+	return n
+}
+
+// truncation returns why the strace output ends before the traced processes
+// exited, given the error RunContext returned, or "" if it doesn't. Attached
+// processes are traced until Ctrl-C and outlive the trace, only the timeout
+// and strace dying cut their trace short.
+func truncation(straceErr error, syscallEvents []*Event, attached bool) string {
+	var interrupted Interrupted
+	var exitErr *exec.ExitError
+	unexited := unexitedThreads(syscallEvents)
+	switch {
+	case errors.Is(straceErr, context.DeadlineExceeded):
+		return "timeout reached"
+	case errors.As(straceErr, &interrupted):
+		if attached {
+			return ""
+		}
+		return "interrupted by " + interrupted.Signal.String()
+	case errors.As(straceErr, &exitErr):
+		// strace kills itself with the signal that killed the command,
+		// which then has its exit recorded.
+		ws, ok := exitErr.Sys().(syscall.WaitStatus)
+		if ok && ws.Signaled() && (attached || unexited > 0) {
+			return "strace killed by " + ws.Signal().String()
+		}
+	}
+	if attached || unexited == 0 {
+		return ""
+	}
+	return fmt.Sprintf("strace exited before %d threads did", unexited)
+}
+
+// truncatedEvent marks the end of a truncated trace with a global instant.
+func truncatedEvent(reason string, at time.Time) *Event {
+	return &Event{
+		Name:  "trace truncated: " + reason,
+		Cat:   "truncated",
+		Ph:    "i",
+		Scope: "g",
+		Ts:    at.UnixMicro(),
+		Cname: "terrible",
+	}
+}